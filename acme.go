@@ -0,0 +1,81 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+const (
+	// acmeStorePrefix is the prefix for the certificates held in the store
+	acmeStorePrefix = "acme:"
+	// acmeTLSProtocol is the alpn protocol used by the tls-alpn-01 challenge
+	acmeTLSProtocol = "acme-tls/1"
+)
+
+//
+// createAcmeManager creates the autocert manager for the hostnames, holding the certificates in the store if
+// we have one, else on disk
+//
+func (r *oauthProxy) createAcmeManager() *autocert.Manager {
+	var cache autocert.Cache
+	switch r.useStore() {
+	case true:
+		log.Infof("acme enabled, holding the certificates in the store")
+		cache = &acmeStoreCache{store: r.store}
+	default:
+		log.Infof("acme enabled, holding the certificates in the directory: %s", r.config.AcmeCacheDir)
+		cache = autocert.DirCache(r.config.AcmeCacheDir)
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(r.config.Hostnames...),
+		Cache:      cache,
+		Email:      r.config.AcmeEmail,
+	}
+}
+
+//
+// acmeStoreCache holds the acme certificates and account key in the store
+//
+type acmeStoreCache struct {
+	store storage
+}
+
+// Get retrieves the data from the store
+func (r *acmeStoreCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.store.Get(acmeStorePrefix + key)
+	if err != nil || value == "" {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// Put adds the data to the store
+func (r *acmeStoreCache) Put(ctx context.Context, key string, data []byte) error {
+	return r.store.Set(acmeStorePrefix+key, base64.StdEncoding.EncodeToString(data))
+}
+
+// Delete removes the data from the store
+func (r *acmeStoreCache) Delete(ctx context.Context, key string) error {
+	return r.store.Delete(acmeStorePrefix + key)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+func TestAcmeStoreCache(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	cache := &acmeStoreCache{store: store}
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+
+	assert.NoError(t, cache.Put(ctx, "example.com", []byte{0x00, 0xff, 0x10}))
+	data, err := cache.Get(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xff, 0x10}, data)
+
+	assert.NoError(t, cache.Delete(ctx, "example.com"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err)
+}
+
+func TestCreateAcmeManager(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.Hostnames = []string{"example.com"}
+	proxy.config.AcmeCacheDir = "/tmp/acme"
+
+	manager := proxy.createAcmeManager()
+	assert.Equal(t, autocert.DirCache("/tmp/acme"), manager.Cache)
+	assert.NoError(t, manager.HostPolicy(context.Background(), "example.com"))
+	assert.Error(t, manager.HostPolicy(context.Background(), "another.com"))
+
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy.store = store
+	_, found := proxy.createAcmeManager().Cache.(*acmeStoreCache)
+	assert.True(t, found, "the store should have been used to hold the certificates")
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// apiKeyStorePrefix is the prefix for the api keys held in the store
+	apiKeyStorePrefix = "apikey:"
+)
+
+//
+// getIdentityFromAPIKey retrieves the identity from a pre-shared api key in the header or query, the key is
+// removed from the request so it is not passed upstream
+//
+func (r *oauthProxy) getIdentityFromAPIKey(cx *gin.Context) (*userContext, error) {
+	key := cx.Request.Header.Get(r.config.APIKeyHeader)
+	cx.Request.Header.Del(r.config.APIKeyHeader)
+	if key == "" && r.config.APIKeyQuery != "" {
+		query := cx.Request.URL.Query()
+		key = query.Get(r.config.APIKeyQuery)
+		if key != "" {
+			query.Del(r.config.APIKeyQuery)
+			cx.Request.URL.RawQuery = query.Encode()
+		}
+	}
+	if key == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	// step: find the key in the config, else the store
+	apiKey, err := r.findAPIKey(hashAPIKey(key))
+	if err != nil {
+		return nil, err
+	}
+	user := extractAPIKeyIdentity(apiKey)
+
+	log.WithFields(log.Fields{
+		"id":    user.id,
+		"key":   apiKey.Name,
+		"roles": strings.Join(user.roles, ","),
+	}).Debugf("found the api key identity: %s in the request", user.id)
+
+	return user, nil
+}
+
+//
+// isAPIKeyResource checks if the resource being accessed permits api keys
+//
+func (r *oauthProxy) isAPIKeyResource(cx *gin.Context) bool {
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).EnableAPIKey
+	}
+
+	return false
+}
+
+//
+// findAPIKey finds the api key with the hash, the configured keys are checked before the store
+//
+func (r *oauthProxy) findAPIKey(hash string) (*APIKey, error) {
+	for _, x := range r.config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(x.Hash)), []byte(hash)) == 1 {
+			return x, nil
+		}
+	}
+	if r.useStore() {
+		value, err := r.store.Get(apiKeyStorePrefix + hash)
+		if err != nil {
+			return nil, err
+		}
+		// step: the store holds the key as json, or the name and roles of the key, name:role1,role2
+		if strings.HasPrefix(value, "{") {
+			apiKey := new(APIKey)
+			if err := json.Unmarshal([]byte(value), apiKey); err != nil || apiKey.Name == "" {
+				return nil, fmt.Errorf("invalid api key held in the store for the hash: %s", hash)
+			}
+			apiKey.Hash = hash
+
+			return apiKey, nil
+		}
+		if value != "" {
+			items := strings.SplitN(value, ":", 2)
+			apiKey := &APIKey{Name: items[0], Hash: hash}
+			if len(items) == 2 && items[1] != "" {
+				apiKey.Roles = strings.Split(items[1], ",")
+			}
+			return apiKey, nil
+		}
+	}
+
+	return nil, ErrInvalidAPIKey
+}
+
+//
+// decodeAPIKey decodes the api key option, name:hash or name:hash:role1,role2
+//
+func decodeAPIKey(value string) (*APIKey, error) {
+	items := strings.Split(value, ":")
+	if len(items) < 2 || len(items) > 3 || items[0] == "" || !isAPIKeyHash(items[1]) {
+		return nil, fmt.Errorf("invalid api key '%s' should be name:sha256_hash:role1,role2", value)
+	}
+	apiKey := &APIKey{
+		Name: items[0],
+		Hash: strings.ToLower(items[1]),
+	}
+	if len(items) == 3 && items[2] != "" {
+		apiKey.Roles = strings.Split(items[2], ",")
+	}
+
+	return apiKey, nil
+}
+
+//
+// extractAPIKeyIdentity constructs the identity for an api key, the subject defaults to the name of the key
+//
+func extractAPIKeyIdentity(key *APIKey) *userContext {
+	subject := key.Subject
+	if subject == "" {
+		subject = key.Name
+	}
+
+	return &userContext{
+		id:            subject,
+		name:          subject,
+		preferredName: subject,
+		roles:         key.Roles,
+		claims: jose.Claims{
+			"sub":              subject,
+			claimPreferredName: subject,
+			"api_key":          key.Name,
+		},
+		apiKey: true,
+	}
+}
+
+//
+// hashAPIKey returns the hex encoded sha256 of the api key
+//
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(hash[:])
+}
+
+//
+// isAPIKeyHash checks the value is a hex encoded sha256
+//
+func isAPIKeyHash(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+
+	return err == nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeAPIKeyProxy(t *testing.T) *oauthProxy {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:          "/legacy",
+			Methods:      []string{"ANY"},
+			Roles:        []string{fakeAdminRole},
+			EnableAPIKey: true,
+		},
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+			Roles:   []string{fakeAdminRole},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.APIKeyHeader = "X-API-Key"
+	proxy.config.APIKeyQuery = "api_key"
+	proxy.config.APIKeys = []*APIKey{
+		{Name: "billing", Hash: hashAPIKey("admin-key"), Roles: []string{fakeAdminRole}},
+		{Name: "reports", Hash: hashAPIKey("reports-key")},
+	}
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Auth-Key", req.Header.Get("X-API-Key"))
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+
+	return proxy
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	proxy := newFakeAPIKeyProxy(t)
+	tests := []struct {
+		URI    string
+		Query  string
+		Header string
+		Code   int
+	}{
+		{URI: "/legacy", Code: http.StatusUnauthorized},
+		{URI: "/legacy", Header: "admin-key", Code: http.StatusOK},
+		{URI: "/legacy", Query: "api_key=admin-key", Code: http.StatusOK},
+		{URI: "/legacy", Header: "unknown", Code: http.StatusUnauthorized},
+		{URI: "/legacy", Header: "reports-key", Code: http.StatusForbidden},
+		{URI: "/admin", Header: "admin-key", Code: http.StatusUnauthorized},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.URL.RawQuery = c.Query
+		if c.Header != "" {
+			req.Header.Set("X-API-Key", c.Header)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		assert.Empty(t, recorder.Header().Get("X-Auth-Key"), "case %d", i)
+	}
+}
+
+func TestGetIdentityFromAPIKey(t *testing.T) {
+	proxy := newFakeAPIKeyProxy(t)
+	context := newFakeGinContext("GET", "/legacy")
+	context.Request.URL.RawQuery = "api_key=admin-key&page=1"
+
+	user, err := proxy.getIdentityFromAPIKey(context)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "billing", user.id)
+	assert.Equal(t, []string{fakeAdminRole}, user.roles)
+	assert.True(t, user.isAPIKey())
+	assert.Equal(t, "page=1", context.Request.URL.RawQuery)
+}
+
+func TestFindAPIKeyInStore(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeAPIKeyProxy(t)
+	proxy.store = store
+
+	hash := hashAPIKey("stored-key")
+	_, err := proxy.findAPIKey(hash)
+	assert.Equal(t, ErrInvalidAPIKey, err)
+
+	assert.NoError(t, store.Set(apiKeyStorePrefix+hash, "stored:role1,role2"))
+	key, err := proxy.findAPIKey(hash)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &APIKey{Name: "stored", Hash: hash, Roles: []string{"role1", "role2"}}, key)
+	}
+
+	assert.NoError(t, store.Set(apiKeyStorePrefix+hash, `{"name": "rotated", "subject": "billing", "roles": ["role1"]}`))
+	key, err = proxy.findAPIKey(hash)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &APIKey{Name: "rotated", Hash: hash, Subject: "billing", Roles: []string{"role1"}}, key)
+	}
+
+	assert.NoError(t, store.Set(apiKeyStorePrefix+hash, `{"subject": "billing"}`))
+	_, err = proxy.findAPIKey(hash)
+	assert.Error(t, err)
+}
+
+func TestExtractAPIKeyIdentity(t *testing.T) {
+	user := extractAPIKeyIdentity(&APIKey{Name: "billing-2017", Subject: "billing", Roles: []string{"a"}})
+	assert.Equal(t, "billing", user.id)
+	assert.Equal(t, "billing", user.claims["sub"])
+	assert.Equal(t, "billing-2017", user.claims["api_key"])
+	assert.Equal(t, []string{"a"}, user.roles)
+	assert.True(t, user.isAPIKey())
+
+	user = extractAPIKeyIdentity(&APIKey{Name: "legacy"})
+	assert.Equal(t, "legacy", user.id)
+}
+
+func TestDecodeAPIKey(t *testing.T) {
+	hash := hashAPIKey("secret")
+	tests := []struct {
+		Value string
+		Ok    bool
+		Key   *APIKey
+	}{
+		{Value: "name:" + hash, Ok: true, Key: &APIKey{Name: "name", Hash: hash}},
+		{Value: "name:" + hash + ":a,b", Ok: true, Key: &APIKey{Name: "name", Hash: hash, Roles: []string{"a", "b"}}},
+		{Value: "name"},
+		{Value: ":" + hash},
+		{Value: "name:notahash"},
+		{Value: "name:" + hash + ":a:b"},
+	}
+	for i, c := range tests {
+		key, err := decodeAPIKey(c.Value)
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Key, key, "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+)
+
+//
+// loadAssertionVerifiers loads the public keys of the assertion issuers, keyed on the issuer
+//
+func loadAssertionVerifiers(issuers []AssertionIssuer) (map[string]jose.Verifier, error) {
+	verifiers := make(map[string]jose.Verifier, 0)
+	for _, x := range issuers {
+		content, err := ioutil.ReadFile(x.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("the public key of the assertion issuer: %s is not pem encoded", x.Issuer)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the public key of the assertion issuer: %s, error: %s", x.Issuer, err)
+		}
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("the public key of the assertion issuer: %s is not a rsa key", x.Issuer)
+		}
+		verifiers[x.Issuer] = &jose.VerifierRSA{PublicKey: *publicKey, Hash: crypto.SHA256}
+	}
+
+	return verifiers, nil
+}
+
+//
+// verifyAssertion verifies the assertion is signed by a trusted issuer, is within its validity and was issued
+// to one of the accepted audiences for the subject of the access token
+//
+func verifyAssertion(assertion string, user *userContext, verifiers map[string]jose.Verifier, audiences []string,
+	now time.Time) error {
+	if assertion == "" {
+		return ErrAssertionNotFound
+	}
+	token, err := jose.ParseJWT(assertion)
+	if err != nil {
+		return ErrInvalidAssertion
+	}
+	if token.Header[jose.HeaderKeyAlgorithm] != "RS256" {
+		return ErrInvalidAssertion
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return ErrInvalidAssertion
+	}
+
+	// step: find the issuer and verify the signature
+	issuer, _, err := claims.StringClaim("iss")
+	if err != nil {
+		return ErrInvalidAssertion
+	}
+	verifier, found := verifiers[issuer]
+	if !found {
+		return ErrInvalidAssertion
+	}
+	if err := verifier.Verify(token.Signature, []byte(token.Data())); err != nil {
+		return ErrInvalidAssertion
+	}
+
+	// step: check the validity, an assertion must expire
+	expires, found, err := claims.TimeClaim("exp")
+	if err != nil || !found || now.After(expires) {
+		return ErrInvalidAssertion
+	}
+	if notBefore, found, err := claims.TimeClaim("nbf"); err != nil || (found && now.Before(notBefore)) {
+		return ErrInvalidAssertion
+	}
+
+	// step: the assertion must be for the bearer of the access token
+	if subject, _, err := claims.StringClaim("sub"); err != nil || subject != user.id {
+		return ErrInvalidAssertion
+	}
+
+	// step: the assertion must be issued to us, else one minted for another relying party could be replayed
+	intended, found := getAudiences(claims)
+	if !found {
+		return ErrInvalidAssertion
+	}
+	for _, x := range intended {
+		if containedIn(x, audiences) {
+			return nil
+		}
+	}
+
+	return ErrInvalidAssertion
+}
+
+//
+// decodeAssertionIssuer decodes the assertion issuer option, issuer=/path/to/key.pem
+//
+func decodeAssertionIssuer(issuer string) (AssertionIssuer, error) {
+	items := strings.SplitN(issuer, "=", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return AssertionIssuer{}, fmt.Errorf("invalid assertion issuer '%s' should be issuer=/path/to/key.pem", issuer)
+	}
+
+	return AssertionIssuer{Issuer: items[0], PublicKey: items[1]}, nil
+}
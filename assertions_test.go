@@ -0,0 +1,165 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeAssertionIssuer = "https://device.example.com"
+
+func newFakeAssertionKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate the rsa key, error: %s", err)
+	}
+	content, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to encode the public key, error: %s", err)
+	}
+	file, err := ioutil.TempFile("", "assertion")
+	if err != nil {
+		t.Fatalf("unable to create the temporary file, error: %s", err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: content}); err != nil {
+		t.Fatalf("unable to write the public key, error: %s", err)
+	}
+
+	return key, file.Name()
+}
+
+func newFakeAssertion(t *testing.T, key *rsa.PrivateKey, claims jose.Claims) string {
+	token, err := jose.NewSignedJWT(claims, jose.NewSignerRSA("", *key))
+	if err != nil {
+		t.Fatalf("unable to sign the assertion, error: %s", err)
+	}
+
+	return token.Encode()
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	key, filename := newFakeAssertionKey(t)
+	defer os.Remove(filename)
+	other, otherFilename := newFakeAssertionKey(t)
+	defer os.Remove(otherFilename)
+
+	verifiers, err := loadAssertionVerifiers([]AssertionIssuer{{Issuer: fakeAssertionIssuer, PublicKey: filename}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	user := &userContext{id: "1e11e539-8256-4b3b-bda8-cc0d56cddb48"}
+	tests := []struct {
+		Key       *rsa.PrivateKey
+		Claims    jose.Claims
+		Assertion string
+		Error     error
+	}{
+		{
+			Error: ErrAssertionNotFound,
+		},
+		{
+			Assertion: "not.an.assertion",
+			Error:     ErrInvalidAssertion,
+		},
+		{
+			Key:    key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": fakeClientID, "exp": now.Add(time.Minute).Unix()},
+		},
+		{
+			Key: key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": "someone", "aud": fakeClientID,
+				"exp": now.Add(time.Minute).Unix()},
+			Error: ErrInvalidAssertion,
+		},
+		{
+			Key:    key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": fakeClientID, "exp": now.Add(-time.Minute).Unix()},
+			Error:  ErrInvalidAssertion,
+		},
+		{
+			Key:    key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": fakeClientID},
+			Error:  ErrInvalidAssertion,
+		},
+		{
+			Key: key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": fakeClientID, "exp": now.Add(time.Hour).Unix(),
+				"nbf": now.Add(time.Minute).Unix()},
+			Error: ErrInvalidAssertion,
+		},
+		{
+			Key:    key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": "other", "exp": now.Add(time.Minute).Unix()},
+			Error:  ErrInvalidAssertion,
+		},
+		{
+			Key:    key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "exp": now.Add(time.Minute).Unix()},
+			Error:  ErrInvalidAssertion,
+		},
+		{
+			Key: key,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": []string{"other", fakeClientID},
+				"exp": now.Add(time.Minute).Unix()},
+		},
+		{
+			Key: key,
+			Claims: jose.Claims{"iss": "https://unknown.example.com", "sub": user.id, "aud": fakeClientID,
+				"exp": now.Add(time.Minute).Unix()},
+			Error: ErrInvalidAssertion,
+		},
+		{
+			Key:    other,
+			Claims: jose.Claims{"iss": fakeAssertionIssuer, "sub": user.id, "aud": fakeClientID, "exp": now.Add(time.Minute).Unix()},
+			Error:  ErrInvalidAssertion,
+		},
+	}
+	for i, c := range tests {
+		assertion := c.Assertion
+		if c.Key != nil {
+			assertion = newFakeAssertion(t, c.Key, c.Claims)
+		}
+		assert.Equal(t, c.Error, verifyAssertion(assertion, user, verifiers, []string{fakeClientID}, now), "case %d", i)
+	}
+}
+
+func TestLoadAssertionVerifiersBadKey(t *testing.T) {
+	_, err := loadAssertionVerifiers([]AssertionIssuer{{Issuer: fakeAssertionIssuer, PublicKey: "/does/not/exist"}})
+	assert.Error(t, err)
+}
+
+func TestDecodeAssertionIssuer(t *testing.T) {
+	issuer, err := decodeAssertionIssuer("https://device.example.com=/etc/keys/device.pem")
+	if assert.NoError(t, err) {
+		assert.Equal(t, AssertionIssuer{Issuer: fakeAssertionIssuer, PublicKey: "/etc/keys/device.pem"}, issuer)
+	}
+	for _, x := range []string{"", "issuer", "=/etc/keys/device.pem", "issuer="} {
+		_, err := decodeAssertionIssuer(x)
+		assert.Error(t, err, x)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/go-oidc/key"
+	"github.com/gambol99/go-oidc/oidc"
+)
+
+const (
+	// audienceValidationAud checks the audiences of the token
+	audienceValidationAud = "aud"
+	// audienceValidationAzp checks the authorized party of the token, keycloak sets the aud to account
+	audienceValidationAzp = "azp"
+	// audienceValidationBoth checks both the audiences and the authorized party of the token
+	audienceValidationBoth = "both"
+	// providerKeysSyncInterval is the minimum time between the retrievals of the keys of the provider
+	providerKeysSyncInterval = time.Duration(10) * time.Second
+)
+
+//
+// getAcceptedAudiences returns the accepted audiences of the access tokens, defaulting to the client id
+//
+func getAcceptedAudiences(config *Config) []string {
+	if len(config.Audiences) > 0 {
+		return config.Audiences
+	}
+	if config.ClientID != "" {
+		return []string{config.ClientID}
+	}
+
+	return nil
+}
+
+//
+// isAcceptedAudience checks the audiences and or the authorized party of the token are accepted
+//
+func (r *oauthProxy) isAcceptedAudience(user *userContext) bool {
+	accepted := getAcceptedAudiences(r.config)
+	if len(accepted) <= 0 {
+		return true
+	}
+	switch r.config.AudienceValidation {
+	case audienceValidationAzp:
+		return containedIn(user.authorizedParty, accepted)
+	case audienceValidationBoth:
+		return user.hasAnyAudience(accepted) && containedIn(user.authorizedParty, accepted)
+	default:
+		return user.hasAnyAudience(accepted)
+	}
+}
+
+//
+// createAudienceVerifiers creates a client of each accepted audience other than the client id; the openid client
+// verifies the token was issued to its client id, so the tokens of the other audiences require their own client
+//
+func createAudienceVerifiers(config *Config) (map[string]*oidc.Client, error) {
+	verifiers := make(map[string]*oidc.Client, 0)
+	for _, x := range config.Audiences {
+		if x == config.ClientID {
+			continue
+		}
+		cfg := *config
+		cfg.ClientID = x
+		cfg.ClientSecret = ""
+		client, _, err := createOpenIDClient(&cfg)
+		if err != nil {
+			return nil, err
+		}
+		verifiers[x] = client
+	}
+
+	return verifiers, nil
+}
+
+//
+// verifyAccessToken verifies the access token with the client of the audience it was issued to
+//
+func (r *oauthProxy) verifyAccessToken(user *userContext) error {
+	if !user.isAudience(r.config.ClientID) {
+		for _, x := range user.audiences {
+			if client, found := r.verifiers[x]; found {
+				return verifyToken(client, user.token)
+			}
+		}
+		// step: the audience is not ours to check when validating the authorized party alone
+		if r.keys != nil && len(user.audiences) > 0 {
+			verifier := oidc.NewJWTVerifier(r.provider.Issuer.String(), user.audiences[0], r.keys.sync, r.keys.get)
+			if err := verifier.Verify(user.token); err != nil {
+				if strings.Contains(err.Error(), "token is expired") {
+					return ErrAccessTokenExpired
+				}
+				return err
+			}
+			return nil
+		}
+	}
+
+	return verifyToken(r.client, user.token)
+}
+
+//
+// providerKeys are the signing keys of the provider, verifying the tokens independent of the audience
+//
+type providerKeys struct {
+	sync.RWMutex
+	// the repository of the keys
+	repo key.ReadableKeySetRepo
+	// the keys of the provider
+	keys []key.PublicKey
+	// the time of the last retrieval
+	synced time.Time
+}
+
+//
+// newProviderKeys creates the keys retrieved from the endpoint
+//
+func newProviderKeys(client *http.Client, endpoint string) *providerKeys {
+	return &providerKeys{repo: oidc.NewRemotePublicKeyRepo(client, endpoint)}
+}
+
+//
+// get returns the keys of the provider
+//
+func (r *providerKeys) get() []key.PublicKey {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.keys
+}
+
+//
+// sync retrieves the keys of the provider, at most once per interval
+//
+func (r *providerKeys) sync() error {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.synced) < providerKeysSyncInterval {
+		return nil
+	}
+	keys, err := r.repo.Get()
+	if err != nil {
+		return err
+	}
+	if set, ok := keys.(*key.PublicKeySet); ok {
+		r.keys = set.Keys()
+	}
+	r.synced = time.Now()
+
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAcceptedAudiences(t *testing.T) {
+	assert.Equal(t, []string{"billing"}, getAcceptedAudiences(&Config{ClientID: fakeClientID, Audiences: []string{"billing"}}))
+	assert.Equal(t, []string{fakeClientID}, getAcceptedAudiences(&Config{ClientID: fakeClientID}))
+	assert.Empty(t, getAcceptedAudiences(&Config{}))
+}
+
+func TestAdmissionHandlerAudiences(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/reports",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.Audiences = []string{fakeClientID, "reporting"}
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Audience interface{}
+		Denied   bool
+	}{
+		{Audience: fakeClientID},
+		{Audience: "reporting"},
+		{Audience: []string{"account", "reporting"}},
+		{Audience: "account", Denied: true},
+		{Audience: []string{"account", "billing"}, Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud": c.Audience,
+			"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/reports")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+}
+
+func TestVerifyAccessTokenAudiences(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Audiences = []string{fakeClientID, "reporting"}
+	proxy, auth, _ := newTestProxyService(t, config)
+	assert.Equal(t, 1, len(proxy.verifiers))
+
+	cs := []struct {
+		Audience interface{}
+		Ok       bool
+	}{
+		{Audience: fakeClientID, Ok: true},
+		{Audience: "reporting", Ok: true},
+		{Audience: []string{"account", "reporting"}, Ok: true},
+		{Audience: "account"},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		for k, v := range auth.claims {
+			claims[k] = v
+		}
+		claims["aud"] = c.Audience
+		token, err := jose.NewSignedJWT(claims, auth.signer)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		user, err := extractIdentity(*token, nil)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		err = proxy.verifyAccessToken(user)
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		assert.Error(t, err, "case %d", i)
+	}
+}
+
+func TestIsAcceptedAudience(t *testing.T) {
+	cs := []struct {
+		Validation string
+		Audiences  []string
+		Party      string
+		Ok         bool
+	}{
+		{Validation: audienceValidationAud, Audiences: []string{fakeClientID}, Ok: true},
+		{Validation: audienceValidationAud, Audiences: []string{"account"}, Party: fakeClientID},
+		{Validation: audienceValidationAzp, Audiences: []string{"account"}, Party: fakeClientID, Ok: true},
+		{Validation: audienceValidationAzp, Audiences: []string{fakeClientID}, Party: "other"},
+		{Validation: audienceValidationBoth, Audiences: []string{fakeClientID}, Party: fakeClientID, Ok: true},
+		{Validation: audienceValidationBoth, Audiences: []string{"account"}, Party: fakeClientID},
+		{Validation: audienceValidationBoth, Audiences: []string{fakeClientID}, Party: "other"},
+	}
+	for i, c := range cs {
+		proxy := &oauthProxy{config: &Config{ClientID: fakeClientID, AudienceValidation: c.Validation}}
+		user := &userContext{audiences: c.Audiences, authorizedParty: c.Party}
+		assert.Equal(t, c.Ok, proxy.isAcceptedAudience(user), "case %d", i)
+	}
+}
+
+func TestVerifyAccessTokenAuthorizedParty(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.AudienceValidation = audienceValidationAzp
+	proxy, auth, _ := newTestProxyService(t, config)
+	if !assert.NotNil(t, proxy.keys) {
+		t.FailNow()
+	}
+
+	cs := []struct {
+		Claims jose.Claims
+		Error  error
+		Ok     bool
+	}{
+		{Claims: jose.Claims{"aud": "account", "azp": fakeClientID}, Ok: true},
+		{Claims: jose.Claims{"aud": []string{"account", "broker"}, "azp": fakeClientID}, Ok: true},
+		{Claims: jose.Claims{"aud": "account", "iss": "https://other.example.com"}},
+		{Claims: jose.Claims{"aud": "account", "exp": time.Now().Add(-time.Hour).Unix()}, Error: ErrAccessTokenExpired},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		for k, v := range auth.claims {
+			claims[k] = v
+		}
+		for k, v := range c.Claims {
+			claims[k] = v
+		}
+		token, err := jose.NewSignedJWT(claims, auth.signer)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		user, err := extractIdentity(*token, nil)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		err = proxy.verifyAccessToken(user)
+		switch {
+		case c.Ok:
+			assert.NoError(t, err, "case %d", i)
+		case c.Error != nil:
+			assert.Equal(t, c.Error, err, "case %d", i)
+		default:
+			assert.Error(t, err, "case %d", i)
+		}
+	}
+
+	// step: a token not signed by the provider is refused
+	claims := jose.Claims{}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+	claims["aud"] = "account"
+	user, err := extractIdentity(*newFakeJWTToken(t, claims), nil)
+	if assert.NoError(t, err) {
+		assert.Error(t, proxy.verifyAccessToken(user))
+	}
+}
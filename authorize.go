@@ -0,0 +1,48 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reservedAuthorizationParameters are the parameters of the authorization set by the proxy
+var reservedAuthorizationParameters = []string{"client_id", "redirect_uri", "response_type", "scope", "state"}
+
+//
+// getAuthorizationParameters returns the additional parameters of the authorization redirect; the configured
+// parameters, overridden by the permitted parameters of the request and the step up parameters
+//
+func (r *oauthProxy) getAuthorizationParameters(cx *gin.Context) url.Values {
+	params := url.Values{}
+	for k, v := range r.config.AuthorizationParameters {
+		params.Set(k, v)
+	}
+	for _, name := range r.config.AllowedAuthorizationParameters {
+		if value := cx.Query(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	for _, name := range []string{"acr_values", "claims"} {
+		if value := cx.Query(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	return params
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationParameters(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.AuthorizationParameters = map[string]string{"kc_idp_hint": "google", "display": "page"}
+	config.AllowedAuthorizationParameters = []string{"kc_idp_hint", "ui_locales"}
+	_, _, u := newTestProxyService(t, config)
+
+	cs := []struct {
+		Query    string
+		Expected map[string]string
+	}{
+		{
+			Expected: map[string]string{"kc_idp_hint": "google", "display": "page", "ui_locales": ""},
+		},
+		{
+			Query:    "kc_idp_hint=github&ui_locales=fr",
+			Expected: map[string]string{"kc_idp_hint": "github", "display": "page", "ui_locales": "fr"},
+		},
+		{
+			Query:    "display=popup&login_hint=admin",
+			Expected: map[string]string{"display": "page", "login_hint": ""},
+		},
+		{
+			Query:    "client_id=evil&acr_values=gold",
+			Expected: map[string]string{"client_id": fakeClientID, "acr_values": "gold"},
+		},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL+"?"+c.Query, nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		for k, v := range c.Expected {
+			assert.Equal(t, v, location.Query().Get(k), "case %d, parameter: %s", i, k)
+		}
+	}
+}
+
+func TestIsValidAuthorizationParameters(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Listen = "127.0.0.1:8080"
+	config.Upstream = "http://127.0.0.1:8081"
+	config.RedirectionURL = "http://127.0.0.1:8080"
+	config.AuthorizationParameters = map[string]string{"kc_idp_hint": "google"}
+	config.AllowedAuthorizationParameters = []string{"ui_locales"}
+	assert.NoError(t, config.isValid())
+
+	config.AuthorizationParameters = map[string]string{"redirect_uri": "https://evil.com"}
+	assert.Error(t, config.isValid())
+
+	config.AuthorizationParameters = map[string]string{}
+	config.AllowedAuthorizationParameters = []string{"state"}
+	assert.Error(t, config.isValid())
+}
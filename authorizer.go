@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// authorizerCacheSize is the number of decisions held before the expired decisions are removed
+const authorizerCacheSize = 10000
+
+//
+// authorizerDecision is a decision of an external authorizer
+//
+type authorizerDecision struct {
+	// whether the request is permitted
+	permitted bool
+	// the time the decision expires
+	expires time.Time
+}
+
+//
+// authorizerCache holds the decisions of the external authorizers for the ttl of the resource
+//
+type authorizerCache struct {
+	sync.Mutex
+	// the decisions keyed on the authorizer and the input posted to it
+	decisions map[string]authorizerDecision
+}
+
+//
+// newAuthorizerCache creates an empty cache of decisions
+//
+func newAuthorizerCache() *authorizerCache {
+	return &authorizerCache{decisions: make(map[string]authorizerDecision, 0)}
+}
+
+//
+// get returns the decision if held and not expired
+//
+func (r *authorizerCache) get(key string, now time.Time) (bool, bool) {
+	r.Lock()
+	defer r.Unlock()
+	decision, found := r.decisions[key]
+	if !found || now.After(decision.expires) {
+		return false, false
+	}
+
+	return decision.permitted, true
+}
+
+//
+// set records the decision, removing the expired decisions when the cache is full
+//
+func (r *authorizerCache) set(key string, permitted bool, expires time.Time, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.decisions) >= authorizerCacheSize {
+		for k, x := range r.decisions {
+			if now.After(x.expires) {
+				delete(r.decisions, k)
+			}
+		}
+		// step: if the cache is still full we start afresh
+		if len(r.decisions) >= authorizerCacheSize {
+			r.decisions = make(map[string]authorizerDecision, 0)
+		}
+	}
+	r.decisions[key] = authorizerDecision{permitted: permitted, expires: expires}
+}
+
+//
+// authorizerDecisionKey is the key of the cached decision, the digest of the authorizer and the input posted to it,
+// so a decision is only reused for the exact same input
+//
+func authorizerDecisionKey(location string, content []byte) string {
+	hash := sha256.Sum256(append([]byte(location+"|"), content...))
+
+	return "authorizer|" + hex.EncodeToString(hash[:])
+}
+
+//
+// queryAuthorizer posts the identity and request details to the external authorizer, a 2xx permits the
+// request and a 401 or 403 denies it, any other response is an error
+//
+func queryAuthorizer(client *http.Client, location string, content []byte) (bool, error) {
+	if client == nil {
+		return false, fmt.Errorf("the client of the external authorizers is not configured")
+	}
+	resp, err := client.Post(location, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("the authorizer returned status: %d", resp.StatusCode)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizerCache(t *testing.T) {
+	cache := newAuthorizerCache()
+	now := time.Now()
+	_, found := cache.get("a", now)
+	assert.False(t, found)
+
+	cache.set("a", true, now.Add(time.Duration(1)*time.Minute), now)
+	cache.set("b", false, now.Add(time.Duration(1)*time.Minute), now)
+	permitted, found := cache.get("a", now)
+	assert.True(t, found)
+	assert.True(t, permitted)
+	permitted, found = cache.get("b", now)
+	assert.True(t, found)
+	assert.False(t, permitted)
+
+	_, found = cache.get("a", now.Add(time.Duration(2)*time.Minute))
+	assert.False(t, found)
+}
+
+func TestAuthorizerCacheFull(t *testing.T) {
+	cache := newAuthorizerCache()
+	now := time.Now()
+	for i := 0; i < authorizerCacheSize; i++ {
+		cache.set(string(rune(i)), true, now, now)
+	}
+	cache.set("live", true, now.Add(time.Duration(1)*time.Minute), now.Add(time.Duration(1)*time.Second))
+	assert.Equal(t, 1, len(cache.decisions))
+}
+
+func TestQueryAuthorizer(t *testing.T) {
+	tests := []struct {
+		Status   int
+		Expected bool
+		Error    bool
+	}{
+		{Status: http.StatusOK, Expected: true},
+		{Status: http.StatusNoContent, Expected: true},
+		{Status: http.StatusUnauthorized},
+		{Status: http.StatusForbidden},
+		{Status: http.StatusInternalServerError, Error: true},
+		{Status: http.StatusFound, Error: true},
+	}
+	for i, c := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(c.Status)
+		}))
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return errUpstreamRedirect
+			},
+		}
+		permitted, err := queryAuthorizer(client, server.URL, []byte(`{}`))
+		server.Close()
+		if c.Error {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, permitted, "case %d", i)
+	}
+}
+
+func TestAdmissionHandlerAuthorizer(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:           "/entitled",
+			Methods:       []string{"ANY"},
+			Authorizer:    server.URL,
+			AuthorizerTTL: time.Duration(1) * time.Minute,
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	token := newFakeJWTToken(t, jose.Claims{
+		"aud": fakeClientID,
+		"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+	})
+	for i := 0; i < 3; i++ {
+		req := newFakeHTTPRequest("GET", "/entitled")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// step: a different query or host is a different input, so a different decision
+	req := newFakeHTTPRequest("GET", "/entitled")
+	req.URL.RawQuery = "account=2"
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	proxy.router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	req = newFakeHTTPRequest("GET", "/entitled")
+	req.Host = "other.example.com"
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	proxy.router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestAuthorizerDecisionKey(t *testing.T) {
+	assert.Equal(t, authorizerDecisionKey("http://a", []byte(`{}`)), authorizerDecisionKey("http://a", []byte(`{}`)))
+	assert.NotEqual(t, authorizerDecisionKey("http://a", []byte(`{}`)), authorizerDecisionKey("http://b", []byte(`{}`)))
+	assert.NotEqual(t, authorizerDecisionKey("http://a", []byte(`{}`)), authorizerDecisionKey("http://a", []byte(`{"a":1}`)))
+}
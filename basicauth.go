@@ -0,0 +1,140 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gambol99/go-oidc/oauth2"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// getIdentityFromBasicAuth retrieves the identity for the basic credentials of the request, performing a direct
+// access grant with the provider; the access token is cached on a hash of the credentials until close to expiry
+//
+func (r *oauthProxy) getIdentityFromBasicAuth(cx *gin.Context) (*userContext, error) {
+	username, password, found := cx.Request.BasicAuth()
+	if !found || username == "" || password == "" {
+		return nil, ErrSessionNotFound
+	}
+	token, err := r.getBasicAuthToken(username, password, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	user, err := extractIdentity(token, r.roles)
+	if err != nil {
+		return nil, err
+	}
+	// step: the token is not held in a session, so is handled as a bearer token
+	user.bearerToken = true
+
+	log.WithFields(log.Fields{
+		"id":    user.id,
+		"name":  user.name,
+		"roles": strings.Join(user.roles, ","),
+	}).Debugf("found the basic credentials identity: %s in the request", user.name)
+
+	return user, nil
+}
+
+//
+// getBasicAuthToken returns the access token for the credentials, from the cache else the provider
+//
+func (r *oauthProxy) getBasicAuthToken(username, password string, now time.Time) (jose.JWT, error) {
+	key := hashBasicCredentials(username, password, r.config.EncryptionKey)
+	if cached, found := r.basicTokens.get(key, now); found {
+		return jose.ParseJWT(cached)
+	}
+
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return jose.JWT{}, err
+	}
+	response, err := client.UserCredsToken(username, password)
+	if err != nil {
+		if e, ok := err.(*oauth2.Error); ok && e.Type == oauth2.ErrorInvalidGrant {
+			return jose.JWT{}, ErrInvalidCredentials
+		}
+		return jose.JWT{}, err
+	}
+	token, err := jose.ParseJWT(response.AccessToken)
+	if err != nil {
+		return jose.JWT{}, err
+	}
+	if err := verifyToken(r.client, token); err != nil {
+		return jose.JWT{}, err
+	}
+	r.basicTokens.set(key, response.AccessToken, getServiceTokenExpiry(response.AccessToken, response.Expires, now), now)
+
+	return token, nil
+}
+
+//
+// isBasicAuthResource checks if the resource being accessed permits basic credentials
+//
+func (r *oauthProxy) isBasicAuthResource(cx *gin.Context) bool {
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).EnableBasicAuth
+	}
+
+	return false
+}
+
+//
+// basicAuthChallenge adds the basic challenge to an unauthorized response of a resource permitting basic
+// credentials, so the tools and browsers prompt for the credentials
+//
+func (r *oauthProxy) basicAuthChallenge(cx *gin.Context, code int) {
+	if code != http.StatusUnauthorized || !r.acceptsBasicCredentials(cx) {
+		return
+	}
+	realm := getRealmName(r.config.DiscoveryURL)
+	if realm == "" {
+		realm = prog
+	}
+
+	cx.Writer.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+}
+
+//
+// hasBasicAuth checks if the request presented basic credentials
+//
+func hasBasicAuth(req *http.Request) bool {
+	_, _, found := req.BasicAuth()
+
+	return found
+}
+
+//
+// isBrowserRequest checks if the client accepts html, else it's a tool which cannot follow the login redirect
+//
+func isBrowserRequest(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+//
+// hashBasicCredentials returns the hex encoded hmac of the credentials, the key of the cached token
+//
+func hashBasicCredentials(username, password, key string) string {
+	return hex.EncodeToString(signData([]byte(username+":"+password), key))
+}
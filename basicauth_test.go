@@ -0,0 +1,71 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasicAuthResource(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Resources = []*Resource{{URL: "/git", Methods: []string{"ANY"}, EnableBasicAuth: true}}
+	proxy, _, u := newTestProxyService(t, config)
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cs := []struct {
+		Username     string
+		Password     string
+		Accept       string
+		ExpectedCode int
+		Challenge    bool
+	}{
+		{Username: "test", Password: "test", ExpectedCode: http.StatusOK},
+		{Username: "test", Password: "invalid", ExpectedCode: http.StatusUnauthorized, Challenge: true},
+		{ExpectedCode: http.StatusUnauthorized, Challenge: true},
+		{Accept: "text/html", ExpectedCode: http.StatusTemporaryRedirect},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+"/git/info/refs", nil)
+		if c.Username != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		if c.Accept != "" {
+			req.Header.Set("Accept", c.Accept)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		challenge := strings.Join(resp.Header["Www-Authenticate"], ",")
+		assert.Equal(t, c.Challenge, strings.Contains(challenge, "Basic realm="), "case %d, challenge: %s", i, challenge)
+	}
+	// step: the token of the accepted credentials is cached
+	assert.Equal(t, 1, len(proxy.basicTokens.tokens))
+}
+
+func TestHashBasicCredentials(t *testing.T) {
+	assert.Equal(t, hashBasicCredentials("a", "b", "key"), hashBasicCredentials("a", "b", "key"))
+	assert.NotEqual(t, hashBasicCredentials("a", "b", "key"), hashBasicCredentials("a", "c", "key"))
+	assert.NotEqual(t, hashBasicCredentials("a", "b", "key"), hashBasicCredentials("a", "b", "other"))
+}
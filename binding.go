@@ -0,0 +1,70 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gambol99/go-oidc/jose"
+)
+
+const (
+	// claimConfirmation is the confirmation claim binding the token to a key (RFC 7800)
+	claimConfirmation = "cnf"
+	// confirmationThumbprint is the sha256 thumbprint of the certificate the token is bound to (RFC 8705)
+	confirmationThumbprint = "x5t#S256"
+)
+
+//
+// getConfirmationThumbprint returns the certificate thumbprint the token is bound to, if any
+//
+func getConfirmationThumbprint(claims jose.Claims) (string, bool) {
+	confirmation, found := claims[claimConfirmation].(map[string]interface{})
+	if !found {
+		return "", false
+	}
+	thumbprint, found := confirmation[confirmationThumbprint].(string)
+
+	return thumbprint, found
+}
+
+//
+// getCertificateThumbprint returns the base64url encoded sha256 of the certificate
+//
+func getCertificateThumbprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+//
+// isBoundToConnection checks a certificate bound token was presented over a connection with the same client
+// certificate, the tokens which are not bound are always permitted
+//
+func isBoundToConnection(claims jose.Claims, req *http.Request) bool {
+	thumbprint, found := getConfirmationThumbprint(claims)
+	if !found {
+		return true
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) <= 0 {
+		return false
+	}
+
+	return getCertificateThumbprint(req.TLS.PeerCertificates[0]) == thumbprint
+}
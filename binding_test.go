@@ -0,0 +1,98 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsBoundToConnection(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	hash := sha256.Sum256(cert.Raw)
+	thumbprint := base64.RawURLEncoding.EncodeToString(hash[:])
+	assert.Equal(t, thumbprint, getCertificateThumbprint(cert))
+
+	cases := []struct {
+		Claims       jose.Claims
+		Certificates []*x509.Certificate
+		Bound        bool
+	}{
+		{Claims: jose.Claims{}, Bound: true},
+		{Claims: jose.Claims{"cnf": map[string]interface{}{"jkt": "key"}}, Bound: true},
+		{Claims: jose.Claims{"cnf": map[string]interface{}{"x5t#S256": thumbprint}}},
+		{
+			Claims:       jose.Claims{"cnf": map[string]interface{}{"x5t#S256": thumbprint}},
+			Certificates: []*x509.Certificate{cert},
+			Bound:        true,
+		},
+		{
+			Claims:       jose.Claims{"cnf": map[string]interface{}{"x5t#S256": "another"}},
+			Certificates: []*x509.Certificate{cert},
+		},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", "/")
+		if c.Certificates != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: c.Certificates}
+		}
+		assert.Equal(t, c.Bound, isBoundToConnection(c.Claims, req), "case %d", i)
+	}
+}
+
+func TestAuthenticationHandlerCertificateBound(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.EnableCertificateBoundTokens = true
+	proxy.createEndpoints()
+
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	token := newFakeJWTToken(t, jose.Claims{
+		"aud": fakeClientID,
+		"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		"cnf": map[string]interface{}{"x5t#S256": getCertificateThumbprint(cert)},
+	})
+	for i, c := range []*x509.Certificate{cert, {Raw: []byte("another")}, nil} {
+		req := newFakeHTTPRequest("GET", "/admin")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		if c != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c}}
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if i == 0 {
+			assert.NotEqual(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `error="invalid_token"`, "case %d", i)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//
+// circuitBreaker stops the requests to the upstream after a number of consecutive failures, permitting a
+// single trial request once the timeout has passed
+//
+type circuitBreaker struct {
+	sync.Mutex
+	// the consecutive failures before the circuit is opened
+	threshold int
+	// the time the circuit is open before a trial request
+	timeout time.Duration
+	// the number of consecutive failures
+	failures int
+	// the time the circuit was opened, or the last trial request
+	opened time.Time
+}
+
+//
+// newCircuitBreaker creates a circuit breaker
+//
+func newCircuitBreaker(threshold int, timeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+//
+// allow checks if a request is permitted to the upstream
+//
+func (r *circuitBreaker) allow(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.failures < r.threshold {
+		return true
+	}
+	// step: permit a single trial request once the timeout has passed
+	if now.Sub(r.opened) >= r.timeout {
+		r.opened = now
+		return true
+	}
+
+	return false
+}
+
+//
+// success records a successful request, closing the circuit
+//
+func (r *circuitBreaker) success() {
+	r.Lock()
+	defer r.Unlock()
+	if r.failures >= r.threshold {
+		log.Infof("the upstream has recovered, closing the circuit")
+	}
+	r.failures = 0
+}
+
+//
+// failure records a failed request, opening the circuit on reaching the threshold
+//
+func (r *circuitBreaker) failure(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.failures++
+	if r.failures == r.threshold {
+		log.Warnf("the upstream has failed %d consecutive requests, opening the circuit for %s", r.failures, r.timeout)
+		r.opened = now
+	}
+}
+
+//
+// upstreamTransport retries the failed idempotent requests and records the outcome against the circuit breaker
+//
+type upstreamTransport struct {
+	// the transport to the upstream
+	transport http.RoundTripper
+	// the number of retries for idempotent requests
+	retries int
+	// the circuit breaker, if any
+	breaker *circuitBreaker
+}
+
+// RoundTrip performs the request to the upstream
+func (r *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	if isRetryableRequest(req) {
+		attempts += r.retries
+	}
+
+	var resp *http.Response
+	var err error
+	for i := 0; i < attempts; i++ {
+		resp, err = r.transport.RoundTrip(req)
+		if err == nil && !isUpstreamFailure(resp.StatusCode) {
+			if r.breaker != nil {
+				r.breaker.success()
+			}
+			return resp, nil
+		}
+		if r.breaker != nil {
+			r.breaker.failure(time.Now())
+		}
+		// step: discard the failed response if we are retrying
+		if i < attempts-1 {
+			if err == nil {
+				resp.Body.Close()
+			}
+			log.WithFields(log.Fields{
+				"method":  req.Method,
+				"path":    req.URL.Path,
+				"attempt": i + 1,
+			}).Warnf("the upstream request failed, retrying")
+		}
+	}
+
+	return resp, err
+}
+
+//
+// isRetryableRequest checks if the request is idempotent and has no body, so is safe to send again
+//
+func isRetryableRequest(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return req.ContentLength == 0 && len(req.TransferEncoding) <= 0
+	}
+
+	return false
+}
+
+//
+// isUpstreamFailure checks if the status code indicates the upstream is failing
+//
+func isUpstreamFailure(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
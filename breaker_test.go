@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(2, time.Duration(10)*time.Second)
+	assert.True(t, breaker.allow(now))
+	breaker.failure(now)
+	assert.True(t, breaker.allow(now))
+	breaker.failure(now)
+	assert.False(t, breaker.allow(now))
+
+	// step: a single trial is permitted after the timeout
+	later := now.Add(time.Duration(10) * time.Second)
+	assert.True(t, breaker.allow(later))
+	assert.False(t, breaker.allow(later))
+	breaker.success()
+	assert.True(t, breaker.allow(later))
+}
+
+func TestIsRetryableRequest(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/", nil)
+	assert.True(t, isRetryableRequest(req))
+	req, _ = http.NewRequest("POST", "http://127.0.0.1/", nil)
+	assert.False(t, isRetryableRequest(req))
+	req, _ = http.NewRequest("PUT", "http://127.0.0.1/", bytes.NewBufferString("body"))
+	assert.False(t, isRetryableRequest(req))
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var requests int32
+	_, location := newFakeRetryProxy(t, func(proxy *oauthProxy) {
+		proxy.config.UpstreamRetries = 2
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	resp, err := http.Get(location + "/upload")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// step: a post is not retried
+	atomic.StoreInt32(&requests, 0)
+	resp, err = http.Post(location+"/upload", "text/plain", bytes.NewBufferString("body"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	var requests int32
+	_, location := newFakeRetryProxy(t, func(proxy *oauthProxy) {
+		proxy.config.UpstreamCircuitThreshold = 2
+		proxy.config.UpstreamCircuitTimeout = time.Duration(1) * time.Hour
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	expected := []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable}
+	for i, code := range expected {
+		resp, err := http.Get(location + "/upload")
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, code, resp.StatusCode, "case %d", i)
+			resp.Body.Close()
+		}
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func newFakeRetryProxy(t *testing.T, configure func(*oauthProxy), upstream http.Handler) (*oauthProxy, string) {
+	service := httptest.NewServer(upstream)
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/upload",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+		},
+	})
+	configure(proxy)
+	proxy.endpoint, _ = url.Parse(service.URL)
+	if err := proxy.createUpstreamProxy(proxy.endpoint); err != nil {
+		t.Fatalf("unable to create the upstream proxy, error: %s", err)
+	}
+	proxy.createEndpoints()
+
+	return proxy, httptest.NewServer(proxy.router).URL
+}
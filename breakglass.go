@@ -0,0 +1,126 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// providerProbeInterval is the time the reachability of the provider is cached
+const providerProbeInterval = time.Duration(10) * time.Second
+
+//
+// providerProbe checks the provider is reachable via a tcp connection, caching the outcome for the interval
+//
+type providerProbe struct {
+	sync.Mutex
+	// the address of the provider
+	address string
+	// the timeout on the connection
+	timeout time.Duration
+	// the time of the last check
+	checked time.Time
+	// whether the provider was reachable on the last check
+	reachable bool
+}
+
+//
+// newProviderProbe creates a probe of the provider from the discovery url
+//
+func newProviderProbe(discoveryURL string, timeout time.Duration) (*providerProbe, error) {
+	location, err := url.Parse(discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &providerProbe{address: dialAddress(location), timeout: timeout}, nil
+}
+
+//
+// isReachable checks if the provider is reachable
+//
+func (r *providerProbe) isReachable(now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	if !r.checked.IsZero() && now.Sub(r.checked) < providerProbeInterval {
+		return r.reachable
+	}
+	conn, err := net.DialTimeout("tcp", r.address, r.timeout)
+	if err == nil {
+		conn.Close()
+	}
+	r.checked = now
+	r.reachable = err == nil
+
+	return r.reachable
+}
+
+//
+// getIdentityFromAuthenticator verifies the basic credentials of the request with the secondary authenticator;
+// permitted only while the provider is unreachable, every attempt is logged
+//
+func (r *oauthProxy) getIdentityFromAuthenticator(cx *gin.Context) (*userContext, error) {
+	username, password, found := cx.Request.BasicAuth()
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	if r.probe.isReachable(time.Now()) {
+		return nil, ErrSessionNotFound
+	}
+
+	fields := log.Fields{
+		"username":      username,
+		"client_ip":     cx.ClientIP(),
+		"path":          cx.Request.URL.Path,
+		"authenticator": r.authenticator.Name(),
+	}
+	user, err := r.authenticator.Authenticate(username, password)
+	if err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warnf("BREAK GLASS: the provider is unreachable and the authenticator refused the credentials")
+		return nil, err
+	}
+	// step: the identity is not held in a session
+	user.bearerToken = true
+
+	log.WithFields(fields).Warnf("BREAK GLASS: the provider is unreachable, the user was authenticated by the authenticator")
+
+	return user, nil
+}
+
+//
+// isBreakGlassResource checks if the resource being accessed permits the secondary authenticator
+//
+func (r *oauthProxy) isBreakGlassResource(cx *gin.Context) bool {
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).BreakGlass && r.authenticator != nil
+	}
+
+	return false
+}
+
+//
+// acceptsBasicCredentials checks if the resource being accessed permits basic credentials of any sort
+//
+func (r *oauthProxy) acceptsBasicCredentials(cx *gin.Context) bool {
+	return r.isBasicAuthResource(cx) || r.isBreakGlassResource(cx)
+}
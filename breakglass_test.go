@@ -0,0 +1,73 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakGlassResource(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.LDAPURL = newFakeLDAPServer(t, "uid=admin,ou=admins,dc=example,dc=com", "secret", true)
+	config.LDAPBindDN = "uid=%s,ou=admins,dc=example,dc=com"
+	config.LDAPFilter = fakeLDAPFilter
+	config.LDAPRoles = []string{fakeAdminRole}
+	config.LDAPTimeout = time.Duration(2) * time.Second
+	config.Resources = []*Resource{{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}, BreakGlass: true}}
+	proxy, _, u := newTestProxyService(t, config)
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	request := func(username, password string) int {
+		req, _ := http.NewRequest("GET", u+"/admin/settings", nil)
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// step: the provider is reachable, so the directory is not consulted
+	assert.Equal(t, http.StatusUnauthorized, request("admin", "secret"))
+
+	// step: the provider is unreachable
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	proxy.probe = &providerProbe{address: listener.Addr().String(), timeout: time.Second}
+	assert.Equal(t, http.StatusOK, request("admin", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, request("admin", "wrong"))
+}
+
+func TestProviderProbe(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	probe := &providerProbe{address: listener.Addr().String(), timeout: time.Second}
+	now := time.Now()
+	assert.True(t, probe.isReachable(now))
+
+	// step: the outcome is cached for the interval
+	listener.Close()
+	assert.True(t, probe.isReachable(now.Add(time.Second)))
+	assert.False(t, probe.isReachable(now.Add(providerProbeInterval)))
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// failureTrackerSize is the number of clients tracked before the stale records are removed
+const failureTrackerSize = 10000
+
+//
+// failureRecord is the authentication failures of a client
+//
+type failureRecord struct {
+	// the failures within the window
+	failures int
+	// the time of the first failure in the window
+	first time.Time
+	// the time the block ends
+	blocked time.Time
+}
+
+//
+// failureTracker counts the authentication failures of the clients, blocking them for an exponentially
+// increasing duration once the threshold is reached
+//
+type failureTracker struct {
+	sync.Mutex
+	// the brute force settings
+	settings BruteForce
+	// the failures keyed on the client address or subject
+	clients map[string]*failureRecord
+}
+
+//
+// newFailureTracker creates a tracker for the brute force settings
+//
+func newFailureTracker(settings BruteForce) *failureTracker {
+	return &failureTracker{
+		settings: settings,
+		clients:  make(map[string]*failureRecord, 0),
+	}
+}
+
+//
+// blockedFor returns the remaining duration of the block on the client, zero if not blocked
+//
+func (r *failureTracker) blockedFor(key string, now time.Time) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if record, found := r.clients[key]; found && now.Before(record.blocked) {
+		return record.blocked.Sub(now)
+	}
+
+	return 0
+}
+
+//
+// failure records a failure of the client, returning the duration of the block if the client is now blocked
+//
+func (r *failureTracker) failure(key string, now time.Time) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	record, found := r.clients[key]
+	if !found {
+		if len(r.clients) >= failureTrackerSize {
+			r.prune(now)
+		}
+		record = &failureRecord{first: now}
+		r.clients[key] = record
+	}
+	// step: the failures are counted within the window, unless the client is blocked
+	if now.Sub(record.first) > r.settings.Window && now.After(record.blocked) {
+		record.failures = 0
+		record.first = now
+	}
+	record.failures++
+	if record.failures < r.settings.Threshold {
+		return 0
+	}
+
+	block := r.settings.MaxBlock
+	if exponent := record.failures - r.settings.Threshold; exponent < 32 {
+		if backoff := r.settings.Backoff * time.Duration(math.Pow(2, float64(exponent))); backoff < block {
+			block = backoff
+		}
+	}
+	record.blocked = now.Add(block)
+
+	return block
+}
+
+//
+// prune removes the records which are no longer blocked and outside the window, else all if none are stale
+//
+func (r *failureTracker) prune(now time.Time) {
+	for key, x := range r.clients {
+		if now.After(x.blocked) && now.Sub(x.first) > r.settings.Window {
+			delete(r.clients, key)
+		}
+	}
+	if len(r.clients) >= failureTrackerSize {
+		r.clients = make(map[string]*failureRecord, 0)
+	}
+}
+
+//
+// bruteForceHandler blocks the client addresses with repeated authentication failures, recording the 401 and 403
+// responses to the requests presenting credentials against the address and subject
+//
+func (r *oauthProxy) bruteForceHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		address := "address:" + cx.ClientIP()
+		if wait := r.failures.blockedFor(address, time.Now()); wait > 0 {
+			r.blockedResponse(cx, address, wait)
+			return
+		}
+
+		cx.Next()
+
+		if code := cx.Writer.Status(); code != http.StatusUnauthorized && code != http.StatusForbidden {
+			return
+		}
+		if !r.hasCredentials(cx.Request) {
+			return
+		}
+		keys := []string{address}
+		if uc, found := cx.Get(userContextName); found {
+			keys = append(keys, "subject:"+uc.(*userContext).id)
+		}
+		for _, key := range keys {
+			if block := r.failures.failure(key, time.Now()); block > 0 {
+				log.WithFields(log.Fields{
+					"client":   key,
+					"duration": block.String(),
+				}).Warnf("repeated authentication failures, blocking the client")
+			}
+		}
+	}
+}
+
+//
+// bruteForceSubjectHandler blocks the subjects with repeated authentication failures, once the identity is known
+//
+func (r *oauthProxy) bruteForceSubjectHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if r.failures == nil {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
+		}
+		subject := "subject:" + uc.(*userContext).id
+		if wait := r.failures.blockedFor(subject, time.Now()); wait > 0 {
+			r.blockedResponse(cx, subject, wait)
+		}
+	}
+}
+
+//
+// blockedResponse refuses the request of a blocked client, indicating when to retry
+//
+func (r *oauthProxy) blockedResponse(cx *gin.Context, client string, wait time.Duration) {
+	log.WithFields(log.Fields{
+		"client": client,
+		"path":   cx.Request.URL.Path,
+		"wait":   wait.String(),
+	}).Warnf("refusing the request of a blocked client")
+
+	cx.Writer.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	r.errorResponse(cx, http.StatusTooManyRequests, reasonClientBlocked)
+}
+
+//
+// hasCredentials checks if the request presented credentials, a bearer token, session, api key or login
+//
+func (r *oauthProxy) hasCredentials(req *http.Request) bool {
+	if req.Header.Get(authorizationHeader) != "" || (len(r.config.APIKeys) > 0 && req.Header.Get(r.config.APIKeyHeader) != "") {
+		return true
+	}
+	if _, err := req.Cookie(r.config.CookieAccessName); err == nil {
+		return true
+	}
+
+	return req.URL.Path == oauthURL+loginURL
+}
+
+//
+// isEnabled checks if the brute force protection has been set
+//
+func (r BruteForce) isEnabled() bool {
+	return r.Threshold > 0
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureTracker(t *testing.T) {
+	tracker := newFailureTracker(BruteForce{
+		Threshold: 3,
+		Window:    time.Duration(1) * time.Minute,
+		Backoff:   time.Duration(10) * time.Second,
+		MaxBlock:  time.Duration(30) * time.Second,
+	})
+	now := time.Now()
+
+	assert.Equal(t, time.Duration(0), tracker.failure("client", now))
+	assert.Equal(t, time.Duration(0), tracker.failure("client", now))
+	assert.Equal(t, time.Duration(0), tracker.blockedFor("client", now))
+	assert.Equal(t, time.Duration(10)*time.Second, tracker.failure("client", now))
+	assert.Equal(t, time.Duration(10)*time.Second, tracker.blockedFor("client", now))
+	assert.Equal(t, time.Duration(0), tracker.blockedFor("another", now))
+
+	// step: the block doubles with each failure up to the max block
+	assert.Equal(t, time.Duration(20)*time.Second, tracker.failure("client", now))
+	assert.Equal(t, time.Duration(30)*time.Second, tracker.failure("client", now))
+	assert.Equal(t, time.Duration(0), tracker.blockedFor("client", now.Add(time.Minute)))
+
+	// step: the failures outside the window are forgotten
+	later := now.Add(time.Duration(2) * time.Minute)
+	assert.Equal(t, time.Duration(0), tracker.failure("client", later))
+}
+
+func TestFailureTrackerPrune(t *testing.T) {
+	tracker := newFailureTracker(BruteForce{Threshold: 1, Window: time.Minute, Backoff: time.Second, MaxBlock: time.Second})
+	now := time.Now()
+	tracker.failure("stale", now.Add(-time.Hour))
+	tracker.failure("blocked", now)
+	tracker.prune(now)
+	_, found := tracker.clients["stale"]
+	assert.False(t, found, "the stale record should have been pruned")
+	_, found = tracker.clients["blocked"]
+	assert.True(t, found, "the blocked record should have been kept")
+}
+
+func TestBruteForceHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.BruteForce = BruteForce{
+		Threshold: 2,
+		Window:    time.Minute,
+		Backoff:   time.Minute,
+		MaxBlock:  time.Hour,
+	}
+	proxy.createEndpoints()
+
+	// step: requests without credentials are not counted
+	for i := 0; i < 3; i++ {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", "/admin"))
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := newFakeHTTPRequest("GET", "/admin")
+		req.Header.Set(authorizationHeader, "Bearer invalid")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, expected, recorder.Code, "case %d, expected: %d, got: %d", i, expected, recorder.Code)
+		if expected == http.StatusTooManyRequests {
+			assert.Equal(t, "60", recorder.Header().Get("Retry-After"))
+		}
+	}
+
+	// step: the client address is blocked regardless of credentials
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", "/admin"))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+}
+
+func TestBruteForceSubjectHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.failures = newFailureTracker(BruteForce{Threshold: 1, Window: time.Minute, Backoff: time.Minute, MaxBlock: time.Hour})
+	proxy.failures.failure("subject:blocked", time.Now())
+	handler := proxy.bruteForceSubjectHandler()
+
+	cx := newFakeGinContext("GET", "/")
+	cx.Set(userContextName, &userContext{id: "blocked"})
+	handler(cx)
+	assert.Equal(t, http.StatusTooManyRequests, cx.Writer.Status())
+
+	cx = newFakeGinContext("GET", "/")
+	cx.Set(userContextName, &userContext{id: "another"})
+	handler(cx)
+	assert.Equal(t, http.StatusOK, cx.Writer.Status())
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/elazarl/goproxy"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// canaryRoute is a compiled canary route
+//
+type canaryRoute struct {
+	// the name or path of the claim
+	claim string
+	// the expression the claim is matched against
+	match *regexp.Regexp
+	// the alternate upstream
+	endpoint *url.URL
+	// the proxy to the alternate upstream
+	proxy reverseProxy
+}
+
+//
+// newCanaryRoutes compiles the canary routes of the config
+//
+func newCanaryRoutes(config *Config) ([]*canaryRoute, error) {
+	var list []*canaryRoute
+	for _, x := range config.CanaryRoutes {
+		if x.Claim == "" || x.Value == "" {
+			return nil, fmt.Errorf("the canary route must have a claim and value")
+		}
+		// step: the expression must match the whole value, not merely a part of it
+		match, err := regexp.Compile("^(?:" + x.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("the value of the canary route for the claim: %s is invalid, %s", x.Claim, err)
+		}
+		endpoint, err := url.Parse(x.Upstream)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, fmt.Errorf("the upstream of the canary route for the claim: %s must be a http or https url", x.Claim)
+		}
+		list = append(list, &canaryRoute{claim: x.Claim, match: match, endpoint: endpoint})
+	}
+
+	return list, nil
+}
+
+//
+// createCanaryProxy creates the proxy to the upstream of a canary route, with a transport of its own so the requests
+// are neither dialed to the unix socket of the upstream, sent cleartext to a https canary with http2, nor counted by
+// the circuit breaker of the upstream
+//
+func (r *oauthProxy) createCanaryProxy(endpoint *url.URL) reverseProxy {
+	dialer := (&net.Dialer{
+		KeepAlive: r.config.UpstreamKeepaliveTimeout,
+		Timeout:   r.config.UpstreamTimeout,
+	}).Dial
+
+	if r.config.EnableHTTP2 {
+		return newHTTP2Proxy(endpoint, dialer, r.upstreamTLS)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr = &http.Transport{
+		Dial:                  dialer,
+		TLSClientConfig:       r.upstreamTLS,
+		TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   r.config.UpstreamMaxIdleConnections,
+		DisableKeepAlives:     !r.config.UpstreamKeepalives,
+	}
+
+	return proxy
+}
+
+//
+// decodeCanaryRoute decodes the canary route option, claim=value=upstream-url
+//
+func decodeCanaryRoute(option string) (*CanaryRoute, error) {
+	items := strings.SplitN(option, "=", 3)
+	if len(items) != 3 || items[0] == "" || items[1] == "" || items[2] == "" {
+		return nil, fmt.Errorf("invalid canary route '%s' should be claim=value=upstream-url", option)
+	}
+
+	return &CanaryRoute{Claim: items[0], Value: items[1], Upstream: items[2]}, nil
+}
+
+//
+// getCanaryRoute returns the first canary route matching the claims of the user, if any
+//
+func getCanaryRoute(cx *gin.Context, routes []*canaryRoute) *canaryRoute {
+	uc, found := cx.Get(userContextName)
+	if !found {
+		return nil
+	}
+	user := uc.(*userContext)
+	for _, route := range routes {
+		value, found := lookupClaim(user.claims, route.claim)
+		if !found {
+			continue
+		}
+		if isCanaryMatch(route.match, value) {
+			log.WithFields(log.Fields{
+				"claim":    route.claim,
+				"upstream": route.endpoint.String(),
+				"username": user.name,
+			}).Debugf("routing the request to the canary upstream")
+
+			return route
+		}
+	}
+
+	return nil
+}
+
+//
+// isCanaryMatch checks the value of the claim, or any of the values of a list, matches the expression
+//
+func isCanaryMatch(match *regexp.Regexp, value interface{}) bool {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, x := range v {
+			if isCanaryMatch(match, x) {
+				return true
+			}
+		}
+		return false
+	case []string:
+		for _, x := range v {
+			if match.MatchString(x) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return match.MatchString(formatClaim(value))
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestNewCanaryRoutes(t *testing.T) {
+	cases := []struct {
+		Route *CanaryRoute
+		Ok    bool
+	}{
+		{Route: &CanaryRoute{Claim: "groups", Value: "^beta-testers$", Upstream: "http://127.0.0.1:8081"}, Ok: true},
+		{Route: &CanaryRoute{Claim: "groups", Value: "(", Upstream: "http://127.0.0.1:8081"}},
+		{Route: &CanaryRoute{Claim: "groups", Value: "beta", Upstream: "unix:///tmp/canary.sock"}},
+		{Route: &CanaryRoute{Value: "beta", Upstream: "http://127.0.0.1:8081"}},
+	}
+	for i, c := range cases {
+		_, err := newCanaryRoutes(&Config{CanaryRoutes: []*CanaryRoute{c.Route}})
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		assert.Error(t, err, "case %d", i)
+	}
+}
+
+func TestCanaryRouteAnchored(t *testing.T) {
+	routes, err := newCanaryRoutes(&Config{CanaryRoutes: []*CanaryRoute{
+		{Claim: "groups", Value: "beta|alpha", Upstream: "http://127.0.0.1:8081"},
+	}})
+	require.NoError(t, err)
+	assert.True(t, isCanaryMatch(routes[0].match, "beta"))
+	assert.True(t, isCanaryMatch(routes[0].match, []string{"staff", "alpha"}))
+	assert.False(t, isCanaryMatch(routes[0].match, "not-beta-testers"))
+	assert.False(t, isCanaryMatch(routes[0].match, []interface{}{"alphabet"}))
+}
+
+func TestCanaryRouteInvalidEndpoints(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.CanaryRoutes = []*CanaryRoute{{Claim: "groups", Value: "(", Upstream: "http://127.0.0.1:8081"}}
+	assert.Error(t, proxy.createEndpoints())
+}
+
+func TestDecodeCanaryRoute(t *testing.T) {
+	route, err := decodeCanaryRoute("groups=beta-testers=http://127.0.0.1:8081")
+	require.NoError(t, err)
+	assert.Equal(t, &CanaryRoute{Claim: "groups", Value: "beta-testers", Upstream: "http://127.0.0.1:8081"}, route)
+
+	_, err = decodeCanaryRoute("groups=beta-testers")
+	assert.Error(t, err)
+}
+
+func newFakeCanaryRequest(t *testing.T, claims jose.Claims) *http.Request {
+	claims["aud"] = "test"
+	claims["sub"] = "1e11e539-8256-4b3b-bda8-cc0d56cddb48"
+	claims["exp"] = time.Now().Add(time.Duration(1) * time.Hour).Unix()
+	req := newFakeHTTPRequest("GET", "/orders")
+	req.Header.Set("Authorization", "Bearer "+newFakeJWTToken(t, claims).Encode())
+
+	return req
+}
+
+func newFakeCanaryUpstream(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestCanaryRouting(t *testing.T) {
+	canary := newFakeCanaryUpstream("canary")
+	defer canary.Close()
+	gold := newFakeCanaryUpstream("gold")
+	defer gold.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	proxy.config.CanaryRoutes = []*CanaryRoute{
+		{Claim: "groups", Value: "^beta-testers$", Upstream: canary.URL},
+		{Claim: "resource_access.app.tier", Value: "^gold$", Upstream: gold.URL},
+	}
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream", "primary")
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+
+	cases := []struct {
+		Claims   jose.Claims
+		Upstream string
+	}{
+		{Claims: jose.Claims{"groups": []string{"staff", "beta-testers"}}, Upstream: "canary"},
+		{Claims: jose.Claims{"groups": []string{"staff"}}, Upstream: "primary"},
+		{Claims: jose.Claims{"resource_access": map[string]interface{}{
+			"app": map[string]interface{}{"tier": "gold"},
+		}}, Upstream: "gold"},
+	}
+	for i, c := range cases {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeCanaryRequest(t, c.Claims))
+		assert.Equal(t, http.StatusOK, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Upstream, recorder.Header().Get("X-Upstream"), "case %d", i)
+	}
+}
+
+func TestCanaryRoutingUnixUpstream(t *testing.T) {
+	canary := newFakeCanaryUpstream("canary")
+	defer canary.Close()
+
+	dir, err := ioutil.TempDir("", "upstream")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "upstream.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream", "primary")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	proxy.config.CanaryRoutes = []*CanaryRoute{{Claim: "groups", Value: "beta-testers", Upstream: canary.URL}}
+	proxy.endpoint, _ = url.Parse("unix://" + socket)
+	require.NoError(t, proxy.createUpstreamProxy(proxy.endpoint))
+	require.NoError(t, proxy.createEndpoints())
+
+	// step: the canary is dialed rather than the unix socket of the upstream
+	for i, c := range []struct {
+		Groups   []string
+		Upstream string
+	}{
+		{Groups: []string{"beta-testers"}, Upstream: "canary"},
+		{Groups: []string{"staff"}, Upstream: "primary"},
+	} {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeCanaryRequest(t, jose.Claims{"groups": c.Groups}))
+		assert.Equal(t, http.StatusOK, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Upstream, recorder.Header().Get("X-Upstream"), "case %d", i)
+	}
+}
+
+func TestCanaryRoutingHTTP2(t *testing.T) {
+	canary := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream", "canary")
+		w.Header().Set("X-Protocol", req.Proto)
+		w.WriteHeader(http.StatusOK)
+	}))
+	require.NoError(t, http2.ConfigureServer(canary.Config, nil))
+	canary.TLS = canary.Config.TLSConfig
+	canary.StartTLS()
+	defer canary.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	proxy.config.EnableHTTP2 = true
+	proxy.config.SkipUpstreamTLSVerify = true
+	proxy.config.CanaryRoutes = []*CanaryRoute{{Claim: "groups", Value: "beta-testers", Upstream: canary.URL}}
+	require.NoError(t, proxy.createUpstreamProxy(proxy.endpoint))
+	require.NoError(t, proxy.createEndpoints())
+
+	// step: the https canary is dialed with tls, though the upstream is cleartext (h2c)
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, newFakeCanaryRequest(t, jose.Claims{"groups": []string{"beta-testers"}}))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "canary", recorder.Header().Get("X-Upstream"))
+	assert.Equal(t, "HTTP/2.0", recorder.Header().Get("X-Protocol"))
+}
+
+func TestCanaryRoutingCircuitBreaker(t *testing.T) {
+	var primaryStatus, canaryStatus int32 = http.StatusOK, http.StatusBadGateway
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&primaryStatus)))
+	}))
+	defer primary.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&canaryStatus)))
+	}))
+	defer canary.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	proxy.config.UpstreamCircuitThreshold = 1
+	proxy.config.UpstreamCircuitTimeout = time.Duration(1) * time.Hour
+	proxy.config.CanaryRoutes = []*CanaryRoute{{Claim: "groups", Value: "beta-testers", Upstream: canary.URL}}
+	proxy.endpoint, _ = url.Parse(primary.URL)
+	require.NoError(t, proxy.createUpstreamProxy(proxy.endpoint))
+	require.NoError(t, proxy.createEndpoints())
+	check := func(groups string) int {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeCanaryRequest(t, jose.Claims{"groups": []string{groups}}))
+		return recorder.Code
+	}
+
+	// step: the failures of the canary do not open the circuit of the upstream
+	assert.Equal(t, http.StatusBadGateway, check("beta-testers"))
+	assert.Equal(t, http.StatusBadGateway, check("beta-testers"))
+	assert.Equal(t, http.StatusOK, check("staff"))
+
+	// step: the open circuit of the upstream does not refuse the canary users
+	atomic.StoreInt32(&primaryStatus, http.StatusBadGateway)
+	atomic.StoreInt32(&canaryStatus, http.StatusOK)
+	assert.Equal(t, http.StatusBadGateway, check("staff"))
+	assert.Equal(t, http.StatusServiceUnavailable, check("staff"))
+	assert.Equal(t, http.StatusOK, check("beta-testers"))
+}
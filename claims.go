@@ -0,0 +1,157 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// lookupClaim returns the value of the claim, the name being the claim or a path into the nested claims, i.e.
+// resource_access.myapp.roles[0] or $['resource_access']['myapp']
+//
+func lookupClaim(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, found := claims[name]; found {
+		return value, true
+	}
+	path, err := parseClaimPath(name)
+	if err != nil {
+		return nil, false
+	}
+
+	var value interface{} = claims
+	for _, x := range path {
+		switch step := x.(type) {
+		case string:
+			items, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = items[step]; !ok {
+				return nil, false
+			}
+		case int:
+			switch items := value.(type) {
+			case []interface{}:
+				if step >= len(items) {
+					return nil, false
+				}
+				value = items[step]
+			case []string:
+				if step >= len(items) {
+					return nil, false
+				}
+				value = items[step]
+			default:
+				return nil, false
+			}
+		}
+	}
+
+	return value, true
+}
+
+//
+// parseClaimPath parses the path into the nested claims, returning the keys (string) and indexes (int)
+//
+func parseClaimPath(name string) ([]interface{}, error) {
+	var path []interface{}
+	invalid := fmt.Errorf("invalid claim path: %s", name)
+
+	remaining := strings.TrimPrefix(strings.TrimPrefix(name, "$"), ".")
+	for remaining != "" {
+		switch remaining[0] {
+		case '.':
+			remaining = remaining[1:]
+			if remaining == "" || remaining[0] == '.' || remaining[0] == '[' {
+				return nil, invalid
+			}
+		case '[':
+			end := strings.Index(remaining, "]")
+			if end < 0 {
+				return nil, invalid
+			}
+			selector := remaining[1:end]
+			remaining = remaining[end+1:]
+			if len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+				path = append(path, selector[1:len(selector)-1])
+				continue
+			}
+			index, err := strconv.Atoi(selector)
+			if err != nil || index < 0 {
+				return nil, invalid
+			}
+			path = append(path, index)
+		default:
+			end := strings.IndexAny(remaining, ".[")
+			if end < 0 {
+				end = len(remaining)
+			}
+			path = append(path, remaining[:end])
+			remaining = remaining[end:]
+		}
+	}
+	if len(path) <= 0 {
+		return nil, invalid
+	}
+
+	return path, nil
+}
+
+//
+// formatClaim formats the value of the claim for a header, lists are comma separated and objects are json
+//
+func formatClaim(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case []interface{}:
+		var list []string
+		for _, x := range v {
+			list = append(list, formatClaim(x))
+		}
+		return strings.Join(list, ",")
+	case map[string]interface{}:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(content)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+//
+// encodeClaims encodes the claims for a header, as json or the base64 encoded json
+//
+func encodeClaims(claims map[string]interface{}, encoding string) (string, error) {
+	content, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(content), nil
+	}
+
+	return string(content), nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeNestedClaims(t *testing.T) map[string]interface{} {
+	claims := make(map[string]interface{}, 0)
+	content := `{
+		"sub": "1e11e539",
+		"https://example.com/tenant": "acme",
+		"resource_access": {
+			"myapp": {"roles": ["admin", "viewer"]},
+			"my.app": {"roles": ["owner"]}
+		},
+		"address": {"country": "UK"},
+		"groups": [{"name": "ops"}, {"name": "dev"}]
+	}`
+	if err := json.Unmarshal([]byte(content), &claims); err != nil {
+		t.Fatalf("unable to decode the claims, error: %s", err)
+	}
+
+	return claims
+}
+
+func TestLookupClaim(t *testing.T) {
+	claims := newFakeNestedClaims(t)
+	tests := []struct {
+		Name     string
+		Expected string
+		Found    bool
+	}{
+		{Name: "sub", Expected: "1e11e539", Found: true},
+		{Name: "https://example.com/tenant", Expected: "acme", Found: true},
+		{Name: "resource_access.myapp.roles[0]", Expected: "admin", Found: true},
+		{Name: "resource_access.myapp.roles[1]", Expected: "viewer", Found: true},
+		{Name: "resource_access.myapp.roles", Expected: "admin,viewer", Found: true},
+		{Name: "$.resource_access.myapp.roles[0]", Expected: "admin", Found: true},
+		{Name: "resource_access['my.app'].roles[0]", Expected: "owner", Found: true},
+		{Name: `$["address"]["country"]`, Expected: "UK", Found: true},
+		{Name: "address", Expected: `{"country":"UK"}`, Found: true},
+		{Name: "groups[1].name", Expected: "dev", Found: true},
+		{Name: "resource_access.myapp.roles[2]"},
+		{Name: "resource_access.other.roles"},
+		{Name: "sub.name"},
+		{Name: "sub[0]"},
+		{Name: "missing"},
+	}
+	for i, c := range tests {
+		value, found := lookupClaim(claims, c.Name)
+		assert.Equal(t, c.Found, found, "case %d, %s", i, c.Name)
+		if c.Found {
+			assert.Equal(t, c.Expected, formatClaim(value), "case %d, %s", i, c.Name)
+		}
+	}
+}
+
+func TestParseClaimPath(t *testing.T) {
+	tests := []struct {
+		Path     string
+		Expected []interface{}
+	}{
+		{Path: "given_name", Expected: []interface{}{"given_name"}},
+		{Path: "a.b[0].c", Expected: []interface{}{"a", "b", 0, "c"}},
+		{Path: "$['a.b'][2]", Expected: []interface{}{"a.b", 2}},
+		{Path: ""},
+		{Path: "$"},
+		{Path: "a..b"},
+		{Path: "a."},
+		{Path: "a[b]"},
+		{Path: "a[-1]"},
+		{Path: "a[0"},
+	}
+	for i, c := range tests {
+		path, err := parseClaimPath(c.Path)
+		if c.Expected == nil {
+			assert.Error(t, err, "case %d, %s", i, c.Path)
+			continue
+		}
+		if assert.NoError(t, err, "case %d, %s", i, c.Path) {
+			assert.Equal(t, c.Expected, path, "case %d, %s", i, c.Path)
+		}
+	}
+}
+
+func TestEncodeClaims(t *testing.T) {
+	claims := map[string]interface{}{"sub": "1e11e539", "roles": []string{"a", "b"}}
+	expected := `{"roles":["a","b"],"sub":"1e11e539"}`
+
+	value, err := encodeClaims(claims, "json")
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, value)
+	}
+	value, err = encodeClaims(claims, "base64")
+	if assert.NoError(t, err) {
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(expected)), value)
+	}
+}
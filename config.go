@@ -16,9 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
@@ -26,23 +29,73 @@ import (
 	"time"
 
 	"github.com/codegangsta/cli"
+	"gopkg.in/ldap.v2"
 	"gopkg.in/yaml.v2"
 )
 
 // newDefaultConfig returns a initialized config
 func newDefaultConfig() *Config {
 	return &Config{
-		Listen:                   "127.0.0.1:3000",
-		TagData:                  make(map[string]string, 0),
-		MatchClaims:              make(map[string]string, 0),
-		Headers:                  make(map[string]string, 0),
-		UpstreamTimeout:          time.Duration(10) * time.Second,
-		UpstreamKeepaliveTimeout: time.Duration(10) * time.Second,
-		CookieAccessName:         "kc-access",
-		CookieRefreshName:        "kc-state",
-		SecureCookie:             true,
-		SkipUpstreamTLSVerify:    true,
-		CrossOrigin:              CORS{},
+		Listen:                      "127.0.0.1:3000",
+		TagData:                     make(map[string]string, 0),
+		Features:                    make(map[string]bool, 0),
+		MatchClaims:                 make(map[string]string, 0),
+		RateLimitTiers:              make(map[string]RateLimit, 0),
+		Headers:                     make(map[string]string, 0),
+		UpstreamTimeout:             time.Duration(10) * time.Second,
+		UpstreamKeepaliveTimeout:    time.Duration(10) * time.Second,
+		UpstreamTLSHandshakeTimeout: time.Duration(10) * time.Second,
+		UpstreamMaxIdleConnections:  http.DefaultMaxIdleConnsPerHost,
+		AcmeCacheDir:                "./acme",
+		CrawlerCacheDuration:        time.Duration(5) * time.Minute,
+		APIKeyHeader:                "X-API-Key",
+		AssertionHeader:             "X-Assertion",
+		IdentityHeaderPrefix:        "X-Auth-",
+		IdentityHeaders:             make(map[string]string, 0),
+		AuthorizationParameters:     make(map[string]string, 0),
+		UpstreamHealthCheck:         "tcp",
+		UpstreamCircuitTimeout:      time.Duration(30) * time.Second,
+		UpstreamHealthInterval:      time.Duration(10) * time.Second,
+		TemplateReloadInterval:      time.Duration(5) * time.Second,
+		OpenPolicyAgentTimeout:      time.Duration(2) * time.Second,
+		AuthorizerTimeout:           time.Duration(2) * time.Second,
+		ResourceSyncInterval:        time.Duration(1) * time.Minute,
+		ReloadDrainTimeout:          time.Duration(30) * time.Second,
+		SecretReloadInterval:        time.Duration(10) * time.Second,
+		ConfigReloadInterval:        time.Duration(10) * time.Second,
+		CookieAccessName:            "kc-access",
+		CookieRefreshName:           "kc-state",
+		LegacyCookieGracePeriod:     time.Duration(24) * time.Hour,
+		CSRFCookieName:              "kc-csrf",
+		CSRFHeader:                  "X-CSRF-Token",
+		PreserveRequestLimit:        65536,
+		ServiceTokenHeader:          authorizationHeader,
+		RememberMeDuration:          time.Duration(720) * time.Hour,
+		OfflineSessionDuration:      time.Duration(720) * time.Hour,
+		LDAPTimeout:                 time.Duration(5) * time.Second,
+		AudienceValidation:          audienceValidationAud,
+		StateDuration:               time.Duration(10) * time.Minute,
+		SignedURLDuration:           time.Duration(15) * time.Minute,
+		DevListen:                   "127.0.0.1:3001",
+		SecureCookie:                true,
+		SkipUpstreamTLSVerify:       true,
+		CrossOrigin:                 CORS{},
+		BruteForce: BruteForce{
+			Window:   time.Duration(5) * time.Minute,
+			Backoff:  time.Duration(30) * time.Second,
+			MaxBlock: time.Duration(1) * time.Hour,
+		},
+	}
+}
+
+// normalize applies the settings implied by the development and sidecar modes, prior to the validation
+func (r *Config) normalize() {
+	if r.DevMode && r.ClientID == "" {
+		r.ClientID = devClientID
+	}
+	// step: the peers of a sidecar present bearer tokens, we hand back a 401 rather than redirect
+	if r.Sidecar {
+		r.NoRedirects = true
 	}
 }
 
@@ -51,6 +104,16 @@ func (r *Config) isValid() error {
 	if r.Listen == "" {
 		return fmt.Errorf("you have not specified the listening interface")
 	}
+	if r.LogOutput != "" && r.LogOutput != "stdout" && r.LogOutput != "stderr" {
+		if _, err := newLogOutputHook(r.LogOutput); err != nil {
+			return err
+		}
+	}
+	for name := range r.Features {
+		if _, found := experimentalFeatures[name]; !found {
+			return fmt.Errorf("the feature: %s is unknown", name)
+		}
+	}
 	if r.TLSCertificate != "" && r.TLSPrivateKey == "" {
 		return fmt.Errorf("you have not provided a private key")
 	}
@@ -66,12 +129,213 @@ func (r *Config) isValid() error {
 	if r.TLSCaCertificate != "" && !fileExists(r.TLSCaCertificate) {
 		return fmt.Errorf("the tls ca certificate file %s does not exist", r.TLSCaCertificate)
 	}
+	if r.EnableAcme && len(r.Hostnames) <= 0 {
+		return fmt.Errorf("you must specify the hostnames to obtain acme certificates for")
+	}
+	if r.EnableAcme && (r.TLSCertificate != "" || len(r.TLSCertificates) > 0) {
+		return fmt.Errorf("you cannot use acme and a tls certificate together")
+	}
+	if r.UpstreamCA != "" && !fileExists(r.UpstreamCA) {
+		return fmt.Errorf("the upstream ca %s does not exist", r.UpstreamCA)
+	}
+	if (r.UpstreamClientCertificate != "") != (r.UpstreamClientPrivateKey != "") {
+		return fmt.Errorf("you must specify both the upstream client certificate and private key")
+	}
+	if r.UpstreamClientCertificate != "" && !fileExists(r.UpstreamClientCertificate) {
+		return fmt.Errorf("the upstream client certificate %s does not exist", r.UpstreamClientCertificate)
+	}
+	if r.UpstreamClientPrivateKey != "" && !fileExists(r.UpstreamClientPrivateKey) {
+		return fmt.Errorf("the upstream client private key %s does not exist", r.UpstreamClientPrivateKey)
+	}
+	for _, x := range r.TLSCertificates {
+		if x.Certificate == "" || x.PrivateKey == "" {
+			return fmt.Errorf("the tls certificates must have both a certificate and private key")
+		}
+		if !fileExists(x.Certificate) {
+			return fmt.Errorf("the tls certificate %s does not exist", x.Certificate)
+		}
+		if !fileExists(x.PrivateKey) {
+			return fmt.Errorf("the tls private key %s does not exist", x.PrivateKey)
+		}
+	}
+	if err := applyTLSOptions(r, &tls.Config{}); err != nil {
+		return err
+	}
+	if r.TLSClientAuth != "" && r.TLSClientAuth != "require" && r.TLSClientAuth != "optional" {
+		return fmt.Errorf("the tls client auth must be either require or optional")
+	}
+	if r.EnableClientCertAuth && r.TLSCaCertificate == "" {
+		return fmt.Errorf("client certificate authentication requires a tls ca certificate")
+	}
+	if r.EnableCertificateBoundTokens && r.TLSCaCertificate == "" {
+		return fmt.Errorf("certificate bound tokens require a tls ca certificate to verify the client certificates")
+	}
+	for _, x := range r.LegacyCookieNames {
+		if x.Access == "" && x.Refresh == "" {
+			return fmt.Errorf("the legacy cookie names must have an access or refresh cookie name")
+		}
+	}
+	if r.LegacyCookieGracePeriod < 0 {
+		return fmt.Errorf("the legacy cookie grace period cannot be negative")
+	}
+	for _, x := range r.APIKeys {
+		if x.Name == "" || !isAPIKeyHash(x.Hash) {
+			return fmt.Errorf("the api keys must have a name and the hex encoded sha256 hash of the key")
+		}
+	}
+	if _, err := parseCIDRs(r.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := parseCertificatePins(r.OpenIDProviderPins); err != nil {
+		return err
+	}
+	if len(r.APIKeys) > 0 && r.APIKeyHeader == "" {
+		return fmt.Errorf("the api key header must be set when using api keys")
+	}
+	for _, x := range r.AssertionIssuers {
+		if x.Issuer == "" || x.PublicKey == "" {
+			return fmt.Errorf("the assertion issuers must have an issuer and public key")
+		}
+	}
+	if r.CrossOrigin.Credentials && containedIn("*", r.CrossOrigin.Origins) {
+		return fmt.Errorf("the cors credentials cannot be permitted with the wildcard origin, you must list the origins")
+	}
+	for _, x := range r.Resources {
+		if x.RequireAssertion && (len(r.AssertionIssuers) <= 0 || r.AssertionHeader == "") {
+			return fmt.Errorf("the resource: %s requires an assertion, you must specify the assertion header and issuers", x.URL)
+		}
+		if x.CrossOrigin != nil && x.CrossOrigin.Credentials && containedIn("*", x.CrossOrigin.Origins) {
+			return fmt.Errorf("the resource: %s permits the cors credentials with the wildcard origin, you must list the origins", x.URL)
+		}
+	}
+	listening := map[string]bool{r.Listen: true}
+	for _, x := range r.Listeners {
+		if err := x.isValid(); err != nil {
+			return err
+		}
+		if x.RedirectHTTPS && r.TLSCertificate == "" && len(r.TLSCertificates) <= 0 && !r.EnableAcme && r.VaultTLS == "" {
+			return fmt.Errorf("the listener: %s redirects to https, but the service listener has no tls", x.Listen)
+		}
+		if listening[x.Listen] {
+			return fmt.Errorf("the interface: %s is listened on more than once", x.Listen)
+		}
+		listening[x.Listen] = true
+	}
+	if r.CanonicalHostname != "" && strings.ContainsAny(r.CanonicalHostname, ":/") {
+		return fmt.Errorf("the canonical hostname: %s should be a hostname only, without the scheme or port", r.CanonicalHostname)
+	}
+	if r.ExtAuthzListen != "" {
+		if _, _, err := net.SplitHostPort(r.ExtAuthzListen); err != nil {
+			return fmt.Errorf("the ext-authz-listen: %s must be a host:port, error: %s", r.ExtAuthzListen, err)
+		}
+	}
+	if r.ExtAuthzHTTPListen != "" {
+		if _, _, err := net.SplitHostPort(r.ExtAuthzHTTPListen); err != nil {
+			return fmt.Errorf("the ext-authz-http-listen: %s must be a host:port, error: %s", r.ExtAuthzHTTPListen, err)
+		}
+		if r.ExtAuthzHTTPListen == r.ExtAuthzListen {
+			return fmt.Errorf("the ext-authz-http-listen and ext-authz-listen cannot be the same interface")
+		}
+	}
+	if r.EnableGracefulReload {
+		if strings.HasPrefix(r.Listen, "unix://") {
+			return fmt.Errorf("the graceful reload hands off tcp listeners only, not unix sockets")
+		}
+		if r.ExtAuthzListen != "" || r.ExtAuthzHTTPListen != "" {
+			return fmt.Errorf("the graceful reload hands off the main listener only, it cannot be used with the ext-authz-listen")
+		}
+		if len(r.Listeners) > 0 {
+			return fmt.Errorf("the graceful reload hands off the main listener only, it cannot be used with additional listeners")
+		}
+		if r.ReloadDrainTimeout <= 0 {
+			return fmt.Errorf("the reload drain timeout must be greater than zero")
+		}
+	}
+	if r.VaultClientSecret != "" || r.VaultEncryptionKey != "" || r.VaultTLS != "" {
+		if r.VaultURL == "" {
+			return fmt.Errorf("the vault secrets require the vault url")
+		}
+	}
+	if r.VaultURL != "" {
+		if u, err := url.Parse(r.VaultURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("the vault url: %s must be a http or https url", r.VaultURL)
+		}
+		if r.VaultToken == "" {
+			return fmt.Errorf("the vault url requires a vault token, i.e. the vault-token-file")
+		}
+		for _, x := range []string{r.VaultClientSecret, r.VaultEncryptionKey} {
+			if x == "" {
+				continue
+			}
+			if _, _, err := decodeVaultReference(x); err != nil {
+				return err
+			}
+		}
+		if r.VaultTLS != "" && (r.TLSCertificate != "" || r.EnableAcme) {
+			return fmt.Errorf("you cannot use the tls certificate from vault with a tls certificate or acme")
+		}
+	}
+	if r.EnableConfigReload {
+		if !r.EnableGracefulReload {
+			return fmt.Errorf("the configuration reload hands off to a new process, it requires the graceful reloads to be enabled")
+		}
+		if r.ConfigReloadInterval <= 0 {
+			return fmt.Errorf("the configuration reload interval must be positive")
+		}
+	}
+	if r.EnableSecretReload {
+		if !r.EnableGracefulReload {
+			return fmt.Errorf("the secret reload hands off to a new process, it requires the graceful reloads to be enabled")
+		}
+		if r.SecretReloadInterval <= 0 {
+			return fmt.Errorf("the secret reload interval must be positive")
+		}
+		if len(getSecretFiles(r)) <= 0 {
+			return fmt.Errorf("the secret reload requires a secret file, i.e. the client-secret-file")
+		}
+	}
+
+	if r.DevMode {
+		if r.DiscoveryURL != "" {
+			return fmt.Errorf("the development mode starts an embedded provider, you cannot specify a discovery url")
+		}
+		if r.DevListen == "" {
+			return fmt.Errorf("the development mode requires the dev-listen interface of the embedded provider")
+		}
+		for _, x := range r.DevUsers {
+			if x.Username == "" {
+				return fmt.Errorf("the users of the development mode must have a username")
+			}
+		}
+		if r.ClientID == "" {
+			return fmt.Errorf("the development mode requires a client id")
+		}
+	}
+
+	if r.Sidecar {
+		if !isLoopbackListener(r.Listen) {
+			return fmt.Errorf("the sidecar mode binds only to localhost, the listen: %s is not a loopback interface", r.Listen)
+		}
+		if r.EnableAcme {
+			return fmt.Errorf("the sidecar mode is not reachable externally, it cannot obtain acme certificates")
+		}
+		if r.EnableRefreshTokens || r.EnableSilentAuthentication || r.EnableDeviceFlow || len(r.SSODomains) > 0 || r.SSOBrokerURL != "" {
+			return fmt.Errorf("the sidecar mode has no login flow, the refresh tokens, silent authentication, device flow and sso cannot be enabled")
+		}
+		// step: the peers in the pod present bearer tokens and reach us on any host
+		if !r.NoRedirects {
+			return fmt.Errorf("the sidecar mode hands back a 401 in place of a redirect, no-redirects must be enabled")
+		}
+		if len(r.Hostnames) > 0 || r.CanonicalHostname != "" {
+			return fmt.Errorf("the sidecar mode accepts any host, the hostnames and canonical hostname cannot be set")
+		}
+	}
 
 	if r.EnableForwarding {
 		if r.ClientID == "" {
 			return fmt.Errorf("you have not specified the client id")
 		}
-		if r.DiscoveryURL == "" {
+		if r.DiscoveryURL == "" && !r.DevMode {
 			return fmt.Errorf("you have not specified the discovery url")
 		}
 		if r.ForwardingUsername == "" {
@@ -84,15 +348,136 @@ func (r *Config) isValid() error {
 		if r.Upstream == "" {
 			return fmt.Errorf("you have not specified an upstream endpoint to proxy to")
 		}
-		if _, err := url.Parse(r.Upstream); err != nil {
+		upstream, err := url.Parse(r.Upstream)
+		if err != nil {
 			return fmt.Errorf("the upstream endpoint is invalid, %s", err)
 		}
+		if upstream.Scheme == "unix" && upstream.Host+upstream.Path == "" {
+			return fmt.Errorf("the upstream unix socket does not have a path, should be unix:///path/to/socket")
+		}
+		if r.UpstreamTimeout < 0 || r.UpstreamResponseHeaderTimeout < 0 || r.UpstreamTLSHandshakeTimeout < 0 {
+			return fmt.Errorf("the upstream timeouts must be positive")
+		}
+		if r.UpstreamMaxIdleConnections < 0 {
+			return fmt.Errorf("the upstream max idle connections must be positive")
+		}
+		if r.UpstreamRetries < 0 || r.UpstreamCircuitThreshold < 0 {
+			return fmt.Errorf("the upstream retries and circuit threshold must be positive")
+		}
+		if r.UpstreamCircuitThreshold > 0 && r.UpstreamCircuitTimeout <= 0 {
+			return fmt.Errorf("the upstream circuit timeout must be positive")
+		}
+		for _, x := range r.UpstreamEndpoints {
+			endpoint, err := url.Parse(x)
+			if err != nil {
+				return fmt.Errorf("the upstream endpoint %s is invalid, %s", x, err)
+			}
+			if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || upstream.Scheme == "unix" {
+				return fmt.Errorf("the upstream endpoints must be http or https, unix sockets are not supported")
+			}
+		}
+		if _, err := newCanaryRoutes(r); err != nil {
+			return err
+		}
+		if len(r.UpstreamEndpoints) > 0 {
+			if r.UpstreamHealthCheck != "tcp" && !strings.HasPrefix(r.UpstreamHealthCheck, "/") {
+				return fmt.Errorf("the upstream health check must be tcp or a http path i.e. /health")
+			}
+			if r.UpstreamHealthInterval <= 0 {
+				return fmt.Errorf("the upstream health interval must be positive")
+			}
+		}
+		if _, err := newRoleRewriter(r); err != nil {
+			return err
+		}
+		if r.OpenPolicyAgentURL != "" {
+			if u, err := url.Parse(r.OpenPolicyAgentURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("the open policy agent url must be a http or https url")
+			}
+			if r.OpenPolicyAgentTimeout <= 0 {
+				return fmt.Errorf("the open policy agent timeout must be positive")
+			}
+		}
+		for _, x := range r.Resources {
+			if x.Authorizer != "" && r.AuthorizerTimeout <= 0 {
+				return fmt.Errorf("the authorizer timeout must be positive")
+			}
+			if x.MinimumACR != "" && len(r.ACRLevels) > 0 && !containedIn(x.MinimumACR, r.ACRLevels) {
+				return fmt.Errorf("the minimum acr of the resource: %s is not one of the acr levels", x.URL)
+			}
+			if x.EnableBasicAuth && r.ClientSecret == "" {
+				return fmt.Errorf("the basic credentials of the resource: %s require the client secret", x.URL)
+			}
+			if x.BreakGlass && r.LDAPURL == "" {
+				return fmt.Errorf("the break glass resource: %s requires the ldap url", x.URL)
+			}
+			if len(x.UMAPermissions) > 0 && !r.isFeatureEnabled(featureUMA) {
+				return fmt.Errorf("the uma permissions of the resource: %s require the %s feature", x.URL, featureUMA)
+			}
+		}
+		if r.UMACacheTTL < 0 {
+			return fmt.Errorf("the uma cache ttl must be positive")
+		}
+		if r.EnableResourceSync {
+			if !r.isFeatureEnabled(featureUMA) {
+				return fmt.Errorf("the resource sync requires the %s feature", featureUMA)
+			}
+			if r.SkipTokenVerification {
+				return fmt.Errorf("the resource sync requires the token verification")
+			}
+			if r.ResourceSyncInterval <= 0 {
+				return fmt.Errorf("the resource sync interval must be positive")
+			}
+		}
+		if r.ClaimsHeader != "" && r.ClaimsHeader != "json" && r.ClaimsHeader != "base64" {
+			return fmt.Errorf("the claims header must be json or base64")
+		}
+		for _, x := range r.AddClaims {
+			if _, err := parseClaimPath(x); err != nil {
+				return err
+			}
+		}
+		for k, v := range r.IdentityHeaders {
+			if k == "" || v == "" {
+				return fmt.Errorf("the identity header renames must have a header and name")
+			}
+		}
+		for _, x := range r.OmitIdentityHeaders {
+			if !r.isIdentityHeader(x) {
+				return fmt.Errorf("the omitted header: %s is not an identity header", x)
+			}
+		}
+		if r.EnableServiceToken {
+			if r.SkipTokenVerification || r.ClientSecret == "" {
+				return fmt.Errorf("the service account token requires the client secret and token verification")
+			}
+			if r.ServiceTokenHeader == "" {
+				return fmt.Errorf("you have not specified the header of the service account token")
+			}
+			if r.OmitAuthorizationHeader && http.CanonicalHeaderKey(r.ServiceTokenHeader) == authorizationHeader {
+				return fmt.Errorf("the service account token is placed in the authorization header which is omitted")
+			}
+		}
+		if r.TokenExchangeAudience != "" {
+			if r.SkipTokenVerification || r.ClientSecret == "" {
+				return fmt.Errorf("the token exchange requires the client secret and token verification")
+			}
+			if r.EnableReferenceTokens {
+				return fmt.Errorf("the token exchange has no effect with reference tokens, the token is not forwarded")
+			}
+		}
+		if r.EnableCSRF && (r.CSRFCookieName == "" || r.CSRFHeader == "") {
+			return fmt.Errorf("the csrf protection requires a cookie name and header")
+		}
+		if r.EnableTemplateReload && r.TemplateReloadInterval <= 0 {
+			return fmt.Errorf("the template reload interval must be positive")
+		}
 		// step: if the skip verification is off, we need the below
 		if !r.SkipTokenVerification {
 			if r.ClientID == "" {
 				return fmt.Errorf("you have not specified the client id")
 			}
-			if r.DiscoveryURL == "" {
+			if r.DiscoveryURL == "" && !r.DevMode {
 				return fmt.Errorf("you have not specified the discovery url")
 			}
 			if strings.HasSuffix(r.RedirectionURL, "/") {
@@ -104,6 +489,24 @@ func (r *Config) isValid() error {
 			if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32) {
 				return fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(r.EncryptionKey))
 			}
+			if r.EnableOfflineTokens && !r.EnableRefreshTokens {
+				return fmt.Errorf("offline tokens require the refresh tokens to be enabled")
+			}
+			if r.EnableOfflineTokens && r.OfflineSessionDuration <= 0 {
+				return fmt.Errorf("the offline session duration must be positive")
+			}
+			if r.EnableOfflineTokens && r.EnableRememberMe {
+				return fmt.Errorf("offline tokens are requested for all the sessions, remember me should not be enabled")
+			}
+			if r.EnableRememberMe && !r.EnableRefreshTokens {
+				return fmt.Errorf("remember me requires the refresh tokens to be enabled")
+			}
+			if r.EnableRememberMe && r.RememberMeDuration <= 0 {
+				return fmt.Errorf("the remember me duration must be positive")
+			}
+			if r.EnableRememberMe && containedIn(offlineAccessScope, r.Scopes) {
+				return fmt.Errorf("remember me requests the %s scope on demand, it should not be in the scopes", offlineAccessScope)
+			}
 			if !r.NoRedirects && r.SecureCookie && !strings.HasPrefix(r.RedirectionURL, "https") {
 				return fmt.Errorf("the cookie is set to secure but your redirection url is non-tls")
 			}
@@ -119,6 +522,164 @@ func (r *Config) isValid() error {
 				return err
 			}
 		}
+		if r.RateLimit.Rate < 0 || r.RateLimit.Burst < 0 {
+			return fmt.Errorf("the rate limit and burst must be positive")
+		}
+		for name, tier := range r.RateLimitTiers {
+			if tier.Rate < 0 || tier.Burst < 0 {
+				return fmt.Errorf("the rate limit and burst for tier: %s must be positive", name)
+			}
+		}
+		if len(r.RateLimitTiers) > 0 && r.RateLimitClaim == "" {
+			return fmt.Errorf("you have specified rate limit tiers but no rate limit claim")
+		}
+		if r.SecurityHeaders.HSTSMaxAge < 0 {
+			return fmt.Errorf("the hsts max age cannot be negative")
+		}
+		if r.SecurityHeaders.FrameOptions != "" && !isValidFrameOptions(r.SecurityHeaders.FrameOptions) {
+			return fmt.Errorf("the frame options must be DENY, SAMEORIGIN or ALLOW-FROM uri")
+		}
+		for _, resource := range r.Resources {
+			if resource.FrameOptions != "" && !isValidFrameOptions(resource.FrameOptions) {
+				return fmt.Errorf("the frame options of the resource: %s must be DENY, SAMEORIGIN or ALLOW-FROM uri", resource.URL)
+			}
+		}
+		if r.BruteForce.Threshold < 0 {
+			return fmt.Errorf("the brute force threshold must be positive")
+		}
+		if r.BruteForce.isEnabled() && (r.BruteForce.Window <= 0 || r.BruteForce.Backoff <= 0 || r.BruteForce.MaxBlock < r.BruteForce.Backoff) {
+			return fmt.Errorf("the brute force window and backoff must be positive, and the max block no less than the backoff")
+		}
+		if r.Quota.Daily < 0 || r.Quota.Monthly < 0 {
+			return fmt.Errorf("the daily and monthly quotas must be positive")
+		}
+		if r.Quota.isEnabled() && r.StoreURL == "" {
+			return fmt.Errorf("the quotas are held in the store, you must specify a store url")
+		}
+		if r.EnableReferenceTokens && r.StoreURL == "" {
+			return fmt.Errorf("the claims of the reference tokens are held in the store, you must specify a store url")
+		}
+		if r.SingleSession && r.StoreURL == "" {
+			return fmt.Errorf("the sessions of a single session are held in the store, you must specify a store url")
+		}
+		if r.RefreshAhead < 0 {
+			return fmt.Errorf("the refresh ahead must be positive")
+		}
+		if r.RefreshAhead > 0 && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+			return fmt.Errorf("refreshing ahead requires the refresh tokens to be enabled and held in the store")
+		}
+		if r.EnableNegotiate && r.RedirectionURL == "" {
+			return fmt.Errorf("the negotiate login requires the redirection url, to recognise the callback of the provider")
+		}
+		if r.EnableDeviceFlow && r.ClientSecret == "" {
+			return fmt.Errorf("the device flow requires the client secret of a confidential client")
+		}
+		if r.EnableDeviceFlow && r.EncryptionKey == "" {
+			return fmt.Errorf("the device authorization of a browser is held in an encrypted cookie, you must specify an encryption key")
+		}
+		if r.DeviceAuthorizationURL != "" {
+			if _, err := url.Parse(r.DeviceAuthorizationURL); err != nil {
+				return fmt.Errorf("the device authorization url is invalid, error: %s", err)
+			}
+		}
+		for k := range r.AuthorizationParameters {
+			if containedIn(k, reservedAuthorizationParameters) {
+				return fmt.Errorf("the authorization parameter: %s is set by the proxy", k)
+			}
+		}
+		for _, x := range r.AllowedAuthorizationParameters {
+			if containedIn(x, reservedAuthorizationParameters) {
+				return fmt.Errorf("the authorization parameter: %s is set by the proxy and cannot be allowed", x)
+			}
+		}
+		if r.AudienceValidation != "" && !containedIn(r.AudienceValidation, []string{audienceValidationAud, audienceValidationAzp, audienceValidationBoth}) {
+			return fmt.Errorf("the audience validation must be %s, %s or %s", audienceValidationAud, audienceValidationAzp, audienceValidationBoth)
+		}
+		if r.LDAPURL != "" {
+			location, err := url.Parse(r.LDAPURL)
+			if err != nil {
+				return fmt.Errorf("the ldap url is invalid, error: %s", err)
+			}
+			if location.Scheme != "ldap" && location.Scheme != "ldaps" {
+				return fmt.Errorf("the ldap url must be ldap:// or ldaps://")
+			}
+			if strings.Count(r.LDAPBindDN, "%s") != 1 {
+				return fmt.Errorf("the ldap bind dn must hold a single %%s, replaced by the username")
+			}
+			if r.LDAPFilter == "" {
+				return fmt.Errorf("the ldap filter must be set, the roles are only granted to the users matching it")
+			}
+			if _, err := ldap.CompileFilter(r.LDAPFilter); err != nil {
+				return fmt.Errorf("the ldap filter is invalid, error: %s", err)
+			}
+			if r.LDAPTimeout <= 0 {
+				return fmt.Errorf("the ldap timeout must be positive")
+			}
+		}
+		if r.EnablePreserveRequests && r.StoreURL == "" {
+			return fmt.Errorf("the preserved requests are held in the store, you must specify a store url")
+		}
+		if r.EnablePreserveRequests && r.PreserveRequestLimit <= 0 {
+			return fmt.Errorf("the preserve request limit must be positive")
+		}
+		if r.EnableReferenceTokens && r.EncryptionKey == "" {
+			return fmt.Errorf("the reference tokens are signed with the encryption key, you must specify one")
+		}
+		if r.EnableSignedState {
+			if r.EncryptionKey == "" {
+				return fmt.Errorf("the state parameter is signed with the encryption key, you must specify one")
+			}
+			if r.StateDuration <= 0 {
+				return fmt.Errorf("the state duration must be positive")
+			}
+		}
+		if r.EnableSignedURLs {
+			if r.EncryptionKey == "" {
+				return fmt.Errorf("the signed urls are signed with the encryption key, you must specify one")
+			}
+			if r.SignedURLDuration <= 0 {
+				return fmt.Errorf("the signed url duration must be positive")
+			}
+		}
+		if r.EnableEncryptedState {
+			if !r.EnableSignedState {
+				return fmt.Errorf("the encrypted state requires the signed state to be enabled")
+			}
+			if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+				return fmt.Errorf("the encrypted state requires an encryption key of 16 or 32 characters")
+			}
+		}
+		if len(r.SSODomains) > 0 || r.SSOBrokerURL != "" {
+			if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+				return fmt.Errorf("the sso transfer tokens require a shared encryption key of 16 or 32 characters")
+			}
+		}
+		if r.UpstreamPreset != "" {
+			if _, found := upstreamPresets[r.UpstreamPreset]; !found {
+				return fmt.Errorf("unknown upstream preset: %s", r.UpstreamPreset)
+			}
+		}
+		for _, x := range r.UpstreamRoleMappings {
+			if x.Role == "" || x.Value == "" {
+				return fmt.Errorf("the upstream role mappings must have a role and value")
+			}
+		}
+		if r.CrawlerCacheDuration < 0 {
+			return fmt.Errorf("the crawler cache duration must be positive")
+		}
+		if r.SSOBrokerURL != "" {
+			if u, err := url.Parse(r.SSOBrokerURL); err != nil || u.Host == "" {
+				return fmt.Errorf("the sso broker url: %s is invalid", r.SSOBrokerURL)
+			}
+			if r.RedirectionURL == "" {
+				return fmt.Errorf("the sso broker requires a redirection url to return the session to")
+			}
+		}
+		for _, x := range r.AllowedRedirects {
+			if err := decodeAllowedRedirect(x); err != nil {
+				return err
+			}
+		}
 		// step: validate the claims are validate regex's
 		for k, claim := range r.MatchClaims {
 			// step: validate the regex
@@ -131,6 +692,48 @@ func (r *Config) isValid() error {
 	return nil
 }
 
+// identityHeader returns the name of the identity header, the prefixed name unless renamed via the key, either
+// explicitly or by the upstream preset
+func (r *Config) identityHeader(key, name string) string {
+	if header, found := r.IdentityHeaders[key]; found {
+		return header
+	}
+	if preset, found := upstreamPresets[r.UpstreamPreset]; found {
+		if header, found := preset.headers[key]; found {
+			return header
+		}
+	}
+
+	return r.IdentityHeaderPrefix + name
+}
+
+// isIdentityHeader checks if the header is prefixed or renamed as an identity header
+func (r *Config) isIdentityHeader(header string) bool {
+	if strings.HasPrefix(strings.ToLower(header), strings.ToLower(r.IdentityHeaderPrefix)) {
+		return true
+	}
+	for _, x := range r.IdentityHeaders {
+		if strings.EqualFold(x, header) {
+			return true
+		}
+	}
+	if preset, found := upstreamPresets[r.UpstreamPreset]; found {
+		for _, x := range preset.headers {
+			if strings.EqualFold(x, header) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isValidFrameOptions checks the value of the x-frame-options header is DENY, SAMEORIGIN or ALLOW-FROM uri
+func isValidFrameOptions(value string) bool {
+	return strings.EqualFold(value, "DENY") || strings.EqualFold(value, "SAMEORIGIN") ||
+		strings.HasPrefix(strings.ToUpper(value), "ALLOW-FROM ")
+}
+
 // hasCustomSignInPage checks if there is a custom sign in  page
 func (r *Config) hasCustomSignInPage() bool {
 	if r.SignInPage != "" {
@@ -157,21 +760,72 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("listen") {
 		config.Listen = cx.String("listen")
 	}
+	if cx.IsSet("canonical-hostname") {
+		config.CanonicalHostname = cx.String("canonical-hostname")
+	}
+	if cx.IsSet("listener") {
+		for _, x := range cx.StringSlice("listener") {
+			listener, err := decodeListener(x)
+			if err != nil {
+				return err
+			}
+			config.Listeners = append(config.Listeners, listener)
+		}
+	}
 	if cx.IsSet("client-secret") {
 		config.ClientSecret = cx.String("client-secret")
 	}
+	if cx.IsSet("client-secret-file") {
+		config.ClientSecretFile = cx.String("client-secret-file")
+	}
 	if cx.IsSet("client-id") {
 		config.ClientID = cx.String("client-id")
 	}
+	if cx.IsSet("audience") {
+		config.Audiences = append(config.Audiences, cx.StringSlice("audience")...)
+	}
+	if cx.IsSet("audience-validation") {
+		config.AudienceValidation = cx.String("audience-validation")
+	}
 	if cx.IsSet("discovery-url") {
 		config.DiscoveryURL = cx.String("discovery-url")
 	}
+	if cx.IsSet("openid-provider-pin") {
+		config.OpenIDProviderPins = cx.StringSlice("openid-provider-pin")
+	}
 	if cx.IsSet("upstream-url") {
 		config.Upstream = cx.String("upstream-url")
 	}
 	if cx.IsSet("revocation-url") {
 		config.RevocationEndpoint = cx.String("revocation-url")
 	}
+	if cx.IsSet("enable-negotiate") {
+		config.EnableNegotiate = cx.Bool("enable-negotiate")
+	}
+	if cx.IsSet("enable-silent-authentication") {
+		config.EnableSilentAuthentication = cx.Bool("enable-silent-authentication")
+	}
+	if cx.IsSet("enable-device-flow") {
+		config.EnableDeviceFlow = cx.Bool("enable-device-flow")
+	}
+	if cx.IsSet("device-authorization-url") {
+		config.DeviceAuthorizationURL = cx.String("device-authorization-url")
+	}
+	if cx.IsSet("ldap-url") {
+		config.LDAPURL = cx.String("ldap-url")
+	}
+	if cx.IsSet("ldap-bind-dn") {
+		config.LDAPBindDN = cx.String("ldap-bind-dn")
+	}
+	if cx.IsSet("ldap-filter") {
+		config.LDAPFilter = cx.String("ldap-filter")
+	}
+	if cx.IsSet("ldap-roles") {
+		config.LDAPRoles = append(config.LDAPRoles, cx.StringSlice("ldap-roles")...)
+	}
+	if cx.IsSet("ldap-timeout") {
+		config.LDAPTimeout = cx.Duration("ldap-timeout")
+	}
 	if cx.IsSet("upstream-keepalives") {
 		config.UpstreamKeepalives = cx.Bool("upstream-keepalives")
 	}
@@ -181,21 +835,78 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("upstream-keepalive-timeout") {
 		config.UpstreamKeepaliveTimeout = cx.Duration("upstream-keepalive-timeout")
 	}
+	if cx.IsSet("upstream-response-header-timeout") {
+		config.UpstreamResponseHeaderTimeout = cx.Duration("upstream-response-header-timeout")
+	}
+	if cx.IsSet("upstream-tls-handshake-timeout") {
+		config.UpstreamTLSHandshakeTimeout = cx.Duration("upstream-tls-handshake-timeout")
+	}
+	if cx.IsSet("upstream-max-idle-connections") {
+		config.UpstreamMaxIdleConnections = cx.Int("upstream-max-idle-connections")
+	}
+	if cx.IsSet("upstream-flush-interval") {
+		config.UpstreamFlushInterval = cx.Duration("upstream-flush-interval")
+	}
 	if cx.IsSet("idle-duration") {
 		config.IdleDuration = cx.Duration("idle-duration")
 	}
+	if cx.IsSet("refresh-ahead") {
+		config.RefreshAhead = cx.Duration("refresh-ahead")
+	}
+	if cx.IsSet("enable-offline-tokens") {
+		config.EnableOfflineTokens = true
+	}
+	if cx.IsSet("offline-session-duration") {
+		config.OfflineSessionDuration = cx.Duration("offline-session-duration")
+	}
+	if cx.IsSet("enable-remember-me") {
+		config.EnableRememberMe = true
+	}
+	if cx.IsSet("remember-me-duration") {
+		config.RememberMeDuration = cx.Duration("remember-me-duration")
+	}
 	if cx.IsSet("skip-token-verification") {
 		config.SkipTokenVerification = cx.Bool("skip-token-verification")
 	}
 	if cx.IsSet("skip-upstream-tls-verify") {
 		config.SkipUpstreamTLSVerify = cx.Bool("skip-upstream-tls-verify")
 	}
+	if cx.IsSet("upstream-retries") {
+		config.UpstreamRetries = cx.Int("upstream-retries")
+	}
+	if cx.IsSet("upstream-circuit-threshold") {
+		config.UpstreamCircuitThreshold = cx.Int("upstream-circuit-threshold")
+	}
+	if cx.IsSet("upstream-circuit-timeout") {
+		config.UpstreamCircuitTimeout = cx.Duration("upstream-circuit-timeout")
+	}
+	if cx.IsSet("upstream-endpoint") {
+		config.UpstreamEndpoints = append(config.UpstreamEndpoints, cx.StringSlice("upstream-endpoint")...)
+	}
+	if cx.IsSet("upstream-health-check") {
+		config.UpstreamHealthCheck = cx.String("upstream-health-check")
+	}
+	if cx.IsSet("upstream-health-interval") {
+		config.UpstreamHealthInterval = cx.Duration("upstream-health-interval")
+	}
+	if cx.IsSet("upstream-ca") {
+		config.UpstreamCA = cx.String("upstream-ca")
+	}
+	if cx.IsSet("upstream-client-cert") {
+		config.UpstreamClientCertificate = cx.String("upstream-client-cert")
+	}
+	if cx.IsSet("upstream-client-private-key") {
+		config.UpstreamClientPrivateKey = cx.String("upstream-client-private-key")
+	}
 	if cx.IsSet("enable-refresh-tokens") {
 		config.EnableRefreshTokens = cx.Bool("enable-refresh-tokens")
 	}
 	if cx.IsSet("encryption-key") {
 		config.EncryptionKey = cx.String("encryption-key")
 	}
+	if cx.IsSet("encryption-key-file") {
+		config.EncryptionKeyFile = cx.String("encryption-key-file")
+	}
 	if cx.IsSet("secure-cookie") {
 		config.SecureCookie = cx.Bool("secure-cookie")
 	}
@@ -205,18 +916,214 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("cookie-refresh-name") {
 		config.CookieRefreshName = cx.String("cookie-refresh-name")
 	}
+	if cx.IsSet("enable-csrf") {
+		config.EnableCSRF = true
+	}
+	if cx.IsSet("csrf-cookie-name") {
+		config.CSRFCookieName = cx.String("csrf-cookie-name")
+	}
+	if cx.IsSet("csrf-header") {
+		config.CSRFHeader = cx.String("csrf-header")
+	}
+	if cx.IsSet("legacy-cookie-names") {
+		for _, x := range cx.StringSlice("legacy-cookie-names") {
+			names, err := decodeCookieNames(x)
+			if err != nil {
+				return err
+			}
+			config.LegacyCookieNames = append(config.LegacyCookieNames, names)
+		}
+	}
+	if cx.IsSet("legacy-cookie-grace-period") {
+		config.LegacyCookieGracePeriod = cx.Duration("legacy-cookie-grace-period")
+	}
 	if cx.IsSet("add-claims") {
 		config.AddClaims = append(config.AddClaims, cx.StringSlice("add-claims")...)
 	}
+	if cx.IsSet("role-rewrite") {
+		for _, x := range cx.StringSlice("role-rewrite") {
+			rule, err := decodeRoleRewrite(x)
+			if err != nil {
+				return err
+			}
+			config.RoleRewrites = append(config.RoleRewrites, rule)
+		}
+	}
+	if cx.IsSet("lowercase-roles") {
+		config.LowercaseRoles = cx.Bool("lowercase-roles")
+	}
+	if cx.IsSet("opa-url") {
+		config.OpenPolicyAgentURL = cx.String("opa-url")
+	}
+	if cx.IsSet("opa-timeout") {
+		config.OpenPolicyAgentTimeout = cx.Duration("opa-timeout")
+	}
+	if cx.IsSet("authorizer-timeout") {
+		config.AuthorizerTimeout = cx.Duration("authorizer-timeout")
+	}
+	if cx.IsSet("uma-cache-ttl") {
+		config.UMACacheTTL = cx.Duration("uma-cache-ttl")
+	}
+	if cx.IsSet("enable-resource-sync") {
+		config.EnableResourceSync = cx.Bool("enable-resource-sync")
+	}
+	if cx.IsSet("resource-sync-interval") {
+		config.ResourceSyncInterval = cx.Duration("resource-sync-interval")
+	}
+	if cx.IsSet("acr-levels") {
+		config.ACRLevels = cx.StringSlice("acr-levels")
+	}
+	if cx.IsSet("claims-header") {
+		config.ClaimsHeader = cx.String("claims-header")
+	}
+	if cx.IsSet("identity-header-prefix") {
+		config.IdentityHeaderPrefix = cx.String("identity-header-prefix")
+	}
+	if cx.IsSet("identity-header") {
+		headers, err := decodeKeyPairs(cx.StringSlice("identity-header"))
+		if err != nil {
+			return err
+		}
+		mergeMaps(headers, config.IdentityHeaders)
+	}
+	if cx.IsSet("feature") {
+		for _, x := range cx.StringSlice("feature") {
+			name, enabled, err := decodeFeature(x)
+			if err != nil {
+				return err
+			}
+			config.Features[name] = enabled
+		}
+	}
+	if cx.IsSet("omit-authorization-header") {
+		config.OmitAuthorizationHeader = true
+	}
+	if cx.IsSet("enable-service-token") {
+		config.EnableServiceToken = true
+	}
+	if cx.IsSet("service-token-header") {
+		config.ServiceTokenHeader = cx.String("service-token-header")
+	}
+	if cx.IsSet("token-exchange-audience") {
+		config.TokenExchangeAudience = cx.String("token-exchange-audience")
+	}
+	if cx.IsSet("omit-identity-header") {
+		config.OmitIdentityHeaders = append(config.OmitIdentityHeaders, cx.StringSlice("omit-identity-header")...)
+	}
+	if cx.IsSet("upstream-preset") {
+		config.UpstreamPreset = cx.String("upstream-preset")
+	}
+	if cx.IsSet("upstream-role-mapping") {
+		for _, x := range cx.StringSlice("upstream-role-mapping") {
+			mapping, err := decodeRoleMapping(x)
+			if err != nil {
+				return err
+			}
+			config.UpstreamRoleMappings = append(config.UpstreamRoleMappings, mapping)
+		}
+	}
 	if cx.IsSet("store-url") {
 		config.StoreURL = cx.String("store-url")
 	}
+	if cx.IsSet("enable-reference-tokens") {
+		config.EnableReferenceTokens = cx.Bool("enable-reference-tokens")
+	}
+	if cx.IsSet("enable-signed-state") {
+		config.EnableSignedState = cx.Bool("enable-signed-state")
+	}
+	if cx.IsSet("enable-encrypted-state") {
+		config.EnableEncryptedState = cx.Bool("enable-encrypted-state")
+	}
+	if cx.IsSet("state-duration") {
+		config.StateDuration = cx.Duration("state-duration")
+	}
+	if cx.IsSet("single-session") {
+		config.SingleSession = cx.Bool("single-session")
+	}
+	if cx.IsSet("enable-preserve-requests") {
+		config.EnablePreserveRequests = true
+	}
+	if cx.IsSet("preserve-request-limit") {
+		config.PreserveRequestLimit = int64(cx.Int("preserve-request-limit"))
+	}
 	if cx.IsSet("no-redirects") {
 		config.NoRedirects = cx.Bool("no-redirects")
 	}
+	if cx.IsSet("enable-api-mode") {
+		config.EnableAPIMode = cx.Bool("enable-api-mode")
+	}
+	if cx.IsSet("enable-error-negotiation") {
+		config.EnableErrorNegotiation = cx.Bool("enable-error-negotiation")
+	}
+	if cx.IsSet("enable-signed-urls") {
+		config.EnableSignedURLs = cx.Bool("enable-signed-urls")
+	}
+	if cx.IsSet("signed-url-duration") {
+		config.SignedURLDuration = cx.Duration("signed-url-duration")
+	}
+	if cx.IsSet("maintenance-mode") {
+		config.MaintenanceMode = cx.Bool("maintenance-mode")
+	}
+	if cx.IsSet("maintenance-role") {
+		config.MaintenanceRoles = append(config.MaintenanceRoles, cx.StringSlice("maintenance-role")...)
+	}
+	if cx.IsSet("admin-role") {
+		config.AdminRoles = append(config.AdminRoles, cx.StringSlice("admin-role")...)
+	}
+	if cx.IsSet("audit-only") {
+		config.AuditOnly = cx.Bool("audit-only")
+	}
+	if cx.IsSet("canary-route") {
+		for _, x := range cx.StringSlice("canary-route") {
+			route, err := decodeCanaryRoute(x)
+			if err != nil {
+				return err
+			}
+			config.CanaryRoutes = append(config.CanaryRoutes, route)
+		}
+	}
+	if cx.IsSet("dev-mode") {
+		config.DevMode = cx.Bool("dev-mode")
+	}
+	if cx.IsSet("dev-listen") {
+		config.DevListen = cx.String("dev-listen")
+	}
+	if cx.IsSet("ext-authz-listen") {
+		config.ExtAuthzListen = cx.String("ext-authz-listen")
+	}
+	if cx.IsSet("ext-authz-http-listen") {
+		config.ExtAuthzHTTPListen = cx.String("ext-authz-http-listen")
+	}
+	if cx.IsSet("sidecar") {
+		config.Sidecar = cx.Bool("sidecar")
+	}
+	if cx.IsSet("dev-user") {
+		for _, x := range cx.StringSlice("dev-user") {
+			user, err := decodeDevUser(x)
+			if err != nil {
+				return err
+			}
+			config.DevUsers = append(config.DevUsers, user)
+		}
+	}
+	if cx.IsSet("crawler-user-agent") {
+		config.CrawlerUserAgents = append(config.CrawlerUserAgents, cx.StringSlice("crawler-user-agent")...)
+	}
+	if cx.IsSet("crawler-cache-duration") {
+		config.CrawlerCacheDuration = cx.Duration("crawler-cache-duration")
+	}
 	if cx.IsSet("redirection-url") {
 		config.RedirectionURL = cx.String("redirection-url")
 	}
+	if cx.IsSet("sso-domain") {
+		config.SSODomains = append(config.SSODomains, cx.StringSlice("sso-domain")...)
+	}
+	if cx.IsSet("allowed-redirect") {
+		config.AllowedRedirects = append(config.AllowedRedirects, cx.StringSlice("allowed-redirect")...)
+	}
+	if cx.IsSet("sso-broker-url") {
+		config.SSOBrokerURL = cx.String("sso-broker-url")
+	}
 	if cx.IsSet("tls-cert") {
 		config.TLSCertificate = cx.String("tls-cert")
 	}
@@ -226,9 +1133,93 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("tls-ca-certificate") {
 		config.TLSCaCertificate = cx.String("tls-ca-certificate")
 	}
+	if cx.IsSet("tls-certificate-pair") {
+		for _, x := range cx.StringSlice("tls-certificate-pair") {
+			pair, err := decodeCertificatePair(x)
+			if err != nil {
+				return err
+			}
+			config.TLSCertificates = append(config.TLSCertificates, pair)
+		}
+	}
+	if cx.IsSet("enable-acme") {
+		config.EnableAcme = cx.Bool("enable-acme")
+	}
+	if cx.IsSet("acme-cache-dir") {
+		config.AcmeCacheDir = cx.String("acme-cache-dir")
+	}
+	if cx.IsSet("acme-email") {
+		config.AcmeEmail = cx.String("acme-email")
+	}
+	if cx.IsSet("tls-min-version") {
+		config.TLSMinVersion = cx.String("tls-min-version")
+	}
+	if cx.IsSet("tls-cipher-suites") {
+		config.TLSCipherSuites = append(config.TLSCipherSuites, cx.StringSlice("tls-cipher-suites")...)
+	}
+	if cx.IsSet("tls-curve-preferences") {
+		config.TLSCurvePreferences = append(config.TLSCurvePreferences, cx.StringSlice("tls-curve-preferences")...)
+	}
+	if cx.IsSet("tls-client-auth") {
+		config.TLSClientAuth = cx.String("tls-client-auth")
+	}
+	if cx.IsSet("enable-client-cert-auth") {
+		config.EnableClientCertAuth = cx.Bool("enable-client-cert-auth")
+	}
+	if cx.IsSet("enable-certificate-bound-tokens") {
+		config.EnableCertificateBoundTokens = cx.Bool("enable-certificate-bound-tokens")
+	}
+	if cx.IsSet("api-key") {
+		for _, x := range cx.StringSlice("api-key") {
+			apiKey, err := decodeAPIKey(x)
+			if err != nil {
+				return err
+			}
+			config.APIKeys = append(config.APIKeys, apiKey)
+		}
+	}
+	if cx.IsSet("api-key-header") {
+		config.APIKeyHeader = cx.String("api-key-header")
+	}
+	if cx.IsSet("api-key-query") {
+		config.APIKeyQuery = cx.String("api-key-query")
+	}
+	if cx.IsSet("assertion-header") {
+		config.AssertionHeader = cx.String("assertion-header")
+	}
+	if cx.IsSet("assertion-issuer") {
+		for _, x := range cx.StringSlice("assertion-issuer") {
+			issuer, err := decodeAssertionIssuer(x)
+			if err != nil {
+				return err
+			}
+			config.AssertionIssuers = append(config.AssertionIssuers, issuer)
+		}
+	}
 	if cx.IsSet("enable-proxy-protocol") {
 		config.EnableProxyProtocol = cx.Bool("enable-proxy-protocol")
 	}
+	if cx.IsSet("trusted-proxy") {
+		config.TrustedProxies = cx.StringSlice("trusted-proxy")
+	}
+	if cx.IsSet("enable-graceful-reload") {
+		config.EnableGracefulReload = cx.Bool("enable-graceful-reload")
+	}
+	if cx.IsSet("reload-drain-timeout") {
+		config.ReloadDrainTimeout = cx.Duration("reload-drain-timeout")
+	}
+	if cx.IsSet("enable-secret-reload") {
+		config.EnableSecretReload = cx.Bool("enable-secret-reload")
+	}
+	if cx.IsSet("secret-reload-interval") {
+		config.SecretReloadInterval = cx.Duration("secret-reload-interval")
+	}
+	if cx.IsSet("enable-config-reload") {
+		config.EnableConfigReload = cx.Bool("enable-config-reload")
+	}
+	if cx.IsSet("config-reload-interval") {
+		config.ConfigReloadInterval = cx.Duration("config-reload-interval")
+	}
 	if cx.IsSet("enable-forwarding") {
 		config.EnableForwarding = cx.Bool("enable-forwarding")
 	}
@@ -238,6 +1229,27 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("forwarding-password") {
 		config.ForwardingPassword = cx.String("forwarding-password")
 	}
+	if cx.IsSet("forwarding-password-file") {
+		config.ForwardingPasswordFile = cx.String("forwarding-password-file")
+	}
+	if cx.IsSet("vault-url") {
+		config.VaultURL = cx.String("vault-url")
+	}
+	if cx.IsSet("vault-token") {
+		config.VaultToken = cx.String("vault-token")
+	}
+	if cx.IsSet("vault-token-file") {
+		config.VaultTokenFile = cx.String("vault-token-file")
+	}
+	if cx.IsSet("vault-client-secret") {
+		config.VaultClientSecret = cx.String("vault-client-secret")
+	}
+	if cx.IsSet("vault-encryption-key") {
+		config.VaultEncryptionKey = cx.String("vault-encryption-key")
+	}
+	if cx.IsSet("vault-tls") {
+		config.VaultTLS = cx.String("vault-tls")
+	}
 	if cx.IsSet("forwarding-domains") {
 		config.ForwardingDomains = append(config.ForwardingDomains, cx.StringSlice("forwarding-domains")...)
 	}
@@ -247,12 +1259,66 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("forbidden-page") {
 		config.ForbiddenPage = cx.String("forbidden-page")
 	}
+	if cx.IsSet("unavailable-page") {
+		config.UnavailablePage = cx.String("unavailable-page")
+	}
+	if cx.IsSet("session-ended-page") {
+		config.SessionEndedPage = cx.String("session-ended-page")
+	}
+	if cx.IsSet("blocked-page") {
+		config.BlockedPage = cx.String("blocked-page")
+	}
+	if cx.IsSet("maintenance-page") {
+		config.MaintenancePage = cx.String("maintenance-page")
+	}
+	if cx.IsSet("enable-template-reload") {
+		config.EnableTemplateReload = true
+	}
+	if cx.IsSet("template-reload-interval") {
+		config.TemplateReloadInterval = cx.Duration("template-reload-interval")
+	}
 	if cx.IsSet("enable-security-filter") {
 		config.EnableSecurityFilter = true
 	}
+	if cx.IsSet("hsts-max-age") {
+		config.SecurityHeaders.HSTSMaxAge = cx.Duration("hsts-max-age")
+	}
+	if cx.IsSet("hsts-include-subdomains") {
+		config.SecurityHeaders.HSTSIncludeSubdomains = cx.Bool("hsts-include-subdomains")
+	}
+	if cx.IsSet("hsts-preload") {
+		config.SecurityHeaders.HSTSPreload = cx.Bool("hsts-preload")
+	}
+	if cx.IsSet("content-security-policy") {
+		config.SecurityHeaders.ContentSecurityPolicy = cx.String("content-security-policy")
+	}
+	if cx.IsSet("referrer-policy") {
+		config.SecurityHeaders.ReferrerPolicy = cx.String("referrer-policy")
+	}
+	if cx.IsSet("frame-options") {
+		config.SecurityHeaders.FrameOptions = cx.String("frame-options")
+	}
+	if cx.IsSet("disable-frame-options") {
+		config.SecurityHeaders.DisableFrameOptions = cx.Bool("disable-frame-options")
+	}
+	if cx.IsSet("disable-nosniff") {
+		config.SecurityHeaders.DisableNoSniff = cx.Bool("disable-nosniff")
+	}
+	if cx.IsSet("disable-xss-filter") {
+		config.SecurityHeaders.DisableXSSFilter = cx.Bool("disable-xss-filter")
+	}
+	if cx.IsSet("enable-http2") {
+		config.EnableHTTP2 = cx.Bool("enable-http2")
+	}
 	if cx.IsSet("json-logging") {
 		config.LogJSONFormat = cx.Bool("json-logging")
 	}
+	if cx.IsSet("log-output") {
+		config.LogOutput = cx.String("log-output")
+	}
+	if cx.IsSet("enable-metrics") {
+		config.EnableMetrics = cx.Bool("enable-metrics")
+	}
 	if cx.IsSet("log-requests") {
 		config.LogRequests = cx.Bool("log-requests")
 	}
@@ -262,6 +1328,16 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("scope") {
 		config.Scopes = cx.StringSlice("scope")
 	}
+	if cx.IsSet("auth-param") {
+		params, err := decodeKeyPairs(cx.StringSlice("auth-param"))
+		if err != nil {
+			return err
+		}
+		mergeMaps(params, config.AuthorizationParameters)
+	}
+	if cx.IsSet("allowed-auth-param") {
+		config.AllowedAuthorizationParameters = append(config.AllowedAuthorizationParameters, cx.StringSlice("allowed-auth-param")...)
+	}
 	if cx.IsSet("hostname") {
 		config.Hostnames = append(config.Hostnames, cx.StringSlice("hostname")...)
 	}
@@ -283,6 +1359,51 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 	if cx.IsSet("cors-credentials") {
 		config.CrossOrigin.Credentials = cx.BoolT("cors-credentials")
 	}
+	if cx.IsSet("cors-preflight") {
+		config.CrossOrigin.Preflight = cx.Bool("cors-preflight")
+	}
+	if cx.IsSet("rate-limit") {
+		config.RateLimit.Rate = cx.Float64("rate-limit")
+	}
+	if cx.IsSet("rate-limit-burst") {
+		config.RateLimit.Burst = cx.Int("rate-limit-burst")
+	}
+	if cx.IsSet("brute-force-threshold") {
+		config.BruteForce.Threshold = cx.Int("brute-force-threshold")
+	}
+	if cx.IsSet("brute-force-window") {
+		config.BruteForce.Window = cx.Duration("brute-force-window")
+	}
+	if cx.IsSet("brute-force-backoff") {
+		config.BruteForce.Backoff = cx.Duration("brute-force-backoff")
+	}
+	if cx.IsSet("brute-force-max-block") {
+		config.BruteForce.MaxBlock = cx.Duration("brute-force-max-block")
+	}
+	if cx.IsSet("quota-daily") {
+		config.Quota.Daily = int64(cx.Int("quota-daily"))
+	}
+	if cx.IsSet("quota-monthly") {
+		config.Quota.Monthly = int64(cx.Int("quota-monthly"))
+	}
+	if cx.IsSet("quota-claim") {
+		config.Quota.Claim = cx.String("quota-claim")
+	}
+	if cx.IsSet("rate-limit-claim") {
+		config.RateLimitClaim = cx.String("rate-limit-claim")
+	}
+	if cx.IsSet("rate-limit-tier") {
+		if config.RateLimitTiers == nil {
+			config.RateLimitTiers = make(map[string]RateLimit, 0)
+		}
+		for _, x := range cx.StringSlice("rate-limit-tier") {
+			name, limit, err := decodeRateLimitTier(x)
+			if err != nil {
+				return err
+			}
+			config.RateLimitTiers[name] = limit
+		}
+	}
 	if cx.IsSet("tag") {
 		tags, err := decodeKeyPairs(cx.StringSlice("tag"))
 		if err != nil {
@@ -304,6 +1425,23 @@ func readOptions(cx *cli.Context, config *Config) (err error) {
 		}
 		mergeMaps(config.MatchClaims, headers)
 	}
+	if cx.IsSet("response-header-add") {
+		headers, err := decodeKeyPairs(cx.StringSlice("response-header-add"))
+		if err != nil {
+			return err
+		}
+		config.ResponseHeaders.Add = headers
+	}
+	if cx.IsSet("response-header-set") {
+		headers, err := decodeKeyPairs(cx.StringSlice("response-header-set"))
+		if err != nil {
+			return err
+		}
+		config.ResponseHeaders.Set = headers
+	}
+	if cx.IsSet("response-header-remove") {
+		config.ResponseHeaders.Remove = cx.StringSlice("response-header-remove")
+	}
 	if cx.IsSet("resource") {
 		for _, x := range cx.StringSlice("resource") {
 			resource, err := newResource().Parse(x)
@@ -345,31 +1483,69 @@ func getOptions() []cli.Flag {
 			Usage:  "the path to the configuration file for the keycloak proxy",
 			EnvVar: "PROXY_CONFIG_FILE",
 		},
+		cli.BoolFlag{
+			Name:  "print-config",
+			Usage: "print the effective configuration, with the secrets redacted, and exit",
+		},
 		cli.StringFlag{
 			Name:   "listen",
 			Usage:  "the interface the service should be listening on",
 			Value:  defaults.Listen,
 			EnvVar: "PROXY_LISTEN",
 		},
+		cli.StringSliceFlag{
+			Name:  "listener",
+			Usage: "an additional interface to listen on, listen, listen=cert:key[:ca] for tls or listen=https redirecting to https",
+		},
+		cli.StringFlag{
+			Name:  "canonical-hostname",
+			Usage: "the hostname the requests for any other host are redirected (301) to, and of the https redirects",
+		},
 		cli.StringFlag{
 			Name:   "client-secret",
 			Usage:  "the client secret used to authenticate to the oauth server (access_type: confidential)",
 			EnvVar: "PROXY_CLIENT_SECRET",
 		},
+		cli.StringFlag{
+			Name:   "client-secret-file",
+			Usage:  "a file holding the client secret, i.e. a mounted secret, rather than a flag or variable visible in ps",
+			EnvVar: "PROXY_CLIENT_SECRET_FILE",
+		},
 		cli.StringFlag{
 			Name:   "client-id",
 			Usage:  "the client id used to authenticate to the oauth service",
 			EnvVar: "PROXY_CLIENT_ID",
 		},
+		cli.StringSliceFlag{
+			Name:  "audience",
+			Usage: "an accepted audience of the access tokens, any of which may match, defaults to the client id",
+		},
+		cli.StringFlag{
+			Name:  "audience-validation",
+			Usage: "the claims checked against the accepted audiences, aud, azp (the authorized party) or both",
+			Value: defaults.AudienceValidation,
+		},
 		cli.StringFlag{
 			Name:   "discovery-url",
 			Usage:  "the discovery url to retrieve the openid configuration",
 			EnvVar: "PROXY_DISCOVERY_URL",
 		},
+		cli.StringSliceFlag{
+			Name:  "openid-provider-pin",
+			Usage: "a pin on the certificate of the identity provider, sha256/<base64> of the public key or cert-sha256/<base64>",
+		},
 		cli.StringSliceFlag{
 			Name:  "scope",
 			Usage: "a variable list of scopes requested when authenticating the user",
 		},
+		cli.StringSliceFlag{
+			Name:  "auth-param",
+			Usage: "an additional query parameter of the authorization redirect, key=value, i.e. kc_idp_hint=google",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowed-auth-param",
+			Usage: "a query parameter of /oauth/authorize passed on to the provider, i.e. kc_idp_hint or ui_locales",
+		},
 		cli.BoolFlag{
 			Name:  "token-validate-only",
 			Usage: "validate the token and roles only, no required implement oauth",
@@ -379,22 +1555,111 @@ func getOptions() []cli.Flag {
 			Usage:  "the expiration of the access token cookie, if not used within this time its removed",
 			EnvVar: "PROXY_IDLE_DURATION",
 		},
+		cli.DurationFlag{
+			Name:  "refresh-ahead",
+			Usage: "refresh the access tokens of the active sessions in the background this long before expiry, requires a store",
+		},
+		cli.BoolFlag{
+			Name:  "enable-offline-tokens",
+			Usage: "request an offline refresh token (offline_access) for all the sessions, surviving the sso session expiry",
+		},
+		cli.DurationFlag{
+			Name:  "offline-session-duration",
+			Usage: "the expiration of the session cookies holding an offline token, i.e. the offline session idle of the realm",
+			Value: defaults.OfflineSessionDuration,
+		},
+		cli.BoolFlag{
+			Name:  "enable-remember-me",
+			Usage: "permits the users to ask to be remembered (remember_me=true), requesting an offline refresh token",
+		},
+		cli.DurationFlag{
+			Name:  "remember-me-duration",
+			Usage: "the expiration of the session cookies of the users asking to be remembered",
+			Value: defaults.RememberMeDuration,
+		},
 		cli.StringFlag{
 			Name:   "redirection-url",
 			Usage:  fmt.Sprintf("redirection url for the oauth callback url (%s is added)", oauthURL),
 			EnvVar: "PROXY_REDIRECTION_URL",
 		},
 		cli.StringFlag{
-			Name:   "revocation-url",
-			Usage:  "the url for the revocation endpoint to revoke refresh token",
-			Value:  "/oauth2/revoke",
-			EnvVar: "PROXY_REVOCATION_URL",
+			Name:   "revocation-url",
+			Usage:  "the url for the revocation endpoint to revoke refresh token",
+			Value:  "/oauth2/revoke",
+			EnvVar: "PROXY_REVOCATION_URL",
+		},
+		cli.BoolFlag{
+			Name:  "enable-negotiate",
+			Usage: "forward the kerberos (spnego) tickets of the browsers to keycloak on login, avoiding the interactive login",
+		},
+		cli.BoolFlag{
+			Name:  "enable-silent-authentication",
+			Usage: fmt.Sprintf("attempts a prompt=none authorization on an expired session before the login, and on %s%s within an iframe", oauthURL, silentURL),
+		},
+		cli.BoolFlag{
+			Name:  "enable-device-flow",
+			Usage: fmt.Sprintf("enables the device authorization grant on %s%s for the headless devices and terminals", oauthURL, deviceURL),
+		},
+		cli.StringFlag{
+			Name:  "device-authorization-url",
+			Usage: "the url of the device authorization endpoint, defaults to the keycloak endpoint alongside the token endpoint",
+		},
+		cli.StringFlag{
+			Name:  "ldap-url",
+			Usage: "the directory verifying the basic credentials on the break glass resources when keycloak is unreachable",
+		},
+		cli.StringFlag{
+			Name:  "ldap-bind-dn",
+			Usage: "the dn the user binds to the directory as, the username replaces the %s, e.g. uid=%s,ou=admins,dc=example,dc=com",
+		},
+		cli.StringFlag{
+			Name:  "ldap-filter",
+			Usage: "the filter the entry of the user must match to be granted the roles, e.g. (memberOf=cn=admins,ou=groups,dc=example,dc=com)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ldap-roles",
+			Usage: "the roles granted to the users authenticated by the directory",
+		},
+		cli.DurationFlag{
+			Name:  "ldap-timeout",
+			Usage: "the timeout on the connection to the directory",
+			Value: defaults.LDAPTimeout,
 		},
 		cli.StringFlag{
 			Name:   "store-url",
 			Usage:  "url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file",
 			EnvVar: "PROXY_STORE_URL",
 		},
+		cli.BoolFlag{
+			Name:  "enable-reference-tokens",
+			Usage: "holds the claims in the store, forwarding only a signed reference (X-Auth-Reference) to the upstream",
+		},
+		cli.BoolFlag{
+			Name:  "enable-signed-state",
+			Usage: "signs the state parameter of the authorization, refusing the tampered states or those replayed after the duration",
+		},
+		cli.BoolFlag{
+			Name:  "enable-encrypted-state",
+			Usage: "encrypts the signed state parameter, hiding the location from the provider",
+		},
+		cli.DurationFlag{
+			Name:  "state-duration",
+			Usage: "the time the signed state parameter is accepted after being issued",
+			Value: defaults.StateDuration,
+		},
+		cli.BoolFlag{
+			Name:  "single-session",
+			Usage: "invalidates the previous sessions of a user on login, requires a store",
+		},
+		cli.BoolFlag{
+			Name:  "enable-preserve-requests",
+			Usage: "holds a form posted without a session in the store, resubmitting it after login, requires a store",
+		},
+		cli.IntFlag{
+			Name:  "preserve-request-limit",
+			Usage: "the largest form body in bytes which is preserved across the login",
+			Value: int(defaults.PreserveRequestLimit),
+		},
 		cli.StringFlag{
 			Name:   "upstream-url",
 			Usage:  "the url for the upstream endpoint you wish to proxy to",
@@ -415,6 +1680,24 @@ func getOptions() []cli.Flag {
 			Usage: "specifies the keep-alive period for an active network connection",
 			Value: defaults.UpstreamKeepaliveTimeout,
 		},
+		cli.DurationFlag{
+			Name:  "upstream-response-header-timeout",
+			Usage: "the time to wait for the response headers of the upstream after the request is sent, zero is no limit",
+		},
+		cli.DurationFlag{
+			Name:  "upstream-tls-handshake-timeout",
+			Usage: "the time to wait for the tls handshake with the upstream",
+			Value: defaults.UpstreamTLSHandshakeTimeout,
+		},
+		cli.IntFlag{
+			Name:  "upstream-max-idle-connections",
+			Usage: "the maximum idle (keepalive) connections held per upstream host",
+			Value: defaults.UpstreamMaxIdleConnections,
+		},
+		cli.DurationFlag{
+			Name:  "upstream-flush-interval",
+			Usage: "the interval the upstream response is flushed to the client, a negative value flushes after every write",
+		},
 		cli.BoolFlag{
 			Name:  "enable-refresh-tokens",
 			Usage: "enables the handling of the refresh tokens",
@@ -433,21 +1716,130 @@ func getOptions() []cli.Flag {
 			Usage: "the name of the cookie used to hold the encrypted refresh token",
 			Value: defaults.CookieRefreshName,
 		},
+		cli.BoolFlag{
+			Name:  "enable-csrf",
+			Usage: "require a csrf token, issued in a cookie, in the header or form of the state changing requests of the sessions",
+		},
+		cli.StringFlag{
+			Name:  "csrf-cookie-name",
+			Usage: "the name of the cookie used to hold the csrf token",
+			Value: defaults.CSRFCookieName,
+		},
+		cli.StringFlag{
+			Name:  "csrf-header",
+			Usage: "the header the csrf token is submitted in, else the _csrf field of a url encoded form",
+			Value: defaults.CSRFHeader,
+		},
+		cli.StringSliceFlag{
+			Name:  "legacy-cookie-names",
+			Usage: "the previous access and refresh cookie names (access:refresh), the sessions are migrated to the current names",
+		},
+		cli.DurationFlag{
+			Name:  "legacy-cookie-grace-period",
+			Usage: "the duration the legacy cookies are kept alongside the current cookies once migrated, zero removes them at once",
+			Value: defaults.LegacyCookieGracePeriod,
+		},
 		cli.StringFlag{
 			Name:  "encryption-key",
 			Usage: "the encryption key used to encrpytion the session state",
 		},
+		cli.StringFlag{
+			Name:   "encryption-key-file",
+			Usage:  "a file holding the encryption key, i.e. a mounted secret",
+			EnvVar: "PROXY_ENCRYPTION_KEY_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:  "sso-domain",
+			Usage: "a sibling domain permitted to obtain a session from this proxy via the sso broker",
+		},
+		cli.StringFlag{
+			Name:  "sso-broker-url",
+			Usage: "the url of the proxy on the primary domain brokering the sessions i.e. https://sso.example.com",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowed-redirect",
+			Usage: "a host, with an optional path prefix, permitted as the redirect after login or logout i.e. *.example.com/app",
+		},
 		cli.BoolFlag{
 			Name:  "no-redirects",
 			Usage: "do not have back redirects when no authentication is present, 401 them",
 		},
+		cli.BoolFlag{
+			Name:  "enable-api-mode",
+			Usage: "never redirect the clients, the errors are returned as json (RFC 7807) with a bearer challenge",
+		},
+		cli.BoolFlag{
+			Name:  "enable-error-negotiation",
+			Usage: "hand the json errors to the xhr (X-Requested-With) and json clients (Accept), the browsers are redirected to login",
+		},
+		cli.BoolFlag{
+			Name:  "enable-signed-urls",
+			Usage: "enable the /oauth/sign endpoint minting the signed temporary urls, honored without a session",
+		},
+		cli.DurationFlag{
+			Name:  "signed-url-duration",
+			Usage: "the default and maximum lifetime of a signed url",
+			Value: defaults.SignedURLDuration,
+		},
+		cli.BoolFlag{
+			Name:  "maintenance-mode",
+			Usage: "start in maintenance, answering a 503 for the resources which are not white-listed",
+		},
+		cli.StringSliceFlag{
+			Name:  "maintenance-role",
+			Usage: "a role permitted through the maintenance and to toggle it via /oauth/maintenance, e.g. role:operator",
+		},
+		cli.StringSliceFlag{
+			Name:  "admin-role",
+			Usage: "a role permitted to the admin endpoints, i.e. the effective configuration on /oauth/config",
+		},
+		cli.StringSliceFlag{
+			Name:  "crawler-user-agent",
+			Usage: "a user agent (case insensitive substring) answered with a cacheable 401 rather than a redirect i.e. googlebot",
+		},
+		cli.DurationFlag{
+			Name:  "crawler-cache-duration",
+			Usage: "the max-age of the cacheable 401 handed back to the crawlers",
+			Value: defaults.CrawlerCacheDuration,
+		},
 		cli.StringSliceFlag{
 			Name:  "hostname",
 			Usage: "a list of hostnames the service will respond to, defaults to all",
 		},
 		cli.BoolFlag{
 			Name:  "enable-proxy-protocol",
-			Usage: "whether to enable proxy protocol",
+			Usage: "whether to enable the proxy protocol (v1 or v2) on the listener, the client address is taken from the header",
+		},
+		cli.StringSliceFlag{
+			Name:  "trusted-proxy",
+			Usage: "a network (cidr) of trusted proxies, the client address is taken from their X-Forwarded-For or X-Real-IP",
+		},
+		cli.BoolFlag{
+			Name:  "enable-graceful-reload",
+			Usage: "hands the listener to a new process of the binary on a SIGUSR2, draining the connections of the old",
+		},
+		cli.DurationFlag{
+			Name:  "reload-drain-timeout",
+			Usage: "the time permitted for the connections to drain after a graceful reload",
+			Value: defaults.ReloadDrainTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "enable-secret-reload",
+			Usage: "gracefully reload the service when the secret files change, requires the graceful reloads",
+		},
+		cli.DurationFlag{
+			Name:  "secret-reload-interval",
+			Usage: "the interval the secret files are checked for changes",
+			Value: defaults.SecretReloadInterval,
+		},
+		cli.BoolFlag{
+			Name:  "enable-config-reload",
+			Usage: "gracefully reload the service when the configuration file (i.e. a mounted configmap) changes and is valid",
+		},
+		cli.DurationFlag{
+			Name:  "config-reload-interval",
+			Usage: "the interval the configuration file is checked for changes",
+			Value: defaults.ConfigReloadInterval,
 		},
 		cli.BoolFlag{
 			Name:  "enable-forwarding",
@@ -461,6 +1853,37 @@ func getOptions() []cli.Flag {
 			Name:  "forwarding-password",
 			Usage: "the password to use when logging into the openid provider",
 		},
+		cli.StringFlag{
+			Name:   "forwarding-password-file",
+			Usage:  "a file holding the password to use when logging into the openid provider",
+			EnvVar: "PROXY_FORWARDING_PASSWORD_FILE",
+		},
+		cli.StringFlag{
+			Name:   "vault-url",
+			Usage:  "the address of vault holding the credentials of the service, e.g. https://vault.example.com:8200",
+			EnvVar: "VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			Usage:  "the token used to authenticate to vault, renewed while the service runs",
+			EnvVar: "VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "vault-token-file",
+			Usage: "a file holding the token used to authenticate to vault",
+		},
+		cli.StringFlag{
+			Name:  "vault-client-secret",
+			Usage: "the field of the secret in vault holding the client secret, path#field e.g. secret/data/proxy#client-secret",
+		},
+		cli.StringFlag{
+			Name:  "vault-encryption-key",
+			Usage: "the field of the secret in vault holding the encryption key, path#field e.g. secret/data/proxy#encryption-key",
+		},
+		cli.StringFlag{
+			Name:  "vault-tls",
+			Usage: "the path of the secret in vault holding the certificate and private_key of the listener, held in memory",
+		},
 		cli.StringSliceFlag{
 			Name:  "forwarding-domains",
 			Usage: "a list of domains which should be signed; everything else is relayed unsigned",
@@ -477,10 +1900,146 @@ func getOptions() []cli.Flag {
 			Name:  "tls-ca-certificate",
 			Usage: "the path to the ca certificate used for mutual TLS",
 		},
+		cli.StringSliceFlag{
+			Name:  "tls-certificate-pair",
+			Usage: "an additional certificate and private key (cert:key), selected on the server name (SNI) of the client",
+		},
+		cli.BoolFlag{
+			Name:  "enable-acme",
+			Usage: "obtains and renews the tls certificates for the hostnames via acme (letsencrypt)",
+		},
+		cli.StringFlag{
+			Name:  "acme-cache-dir",
+			Usage: "the directory holding the acme certificates, the store is used if configured",
+			Value: defaults.AcmeCacheDir,
+		},
+		cli.StringFlag{
+			Name:  "acme-email",
+			Usage: "the contact email for the acme account",
+		},
+		cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "the minimum tls version for the listener, upstream and openid clients, i.e. tlsv1.0, tlsv1.1 or tlsv1.2",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-cipher-suites",
+			Usage: "a list of the cipher suites permitted, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+		cli.StringSliceFlag{
+			Name:  "tls-curve-preferences",
+			Usage: "a list of the elliptic curves in order of preference, i.e. P256, P384 or P521",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-auth",
+			Usage: "whether a client certificate is require or optional when using mutual TLS",
+			Value: "require",
+		},
+		cli.BoolFlag{
+			Name:  "enable-client-cert-auth",
+			Usage: "permits clients to authenticate with a verified certificate (cn is the subject, ou the roles)",
+		},
+		cli.BoolFlag{
+			Name:  "enable-certificate-bound-tokens",
+			Usage: "refuse the tokens bound to a client certificate (cnf x5t#S256) presented without the same certificate",
+		},
+		cli.StringSliceFlag{
+			Name:  "api-key",
+			Usage: "a pre-shared api key for the resources with enable-api-key, name:sha256_hash:role1,role2",
+		},
+		cli.StringFlag{
+			Name:  "api-key-header",
+			Usage: "the header holding the api key",
+			Value: defaults.APIKeyHeader,
+		},
+		cli.StringFlag{
+			Name:  "api-key-query",
+			Usage: "the query parameter holding the api key, by default the key is only read from the header",
+		},
+		cli.StringFlag{
+			Name:  "assertion-header",
+			Usage: "the header holding the assertion for the resources with require-assertion",
+			Value: defaults.AssertionHeader,
+		},
+		cli.StringSliceFlag{
+			Name:  "assertion-issuer",
+			Usage: "a trusted issuer of the assertions and its rsa public key, issuer=/path/to/key.pem",
+		},
 		cli.BoolTFlag{
 			Name:  "skip-upstream-tls-verify",
 			Usage: "whether to skip the verification of any upstream TLS (defaults to true)",
 		},
+		cli.IntFlag{
+			Name:  "upstream-retries",
+			Usage: "the number of times a failed idempotent request (without a body) is retried",
+		},
+		cli.IntFlag{
+			Name:  "upstream-circuit-threshold",
+			Usage: "the consecutive upstream failures before the circuit is opened and a 503 returned, zero disables",
+		},
+		cli.DurationFlag{
+			Name:  "upstream-circuit-timeout",
+			Usage: "the time the circuit is open before a trial request is permitted to the upstream",
+			Value: defaults.UpstreamCircuitTimeout,
+		},
+		cli.StringSliceFlag{
+			Name:  "upstream-endpoint",
+			Usage: "an additional upstream endpoint, the requests are balanced across the healthy endpoints",
+		},
+		cli.BoolFlag{
+			Name:  "audit-only",
+			Usage: "log the would be denials of the roles, claims and policies of the resources, permitting the requests",
+		},
+		cli.StringSliceFlag{
+			Name:  "canary-route",
+			Usage: "route the users with a matching claim to an alternate upstream, claim=value=upstream-url e.g. groups=beta-testers=http://127.0.0.1:8081",
+		},
+		cli.BoolFlag{
+			Name:  "dev-mode",
+			Usage: "start an embedded openid provider in place of keycloak, for local development only",
+		},
+		cli.StringFlag{
+			Name:  "dev-listen",
+			Usage: "the interface the embedded provider of the development mode listens on",
+			Value: defaults.DevListen,
+		},
+		cli.StringSliceFlag{
+			Name:  "dev-user",
+			Usage: "a user of the development mode, username=password=roles e.g. jane=secret=admin,app:viewer",
+		},
+		cli.StringFlag{
+			Name:  "ext-authz-listen",
+			Usage: "the interface of the envoy external authorization grpc service (cleartext http2), disabled when empty",
+		},
+		cli.StringFlag{
+			Name:  "ext-authz-http-listen",
+			Usage: "the interface of the envoy external authorization service of the http mode, disabled when empty",
+		},
+		cli.BoolFlag{
+			Name:  "sidecar",
+			Usage: "run as a pod sidecar, binding only to localhost, accepting bearer tokens and disabling the login flow",
+		},
+		cli.StringFlag{
+			Name:  "upstream-health-check",
+			Usage: "the health check of the upstream endpoints, tcp or a http path i.e. /health",
+			Value: defaults.UpstreamHealthCheck,
+		},
+		cli.DurationFlag{
+			Name:  "upstream-health-interval",
+			Usage: "the interval the upstream endpoints are health checked",
+			Value: defaults.UpstreamHealthInterval,
+		},
+		cli.StringFlag{
+			Name:  "upstream-ca",
+			Usage: "the path to a ca bundle used to verify the upstream certificate (requires skip-upstream-tls-verify=false)",
+		},
+		cli.StringFlag{
+			Name:  "upstream-client-cert",
+			Usage: "the path to a client certificate presented to the upstream, for mutual tls",
+		},
+		cli.StringFlag{
+			Name:  "upstream-client-private-key",
+			Usage: "the path to the private key for the upstream client certificate",
+		},
 		cli.StringSliceFlag{
 			Name:  "match-claims",
 			Usage: "keypair values for matching access token claims e.g. aud=myapp, iss=http://example.*",
@@ -489,6 +2048,91 @@ func getOptions() []cli.Flag {
 			Name:  "add-claims",
 			Usage: "retrieve extra claims from the token and inject into headers, e.g given_name -> X-Auth-Given-Name",
 		},
+		cli.StringSliceFlag{
+			Name:  "feature",
+			Usage: "enable or disable an experimental feature, name[=true|false], i.e. uma",
+		},
+		cli.StringSliceFlag{
+			Name:  "role-rewrite",
+			Usage: "renames the roles from the token, the first matching rule applied, e.g. '^kc-client:admin$ admin' or '^kc-client:'",
+		},
+		cli.BoolFlag{
+			Name:  "lowercase-roles",
+			Usage: "lowercase the roles extracted from the token, after the role rewrites",
+		},
+		cli.StringFlag{
+			Name:  "opa-url",
+			Usage: "the data api of the open policy agent deciding the access to the resources, e.g. http://127.0.0.1:8181/v1/data/httpapi/authz",
+		},
+		cli.DurationFlag{
+			Name:  "opa-timeout",
+			Usage: "the timeout of the requests to the open policy agent",
+			Value: defaults.OpenPolicyAgentTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "authorizer-timeout",
+			Usage: "the timeout of the requests to the external authorizers of the resources",
+			Value: defaults.AuthorizerTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "uma-cache-ttl",
+			Usage: "the duration the decisions of the keycloak authorization services are cached, requires the uma feature",
+		},
+		cli.BoolFlag{
+			Name:  "enable-resource-sync",
+			Usage: "pull the protected resources from the authorization services of the client in keycloak, requires the uma feature",
+		},
+		cli.DurationFlag{
+			Name:  "resource-sync-interval",
+			Usage: "the interval the protected resources are pulled from keycloak",
+			Value: defaults.ResourceSyncInterval,
+		},
+		cli.StringSliceFlag{
+			Name:  "acr-levels",
+			Usage: "the authentication context classes, lowest first, ranking the acr against the minimum-acr of the resources",
+		},
+		cli.StringFlag{
+			Name:  "claims-header",
+			Usage: "forward all the claims in the X-Auth-Claims header, encoded as json or base64 (the base64 encoded json)",
+		},
+		cli.StringFlag{
+			Name:  "identity-header-prefix",
+			Usage: "the prefix of the identity headers forwarded to the upstream",
+			Value: defaults.IdentityHeaderPrefix,
+		},
+		cli.StringSliceFlag{
+			Name:  "identity-header",
+			Usage: "rename an identity header, keyed on the header without the prefix or the claim, e.g. username=Remote-User",
+		},
+		cli.BoolFlag{
+			Name:  "omit-authorization-header",
+			Usage: "remove the authorization header holding the raw token from the upstream request",
+		},
+		cli.StringSliceFlag{
+			Name:  "omit-identity-header",
+			Usage: "an identity header removed from the upstream request, e.g. X-Auth-Token or X-Auth-Roles",
+		},
+		cli.BoolFlag{
+			Name:  "enable-service-token",
+			Usage: "inject the access token of the service account of the client (client credentials) into the upstream requests",
+		},
+		cli.StringFlag{
+			Name:  "service-token-header",
+			Usage: "the header holding the service account token, the authorization header replaces the user token",
+			Value: defaults.ServiceTokenHeader,
+		},
+		cli.StringFlag{
+			Name:  "token-exchange-audience",
+			Usage: "exchange the access token (RFC 8693) for one issued to the client before forwarding to the upstream",
+		},
+		cli.StringFlag{
+			Name:  "upstream-preset",
+			Usage: "the identity header names expected by a self-hosted application: grafana, gitea, kibana or jenkins",
+		},
+		cli.StringSliceFlag{
+			Name:  "upstream-role-mapping",
+			Usage: "maps a role to the role of the application, in order of precedence, e.g. admins=Admin",
+		},
 		cli.StringSliceFlag{
 			Name:  "resource",
 			Usage: "a list of resources 'uri=/admin|methods=GET|roles=role1,role2'",
@@ -497,6 +2141,18 @@ func getOptions() []cli.Flag {
 			Name:  "headers",
 			Usage: "Add custom headers to the upstream request, key=value",
 		},
+		cli.StringSliceFlag{
+			Name:  "response-header-add",
+			Usage: "a header added to the upstream responses, keeping any existing values, key=value",
+		},
+		cli.StringSliceFlag{
+			Name:  "response-header-set",
+			Usage: "a header set on the upstream responses, replacing any existing values, key=value",
+		},
+		cli.StringSliceFlag{
+			Name:  "response-header-remove",
+			Usage: "a header removed from the upstream responses, i.e. Server",
+		},
 		cli.StringFlag{
 			Name:  "signin-page",
 			Usage: "a custom template displayed for signin",
@@ -505,6 +2161,31 @@ func getOptions() []cli.Flag {
 			Name:  "forbidden-page",
 			Usage: "a custom template used for access forbidden",
 		},
+		cli.StringFlag{
+			Name:  "unavailable-page",
+			Usage: "a custom template used when the circuit for the upstream is open",
+		},
+		cli.StringFlag{
+			Name:  "session-ended-page",
+			Usage: "a custom template used when a session was ended by a newer login, else the user is redirected",
+		},
+		cli.StringFlag{
+			Name:  "blocked-page",
+			Usage: "a custom template displayed to the clients blocked after repeated authentication failures",
+		},
+		cli.StringFlag{
+			Name:  "maintenance-page",
+			Usage: "a custom template displayed while the service is in maintenance",
+		},
+		cli.BoolFlag{
+			Name:  "enable-template-reload",
+			Usage: "reload the custom templates when the files change, keeping the previous version if invalid",
+		},
+		cli.DurationFlag{
+			Name:  "template-reload-interval",
+			Usage: "the interval the custom templates are checked for changes",
+			Value: defaults.TemplateReloadInterval,
+		},
 		cli.StringSliceFlag{
 			Name:  "tag",
 			Usage: "keypair's passed to the templates at render,e.g title='My Page'",
@@ -533,10 +2214,105 @@ func getOptions() []cli.Flag {
 			Name:  "cors-credentials",
 			Usage: "the credentials access control header (Access-Control-Allow-Credentials)",
 		},
+		cli.BoolFlag{
+			Name:  "cors-preflight",
+			Usage: "answer the cors preflight requests directly, without authentication",
+		},
+		cli.Float64Flag{
+			Name:  "rate-limit",
+			Usage: "the number of requests per second a client (subject or address) is permitted, zero disables",
+		},
+		cli.IntFlag{
+			Name:  "rate-limit-burst",
+			Usage: "the maximum burst of requests permitted by the rate limit, defaults to the rate",
+		},
+		cli.IntFlag{
+			Name:  "brute-force-threshold",
+			Usage: "the authentication failures (401 or 403) of a client address or subject within the window before it's blocked, zero disables",
+		},
+		cli.DurationFlag{
+			Name:  "brute-force-window",
+			Usage: "the period the authentication failures are counted over",
+			Value: defaults.BruteForce.Window,
+		},
+		cli.DurationFlag{
+			Name:  "brute-force-backoff",
+			Usage: "the duration of the first block, doubling with each further failure",
+			Value: defaults.BruteForce.Backoff,
+		},
+		cli.DurationFlag{
+			Name:  "brute-force-max-block",
+			Usage: "the longest a client is blocked for",
+			Value: defaults.BruteForce.MaxBlock,
+		},
+		cli.StringFlag{
+			Name:  "rate-limit-claim",
+			Usage: "the claim in the token used to select the rate limit tier of the user, e.g. tier",
+		},
+		cli.StringSliceFlag{
+			Name:  "rate-limit-tier",
+			Usage: "the rate limit for a value of the rate limit claim, tier=rate[:burst] e.g. premium=50:100",
+		},
+		cli.IntFlag{
+			Name:  "quota-daily",
+			Usage: "the number of requests a subject is permitted per day (UTC), requires a store, zero disables",
+		},
+		cli.IntFlag{
+			Name:  "quota-monthly",
+			Usage: "the number of requests a subject is permitted per month (UTC), requires a store, zero disables",
+		},
+		cli.StringFlag{
+			Name:  "quota-claim",
+			Usage: "the claim the quotas are keyed on, e.g. azp for the client, defaults to the subject",
+		},
+		cli.BoolFlag{
+			Name:  "enable-metrics",
+			Usage: fmt.Sprintf("enables the prometheus metrics on %s%s", oauthURL, metricsURL),
+		},
 		cli.BoolFlag{
 			Name:  "enable-security-filter",
 			Usage: "enables the security filter handler",
 		},
+		cli.DurationFlag{
+			Name:  "hsts-max-age",
+			Usage: "the max-age of the strict transport security header added by the security filter, zero disables",
+		},
+		cli.BoolFlag{
+			Name:  "hsts-include-subdomains",
+			Usage: "add the includeSubDomains directive to the strict transport security header",
+		},
+		cli.BoolFlag{
+			Name:  "hsts-preload",
+			Usage: "add the preload directive to the strict transport security header",
+		},
+		cli.StringFlag{
+			Name:  "content-security-policy",
+			Usage: "the content security policy header added by the security filter",
+		},
+		cli.StringFlag{
+			Name:  "referrer-policy",
+			Usage: "the referrer policy header added by the security filter, e.g. same-origin",
+		},
+		cli.StringFlag{
+			Name:  "frame-options",
+			Usage: "the x-frame-options header added by the security filter, DENY or SAMEORIGIN, defaults to DENY",
+		},
+		cli.BoolFlag{
+			Name:  "disable-frame-options",
+			Usage: "do not add the x-frame-options header, for the applications setting their own",
+		},
+		cli.BoolFlag{
+			Name:  "disable-nosniff",
+			Usage: "do not add the x-content-type-options header",
+		},
+		cli.BoolFlag{
+			Name:  "disable-xss-filter",
+			Usage: "do not add the x-xss-protection header",
+		},
+		cli.BoolFlag{
+			Name:  "enable-http2",
+			Usage: "enables http2 on the tls listener and to the upstream (h2c for http upstreams), required for grpc",
+		},
 		cli.BoolFlag{
 			Name:  "skip-token-verification",
 			Usage: "TESTING ONLY; bypass token verification, only expiration and roles enforced",
@@ -545,6 +2321,11 @@ func getOptions() []cli.Flag {
 			Name:  "json-logging",
 			Usage: "switch on json logging rather than text (defaults true)",
 		},
+		cli.StringFlag{
+			Name:   "log-output",
+			Usage:  "the destination of the logs; stdout, stderr, journald or syslog[+udp|+tcp|+unix]://address",
+			EnvVar: "PROXY_LOG_OUTPUT",
+		},
 		cli.BoolTFlag{
 			Name:  "log-requests",
 			Usage: "switch on logging of all incoming requests (defaults true)",
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewDefaultConfig(t *testing.T) {
@@ -180,6 +181,14 @@ func TestIsConfig(t *testing.T) {
 			},
 			Ok: true,
 		},
+		{
+			Config: &Config{
+				Listen:                ":8080",
+				SkipTokenVerification: true,
+				Upstream:              "http://120.0.0.1",
+				CrossOrigin:           CORS{Origins: []string{"*"}, Credentials: true},
+			},
+		},
 	}
 
 	for i, c := range tests {
@@ -189,6 +198,72 @@ func TestIsConfig(t *testing.T) {
 	}
 }
 
+func TestIsConfigCrossOriginCredentials(t *testing.T) {
+	config := &Config{
+		Listen:                ":8080",
+		SkipTokenVerification: true,
+		Upstream:              "http://127.0.0.1:8080",
+		CrossOrigin:           CORS{Origins: []string{"*"}, Credentials: true},
+	}
+	assert.Error(t, config.isValid())
+	config.CrossOrigin = CORS{Origins: []string{"https://app.example.com"}, Credentials: true}
+	assert.NoError(t, config.isValid())
+	config.Resources = append(config.Resources, &Resource{
+		URL:         "/api",
+		Methods:     []string{"ANY"},
+		CrossOrigin: &CORS{Origins: []string{"*"}, Credentials: true},
+	})
+	assert.Error(t, config.isValid())
+}
+
+func TestIdentityHeaderPreset(t *testing.T) {
+	config := &Config{
+		IdentityHeaderPrefix: "X-Auth-",
+		IdentityHeaders:      map[string]string{"email": "X-Custom-Email"},
+		UpstreamPreset:       "grafana",
+	}
+	assert.Equal(t, "X-WEBAUTH-USER", config.identityHeader("username", "Username"))
+	assert.Equal(t, "X-Custom-Email", config.identityHeader("email", "Email"))
+	assert.Equal(t, "X-Auth-Subject", config.identityHeader("subject", "Subject"))
+	assert.True(t, config.isIdentityHeader("X-WEBAUTH-ROLE"))
+	assert.True(t, config.isIdentityHeader("X-Custom-Email"))
+	assert.False(t, config.isIdentityHeader("X-Forwarded-User"))
+}
+
+func TestSidecarMode(t *testing.T) {
+	config := &Config{
+		Listen:         "127.0.0.1:3000",
+		Upstream:       "http://127.0.0.1:8080",
+		RedirectionURL: "http://127.0.0.1:3000",
+		DiscoveryURL:   "http://127.0.0.1:8080",
+		ClientID:       "client",
+		SecureCookie:   true,
+		Sidecar:        true,
+	}
+	config.normalize()
+	assert.True(t, config.NoRedirects)
+	assert.NoError(t, config.isValid())
+
+	// step: the settings contradicting the sidecar mode are refused
+	config.NoRedirects = false
+	assert.Error(t, config.isValid())
+	config.NoRedirects = true
+	config.Hostnames = []string{"app.example.com"}
+	assert.Error(t, config.isValid())
+	config.Hostnames = nil
+	config.CanonicalHostname = "app.example.com"
+	assert.Error(t, config.isValid())
+	config.CanonicalHostname = ""
+
+	config.Listen = ":3000"
+	assert.Error(t, config.isValid())
+
+	config.Listen = "127.0.0.1:3000"
+	config.EnableRefreshTokens = true
+	config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	assert.Error(t, config.isValid())
+}
+
 func TestReadOptions(t *testing.T) {
 	c := cli.NewApp()
 	c.Flags = getOptions()
@@ -20,6 +20,7 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 )
 
@@ -59,6 +60,17 @@ func (r oauthProxy) dropRefreshTokenCookie(cx *gin.Context, value string, durati
 // clearAllCookies is just a helper function for the below
 //
 func (r oauthProxy) clearAllCookies(cx *gin.Context) {
+	r.clearSessionCookies(cx)
+	if r.config.EnableCSRF {
+		r.dropCookie(cx, r.config.CSRFCookieName, "", time.Duration(-10*time.Hour))
+	}
+}
+
+//
+// clearSessionCookies clears the session cookies of an expired session, the csrf cookie is kept so the forms of
+// the browser can still be preserved across the login
+//
+func (r oauthProxy) clearSessionCookies(cx *gin.Context) {
 	r.clearAccessTokenCookie(cx)
 	r.clearRefreshTokenCookie(cx)
 }
@@ -76,3 +88,41 @@ func (r oauthProxy) clearRefreshTokenCookie(cx *gin.Context) {
 func (r oauthProxy) clearAccessTokenCookie(cx *gin.Context) {
 	r.dropCookie(cx, r.config.CookieAccessName, "", time.Duration(-10*time.Hour))
 }
+
+//
+// migrateLegacyCookies moves a session held in the legacy cookie names to the current names, the cookie is
+// added to the request so the session is found; the legacy cookie is kept for the grace period, so the instances
+// still on the legacy names find the session too, and expires thereafter
+//
+func (r oauthProxy) migrateLegacyCookies(cx *gin.Context) {
+	cookies := cx.Request.Cookies()
+	for _, x := range r.config.LegacyCookieNames {
+		migrations := []struct {
+			legacy   string
+			name     string
+			duration time.Duration
+		}{
+			{legacy: x.Access, name: r.config.CookieAccessName, duration: r.config.IdleDuration},
+			{legacy: x.Refresh, name: r.config.CookieRefreshName, duration: r.config.IdleDuration * 2},
+		}
+		for _, m := range migrations {
+			if m.legacy == "" || m.legacy == m.name {
+				continue
+			}
+			cookie := findCookie(m.legacy, cookies)
+			if cookie == nil || findCookie(m.name, cookies) != nil {
+				continue
+			}
+			log.Debugf("migrating the session from the legacy cookie: %s to %s", m.legacy, m.name)
+
+			cx.Request.AddCookie(&http.Cookie{Name: m.name, Value: cookie.Value})
+			cookies = append(cookies, &http.Cookie{Name: m.name, Value: cookie.Value})
+			r.dropCookie(cx, m.name, cookie.Value, m.duration)
+			if r.config.LegacyCookieGracePeriod > 0 {
+				r.dropCookie(cx, m.legacy, cookie.Value, r.config.LegacyCookieGracePeriod)
+				continue
+			}
+			r.dropCookie(cx, m.legacy, "", time.Duration(-10*time.Hour))
+		}
+	}
+}
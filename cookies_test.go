@@ -16,7 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -73,3 +76,62 @@ func TestClearAllCookies(t *testing.T) {
 		"kc-access=; Path=/; Domain=127.0.0.1; Expires=",
 		"we have not cleared the, headers: %v", context.Writer.Header())
 }
+
+func TestClearSessionCookies(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.EnableCSRF = true
+	p.config.CSRFCookieName = "kc-csrf"
+	context := newFakeGinContext("GET", "/admin")
+	p.clearSessionCookies(context)
+	cookies := strings.Join(context.Writer.Header()["Set-Cookie"], "\n")
+	assert.Contains(t, cookies, "kc-access=;")
+	assert.Contains(t, cookies, "kc-state=;")
+	assert.NotContains(t, cookies, "kc-csrf=")
+}
+
+func TestMigrateLegacyCookies(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.LegacyCookieNames = []CookieNames{{Access: "old-access", Refresh: "old-state"}}
+
+	context := newFakeGinContext("GET", "/admin")
+	context.Request.AddCookie(&http.Cookie{Name: "old-access", Value: "token"})
+	p.migrateLegacyCookies(context)
+
+	cookie := findCookie(p.config.CookieAccessName, context.Request.Cookies())
+	if assert.NotNil(t, cookie) {
+		assert.Equal(t, "token", cookie.Value)
+	}
+	assert.Nil(t, findCookie(p.config.CookieRefreshName, context.Request.Cookies()))
+	cookies := context.Writer.Header()["Set-Cookie"]
+	if assert.Len(t, cookies, 2) {
+		assert.Contains(t, cookies[0], "kc-access=token;")
+		assert.Contains(t, cookies[1], "old-access=; Path=/; Domain=127.0.0.1; Expires=")
+	}
+
+	// step: the current cookie takes precedence over the legacy
+	context = newFakeGinContext("GET", "/admin")
+	context.Request.AddCookie(&http.Cookie{Name: "old-access", Value: "token"})
+	context.Request.AddCookie(&http.Cookie{Name: "kc-access", Value: "current"})
+	p.migrateLegacyCookies(context)
+	assert.Empty(t, context.Writer.Header()["Set-Cookie"])
+	assert.Equal(t, "current", findCookie(p.config.CookieAccessName, context.Request.Cookies()).Value)
+}
+
+func TestMigrateLegacyCookiesGracePeriod(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.LegacyCookieNames = []CookieNames{{Access: "old-access", Refresh: "old-state"}}
+	p.config.LegacyCookieGracePeriod = time.Duration(24) * time.Hour
+
+	context := newFakeGinContext("GET", "/admin")
+	context.Request.AddCookie(&http.Cookie{Name: "old-access", Value: "token"})
+	p.migrateLegacyCookies(context)
+
+	// step: the legacy cookie is kept with the session until the grace period has passed
+	cookies := (&http.Response{Header: context.Writer.Header()}).Cookies()
+	if assert.Len(t, cookies, 2) {
+		assert.Equal(t, "kc-access", cookies[0].Name)
+		assert.Equal(t, "old-access", cookies[1].Name)
+		assert.Equal(t, "token", cookies[1].Value)
+		assert.WithinDuration(t, time.Now().Add(p.config.LegacyCookieGracePeriod), cookies[1].Expires, time.Minute)
+	}
+}
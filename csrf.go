@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// csrfFormField is the form field holding the csrf token, for the forms which cannot set the header
+	csrfFormField = "_csrf"
+	// csrfUpstreamHeader is the header passing the csrf token to the upstream, for embedding in the forms
+	csrfUpstreamHeader = "X-Auth-CSRF-Token"
+	// csrfMaxFormSize is the largest form body read in search of the csrf token
+	csrfMaxFormSize = 1 << 20
+)
+
+//
+// csrfHandler issues a csrf token in a cookie to the sessions and validates the token is submitted in the header
+// or form alongside the state changing requests (double submit cookie), only the cookie sessions are subject to it
+//
+func (r *oauthProxy) csrfHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if !r.config.EnableCSRF {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found || !uc.(*userContext).isCookieSession() {
+			return
+		}
+		user := uc.(*userContext)
+
+		var token string
+		if cookie, err := cx.Request.Cookie(r.config.CSRFCookieName); err == nil {
+			token = cookie.Value
+		}
+		if isStateChangingMethod(cx.Request.Method) && !r.checkCSRFToken(cx, user) {
+			return
+		}
+
+		// step: issue a token to the sessions without one
+		if token == "" {
+			var err error
+			if token, err = newCSRFToken(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to generate a csrf token")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
+			}
+			r.dropCookie(cx, r.config.CSRFCookieName, token, 0)
+		}
+		cx.Request.Header.Set(csrfUpstreamHeader, token)
+	}
+}
+
+//
+// checkCSRFToken checks the csrf token submitted with the request matches the cookie, refusing the request if not
+//
+func (r *oauthProxy) checkCSRFToken(cx *gin.Context, user *userContext) bool {
+	var token string
+	if cookie, err := cx.Request.Cookie(r.config.CSRFCookieName); err == nil {
+		token = cookie.Value
+	}
+	submitted, err := getSubmittedCSRFToken(cx.Request, r.config.CSRFHeader)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to read the request body for the csrf token")
+
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return false
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) != 1 {
+		log.WithFields(log.Fields{
+			"username": user.name,
+			"method":   cx.Request.Method,
+			"path":     cx.Request.URL.Path,
+		}).Warnf("the request has a missing or invalid csrf token")
+
+		r.errorResponse(cx, http.StatusForbidden, reasonInvalidCSRFToken)
+		return false
+	}
+
+	return true
+}
+
+//
+// getSubmittedCSRFToken returns the csrf token from the header, else the field of a url encoded form, restoring the
+// body for the upstream
+//
+func getSubmittedCSRFToken(req *http.Request, header string) (string, error) {
+	if token := req.Header.Get(header); token != "" {
+		return token, nil
+	}
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, csrfMaxFormSize+1))
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(content), req.Body))
+	if len(content) > csrfMaxFormSize {
+		return "", nil
+	}
+	values, err := url.ParseQuery(string(content))
+	if err != nil {
+		return "", nil
+	}
+
+	return values.Get(csrfFormField), nil
+}
+
+//
+// newCSRFToken generates a random csrf token
+//
+func newCSRFToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+//
+// isStateChangingMethod checks if the method changes state, so requires the csrf token
+//
+func isStateChangingMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+
+	return false
+}
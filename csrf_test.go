@@ -0,0 +1,94 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.EnableCSRF = true
+	proxy.config.CSRFCookieName = "kc-csrf"
+	proxy.config.CSRFHeader = "X-CSRF-Token"
+	handler := proxy.csrfHandler()
+
+	// step: a session without a token is issued one
+	cx := newFakeGinContext("GET", "/")
+	cx.Set(userContextName, &userContext{id: "test"})
+	handler(cx)
+	assert.Equal(t, http.StatusOK, cx.Writer.Status())
+	assert.Contains(t, cx.Writer.Header().Get("Set-Cookie"), "kc-csrf=")
+	assert.NotEmpty(t, cx.Request.Header.Get(csrfUpstreamHeader))
+
+	cases := []struct {
+		Method   string
+		Cookie   string
+		Header   string
+		Form     string
+		Bearer   bool
+		APIKey   bool
+		Cert     bool
+		Expected int
+	}{
+		{Method: "GET", Cookie: "token", Expected: http.StatusOK},
+		{Method: "POST", Expected: http.StatusForbidden},
+		{Method: "POST", Cookie: "token", Expected: http.StatusForbidden},
+		{Method: "POST", Cookie: "token", Header: "another", Expected: http.StatusForbidden},
+		{Method: "POST", Header: "token", Expected: http.StatusForbidden},
+		{Method: "POST", Cookie: "token", Header: "token", Expected: http.StatusOK},
+		{Method: "DELETE", Cookie: "token", Header: "token", Expected: http.StatusOK},
+		{Method: "PUT", Cookie: "token", Form: "name=test&_csrf=token", Expected: http.StatusOK},
+		{Method: "PUT", Cookie: "token", Form: "name=test&_csrf=another", Expected: http.StatusForbidden},
+		{Method: "POST", Bearer: true, Expected: http.StatusOK},
+		{Method: "POST", APIKey: true, Expected: http.StatusOK},
+		{Method: "POST", Cert: true, Expected: http.StatusOK},
+	}
+	for i, c := range cases {
+		cx := newFakeGinContext(c.Method, "/")
+		cx.Set(userContextName, &userContext{id: "test", bearerToken: c.Bearer, apiKey: c.APIKey, certificate: c.Cert})
+		if c.Cookie != "" {
+			cx.Request.AddCookie(&http.Cookie{Name: proxy.config.CSRFCookieName, Value: c.Cookie})
+		}
+		if c.Header != "" {
+			cx.Request.Header.Set(proxy.config.CSRFHeader, c.Header)
+		}
+		if c.Form != "" {
+			cx.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			cx.Request.Body = ioutil.NopCloser(strings.NewReader(c.Form))
+		}
+		handler(cx)
+		assert.Equal(t, c.Expected, cx.Writer.Status(), "case %d, expected: %d, got: %d", i, c.Expected, cx.Writer.Status())
+		if c.Form != "" {
+			content, _ := ioutil.ReadAll(cx.Request.Body)
+			assert.Equal(t, c.Form, string(content), "case %d, the body should have been restored", i)
+		}
+	}
+}
+
+func TestIsStateChangingMethod(t *testing.T) {
+	for _, x := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		assert.True(t, isStateChangingMethod(x), "%s should change state", x)
+	}
+	for _, x := range []string{"GET", "HEAD", "OPTIONS"} {
+		assert.False(t, isStateChangingMethod(x), "%s should not change state", x)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/oauth2"
+	"github.com/gambol99/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// deviceGrantType is the grant type of the device authorization flow (RFC 8628)
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// deviceCookieName is the cookie holding the pending device authorization of the browser
+	deviceCookieName = "kc-device"
+	// deviceInterval is the minimum polling interval of the device flow
+	deviceInterval = 5
+	// deviceAuthorizationPending indicates the user has yet to approve the device
+	deviceAuthorizationPending = "authorization_pending"
+	// deviceSlowDown indicates the device is polling too often
+	deviceSlowDown = "slow_down"
+)
+
+//
+// deviceAuthorization is the response of the device authorization endpoint
+//
+type deviceAuthorization struct {
+	// DeviceCode is the code the device polls with
+	DeviceCode string `json:"device_code"`
+	// UserCode is the code the user enters on the verification page
+	UserCode string `json:"user_code"`
+	// VerificationURI is the page the user approves the device on
+	VerificationURI string `json:"verification_uri"`
+	// VerificationURIComplete is the verification page with the user code filled in
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	// ExpiresIn is the lifetime in seconds of the codes
+	ExpiresIn int `json:"expires_in"`
+	// Interval is the minimum time in seconds between the polling requests
+	Interval int `json:"interval,omitempty"`
+}
+
+// deviceTemplate is the page displaying the user code, refreshed on the interval to poll for the approval
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Device Login</title>
+<meta http-equiv="refresh" content="{{ .Interval }}">
+</head>
+<body>
+<p>To sign in, visit <a href="{{ .Location }}">{{ .VerificationURI }}</a> and enter the code:</p>
+<h1>{{ .UserCode }}</h1>
+</body>
+</html>
+`))
+
+//
+// deviceAuthorizationHandler starts a device authorization with the provider on behalf of the device, handing back
+// the user code to display and the device code to poll the device token endpoint with
+//
+func (r *oauthProxy) deviceAuthorizationHandler(cx *gin.Context) {
+	authorization, err := r.requestDeviceAuthorization()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to request the device authorization from the provider")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+
+	cx.Header("Cache-Control", "no-store")
+	cx.JSON(http.StatusOK, authorization)
+}
+
+//
+// deviceTokenHandler polls the provider for the approval of the device code, dropping the session cookies and
+// handing back the tokens once approved; the pending, slow down and denied errors are relayed as is
+//
+func (r *oauthProxy) deviceTokenHandler(cx *gin.Context) {
+	code := cx.Request.PostFormValue("device_code")
+	if code == "" {
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return
+	}
+
+	token, err := r.requestDeviceToken(code)
+	if err != nil {
+		if e, ok := err.(*oauth2.Error); ok {
+			cx.Header("Cache-Control", "no-store")
+			cx.JSON(http.StatusBadRequest, e)
+			return
+		}
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to request the access token via the device code")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+
+	user, err := r.establishSession(cx, token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"expires":   user.expiresAt.Format(time.RFC822Z),
+	}).Infof("issuing a new access token for user via the device code, email: %s", user.email)
+
+	cx.Header("Cache-Control", "no-store")
+	cx.JSON(http.StatusOK, token)
+}
+
+//
+// deviceHandler is the device flow for browsers without a keyboard, displaying the user code and refreshing on the
+// interval until the user has approved the device elsewhere, at which point the session is established
+//
+func (r *oauthProxy) deviceHandler(cx *gin.Context) {
+	// step: poll for the approval of a pending authorization
+	if authorization, err := r.getDeviceCookie(cx); err == nil {
+		token, err := r.requestDeviceToken(authorization.DeviceCode)
+		if err == nil {
+			r.dropCookie(cx, deviceCookieName, "", time.Duration(-10*time.Hour))
+			if _, err := r.establishSession(cx, token.AccessToken, token.RefreshToken); err != nil {
+				return
+			}
+			r.redirectToURL("/", cx)
+			return
+		}
+		if e, ok := err.(*oauth2.Error); ok && (e.Type == deviceAuthorizationPending || e.Type == deviceSlowDown) {
+			r.deviceResponse(cx, authorization)
+			return
+		}
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("the device authorization was not approved, starting a new one")
+	}
+
+	authorization, err := r.requestDeviceAuthorization()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to request the device authorization from the provider")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+	content, err := json.Marshal(authorization)
+	if err != nil {
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+	encoded, err := encodeText(string(content), r.config.EncryptionKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to encrypt the device authorization")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+	r.dropCookie(cx, deviceCookieName, encoded, time.Duration(authorization.ExpiresIn)*time.Second)
+
+	r.deviceResponse(cx, authorization)
+}
+
+//
+// deviceResponse renders the page displaying the user code
+//
+func (r *oauthProxy) deviceResponse(cx *gin.Context, authorization *deviceAuthorization) {
+	location := authorization.VerificationURIComplete
+	if location == "" {
+		location = authorization.VerificationURI
+	}
+	interval := authorization.Interval
+	if interval < deviceInterval {
+		interval = deviceInterval
+	}
+
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Content-Type", "text/html; charset=utf-8")
+	cx.Status(http.StatusOK)
+	if err := deviceTemplate.Execute(cx.Writer, map[string]interface{}{
+		"Interval":        interval,
+		"Location":        location,
+		"VerificationURI": authorization.VerificationURI,
+		"UserCode":        authorization.UserCode,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to render the device page")
+	}
+	cx.Abort()
+}
+
+//
+// getDeviceCookie decrypts the pending device authorization of the browser
+//
+func (r *oauthProxy) getDeviceCookie(cx *gin.Context) (*deviceAuthorization, error) {
+	cookie, err := cx.Request.Cookie(deviceCookieName)
+	if err != nil {
+		return nil, err
+	}
+	content, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	authorization := new(deviceAuthorization)
+	if err := json.Unmarshal([]byte(content), authorization); err != nil {
+		return nil, err
+	}
+
+	return authorization, nil
+}
+
+//
+// requestDeviceAuthorization requests a device and user code from the device authorization endpoint
+//
+func (r *oauthProxy) requestDeviceAuthorization() (*deviceAuthorization, error) {
+	values := url.Values{}
+	values.Set("client_id", r.config.ClientID)
+	values.Set("scope", strings.Join(append(r.config.Scopes, oidc.DefaultScope...), " "))
+
+	content, code, err := r.postToProvider(r.getDeviceAuthorizationURL(), values)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("the device authorization endpoint returned status: %d, response: %s", code, content)
+	}
+
+	authorization := new(deviceAuthorization)
+	if err := json.Unmarshal(content, authorization); err != nil {
+		return nil, fmt.Errorf("invalid response from the device authorization endpoint, error: %s", err)
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" {
+		return nil, fmt.Errorf("the device authorization endpoint did not return the device and user codes")
+	}
+
+	return authorization, nil
+}
+
+//
+// requestDeviceToken requests the tokens for the device code from the token endpoint, the provider errors are
+// returned as an oauth2.Error
+//
+func (r *oauthProxy) requestDeviceToken(deviceCode string) (*tokenResponse, error) {
+	if r.provider.TokenEndpoint == nil {
+		return nil, fmt.Errorf("the provider does not have a token endpoint")
+	}
+	values := url.Values{}
+	values.Set("grant_type", deviceGrantType)
+	values.Set("device_code", deviceCode)
+	values.Set("client_id", r.config.ClientID)
+
+	content, code, err := r.postToProvider(r.provider.TokenEndpoint.String(), values)
+	if err != nil {
+		return nil, err
+	}
+	if code != http.StatusOK {
+		e := new(oauth2.Error)
+		if err := json.Unmarshal(content, e); err != nil || e.Type == "" {
+			return nil, fmt.Errorf("the token endpoint returned status: %d, response: %s", code, content)
+		}
+		return nil, e
+	}
+
+	token := new(tokenResponse)
+	if err := json.Unmarshal(content, token); err != nil {
+		return nil, fmt.Errorf("invalid response from the token endpoint, error: %s", err)
+	}
+
+	return token, nil
+}
+
+//
+// getDeviceAuthorizationURL returns the device authorization endpoint, by default the keycloak endpoint alongside the
+// token endpoint of the provider
+//
+func (r *oauthProxy) getDeviceAuthorizationURL() string {
+	if r.config.DeviceAuthorizationURL != "" || r.provider.TokenEndpoint == nil {
+		return r.config.DeviceAuthorizationURL
+	}
+
+	return strings.TrimSuffix(r.provider.TokenEndpoint.String(), "/token") + "/auth/device"
+}
+
+//
+// postToProvider posts the form to the endpoint of the provider, authenticated with the client credentials
+//
+func (r *oauthProxy) postToProvider(endpoint string, values url.Values) ([]byte, int, error) {
+	if endpoint == "" {
+		return nil, 0, fmt.Errorf("the provider endpoint has not been set")
+	}
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.HttpClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return content, resp.StatusCode, nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeDeviceProxy(t *testing.T) (*oauthProxy, string) {
+	config := newFakeKeycloakConfig()
+	config.EnableDeviceFlow = true
+	proxy, _, u := newTestProxyService(t, config)
+
+	return proxy, u
+}
+
+func TestDeviceAuthorizationHandler(t *testing.T) {
+	_, u := newFakeDeviceProxy(t)
+	resp, err := http.PostForm(u+oauthURL+deviceURL, url.Values{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	authorization := new(deviceAuthorization)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(authorization))
+	assert.Equal(t, "pending", authorization.DeviceCode)
+	assert.Equal(t, "ABCD-EFGH", authorization.UserCode)
+}
+
+func TestDeviceTokenHandler(t *testing.T) {
+	proxy, u := newFakeDeviceProxy(t)
+	cs := []struct {
+		Code         string
+		ExpectedCode int
+		ExpectedBody string
+		Cookie       bool
+	}{
+		{
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Code:         "pending",
+			ExpectedCode: http.StatusBadRequest,
+			ExpectedBody: deviceAuthorizationPending,
+		},
+		{
+			Code:         "approved",
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: "access_token",
+			Cookie:       true,
+		},
+	}
+	for i, c := range cs {
+		values := url.Values{}
+		if c.Code != "" {
+			values.Set("device_code", c.Code)
+		}
+		resp, err := http.PostForm(u+oauthURL+deviceTokenURL, values)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		assert.Contains(t, string(content), c.ExpectedBody, "case %d", i)
+		found := false
+		for _, x := range resp.Cookies() {
+			if x.Name == proxy.config.CookieAccessName {
+				found = true
+			}
+		}
+		assert.Equal(t, c.Cookie, found, "case %d", i)
+	}
+}
+
+func TestDeviceHandler(t *testing.T) {
+	proxy, u := newFakeDeviceProxy(t)
+	get := func(cookie *http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", u+oauthURL+deviceURL, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("unable to make request, error: %s", err)
+		}
+		return resp
+	}
+	getCookie := func(resp *http.Response, name string) *http.Cookie {
+		for _, x := range resp.Cookies() {
+			if x.Name == name {
+				return x
+			}
+		}
+		return nil
+	}
+
+	// step: the user code is displayed and the authorization held in a cookie
+	resp := get(nil)
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(content), "ABCD-EFGH")
+	cookie := getCookie(resp, deviceCookieName)
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+
+	// step: the pending authorization is polled, displaying the same code
+	resp = get(cookie)
+	content, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(content), "ABCD-EFGH"))
+	assert.Nil(t, getCookie(resp, deviceCookieName))
+
+	// step: the approved authorization establishes the session
+	encoded, err := encodeText(`{"device_code":"approved","user_code":"ABCD-EFGH"}`, proxy.config.EncryptionKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp = get(&http.Cookie{Name: deviceCookieName, Value: encoded})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.NotNil(t, getCookie(resp, proxy.config.CookieAccessName))
+}
+
+func TestGetDeviceAuthorizationURL(t *testing.T) {
+	proxy, _ := newFakeDeviceProxy(t)
+	assert.True(t, strings.HasSuffix(proxy.getDeviceAuthorizationURL(), "/protocol/openid-connect/auth/device"))
+	proxy.config.DeviceAuthorizationURL = "https://keycloak.example.com/device"
+	assert.Equal(t, "https://keycloak.example.com/device", proxy.getDeviceAuthorizationURL())
+}
@@ -0,0 +1,457 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gambol99/go-oidc/oauth2"
+	"github.com/gambol99/go-oidc/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// devRealm is the path of the realm served by the development provider
+	devRealm = "/auth/realms/dev"
+	// devKeyID is the key id of the signing key of the development provider
+	devKeyID = "dev-mode"
+	// devClientID is the client id used when none is specified in the development mode
+	devClientID = "dev-mode"
+	// devTokenDuration is the lifetime of the access tokens issued by the development provider
+	devTokenDuration = time.Duration(1) * time.Hour
+)
+
+// devLoginTemplate is the login form of the development provider, listing the users
+var devLoginTemplate = template.Must(template.New("dev-login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Development Login</title>
+</head>
+<body>
+<h3>keycloak-proxy development mode - not for production use</h3>
+{{ if .Error }}<p>{{ .Error }}</p>{{ end }}
+<form method="POST">
+<input type="hidden" name="redirect_uri" value="{{ .RedirectURI }}">
+<input type="hidden" name="state" value="{{ .State }}">
+<select name="username">
+{{ range .Users }}<option value="{{ .Username }}">{{ .Username }} {{ .Roles }}</option>
+{{ end }}</select>
+<input type="password" name="password" placeholder="password">
+<input type="submit" value="Login">
+</form>
+</body>
+</html>
+`))
+
+//
+// devProvider is an embedded openid provider standing in for keycloak in the development mode
+//
+type devProvider struct {
+	sync.Mutex
+	// the issuer of the tokens
+	issuer string
+	// the client id the tokens are issued to
+	clientID string
+	// the users of the provider, keyed on the username
+	users map[string]*DevUser
+	// the authorization codes handed out, keyed on the code
+	codes map[string]string
+	// the signer of the tokens
+	signer jose.Signer
+	// the public key of the signer
+	key jose.JWK
+	// the listener of the provider
+	listener net.Listener
+}
+
+//
+// newDevProvider creates the development provider, listening on the dev-listen interface
+//
+func newDevProvider(config *Config) (*devProvider, error) {
+	// step: the signing key is generated on each start
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", config.DevListen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on the dev-listen interface: %s, %s", config.DevListen, err)
+	}
+
+	provider := &devProvider{
+		issuer:   "http://" + listener.Addr().String() + devRealm,
+		clientID: config.ClientID,
+		users:    make(map[string]*DevUser),
+		codes:    make(map[string]string),
+		signer:   jose.NewSignerRSA(devKeyID, *privateKey),
+		key: jose.JWK{
+			ID:       devKeyID,
+			Type:     "RSA",
+			Alg:      "RS256",
+			Use:      "sig",
+			Exponent: privateKey.PublicKey.E,
+			Modulus:  privateKey.PublicKey.N,
+		},
+		listener: listener,
+	}
+	for _, x := range getDevUsers(config) {
+		provider.users[x.Username] = x
+	}
+
+	return provider, nil
+}
+
+//
+// getDevUsers returns the users of the development provider, a developer user when none are configured
+//
+func getDevUsers(config *Config) []*DevUser {
+	if len(config.DevUsers) > 0 {
+		return config.DevUsers
+	}
+
+	return []*DevUser{{Username: "developer", Password: "developer"}}
+}
+
+//
+// decodeDevUser decodes the development user option, username=password=role1,role2
+//
+func decodeDevUser(option string) (*DevUser, error) {
+	items := strings.SplitN(option, "=", 3)
+	if len(items) < 2 || items[0] == "" {
+		return nil, fmt.Errorf("invalid development user '%s' should be username=password=roles", option)
+	}
+	user := &DevUser{Username: items[0], Password: items[1]}
+	if len(items) == 3 && items[2] != "" {
+		user.Roles = strings.Split(items[2], ",")
+	}
+
+	return user, nil
+}
+
+//
+// run starts serving the development provider
+//
+func (r *devProvider) run() {
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	engine.GET(devRealm+"/.well-known/openid-configuration", r.discoveryHandler)
+	engine.GET(devRealm+"/protocol/openid-connect/certs", r.keysHandler)
+	engine.GET(devRealm+"/protocol/openid-connect/auth", r.authHandler)
+	engine.POST(devRealm+"/protocol/openid-connect/auth", r.loginHandler)
+	engine.POST(devRealm+"/protocol/openid-connect/token", r.tokenHandler)
+	engine.GET(devRealm+"/protocol/openid-connect/logout", r.logoutHandler)
+
+	log.WithFields(log.Fields{
+		"issuer": r.issuer,
+		"users":  len(r.users),
+	}).Warnf("DEVELOPMENT MODE - the embedded identity provider is issuing tokens, never use in production")
+
+	go func() {
+		if err := http.Serve(r.listener, engine); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("the development provider has stopped")
+		}
+	}()
+}
+
+//
+// discoveryHandler returns the openid configuration of the development provider
+//
+func (r *devProvider) discoveryHandler(cx *gin.Context) {
+	cx.JSON(http.StatusOK, gin.H{
+		"issuer":                                r.issuer,
+		"authorization_endpoint":                r.issuer + "/protocol/openid-connect/auth",
+		"token_endpoint":                        r.issuer + "/protocol/openid-connect/token",
+		"jwks_uri":                              r.issuer + "/protocol/openid-connect/certs",
+		"end_session_endpoint":                  r.issuer + "/protocol/openid-connect/logout",
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "password"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+	})
+}
+
+//
+// keysHandler returns the signing key of the development provider
+//
+func (r *devProvider) keysHandler(cx *gin.Context) {
+	cx.JSON(http.StatusOK, jose.JWKSet{Keys: []jose.JWK{r.key}})
+}
+
+//
+// authHandler renders the login form of the development provider
+//
+func (r *devProvider) authHandler(cx *gin.Context) {
+	r.renderLogin(cx, http.StatusOK, cx.Query("redirect_uri"), cx.Query("state"), "")
+}
+
+//
+// loginHandler authenticates the user of the login form, returning to the proxy with an authorization code
+//
+func (r *devProvider) loginHandler(cx *gin.Context) {
+	redirect := cx.PostForm("redirect_uri")
+	state := cx.PostForm("state")
+
+	location, err := url.Parse(redirect)
+	if err != nil || redirect == "" {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	user, found := r.authenticate(cx.PostForm("username"), cx.PostForm("password"))
+	if !found {
+		r.renderLogin(cx, http.StatusUnauthorized, redirect, state, "invalid username or password")
+		return
+	}
+	code, err := newCSRFToken()
+	if err != nil {
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	r.Lock()
+	r.codes[code] = user.Username
+	r.Unlock()
+
+	query := location.Query()
+	query.Set("code", code)
+	query.Set("state", state)
+	location.RawQuery = query.Encode()
+
+	cx.Redirect(http.StatusFound, location.String())
+}
+
+//
+// renderLogin renders the login form of the development provider
+//
+func (r *devProvider) renderLogin(cx *gin.Context, code int, redirect, state, reason string) {
+	if redirect == "" {
+		cx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Content-Type", "text/html; charset=utf-8")
+	cx.Status(code)
+
+	if err := devLoginTemplate.Execute(cx.Writer, map[string]interface{}{
+		"Error":       reason,
+		"RedirectURI": redirect,
+		"State":       state,
+		"Users":       r.listUsers(),
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to render the development login form")
+	}
+}
+
+//
+// tokenHandler issues the tokens for the authorization codes, refresh tokens and user credentials
+//
+func (r *devProvider) tokenHandler(cx *gin.Context) {
+	var user *DevUser
+	var found bool
+
+	switch cx.PostForm("grant_type") {
+	case oauth2.GrantTypeAuthCode:
+		code := cx.PostForm("code")
+		r.Lock()
+		username, issued := r.codes[code]
+		delete(r.codes, code)
+		r.Unlock()
+		if issued {
+			user, found = r.users[username]
+		}
+	case oauth2.GrantTypeRefreshToken:
+		user, found = r.getRefreshTokenUser(cx.PostForm("refresh_token"))
+	case oauth2.GrantTypeUserCreds:
+		user, found = r.authenticate(cx.PostForm("username"), cx.PostForm("password"))
+	default:
+		cx.JSON(http.StatusBadRequest, gin.H{"error": oauth2.ErrorUnsupportedGrantType})
+		return
+	}
+	if !found {
+		cx.JSON(http.StatusBadRequest, gin.H{"error": oauth2.ErrorInvalidGrant})
+		return
+	}
+
+	response, err := r.issueTokens(user)
+	if err != nil {
+		cx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cx.JSON(http.StatusOK, response)
+}
+
+//
+// logoutHandler ends the session at the development provider, returning to the redirect uri if any
+//
+func (r *devProvider) logoutHandler(cx *gin.Context) {
+	if redirect := cx.Query("redirect_uri"); redirect != "" {
+		cx.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	cx.String(http.StatusOK, "logged out")
+}
+
+//
+// authenticate checks the credentials of a user
+//
+func (r *devProvider) authenticate(username, password string) (*DevUser, bool) {
+	user, found := r.users[username]
+	if !found || user.Password != password {
+		return nil, false
+	}
+
+	return user, true
+}
+
+//
+// getRefreshTokenUser returns the user of a refresh token issued by the development provider
+//
+func (r *devProvider) getRefreshTokenUser(refreshToken string) (*DevUser, bool) {
+	token, err := jose.ParseJWT(refreshToken)
+	if err != nil {
+		return nil, false
+	}
+	verifier, err := jose.NewVerifierRSA(r.key)
+	if err != nil || verifier.Verify(token.Signature, []byte(token.Data())) != nil {
+		return nil, false
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return nil, false
+	}
+	if expires, found, err := claims.TimeClaim("exp"); err != nil || !found || time.Now().After(expires) {
+		return nil, false
+	}
+	username, found, err := claims.StringClaim("preferred_username")
+	if err != nil || !found {
+		return nil, false
+	}
+	user, found := r.users[username]
+
+	return user, found
+}
+
+//
+// issueTokens signs the identity, access and refresh tokens of the user
+//
+func (r *devProvider) issueTokens(user *DevUser) (*tokenResponse, error) {
+	now := time.Now()
+	session, err := newCSRFToken()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := r.getClaims(user)
+	claims.Add("session_state", session)
+	claims.Add("iat", now.Unix())
+	claims.Add("exp", now.Add(devTokenDuration).Unix())
+	claims.Add("typ", "Bearer")
+	access, err := jose.NewSignedJWT(claims, r.signer)
+	if err != nil {
+		return nil, err
+	}
+	claims["typ"] = "ID"
+	identity, err := jose.NewSignedJWT(claims, r.signer)
+	if err != nil {
+		return nil, err
+	}
+	claims["typ"] = "Refresh"
+	claims["exp"] = now.Add(devTokenDuration * 8).Unix()
+	refresh, err := jose.NewSignedJWT(claims, r.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		TokenType:    "bearer",
+		AccessToken:  access.Encode(),
+		IDToken:      identity.Encode(),
+		RefreshToken: refresh.Encode(),
+		ExpiresIn:    int(devTokenDuration.Seconds()),
+		Scope:        strings.Join(oidc.DefaultScope, " "),
+	}, nil
+}
+
+//
+// getClaims returns the claims of the user, the roles prefixed with a client are placed in its resource access
+//
+func (r *devProvider) getClaims(user *DevUser) jose.Claims {
+	email := user.Email
+	if email == "" {
+		email = user.Username + "@localhost"
+	}
+	realmRoles := []string{}
+	clientRoles := make(map[string]interface{})
+	for _, x := range user.Roles {
+		if items := strings.SplitN(x, ":", 2); len(items) == 2 {
+			var roles []string
+			if list, found := clientRoles[items[0]]; found {
+				roles = list.(map[string]interface{})["roles"].([]string)
+			}
+			clientRoles[items[0]] = map[string]interface{}{"roles": append(roles, items[1])}
+			continue
+		}
+		realmRoles = append(realmRoles, x)
+	}
+
+	return jose.Claims{
+		"iss":                r.issuer,
+		"aud":                r.clientID,
+		"azp":                r.clientID,
+		"sub":                base64.RawURLEncoding.EncodeToString([]byte(user.Username)),
+		"email":              email,
+		"name":               user.Username,
+		"preferred_username": user.Username,
+		"realm_access":       map[string]interface{}{"roles": realmRoles},
+		"resource_access":    clientRoles,
+	}
+}
+
+//
+// listUsers returns the users of the development provider
+//
+func (r *devProvider) listUsers() []*DevUser {
+	var names []string
+	for name := range r.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []*DevUser
+	for _, name := range names {
+		list = append(list, r.users[name])
+	}
+
+	return list
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeDevModeProxy(t *testing.T) *oauthProxy {
+	config := newFakeKeycloakConfig()
+	config.DiscoveryURL = ""
+	config.SkipTokenVerification = false
+	config.DevMode = true
+	config.DevListen = "127.0.0.1:0"
+	config.Listen = "127.0.0.1:0"
+	config.Upstream = "http://127.0.0.1:8080"
+	config.DevUsers = []*DevUser{
+		{Username: "jane", Password: "secret", Roles: []string{fakeAdminRole, "app:viewer"}},
+	}
+	require.NoError(t, config.isValid())
+	proxy, err := newProxy(config)
+	require.NoError(t, err)
+
+	return proxy
+}
+
+func TestDecodeDevUser(t *testing.T) {
+	cs := []struct {
+		Option   string
+		Expected *DevUser
+		Ok       bool
+	}{
+		{Option: "jane=secret", Expected: &DevUser{Username: "jane", Password: "secret"}, Ok: true},
+		{Option: "jane=secret=admin,app:viewer", Expected: &DevUser{Username: "jane", Password: "secret", Roles: []string{"admin", "app:viewer"}}, Ok: true},
+		{Option: "jane"},
+		{Option: "=secret=admin"},
+	}
+	for i, c := range cs {
+		user, err := decodeDevUser(c.Option)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, user, "case %d", i)
+	}
+}
+
+func TestDevModeConfig(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.DevMode = true
+	config.DevListen = "127.0.0.1:0"
+	config.Listen = "127.0.0.1:3000"
+	config.Upstream = "http://127.0.0.1:8080"
+	assert.Error(t, config.isValid(), "the discovery url should be refused in the development mode")
+
+	config.DiscoveryURL = ""
+	config.ClientID = ""
+	assert.Error(t, config.isValid(), "the client id should be required")
+	config.normalize()
+	assert.Equal(t, devClientID, config.ClientID)
+	assert.NoError(t, config.isValid())
+}
+
+func TestDevModeLogin(t *testing.T) {
+	proxy := newFakeDevModeProxy(t)
+	assert.True(t, strings.HasPrefix(proxy.config.DiscoveryURL, "http://127.0.0.1:"))
+	authURL := proxy.config.DiscoveryURL + "/protocol/openid-connect/auth"
+
+	// step: the login form lists the users
+	resp, err := http.Get(authURL + "?redirect_uri=" + url.QueryEscape("http://127.0.0.1/oauth/callback") + "&state=xyz")
+	require.NoError(t, err)
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(content), "jane")
+
+	login := func(password string) *http.Response {
+		values := url.Values{
+			"redirect_uri": {"http://127.0.0.1/oauth/callback"},
+			"state":        {"xyz"},
+			"username":     {"jane"},
+			"password":     {password},
+		}
+		req, _ := http.NewRequest("POST", authURL, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusUnauthorized, login("invalid").StatusCode)
+
+	resp = login("secret")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	// step: the code is exchanged for tokens signed by the provider
+	response, err := exchangeAuthenticationCode(proxy.client, code)
+	require.NoError(t, err)
+	token, identity, err := parseToken(response.AccessToken)
+	require.NoError(t, err)
+	assert.NoError(t, verifyToken(proxy.client, token))
+	assert.Equal(t, "jane@localhost", identity.Email)
+	user, err := extractIdentity(token, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "jane", user.preferredName)
+	assert.Contains(t, user.roles, fakeAdminRole)
+	assert.Contains(t, user.roles, "app:viewer")
+
+	// step: the codes are used once
+	_, err = exchangeAuthenticationCode(proxy.client, code)
+	assert.Error(t, err)
+
+	// step: the refresh token is honored
+	_, _, err = getRefreshedToken(proxy.client, response.RefreshToken)
+	assert.NoError(t, err)
+}
@@ -44,13 +44,28 @@ const (
 	tokenURL         = "/token"
 	expiredURL       = "/expired"
 	logoutURL        = "/logout"
+	metricsURL       = "/metrics"
 	loginURL         = "/login"
+	ssoURL           = "/sso"
+	ssoCallbackURL   = "/sso/callback"
+	userInfoURL      = "/userinfo"
+	replayURL        = "/replay"
+	deviceURL        = "/device"
+	deviceTokenURL   = "/device/token"
+	silentURL        = "/silent"
+	signURL          = "/sign"
+	maintenanceURL   = "/maintenance"
+	configURL        = "/config"
 
-	claimPreferredName  = "preferred_username"
-	claimAudience       = "aud"
-	claimResourceAccess = "resource_access"
-	claimRealmAccess    = "realm_access"
-	claimResourceRoles  = "roles"
+	claimPreferredName   = "preferred_username"
+	claimAudience        = "aud"
+	claimResourceAccess  = "resource_access"
+	claimRealmAccess     = "realm_access"
+	claimResourceRoles   = "roles"
+	claimAuthorizedParty = "azp"
+	claimClientID        = "clientId"
+	claimSessionState    = "session_state"
+	claimAuthTime        = "auth_time"
 )
 
 var (
@@ -66,6 +81,32 @@ var (
 	ErrRefreshTokenExpired = errors.New("the refresh token has expired")
 	// ErrNoTokenAudience indicates their is not audience in the token
 	ErrNoTokenAudience = errors.New("the token does not audience in claims")
+	// ErrNoCertificateName indicates the client certificate has no common name
+	ErrNoCertificateName = errors.New("the client certificate does not have a common name")
+	// ErrInvalidTransferToken indicates the sso transfer token failed verification
+	ErrInvalidTransferToken = errors.New("the sso transfer token is invalid")
+	// ErrTransferTokenExpired indicates the sso transfer token has expired
+	ErrTransferTokenExpired = errors.New("the sso transfer token has expired")
+	// ErrInvalidReferenceToken indicates the reference token is invalid
+	ErrInvalidReferenceToken = errors.New("the reference token is invalid")
+	// ErrReferenceTokenExpired indicates the reference token has expired
+	ErrReferenceTokenExpired = errors.New("the reference token has expired")
+	// ErrInvalidState indicates the state parameter failed verification
+	ErrInvalidState = errors.New("the state parameter is invalid")
+	// ErrStateExpired indicates the state parameter was issued outside the permitted duration
+	ErrStateExpired = errors.New("the state parameter has expired")
+	// ErrInvalidSignedURL indicates the signature of the signed url failed verification
+	ErrInvalidSignedURL = errors.New("the signature of the url is invalid")
+	// ErrSignedURLExpired indicates the signed url is past its expiration
+	ErrSignedURLExpired = errors.New("the signed url has expired")
+	// ErrInvalidAPIKey indicates the api key is not known
+	ErrInvalidAPIKey = errors.New("the api key is invalid")
+	// ErrInvalidCredentials indicates the basic credentials were refused by the provider
+	ErrInvalidCredentials = errors.New("the credentials were refused by the provider")
+	// ErrAssertionNotFound indicates the request does not have an assertion
+	ErrAssertionNotFound = errors.New("the request does not have an assertion")
+	// ErrInvalidAssertion indicates the assertion failed verification
+	ErrInvalidAssertion = errors.New("the assertion is invalid")
 )
 
 // Resource represents a url resource to protect
@@ -78,6 +119,242 @@ type Resource struct {
 	WhiteListed bool `json:"white-listed" yaml:"white-listed"`
 	// Roles the roles required to access this url
 	Roles []string `json:"roles" yaml:"roles"`
+	// DeniedRoles are the roles refused access to this url, regardless of the other roles held
+	DeniedRoles []string `json:"denied-roles" yaml:"denied-roles"`
+	// RequireAnyRole permits access with any one of the roles, rather than requiring all of them
+	RequireAnyRole bool `json:"require-any-role" yaml:"require-any-role"`
+	// Scopes are the oauth scopes the access token must have been granted to access this url
+	Scopes []string `json:"scopes" yaml:"scopes"`
+	// RateLimit overrides the global rate limit for this resource
+	RateLimit *RateLimit `json:"rate-limit" yaml:"rate-limit"`
+	// CrossOrigin are the CORS headers of this url, in place of none
+	CrossOrigin *CORS `json:"cors" yaml:"cors"`
+	// AllowedCIDRs is a list of networks the client must be within, if any
+	AllowedCIDRs []string `json:"allowed-cidrs" yaml:"allowed-cidrs"`
+	// DeniedCIDRs is a list of networks the client is refused access from
+	DeniedCIDRs []string `json:"denied-cidrs" yaml:"denied-cidrs"`
+	// LatencySLO is the upstream latency objective for the resource, requests over are counted in the metrics
+	LatencySLO time.Duration `json:"latency-slo" yaml:"latency-slo"`
+	// DisableFrameDeny permits the resource to be framed, overriding the security filter
+	DisableFrameDeny bool `json:"disable-frame-deny" yaml:"disable-frame-deny"`
+	// DisableNoSniff removes the nosniff content type option, overriding the security filter
+	DisableNoSniff bool `json:"disable-nosniff" yaml:"disable-nosniff"`
+	// FrameOptions overrides the X-Frame-Options header of the security filter, i.e. SAMEORIGIN for the embedded pages
+	FrameOptions string `json:"frame-options" yaml:"frame-options"`
+	// ContentSecurityPolicy overrides the Content-Security-Policy header of the security filter
+	ContentSecurityPolicy string `json:"content-security-policy" yaml:"content-security-policy"`
+	// ReferrerPolicy overrides the Referrer-Policy header of the security filter
+	ReferrerPolicy string `json:"referrer-policy" yaml:"referrer-policy"`
+	// EnableAPIKey permits the clients to authenticate to the resource with an api key
+	EnableAPIKey bool `json:"enable-api-key" yaml:"enable-api-key"`
+	// EnableBasicAuth permits the clients to authenticate to the resource with the basic credentials of the user
+	EnableBasicAuth bool `json:"enable-basic-auth" yaml:"enable-basic-auth"`
+	// APIMode never redirects the clients, the errors are returned as json with a bearer challenge
+	APIMode bool `json:"api-mode" yaml:"api-mode"`
+	// AuditOnly logs the denials of the admission, the requests are permitted
+	AuditOnly bool `json:"audit-only" yaml:"audit-only"`
+	// NegotiateErrors hands the json errors to the xhr and api clients, while the browsers are redirected to login
+	NegotiateErrors bool `json:"negotiate-errors" yaml:"negotiate-errors"`
+	// TokenParameter is the query parameter the access token is accepted from, the client is redirected without it
+	TokenParameter string `json:"token-param" yaml:"token-param"`
+	// BreakGlass permits the basic credentials verified by the secondary authenticator when the provider is unreachable
+	BreakGlass bool `json:"break-glass" yaml:"break-glass"`
+	// MaxTokenAge is the maximum time since the user authenticated (auth_time), else the user must authenticate again
+	MaxTokenAge time.Duration `json:"max-token-age" yaml:"max-token-age"`
+	// DisableRememberMe requires the remembered sessions to authenticate again for the resource
+	DisableRememberMe bool `json:"disable-remember-me" yaml:"disable-remember-me"`
+	// Policy is an expression over the claims, request and user which must be true for access, i.e.
+	// claims.department == 'finance' && request.method != 'DELETE'
+	Policy string `json:"policy" yaml:"policy"`
+	// Authorizer is the url of an external authorizer consulted with the identity and request details
+	Authorizer string `json:"authorizer" yaml:"authorizer"`
+	// AuthorizerTTL is the duration the decisions of the authorizer are cached, zero disables the caching
+	AuthorizerTTL time.Duration `json:"authorizer-ttl" yaml:"authorizer-ttl"`
+	// UMAPermissions are the permissions, resource#scope, the keycloak authorization services must grant the user
+	UMAPermissions []string `json:"uma-permissions" yaml:"uma-permissions"`
+	// AccessWindows are the periods the resource is accessible, any of them, always if empty
+	AccessWindows []AccessWindow `json:"access-windows" yaml:"access-windows"`
+	// MinimumACR is the minimum authentication context class (acr) of the token, else the user is asked to step up
+	MinimumACR string `json:"minimum-acr" yaml:"minimum-acr"`
+	// RequiredAMR are the authentication methods (amr) the token must have, i.e. otp, else the user is asked to step up
+	RequiredAMR []string `json:"required-amr" yaml:"required-amr"`
+	// RequireAssertion requires a verified assertion from the assertion issuers alongside the access token
+	RequireAssertion bool `json:"require-assertion" yaml:"require-assertion"`
+	// StripPrefix is the prefix removed from the path before proxying to the upstream
+	StripPrefix string `json:"strip-prefix" yaml:"strip-prefix"`
+	// RewritePath are the rules rewriting the path before proxying, the first matching rule is applied
+	RewritePath []PathRewrite `json:"rewrite-path" yaml:"rewrite-path"`
+	// ResponseHeaders are the changes to the headers of the upstream responses, after the global changes
+	ResponseHeaders *ResponseHeaders `json:"response-headers" yaml:"response-headers"`
+}
+
+// AccessWindow is a period of the week the resource is accessible
+type AccessWindow struct {
+	// Days are the days or ranges of days, i.e. mon-fri or sat, all the days if empty
+	Days []string `json:"days" yaml:"days"`
+	// Hours are the hours of the day, hh:mm-hh:mm, all day if empty
+	Hours string `json:"hours" yaml:"hours"`
+	// Timezone is the timezone of the days and hours, i.e. Europe/London, defaults to UTC
+	Timezone string `json:"timezone" yaml:"timezone"`
+}
+
+// PathRewrite is a rule rewriting the path to the upstream
+type PathRewrite struct {
+	// Pattern is the regular expression matching the path
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// Replacement is the replacement path, expanding the $1 style submatches
+	Replacement string `json:"replacement" yaml:"replacement"`
+}
+
+// RoleRewrite is a rule renaming the roles extracted from the access token
+type RoleRewrite struct {
+	// Pattern is the regular expression matching the role
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// Replacement is the replacement role, expanding the $1 style submatches, an empty role is dropped
+	Replacement string `json:"replacement" yaml:"replacement"`
+}
+
+// AssertionIssuer is a trusted issuer of the secondary assertions i.e. a device attestation
+type AssertionIssuer struct {
+	// Issuer is the iss claim of the assertions
+	Issuer string `json:"issuer" yaml:"issuer"`
+	// PublicKey is the location of the pem encoded rsa public key which signs the assertions
+	PublicKey string `json:"public-key" yaml:"public-key"`
+}
+
+// ResponseHeaders defines the changes to the headers of the upstream response, applied in the order remove,
+// set and add
+type ResponseHeaders struct {
+	// Add are the headers added to the response, keeping any existing values
+	Add map[string]string `json:"add" yaml:"add"`
+	// Set are the headers set on the response, replacing any existing values
+	Set map[string]string `json:"set" yaml:"set"`
+	// Remove are the headers removed from the response
+	Remove []string `json:"remove" yaml:"remove"`
+}
+
+// RateLimit defines the requests a client is permitted
+type RateLimit struct {
+	// Rate is the number of requests per second permitted
+	Rate float64 `json:"rate" yaml:"rate"`
+	// Burst is the maximum number of requests permitted at once
+	Burst int `json:"burst" yaml:"burst"`
+}
+
+// CertificatePair is a tls certificate and private key, selected on the server name (SNI)
+type CertificatePair struct {
+	// Certificate is the location of the tls certificate
+	Certificate string `json:"cert" yaml:"cert"`
+	// PrivateKey is the location of the tls private key
+	PrivateKey string `json:"private-key" yaml:"private-key"`
+}
+
+// Listener is an additional interface the service listens on, with its own tls settings
+type Listener struct {
+	// Listen is the binding interface, host:port or unix://path
+	Listen string `json:"listen" yaml:"listen"`
+	// TLSCertificate is the location of the tls certificate, the listener is plain http when empty
+	TLSCertificate string `json:"tls-cert" yaml:"tls-cert"`
+	// TLSPrivateKey is the location of the tls private key
+	TLSPrivateKey string `json:"tls-private-key" yaml:"tls-private-key"`
+	// TLSCaCertificate is the CA certificate which the client cert must be signed, enabling mutual tls
+	TLSCaCertificate string `json:"tls-ca-certificate" yaml:"tls-ca-certificate"`
+	// RedirectHTTPS redirects (301) all the requests to https rather than serving them, the listener must be plain http
+	RedirectHTTPS bool `json:"redirect-https" yaml:"redirect-https"`
+}
+
+// CookieNames is the names of the access and refresh cookies
+type CookieNames struct {
+	// Access is the name of the access cookie
+	Access string `json:"access" yaml:"access"`
+	// Refresh is the name of the refresh cookie
+	Refresh string `json:"refresh" yaml:"refresh"`
+}
+
+// RoleMapping maps a role to the role of the upstream application
+type RoleMapping struct {
+	// Role is the role in the token
+	Role string `json:"role" yaml:"role"`
+	// Value is the role of the application
+	Value string `json:"value" yaml:"value"`
+}
+
+// APIKey is a pre-shared key permitted to access the resources with api keys enabled
+type APIKey struct {
+	// Name is the name of the key, used as the subject unless one is set
+	Name string `json:"name" yaml:"name"`
+	// Hash is the hex encoded sha256 of the key
+	Hash string `json:"hash" yaml:"hash"`
+	// Subject is the subject of the identity, permitting multiple keys (i.e. during a rotation) for one client
+	Subject string `json:"subject,omitempty" yaml:"subject,omitempty"`
+	// Roles is the roles granted to the key
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// BruteForce defines the blocking of the clients with repeated authentication failures
+type BruteForce struct {
+	// Threshold is the failures within the window before the client is blocked, zero disables
+	Threshold int `json:"threshold" yaml:"threshold"`
+	// Window is the period the failures are counted over
+	Window time.Duration `json:"window" yaml:"window"`
+	// Backoff is the duration of the first block, doubling with each further failure
+	Backoff time.Duration `json:"backoff" yaml:"backoff"`
+	// MaxBlock is the longest a client is blocked
+	MaxBlock time.Duration `json:"max-block" yaml:"max-block"`
+}
+
+// CanaryRoute routes the requests of the users with a matching claim to an alternate upstream
+type CanaryRoute struct {
+	// Claim is the name or path of the claim, i.e. groups
+	Claim string `json:"claim" yaml:"claim"`
+	// Value is the expression matched against the whole claim, or any of the values of a list
+	Value string `json:"value" yaml:"value"`
+	// Upstream is the url of the alternate upstream
+	Upstream string `json:"upstream-url" yaml:"upstream-url"`
+}
+
+// DevUser is a user of the embedded provider of the development mode
+type DevUser struct {
+	// Username is the name of the user
+	Username string `json:"username" yaml:"username"`
+	// Password is the password of the user
+	Password string `json:"password" yaml:"password"`
+	// Email is the email of the user, defaults to username@localhost
+	Email string `json:"email" yaml:"email"`
+	// Roles are the realm roles of the user, the client roles are prefixed with the client i.e. client:role
+	Roles []string `json:"roles" yaml:"roles"`
+}
+
+// SecurityHeaders defines the headers added to the responses by the security filter
+type SecurityHeaders struct {
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header, zero disables
+	HSTSMaxAge time.Duration `json:"hsts-max-age" yaml:"hsts-max-age"`
+	// HSTSIncludeSubdomains adds the includeSubDomains directive to the Strict-Transport-Security header
+	HSTSIncludeSubdomains bool `json:"hsts-include-subdomains" yaml:"hsts-include-subdomains"`
+	// HSTSPreload adds the preload directive to the Strict-Transport-Security header
+	HSTSPreload bool `json:"hsts-preload" yaml:"hsts-preload"`
+	// ContentSecurityPolicy is the Content-Security-Policy header, empty disables
+	ContentSecurityPolicy string `json:"content-security-policy" yaml:"content-security-policy"`
+	// ReferrerPolicy is the Referrer-Policy header, empty disables
+	ReferrerPolicy string `json:"referrer-policy" yaml:"referrer-policy"`
+	// FrameOptions is the X-Frame-Options header, DENY unless set
+	FrameOptions string `json:"frame-options" yaml:"frame-options"`
+	// DisableFrameOptions removes the X-Frame-Options header, for the applications setting their own
+	DisableFrameOptions bool `json:"disable-frame-options" yaml:"disable-frame-options"`
+	// DisableNoSniff removes the X-Content-Type-Options header
+	DisableNoSniff bool `json:"disable-nosniff" yaml:"disable-nosniff"`
+	// DisableXSSFilter removes the X-XSS-Protection header
+	DisableXSSFilter bool `json:"disable-xss-filter" yaml:"disable-xss-filter"`
+}
+
+// Quota defines the requests a subject is permitted over a calendar period
+type Quota struct {
+	// Daily is the number of requests permitted per day
+	Daily int64 `json:"daily" yaml:"daily"`
+	// Monthly is the number of requests permitted per month
+	Monthly int64 `json:"monthly" yaml:"monthly"`
+	// Claim is the claim the quota is keyed on, defaults to the subject
+	Claim string `json:"claim" yaml:"claim"`
 }
 
 // CORS access controls
@@ -94,44 +371,141 @@ type CORS struct {
 	Credentials bool `json:"credentials" yaml:"credentials"`
 	// MaxAge is the age for CORS
 	MaxAge time.Duration `json:"max-age" yaml:"max-age"`
+	// Preflight answers the preflight requests directly, without authentication
+	Preflight bool `json:"preflight" yaml:"preflight"`
 }
 
 // Config is the configuration for the proxy
 type Config struct {
 	// Listen is the binding interface
 	Listen string `json:"listen" yaml:"listen"`
+	// Listeners are the additional interfaces the service listens on, each with their own tls settings
+	Listeners []*Listener `json:"listeners" yaml:"listeners"`
 	// DiscoveryURL is the url for the keycloak server
 	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// OpenIDProviderPins is a list of pins on the certificate of the identity provider, any of which may match
+	OpenIDProviderPins []string `json:"openid-provider-pins" yaml:"openid-provider-pins"`
 	// ClientID is the client id
 	ClientID string `json:"client-id" yaml:"client-id"`
+	// Audiences are the accepted audiences of the access tokens, defaults to the client id
+	Audiences []string `json:"audiences" yaml:"audiences"`
+	// AudienceValidation is the claims checked against the accepted audiences, aud, azp or both
+	AudienceValidation string `json:"audience-validation" yaml:"audience-validation"`
 	// ClientSecret is the secret for AS
 	ClientSecret string `json:"client-secret" yaml:"client-secret"`
+	// ClientSecretFile is a file holding the client secret, i.e. a mounted secret
+	ClientSecretFile string `json:"client-secret-file" yaml:"client-secret-file"`
 	// RedirectionURL the redirection url
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url"`
+	// EnableNegotiate forwards the kerberos (spnego) tickets of the browsers to the provider on login
+	EnableNegotiate bool `json:"enable-negotiate" yaml:"enable-negotiate"`
+	// EnableSilentAuthentication attempts a prompt=none authorization on an expired session before the login
+	EnableSilentAuthentication bool `json:"enable-silent-authentication" yaml:"enable-silent-authentication"`
+	// EnableDeviceFlow enables the device authorization grant endpoints for the headless devices
+	EnableDeviceFlow bool `json:"enable-device-flow" yaml:"enable-device-flow"`
+	// DeviceAuthorizationURL is the device authorization endpoint, defaults to the keycloak endpoint of the realm
+	DeviceAuthorizationURL string `json:"device-authorization-url" yaml:"device-authorization-url"`
+	// LDAPURL is the directory verifying the credentials on the break glass resources, ldap:// or ldaps://
+	LDAPURL string `json:"ldap-url" yaml:"ldap-url"`
+	// LDAPBindDN is the template of the dn the user binds as, the username replaces the %s
+	LDAPBindDN string `json:"ldap-bind-dn" yaml:"ldap-bind-dn"`
+	// LDAPFilter is the filter the entry of the user must match to be granted the roles, i.e. the group membership
+	LDAPFilter string `json:"ldap-filter" yaml:"ldap-filter"`
+	// LDAPRoles are the roles granted to the users authenticated by the directory
+	LDAPRoles []string `json:"ldap-roles" yaml:"ldap-roles"`
+	// LDAPTimeout is the timeout on the directory
+	LDAPTimeout time.Duration `json:"ldap-timeout" yaml:"ldap-timeout"`
 	// Scopes is a list of scope we should request
 	Scopes []string `json:"scopes" yaml:"scopes"`
+	// AuthorizationParameters are the additional query parameters of the authorization redirect, i.e. kc_idp_hint
+	AuthorizationParameters map[string]string `json:"authorization-params" yaml:"authorization-params"`
+	// AllowedAuthorizationParameters are the query parameters of /oauth/authorize passed on to the provider
+	AllowedAuthorizationParameters []string `json:"allowed-authorization-params" yaml:"allowed-authorization-params"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url"`
 	// Resources is a list of protected resources
 	Resources []*Resource `json:"resources" yaml:"resources"`
 	// Headers permits adding customs headers across the board
 	Headers map[string]string `json:"headers" yaml:"headers"`
+	// ResponseHeaders are the changes to the headers of all the upstream responses
+	ResponseHeaders ResponseHeaders `json:"response-headers" yaml:"response-headers"`
 
 	// CookieAccessName is the name of the access cookie holding the access token
 	CookieAccessName string `json:"cookie-access-name" yaml:"cookie-access-name"`
 	// CookieRefreshName is the name of the refresh cookie
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name"`
+	// LegacyCookieNames is a list of the previous cookie names, the sessions are migrated to the current names
+	LegacyCookieNames []CookieNames `json:"legacy-cookie-names" yaml:"legacy-cookie-names"`
+	// LegacyCookieGracePeriod is the duration the legacy cookies are kept alongside the current cookies once migrated
+	LegacyCookieGracePeriod time.Duration `json:"legacy-cookie-grace-period" yaml:"legacy-cookie-grace-period"`
 	// SecureCookie enforces the cookie as secure
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie"`
+	// EnableCSRF requires a csrf token (double submit cookie) on the state changing requests of the sessions
+	EnableCSRF bool `json:"enable-csrf" yaml:"enable-csrf"`
+	// CSRFCookieName is the name of the cookie holding the csrf token
+	CSRFCookieName string `json:"csrf-cookie-name" yaml:"csrf-cookie-name"`
+	// CSRFHeader is the header the csrf token is submitted in
+	CSRFHeader string `json:"csrf-header" yaml:"csrf-header"`
 
 	// IdleDuration is the max amount of time a session can last without being used
 	IdleDuration time.Duration `json:"idle-duration" yaml:"idle-duration"`
+	// RefreshAhead is the time before expiry the access tokens of the active sessions are refreshed in the background
+	RefreshAhead time.Duration `json:"refresh-ahead" yaml:"refresh-ahead"`
+	// EnableOfflineTokens requests an offline refresh token for all the sessions, surviving the sso session expiry
+	EnableOfflineTokens bool `json:"enable-offline-tokens" yaml:"enable-offline-tokens"`
+	// OfflineSessionDuration is the lifetime of the session cookies holding an offline token
+	OfflineSessionDuration time.Duration `json:"offline-session-duration" yaml:"offline-session-duration"`
+	// EnableRememberMe permits the users to ask to be remembered, requesting an offline refresh token
+	EnableRememberMe bool `json:"enable-remember-me" yaml:"enable-remember-me"`
+	// RememberMeDuration is the lifetime of the session cookies of the remembered sessions
+	RememberMeDuration time.Duration `json:"remember-me-duration" yaml:"remember-me-duration"`
 	// MatchClaims is a series of checks, the claims in the token must match those here
 	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims"`
 	// AddClaims is a series of claims that should be added to the auth headers
 	AddClaims []string `json:"add-claims" yaml:"add-claims"`
+	// RoleRewrites are the rules renaming the roles extracted from the token, the first matching rule is applied
+	RoleRewrites []RoleRewrite `json:"role-rewrites" yaml:"role-rewrites"`
+	// LowercaseRoles lowercases the roles extracted from the token, after the role rewrites
+	LowercaseRoles bool `json:"lowercase-roles" yaml:"lowercase-roles"`
+	// OpenPolicyAgentURL is the data api of the open policy agent deciding the access to the resources, i.e.
+	// http://127.0.0.1:8181/v1/data/httpapi/authz
+	OpenPolicyAgentURL string `json:"opa-url" yaml:"opa-url"`
+	// OpenPolicyAgentTimeout is the timeout of the requests to the open policy agent
+	OpenPolicyAgentTimeout time.Duration `json:"opa-timeout" yaml:"opa-timeout"`
+	// AuthorizerTimeout is the timeout of the requests to the external authorizers of the resources
+	AuthorizerTimeout time.Duration `json:"authorizer-timeout" yaml:"authorizer-timeout"`
+	// UMACacheTTL is the duration the decisions of the keycloak authorization services are cached
+	UMACacheTTL time.Duration `json:"uma-cache-ttl" yaml:"uma-cache-ttl"`
+	// EnableResourceSync pulls the protected resources from the authorization services of the client in keycloak
+	EnableResourceSync bool `json:"enable-resource-sync" yaml:"enable-resource-sync"`
+	// ResourceSyncInterval is the interval the resources are pulled from keycloak
+	ResourceSyncInterval time.Duration `json:"resource-sync-interval" yaml:"resource-sync-interval"`
+	// ACRLevels are the authentication context classes, lowest first, ranking the acr against the minimum-acr of
+	// the resources; without the levels they are compared as numbers
+	ACRLevels []string `json:"acr-levels" yaml:"acr-levels"`
+	// ClaimsHeader forwards all the claims in a single header, json or base64 (the base64 encoded json)
+	ClaimsHeader string `json:"claims-header" yaml:"claims-header"`
+	// IdentityHeaderPrefix is the prefix of the identity headers forwarded to the upstream
+	IdentityHeaderPrefix string `json:"identity-header-prefix" yaml:"identity-header-prefix"`
+	// IdentityHeaders renames the identity headers, keyed on userid, subject, username, email, expiresin, roles,
+	// token, claims or the custom claim
+	IdentityHeaders map[string]string `json:"identity-headers" yaml:"identity-headers"`
+	// OmitAuthorizationHeader removes the authorization header holding the raw token from the upstream request
+	OmitAuthorizationHeader bool `json:"omit-authorization-header" yaml:"omit-authorization-header"`
+	// OmitIdentityHeaders are the identity headers removed from the upstream request, i.e. X-Auth-Token
+	OmitIdentityHeaders []string `json:"omit-identity-headers" yaml:"omit-identity-headers"`
+	// EnableServiceToken injects the access token of the service account of the client into the upstream requests
+	EnableServiceToken bool `json:"enable-service-token" yaml:"enable-service-token"`
+	// ServiceTokenHeader is the header holding the service account token, the authorization header replaces the user token
+	ServiceTokenHeader string `json:"service-token-header" yaml:"service-token-header"`
+	// TokenExchangeAudience is the client the access token is exchanged for before forwarding to the upstream
+	TokenExchangeAudience string `json:"token-exchange-audience" yaml:"token-exchange-audience"`
+	// UpstreamPreset renames the identity headers as expected by a self-hosted application i.e. grafana or kibana
+	UpstreamPreset string `json:"upstream-preset" yaml:"upstream-preset"`
+	// UpstreamRoleMappings maps the roles to the roles of the application, in order of precedence
+	UpstreamRoleMappings []RoleMapping `json:"upstream-role-mappings" yaml:"upstream-role-mappings"`
 
 	// TLSCertificate is the location for a tls certificate
 	TLSCertificate string `json:"tls-cert" yaml:"tls-cert"`
@@ -139,32 +513,158 @@ type Config struct {
 	TLSPrivateKey string `json:"tls-private-key" yaml:"tls-private-key"`
 	// TLSCaCertificate is the CA certificate which the client cert must be signed
 	TLSCaCertificate string `json:"tls-ca-certificate" yaml:"tls-ca-certificate"`
+	// TLSCertificates is a list of additional certificates, selected on the server name (SNI) of the client
+	TLSCertificates []CertificatePair `json:"tls-certificates" yaml:"tls-certificates"`
+	// EnableAcme obtains and renews the certificates for the hostnames via acme (i.e. letsencrypt)
+	EnableAcme bool `json:"enable-acme" yaml:"enable-acme"`
+	// AcmeCacheDir is the directory holding the acme certificates, when no store is configured
+	AcmeCacheDir string `json:"acme-cache-dir" yaml:"acme-cache-dir"`
+	// AcmeEmail is the contact email for the acme account
+	AcmeEmail string `json:"acme-email" yaml:"acme-email"`
+	// TLSMinVersion is the minimum tls version for the listener and clients i.e. tlsv1.2
+	TLSMinVersion string `json:"tls-min-version" yaml:"tls-min-version"`
+	// TLSCipherSuites is a list of the cipher suites permitted by the listener and clients
+	TLSCipherSuites []string `json:"tls-cipher-suites" yaml:"tls-cipher-suites"`
+	// TLSCurvePreferences is a list of the elliptic curves in order of preference
+	TLSCurvePreferences []string `json:"tls-curve-preferences" yaml:"tls-curve-preferences"`
+	// TLSClientAuth is whether a client certificate is required or optional when using mutual tls
+	TLSClientAuth string `json:"tls-client-auth" yaml:"tls-client-auth"`
+	// EnableClientCertAuth permits clients to authenticate with a verified certificate in place of a token
+	EnableClientCertAuth bool `json:"enable-client-cert-auth" yaml:"enable-client-cert-auth"`
+	// EnableCertificateBoundTokens refuses the certificate bound tokens presented without the same client certificate
+	EnableCertificateBoundTokens bool `json:"enable-certificate-bound-tokens" yaml:"enable-certificate-bound-tokens"`
+	// APIKeys is a list of the pre-shared api keys, the keys may also be held in the store
+	APIKeys []*APIKey `json:"api-keys" yaml:"api-keys"`
+	// APIKeyHeader is the header holding the api key
+	APIKeyHeader string `json:"api-key-header" yaml:"api-key-header"`
+	// APIKeyQuery is the query parameter holding the api key, if permitted
+	APIKeyQuery string `json:"api-key-query" yaml:"api-key-query"`
+	// AssertionHeader is the header holding the secondary assertion
+	AssertionHeader string `json:"assertion-header" yaml:"assertion-header"`
+	// AssertionIssuers is a list of the trusted issuers of the assertions
+	AssertionIssuers []AssertionIssuer `json:"assertion-issuers" yaml:"assertion-issuers"`
 	// SkipUpstreamTLSVerify skips the verification of any upstream tls
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify"`
+	// UpstreamRetries is the number of times a failed idempotent request is retried
+	UpstreamRetries int `json:"upstream-retries" yaml:"upstream-retries"`
+	// UpstreamCircuitThreshold is the consecutive upstream failures before the circuit is opened, zero disables
+	UpstreamCircuitThreshold int `json:"upstream-circuit-threshold" yaml:"upstream-circuit-threshold"`
+	// UpstreamCircuitTimeout is the time the circuit is open before a trial request is permitted
+	UpstreamCircuitTimeout time.Duration `json:"upstream-circuit-timeout" yaml:"upstream-circuit-timeout"`
+	// UpstreamEndpoints is a list of additional upstream endpoints, the requests are balanced across the healthy endpoints
+	UpstreamEndpoints []string `json:"upstream-endpoints" yaml:"upstream-endpoints"`
+	// UpstreamHealthCheck is the health check of the upstream endpoints, tcp or a http path i.e. /health
+	UpstreamHealthCheck string `json:"upstream-health-check" yaml:"upstream-health-check"`
+	// UpstreamHealthInterval is the interval the upstream endpoints are health checked
+	UpstreamHealthInterval time.Duration `json:"upstream-health-interval" yaml:"upstream-health-interval"`
+	// UpstreamCA is the ca bundle used to verify the upstream certificate
+	UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca"`
+	// UpstreamClientCertificate is the client certificate presented to the upstream
+	UpstreamClientCertificate string `json:"upstream-client-cert" yaml:"upstream-client-cert"`
+	// UpstreamClientPrivateKey is the private key for the upstream client certificate
+	UpstreamClientPrivateKey string `json:"upstream-client-private-key" yaml:"upstream-client-private-key"`
     // SkipClientID indicates we don't need to check the client id of the token
     SkipClientID bool `json:"skip-client-id" yaml:"skip-client-id" usage:"skip the check on the client token"`
 
+	// EnableMetrics indicates the prometheus metrics are exposed on /oauth/metrics
+	EnableMetrics bool `json:"enable-metrics" yaml:"enable-metrics"`
+
 	// CrossOrigin permits adding headers to the /oauth handlers
 	CrossOrigin CORS `json:"cors" yaml:"cors"`
 
+	// RateLimit is the default rate limit applied to all clients
+	RateLimit RateLimit `json:"rate-limit" yaml:"rate-limit"`
+	// RateLimitClaim is the claim in the token used to select the rate limit tier
+	RateLimitClaim string `json:"rate-limit-claim" yaml:"rate-limit-claim"`
+	// RateLimitTiers are the rate limits keyed on the value of the rate limit claim
+	RateLimitTiers map[string]RateLimit `json:"rate-limit-tiers" yaml:"rate-limit-tiers"`
+	// Quota is the requests permitted per subject per day or month, held in the store
+	Quota Quota `json:"quota" yaml:"quota"`
+	// BruteForce blocks the client addresses and subjects with repeated authentication failures
+	BruteForce BruteForce `json:"brute-force" yaml:"brute-force"`
+
 	// Hostname is a list of hostname's the service should response to
 	Hostnames []string `json:"hostnames" yaml:"hostnames"`
+	// CanonicalHostname is the hostname the requests for any other host are redirected (301) to
+	CanonicalHostname string `json:"canonical-hostname" yaml:"canonical-hostname"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
 	StoreURL string `json:"store-url" yaml:"store-url"`
+	// EnableReferenceTokens holds the claims in the store, forwarding only a signed reference to the upstream
+	EnableReferenceTokens bool `json:"enable-reference-tokens" yaml:"enable-reference-tokens"`
+	// EnableSignedState signs the state parameter of the authorization, refusing the tampered or replayed states
+	EnableSignedState bool `json:"enable-signed-state" yaml:"enable-signed-state"`
+	// EnableEncryptedState encrypts the signed state parameter, hiding the location from the provider logs
+	EnableEncryptedState bool `json:"enable-encrypted-state" yaml:"enable-encrypted-state"`
+	// StateDuration is the time the signed state parameter is accepted after being issued
+	StateDuration time.Duration `json:"state-duration" yaml:"state-duration"`
+	// SingleSession invalidates the previous sessions of a subject on login, the sessions are held in the store
+	SingleSession bool `json:"single-session" yaml:"single-session"`
+	// EnablePreserveRequests holds the forms posted without a session in the store, resubmitting them after login
+	EnablePreserveRequests bool `json:"enable-preserve-requests" yaml:"enable-preserve-requests"`
+	// PreserveRequestLimit is the largest form body in bytes which is preserved
+	PreserveRequestLimit int64 `json:"preserve-request-limit" yaml:"preserve-request-limit"`
 	// EncryptionKey is the encryption key used to encrypt the refresh token
 	EncryptionKey string `json:"encryption-key" yaml:"encryption-key"`
+	// EncryptionKeyFile is a file holding the encryption key, i.e. a mounted secret
+	EncryptionKeyFile string `json:"encryption-key-file" yaml:"encryption-key-file"`
+	// SSODomains is a list of sibling domains permitted to obtain a session from the broker
+	SSODomains []string `json:"sso-domains" yaml:"sso-domains"`
+	// SSOBrokerURL is the url of the proxy on the primary domain brokering the sessions
+	SSOBrokerURL string `json:"sso-broker-url" yaml:"sso-broker-url"`
+	// AllowedRedirects are the hosts, with an optional path prefix, permitted as the redirect after login or logout
+	AllowedRedirects []string `json:"allowed-redirects" yaml:"allowed-redirects"`
 
 	// EnableSecurityFilter enabled the security handler
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter"`
+	// SecurityHeaders are the headers added by the security filter
+	SecurityHeaders SecurityHeaders `json:"security-headers" yaml:"security-headers"`
+	// EnableHTTP2 enables http2 on the tls listener and to the upstream (h2c for http), required for grpc
+	EnableHTTP2 bool `json:"enable-http2" yaml:"enable-http2"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens"`
 	// LogRequests indicates if we should log all the requests
 	LogRequests bool `json:"log-requests" yaml:"log-requests"`
 	// LogFormat is the logging format
 	LogJSONFormat bool `json:"log-json-format" yaml:"log-json-format"`
+	// LogOutput is the destination for the application and access logs
+	LogOutput string `json:"log-output" yaml:"log-output"`
 	// NoRedirects informs we should hand back a 401 not a redirect
 	NoRedirects bool `json:"no-redirects" yaml:"no-redirects"`
+	// EnableAPIMode never redirects the clients on any resource, the errors are returned as json with a bearer challenge
+	EnableAPIMode bool `json:"enable-api-mode" yaml:"enable-api-mode"`
+	// EnableErrorNegotiation hands the json errors to the xhr and api clients on any resource, the browsers are redirected
+	EnableErrorNegotiation bool `json:"enable-error-negotiation" yaml:"enable-error-negotiation"`
+	// EnableSignedURLs enables the endpoint minting the signed temporary urls, which are honored without a session
+	EnableSignedURLs bool `json:"enable-signed-urls" yaml:"enable-signed-urls"`
+	// SignedURLDuration is the default and maximum lifetime of a signed url
+	SignedURLDuration time.Duration `json:"signed-url-duration" yaml:"signed-url-duration"`
+	// MaintenanceMode starts the service in maintenance, refusing the resources which are not white-listed
+	MaintenanceMode bool `json:"maintenance-mode" yaml:"maintenance-mode"`
+	// MaintenanceRoles are the roles permitted through and to toggle the maintenance via /oauth/maintenance
+	MaintenanceRoles []string `json:"maintenance-roles" yaml:"maintenance-roles"`
+	// AdminRoles are the roles permitted to the admin endpoints, i.e. the effective configuration on /oauth/config
+	AdminRoles []string `json:"admin-roles" yaml:"admin-roles"`
+	// CanaryRoutes routes the requests of the users with a matching claim to the alternate upstreams
+	CanaryRoutes []*CanaryRoute `json:"canary-routes" yaml:"canary-routes"`
+	// AuditOnly logs the denials of the admission on all the resources, the requests are permitted
+	AuditOnly bool `json:"audit-only" yaml:"audit-only"`
+	// DevMode starts an embedded openid provider in place of keycloak - for development purposes
+	DevMode bool `json:"dev-mode" yaml:"dev-mode"`
+	// DevListen is the interface the embedded provider of the development mode listens on
+	DevListen string `json:"dev-listen" yaml:"dev-listen"`
+	// DevUsers are the users of the embedded provider of the development mode
+	DevUsers []*DevUser `json:"dev-users" yaml:"dev-users"`
+	// ExtAuthzListen is the interface of the envoy external authorization (grpc) service, if any
+	ExtAuthzListen string `json:"ext-authz-listen" yaml:"ext-authz-listen"`
+	// ExtAuthzHTTPListen is the interface of the envoy external authorization service of the http mode, if any
+	ExtAuthzHTTPListen string `json:"ext-authz-http-listen" yaml:"ext-authz-http-listen"`
+	// Sidecar binds to localhost, accepts bearer tokens only and disables the login flow - for pod sidecars
+	Sidecar bool `json:"sidecar" yaml:"sidecar"`
+	// CrawlerUserAgents is a list of user agents answered with a cacheable 401 rather than a redirect
+	CrawlerUserAgents []string `json:"crawler-user-agents" yaml:"crawler-user-agents"`
+	// CrawlerCacheDuration is the max-age of the 401 handed back to the crawlers
+	CrawlerCacheDuration time.Duration `json:"crawler-cache-duration" yaml:"crawler-cache-duration"`
 	// SkipTokenVerification tells the service to skipp verifying the access token - for testing purposes
 	SkipTokenVerification bool `json:"skip-token-verification" yaml:"skip-token-verification"`
 	// UpstreamKeepalives specifies whether we use keepalives on the upstream
@@ -173,15 +673,51 @@ type Config struct {
 	UpstreamTimeout time.Duration `json:"upstream-timeout" yaml:"upstream-timeout"`
 	// UpstreamKeepaliveTimeout
 	UpstreamKeepaliveTimeout time.Duration `json:"upstream-keepalive-timeout" yaml:"upstream-keepalive-timeout"`
+	// UpstreamResponseHeaderTimeout is the time to wait for the response headers of the upstream, zero is no limit
+	UpstreamResponseHeaderTimeout time.Duration `json:"upstream-response-header-timeout" yaml:"upstream-response-header-timeout"`
+	// UpstreamTLSHandshakeTimeout is the time to wait for the tls handshake with the upstream
+	UpstreamTLSHandshakeTimeout time.Duration `json:"upstream-tls-handshake-timeout" yaml:"upstream-tls-handshake-timeout"`
+	// UpstreamMaxIdleConnections is the maximum idle (keepalive) connections per upstream host
+	UpstreamMaxIdleConnections int `json:"upstream-max-idle-connections" yaml:"upstream-max-idle-connections"`
+	// UpstreamFlushInterval is the interval the response is flushed to the client, negative flushes every write
+	UpstreamFlushInterval time.Duration `json:"upstream-flush-interval" yaml:"upstream-flush-interval"`
 	// Verbose switches on debug logging
 	Verbose bool `json:"verbose" yaml:"verbose"`
 	// EnableProxyProtocol controls the proxy protocol
 	EnableProxyProtocol bool `json:"enabled-proxy-protocol" yaml:"enabled-proxy-protocol"`
+	// TrustedProxies is a list of networks whose X-Forwarded-For and X-Real-IP headers are honoured
+	TrustedProxies []string `json:"trusted-proxies" yaml:"trusted-proxies"`
+	// EnableGracefulReload hands the listener to a new process of the binary on a SIGUSR2
+	EnableGracefulReload bool `json:"enable-graceful-reload" yaml:"enable-graceful-reload"`
+	// ReloadDrainTimeout is the time permitted for the connections to drain after a reload
+	ReloadDrainTimeout time.Duration `json:"reload-drain-timeout" yaml:"reload-drain-timeout"`
+	// EnableSecretReload gracefully reloads the service when the secret files change
+	EnableSecretReload bool `json:"enable-secret-reload" yaml:"enable-secret-reload"`
+	// SecretReloadInterval is the interval the secret files are checked for changes
+	SecretReloadInterval time.Duration `json:"secret-reload-interval" yaml:"secret-reload-interval"`
+	// EnableConfigReload gracefully reloads the service when the configuration file changes, i.e. a mounted configmap
+	EnableConfigReload bool `json:"enable-config-reload" yaml:"enable-config-reload"`
+	// ConfigReloadInterval is the interval the configuration file is checked for changes
+	ConfigReloadInterval time.Duration `json:"config-reload-interval" yaml:"config-reload-interval"`
 
 	// SignInPage is the relative url for the sign in page
 	SignInPage string `json:"sign-in-page" yaml:"sign-in-page"`
 	// ForbiddenPage is a access forbidden page
 	ForbiddenPage string `json:"forbidden-page" yaml:"forbidden-page"`
+	// UnavailablePage is the page shown when the circuit for the upstream is open
+	UnavailablePage string `json:"unavailable-page" yaml:"unavailable-page"`
+	// SessionEndedPage is the page shown when a session was ended by a newer login
+	SessionEndedPage string `json:"session-ended-page" yaml:"session-ended-page"`
+	// BlockedPage is the page shown to the clients blocked by the brute force protection
+	BlockedPage string `json:"blocked-page" yaml:"blocked-page"`
+	// MaintenancePage is the page shown while the service is in maintenance
+	MaintenancePage string `json:"maintenance-page" yaml:"maintenance-page"`
+	// EnableTemplateReload indicates the custom templates are reloaded when the files change
+	EnableTemplateReload bool `json:"enable-template-reload" yaml:"enable-template-reload"`
+	// TemplateReloadInterval is the interval the custom templates are checked for changes
+	TemplateReloadInterval time.Duration `json:"template-reload-interval" yaml:"template-reload-interval"`
+	// Features enables or disables the experimental subsystems, i.e. uma
+	Features map[string]bool `json:"features" yaml:"features"`
 	// TagData is passed to the templates
 	TagData map[string]string `json:"tag-data" yaml:"tag-data"`
 
@@ -191,19 +727,46 @@ type Config struct {
 	ForwardingUsername string `json:"forwarding-username" yaml:"forwarding-username"`
 	// ForwardingPassword is the password to use for the above
 	ForwardingPassword string `json:"forwarding-password" yaml:"forwarding-password"`
+	// ForwardingPasswordFile is a file holding the forwarding password, i.e. a mounted secret
+	ForwardingPasswordFile string `json:"forwarding-password-file" yaml:"forwarding-password-file"`
+
+	// VaultURL is the address of vault holding the credentials of the service
+	VaultURL string `json:"vault-url" yaml:"vault-url"`
+	// VaultToken is the token used to authenticate to vault
+	VaultToken string `json:"vault-token" yaml:"vault-token"`
+	// VaultTokenFile is a file holding the vault token
+	VaultTokenFile string `json:"vault-token-file" yaml:"vault-token-file"`
+	// VaultClientSecret is the field of the secret in vault holding the client secret, path#field
+	VaultClientSecret string `json:"vault-client-secret" yaml:"vault-client-secret"`
+	// VaultEncryptionKey is the field of the secret in vault holding the encryption key, path#field
+	VaultEncryptionKey string `json:"vault-encryption-key" yaml:"vault-encryption-key"`
+	// VaultTLS is the path of the secret in vault holding the certificate and private_key of the listener
+	VaultTLS string `json:"vault-tls" yaml:"vault-tls"`
 	// ForwardingDomains is a collection of domains to signs
 	ForwardingDomains []string `json:"forwarding-domains" yaml:"forwarding-domains"`
 }
 
+// authenticator verifies the credentials of a user without the provider, i.e. the break glass access
+type authenticator interface {
+	// Name is the name of the authenticator
+	Name() string
+	// Authenticate verifies the username and password, returning the identity
+	Authenticate(string, string) (*userContext, error)
+}
+
 // store is used to hold the offline refresh token, assuming you don't want to use
 // the default practice of a encrypted cookie
 type storage interface {
 	// Add the token to the store
 	Set(string, string) error
+	// SetWithExpiry adds the key to the store, removed once the duration has passed
+	SetWithExpiry(string, string, time.Duration) error
 	// Get retrieves a token from the store
 	Get(string) (string, error)
 	// Delete removes a key from the store
 	Delete(string) error
+	// Increment increments a counter, returning the count and the time left before it expires
+	Increment(string, time.Duration) (int64, time.Duration, error)
 	// Close is used to close off any resources
 	Close() error
 }
@@ -217,3 +780,12 @@ type tokenResponse struct {
 	ExpiresIn    int    `json:"expires_in"`
 	Scope        string `json:"scope,omitempty"`
 }
+
+// loginRequestLimit is the maximum size of the json body of a login request
+const loginRequestLimit = 4096
+
+// loginRequest is the json body of a login request
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gambol99/go-oidc/oauth2"
+)
+
+const (
+	// tokenExchangeGrantType is the grant type of the token exchange (RFC 8693)
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// accessTokenType is the token type of an access token in the token exchange
+	accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	// tokenCacheSize is the number of cached tokens before the expired are pruned
+	tokenCacheSize = 10000
+)
+
+//
+// cachedToken is an access token obtained on behalf of the user
+//
+type cachedToken struct {
+	// the access token
+	token string
+	// the expiration of the access token
+	expires time.Time
+}
+
+//
+// tokenCache caches the access tokens obtained on behalf of the users, keyed on a hash of the user token or
+// credentials
+//
+type tokenCache struct {
+	sync.Mutex
+	// the cached tokens
+	tokens map[string]*cachedToken
+}
+
+//
+// newTokenCache creates the cache of tokens
+//
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*cachedToken, 0)}
+}
+
+//
+// get returns the token if cached and not close to expiry
+//
+func (r *tokenCache) get(key string, now time.Time) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	token, found := r.tokens[key]
+	if !found || !now.Add(serviceTokenMargin).Before(token.expires) {
+		return "", false
+	}
+
+	return token.token, true
+}
+
+//
+// set caches the token, pruning the expired tokens once the cache is full
+//
+func (r *tokenCache) set(key, token string, expires, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.tokens) >= tokenCacheSize {
+		for k, x := range r.tokens {
+			if now.After(x.expires) {
+				delete(r.tokens, k)
+			}
+		}
+	}
+	if len(r.tokens) >= tokenCacheSize {
+		r.tokens = make(map[string]*cachedToken, 0)
+	}
+	r.tokens[key] = &cachedToken{token: token, expires: expires}
+}
+
+//
+// exchangeToken exchanges the access token of the user at the provider for a token issued to the audience of
+// the upstream, the tokens are cached until close to expiry
+//
+func (r *oauthProxy) exchangeToken(token jose.JWT, now time.Time) (string, error) {
+	key := getHashKey(&token)
+	if exchanged, found := r.exchanged.get(key, now); found {
+		return exchanged, nil
+	}
+	if r.provider.TokenEndpoint == nil {
+		return "", fmt.Errorf("the provider does not have a token endpoint")
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", tokenExchangeGrantType)
+	values.Set("client_id", r.config.ClientID)
+	values.Set("subject_token", token.Encode())
+	values.Set("subject_token_type", accessTokenType)
+	values.Set("requested_token_type", accessTokenType)
+	values.Set("audience", r.config.TokenExchangeAudience)
+
+	content, code, err := r.postToProvider(r.provider.TokenEndpoint.String(), values)
+	if err != nil {
+		return "", err
+	}
+	if code != http.StatusOK {
+		e := new(oauth2.Error)
+		if err := json.Unmarshal(content, e); err != nil || e.Type == "" {
+			return "", fmt.Errorf("the token endpoint returned status: %d, response: %s", code, content)
+		}
+		return "", e
+	}
+	response := new(tokenResponse)
+	if err := json.Unmarshal(content, response); err != nil {
+		return "", fmt.Errorf("invalid response from the token endpoint, error: %s", err)
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("the token endpoint did not return an access token")
+	}
+	r.exchanged.set(key, response.AccessToken, getServiceTokenExpiry(response.AccessToken, response.ExpiresIn, now), now)
+
+	return response.AccessToken, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCache(t *testing.T) {
+	cache := newTokenCache()
+	now := time.Now()
+	cache.set("a", "token-a", now.Add(time.Hour), now)
+	cache.set("b", "token-b", now.Add(serviceTokenMargin/2), now)
+
+	token, found := cache.get("a", now)
+	assert.True(t, found)
+	assert.Equal(t, "token-a", token)
+	_, found = cache.get("b", now)
+	assert.False(t, found, "the token close to expiry should not be returned")
+	_, found = cache.get("c", now)
+	assert.False(t, found)
+}
+
+func TestExchangeToken(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.TokenExchangeAudience = "upstream"
+	proxy, _, _ := newTestProxyService(t, config)
+	user := newFakeJWTToken(t, jose.Claims{"aud": "test", "sub": "test-subject"})
+	now := time.Now()
+
+	token, err := proxy.exchangeToken(*user, now)
+	if !assert.NoError(t, err) {
+		return
+	}
+	exchanged, err := jose.ParseJWT(token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	claims, err := exchanged.Claims()
+	assert.NoError(t, err)
+	assert.Equal(t, "upstream", claims["aud"])
+
+	// step: the exchanged token is reused until close to the expiry
+	proxy.exchanged.set(getHashKey(user), "cached", now.Add(time.Hour), now)
+	token, err = proxy.exchangeToken(*user, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", token)
+}
+
+func TestUpstreamHeadersTokenExchange(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.TokenExchangeAudience = "upstream"
+	proxy.exchanged = newTokenCache()
+	user := &userContext{id: "test-subject", name: "test", token: *newFakeBearerToken(t)}
+	proxy.exchanged.set(getHashKey(&user.token), "exchanged", time.Now().Add(time.Hour), time.Now())
+
+	cx := newFakeGinContext("GET", "/admin")
+	cx.Set(userContextName, user)
+	proxy.upstreamHeadersHandler([]string{})(cx)
+	assert.Equal(t, "Bearer exchanged", cx.Request.Header.Get(authorizationHeader))
+	assert.Equal(t, "exchanged", cx.Request.Header.Get("X-Auth-Token"))
+}
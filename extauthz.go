@@ -0,0 +1,558 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// extAuthzCheckPath is the grpc method of the envoy external authorization service
+	extAuthzCheckPath = "/envoy.service.auth.v3.Authorization/Check"
+	// extAuthzCheckPathV2 is the grpc method of the v2 api, the messages we use are unchanged
+	extAuthzCheckPathV2 = "/envoy.service.auth.v2.Authorization/Check"
+	// extAuthzAllowedHeader marks the response of a request permitted by the admission
+	extAuthzAllowedHeader = "X-Ext-Authz-Allowed"
+	// extAuthzMaxMessageSize is the maximum size of a check request
+	extAuthzMaxMessageSize = 4 << 20
+)
+
+// the grpc status codes handed back to envoy
+const (
+	grpcStatusOK               = 0
+	grpcStatusInvalidArgument  = 3
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnimplemented    = 12
+	grpcStatusUnauthenticated  = 16
+)
+
+//
+// the messages of the envoy external authorization api (envoy.service.auth.v3), only the fields we use are
+// declared, the others are skipped when decoding
+//
+
+// checkRequest is the envoy CheckRequest
+type checkRequest struct {
+	Attributes *attributeContext `protobuf:"bytes,1,opt,name=attributes,proto3"`
+}
+
+// attributeContext is the envoy AttributeContext
+type attributeContext struct {
+	Source  *attributeContextPeer    `protobuf:"bytes,1,opt,name=source,proto3"`
+	Request *attributeContextRequest `protobuf:"bytes,4,opt,name=request,proto3"`
+}
+
+// attributeContextPeer is the envoy AttributeContext.Peer
+type attributeContextPeer struct {
+	Address *peerAddress `protobuf:"bytes,1,opt,name=address,proto3"`
+}
+
+// peerAddress is the envoy config.core.v3.Address
+type peerAddress struct {
+	SocketAddress *socketAddress `protobuf:"bytes,1,opt,name=socket_address,proto3"`
+}
+
+// socketAddress is the envoy config.core.v3.SocketAddress
+type socketAddress struct {
+	Address   string `protobuf:"bytes,2,opt,name=address,proto3"`
+	PortValue uint32 `protobuf:"varint,3,opt,name=port_value,proto3"`
+}
+
+// attributeContextRequest is the envoy AttributeContext.Request
+type attributeContextRequest struct {
+	HTTP *attributeContextHTTPRequest `protobuf:"bytes,2,opt,name=http,proto3"`
+}
+
+// attributeContextHTTPRequest is the envoy AttributeContext.HttpRequest
+type attributeContextHTTPRequest struct {
+	Method    string            `protobuf:"bytes,2,opt,name=method,proto3"`
+	Headers   map[string]string `protobuf:"bytes,3,rep,name=headers,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Path      string            `protobuf:"bytes,4,opt,name=path,proto3"`
+	Host      string            `protobuf:"bytes,5,opt,name=host,proto3"`
+	Scheme    string            `protobuf:"bytes,6,opt,name=scheme,proto3"`
+	Protocol  string            `protobuf:"bytes,10,opt,name=protocol,proto3"`
+	Body      string            `protobuf:"bytes,11,opt,name=body,proto3"`
+	RawBody   []byte            `protobuf:"bytes,12,opt,name=raw_body,proto3"`
+	HeaderMap *headerMap        `protobuf:"bytes,13,opt,name=header_map,proto3"`
+}
+
+// headerMap is the envoy config.core.v3.HeaderMap, sent in place of the headers when envoy encodes the raw headers
+type headerMap struct {
+	Headers []*headerValue `protobuf:"bytes,1,rep,name=headers,proto3"`
+}
+
+// headerValue is the envoy config.core.v3.HeaderValue
+type headerValue struct {
+	Key      string `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value    string `protobuf:"bytes,2,opt,name=value,proto3"`
+	RawValue []byte `protobuf:"bytes,3,opt,name=raw_value,proto3"`
+}
+
+// headerValueOption is the envoy config.core.v3.HeaderValueOption
+type headerValueOption struct {
+	Header *headerValue `protobuf:"bytes,1,opt,name=header,proto3"`
+	Append *boolValue   `protobuf:"bytes,2,opt,name=append,proto3"`
+}
+
+// boolValue is the google.protobuf.BoolValue
+type boolValue struct {
+	Value bool `protobuf:"varint,1,opt,name=value,proto3"`
+}
+
+// checkResponse is the envoy CheckResponse, one of the denied or ok response is set
+type checkResponse struct {
+	Status         *rpcStatus          `protobuf:"bytes,1,opt,name=status,proto3"`
+	DeniedResponse *deniedHTTPResponse `protobuf:"bytes,2,opt,name=denied_response,proto3"`
+	OkResponse     *okHTTPResponse     `protobuf:"bytes,3,opt,name=ok_response,proto3"`
+}
+
+// rpcStatus is the google.rpc.Status
+type rpcStatus struct {
+	Code    int32  `protobuf:"varint,1,opt,name=code,proto3"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3"`
+}
+
+// deniedHTTPResponse is the envoy DeniedHttpResponse
+type deniedHTTPResponse struct {
+	Status  *httpStatus          `protobuf:"bytes,1,opt,name=status,proto3"`
+	Headers []*headerValueOption `protobuf:"bytes,2,rep,name=headers,proto3"`
+	Body    string               `protobuf:"bytes,3,opt,name=body,proto3"`
+}
+
+// httpStatus is the envoy type.v3.HttpStatus
+type httpStatus struct {
+	Code int32 `protobuf:"varint,1,opt,name=code,proto3"`
+}
+
+// okHTTPResponse is the envoy OkHttpResponse
+type okHTTPResponse struct {
+	Headers         []*headerValueOption `protobuf:"bytes,2,rep,name=headers,proto3"`
+	HeadersToRemove []string             `protobuf:"bytes,5,rep,name=headers_to_remove,proto3"`
+}
+
+func (m *checkRequest) Reset()                        { *m = checkRequest{} }
+func (m *checkRequest) String() string                { return proto.CompactTextString(m) }
+func (*checkRequest) ProtoMessage()                   {}
+func (m *attributeContext) Reset()                    { *m = attributeContext{} }
+func (m *attributeContext) String() string            { return proto.CompactTextString(m) }
+func (*attributeContext) ProtoMessage()               {}
+func (m *attributeContextPeer) Reset()                { *m = attributeContextPeer{} }
+func (m *attributeContextPeer) String() string        { return proto.CompactTextString(m) }
+func (*attributeContextPeer) ProtoMessage()           {}
+func (m *peerAddress) Reset()                         { *m = peerAddress{} }
+func (m *peerAddress) String() string                 { return proto.CompactTextString(m) }
+func (*peerAddress) ProtoMessage()                    {}
+func (m *socketAddress) Reset()                       { *m = socketAddress{} }
+func (m *socketAddress) String() string               { return proto.CompactTextString(m) }
+func (*socketAddress) ProtoMessage()                  {}
+func (m *attributeContextRequest) Reset()             { *m = attributeContextRequest{} }
+func (m *attributeContextRequest) String() string     { return proto.CompactTextString(m) }
+func (*attributeContextRequest) ProtoMessage()        {}
+func (m *attributeContextHTTPRequest) Reset()         { *m = attributeContextHTTPRequest{} }
+func (m *attributeContextHTTPRequest) String() string { return proto.CompactTextString(m) }
+func (*attributeContextHTTPRequest) ProtoMessage()    {}
+func (m *headerMap) Reset()                           { *m = headerMap{} }
+func (m *headerMap) String() string                   { return proto.CompactTextString(m) }
+func (*headerMap) ProtoMessage()                      {}
+func (m *headerValue) Reset()                         { *m = headerValue{} }
+func (m *headerValue) String() string                 { return proto.CompactTextString(m) }
+func (*headerValue) ProtoMessage()                    {}
+func (m *headerValueOption) Reset()                   { *m = headerValueOption{} }
+func (m *headerValueOption) String() string           { return proto.CompactTextString(m) }
+func (*headerValueOption) ProtoMessage()              {}
+func (m *boolValue) Reset()                           { *m = boolValue{} }
+func (m *boolValue) String() string                   { return proto.CompactTextString(m) }
+func (*boolValue) ProtoMessage()                      {}
+func (m *checkResponse) Reset()                       { *m = checkResponse{} }
+func (m *checkResponse) String() string               { return proto.CompactTextString(m) }
+func (*checkResponse) ProtoMessage()                  {}
+func (m *rpcStatus) Reset()                           { *m = rpcStatus{} }
+func (m *rpcStatus) String() string                   { return proto.CompactTextString(m) }
+func (*rpcStatus) ProtoMessage()                      {}
+func (m *deniedHTTPResponse) Reset()                  { *m = deniedHTTPResponse{} }
+func (m *deniedHTTPResponse) String() string          { return proto.CompactTextString(m) }
+func (*deniedHTTPResponse) ProtoMessage()             {}
+func (m *httpStatus) Reset()                          { *m = httpStatus{} }
+func (m *httpStatus) String() string                  { return proto.CompactTextString(m) }
+func (*httpStatus) ProtoMessage()                     {}
+func (m *okHTTPResponse) Reset()                      { *m = okHTTPResponse{} }
+func (m *okHTTPResponse) String() string              { return proto.CompactTextString(m) }
+func (*okHTTPResponse) ProtoMessage()                 {}
+
+//
+// createExtAuthzService starts the envoy external authorization grpc service (cleartext http2), on the socket
+// activated by systemd if any
+//
+func (r *oauthProxy) createExtAuthzService(listener net.Listener) error {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", r.config.ExtAuthzListen); err != nil {
+			return err
+		}
+	}
+	log.Infof("envoy external authorization grpc service starting on %s", listener.Addr())
+
+	go r.serveExtAuthz(listener)
+
+	return nil
+}
+
+//
+// createExtAuthzHTTPService starts the envoy external authorization service of the http mode, on the socket
+// activated by systemd if any
+//
+func (r *oauthProxy) createExtAuthzHTTPService(listener net.Listener) error {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", r.config.ExtAuthzHTTPListen); err != nil {
+			return err
+		}
+	}
+	server := &http.Server{
+		Addr:    r.config.ExtAuthzHTTPListen,
+		Handler: r.extAuthz,
+	}
+
+	go func() {
+		log.Infof("envoy external authorization http service starting on %s", listener.Addr())
+
+		if err := server.Serve(listener); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("the external authorization http service has stopped")
+		}
+	}()
+
+	return nil
+}
+
+//
+// serveExtAuthz accepts the connections of envoy, speaking grpc with prior knowledge of http2
+//
+func (r *oauthProxy) serveExtAuthz(listener net.Listener) {
+	server := &http2.Server{}
+	handler := http.HandlerFunc(r.extAuthzGRPCHandler)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				time.Sleep(time.Duration(100) * time.Millisecond)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("the external authorization service has stopped accepting connections")
+
+			return
+		}
+		go server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+	}
+}
+
+//
+// extAuthzGRPCHandler answers the grpc check requests of envoy
+//
+func (r *oauthProxy) extAuthzGRPCHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method != "POST" || (req.URL.Path != extAuthzCheckPath && req.URL.Path != extAuthzCheckPathV2) {
+		setGRPCStatus(w, grpcStatusUnimplemented, "unknown method: "+req.URL.Path)
+		return
+	}
+	message, err := readGRPCMessage(req.Body)
+	if err != nil {
+		setGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+	check := &checkRequest{}
+	if err := proto.Unmarshal(message, check); err != nil {
+		setGRPCStatus(w, grpcStatusInvalidArgument, "invalid check request: "+err.Error())
+		return
+	}
+	resp, err := r.checkExtAuthz(check)
+	if err != nil {
+		setGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+	encoded, err := proto.Marshal(resp)
+	if err != nil {
+		setGRPCStatus(w, grpcStatusInvalidArgument, err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"allowed": resp.OkResponse != nil,
+		"method":  check.Attributes.Request.HTTP.Method,
+		"path":    check.Attributes.Request.HTTP.Path,
+	}).Debugf("answered the external authorization check")
+
+	w.Write(encodeGRPCMessage(encoded))
+	setGRPCStatus(w, grpcStatusOK, "")
+}
+
+//
+// checkExtAuthz runs the request of the check through the admission of the proxy, the request is permitted along
+// with the identity headers, else the response of the denial is handed back to envoy
+//
+func (r *oauthProxy) checkExtAuthz(check *checkRequest) (*checkResponse, error) {
+	req, err := newExtAuthzRequest(check)
+	if err != nil {
+		return nil, err
+	}
+	original := make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		original[name] = values
+	}
+
+	recorder := httptest.NewRecorder()
+	r.extAuthz.ServeHTTP(recorder, req)
+
+	if recorder.Header().Get(extAuthzAllowedHeader) == "" {
+		code := grpcStatusPermissionDenied
+		if recorder.Code == http.StatusUnauthorized {
+			code = grpcStatusUnauthenticated
+		}
+
+		return &checkResponse{
+			Status: &rpcStatus{Code: int32(code), Message: http.StatusText(recorder.Code)},
+			DeniedResponse: &deniedHTTPResponse{
+				Status:  &httpStatus{Code: int32(recorder.Code)},
+				Headers: newHeaderValueOptions(recorder.Header()),
+				Body:    recorder.Body.String(),
+			},
+		}, nil
+	}
+
+	// step: the headers added or changed by the admission are handed to envoy, as are those removed
+	changed := make(http.Header)
+	for name, values := range req.Header {
+		if strings.Join(values, "\x00") != strings.Join(original[name], "\x00") {
+			changed[name] = values
+		}
+	}
+	ok := &okHTTPResponse{Headers: newHeaderValueOptions(changed)}
+	for name := range original {
+		if _, found := req.Header[name]; !found {
+			ok.HeadersToRemove = append(ok.HeadersToRemove, strings.ToLower(name))
+		}
+	}
+	sort.Strings(ok.HeadersToRemove)
+
+	return &checkResponse{Status: &rpcStatus{Code: grpcStatusOK}, OkResponse: ok}, nil
+}
+
+//
+// extAuthzHandler is the first handler of the admission of the external authorization, in the http mode the
+// request forwarded by envoy carries the method, path and headers of the client request. A denial is the response
+// handed to the client, else the 200 carries the headers added or changed by the admission, which envoy adds to
+// the upstream request
+//
+func (r *oauthProxy) extAuthzHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		original := make(http.Header, len(cx.Request.Header))
+		for name, values := range cx.Request.Header {
+			original[name] = values
+		}
+
+		cx.Next()
+
+		if cx.IsAborted() || cx.Writer.Written() {
+			return
+		}
+		for name, values := range cx.Request.Header {
+			if strings.Join(values, "\x00") != strings.Join(original[name], "\x00") {
+				cx.Writer.Header()[name] = values
+			}
+		}
+		// step: the headers removed by the admission (i.e. the spoofed identity headers) are blanked, as envoy
+		// overwrites the upstream headers with those of the response
+		for name := range original {
+			if _, found := cx.Request.Header[name]; !found {
+				cx.Writer.Header()[name] = []string{""}
+			}
+		}
+		cx.Writer.Header().Set(extAuthzAllowedHeader, "true")
+		cx.Status(http.StatusOK)
+	}
+}
+
+//
+// newExtAuthzRequest creates the http request of the check, run through the admission
+//
+func newExtAuthzRequest(check *checkRequest) (*http.Request, error) {
+	if check.Attributes == nil || check.Attributes.Request == nil || check.Attributes.Request.HTTP == nil {
+		return nil, errors.New("the check request has no http request")
+	}
+	request := check.Attributes.Request.HTTP
+	if request.Method == "" || request.Path == "" {
+		return nil, errors.New("the check request has no http method or path")
+	}
+
+	// step: the http2 pseudo headers are dropped, the authority is the host if none is given
+	headers := make(http.Header)
+	var authority string
+	addHeader := func(name, value string) {
+		if name == ":authority" {
+			authority = value
+		}
+		if !strings.HasPrefix(name, ":") {
+			headers.Add(name, value)
+		}
+	}
+	for name, value := range request.Headers {
+		addHeader(name, value)
+	}
+	if request.HeaderMap != nil {
+		for _, x := range request.HeaderMap.Headers {
+			value := x.Value
+			if value == "" {
+				value = string(x.RawValue)
+			}
+			addHeader(x.Key, value)
+		}
+	}
+	host := request.Host
+	if host == "" {
+		host = authority
+	}
+
+	location, err := url.ParseRequestURI(request.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request path: %s", request.Path)
+	}
+	location.Scheme = request.Scheme
+	if location.Scheme == "" {
+		location.Scheme = "http"
+	}
+	location.Host = host
+
+	body := request.RawBody
+	if len(body) <= 0 {
+		body = []byte(request.Body)
+	}
+	req := &http.Request{
+		Method:        request.Method,
+		URL:           location,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        headers,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Host:          host,
+		RequestURI:    request.Path,
+	}
+	if major, minor, ok := http.ParseHTTPVersion(request.Protocol); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = request.Protocol, major, minor
+	}
+	if source := check.Attributes.Source; source != nil && source.Address != nil && source.Address.SocketAddress != nil {
+		address := source.Address.SocketAddress
+		if address.Address != "" {
+			req.RemoteAddr = net.JoinHostPort(address.Address, strconv.FormatUint(uint64(address.PortValue), 10))
+		}
+	}
+
+	return req, nil
+}
+
+//
+// newHeaderValueOptions creates the header options of the headers, the values after the first are appended
+//
+func newHeaderValueOptions(headers http.Header) []*headerValueOption {
+	var names []string
+	for name := range headers {
+		if name != extAuthzAllowedHeader {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var options []*headerValueOption
+	for _, name := range names {
+		for i, value := range headers[name] {
+			option := &headerValueOption{Header: &headerValue{Key: strings.ToLower(name), Value: value}}
+			if i > 0 {
+				option.Append = &boolValue{Value: true}
+			}
+			options = append(options, option)
+		}
+	}
+
+	return options
+}
+
+//
+// readGRPCMessage reads a length prefixed grpc message, compression is not supported
+//
+func readGRPCMessage(reader io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, fmt.Errorf("unable to read the grpc message: %s", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed grpc messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > extAuthzMaxMessageSize {
+		return nil, fmt.Errorf("the grpc message of %d bytes exceeds the maximum size", size)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, fmt.Errorf("unable to read the grpc message: %s", err)
+	}
+
+	return message, nil
+}
+
+//
+// encodeGRPCMessage prefixes the message with the uncompressed flag and the length
+//
+func encodeGRPCMessage(message []byte) []byte {
+	encoded := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(encoded[1:], uint32(len(message)))
+
+	return append(encoded, message...)
+}
+
+//
+// setGRPCStatus sets the grpc status trailers of the response
+//
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func newFakeCheckRequest(method, path string, headers map[string]string) *checkRequest {
+	return &checkRequest{
+		Attributes: &attributeContext{
+			Source: &attributeContextPeer{
+				Address: &peerAddress{SocketAddress: &socketAddress{Address: "10.0.0.1", PortValue: 43210}},
+			},
+			Request: &attributeContextRequest{
+				HTTP: &attributeContextHTTPRequest{
+					Method:   method,
+					Headers:  headers,
+					Path:     path,
+					Host:     "app.example.com",
+					Scheme:   "https",
+					Protocol: "HTTP/1.1",
+				},
+			},
+		},
+	}
+}
+
+func newFakeExtAuthzProxy(t *testing.T) *oauthProxy {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.ExtAuthzListen = "127.0.0.1:0"
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	return proxy
+}
+
+func newFakeExtAuthzToken(t *testing.T) string {
+	return newFakeJWTToken(t, jose.Claims{
+		"aud":                "test",
+		"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"preferred_username": "rjayawardene",
+		"email":              "gambol99@gmail.com",
+		"exp":                time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		"realm_access": map[string]interface{}{
+			"roles": []string{fakeAdminRole},
+		},
+	}).Encode()
+}
+
+func TestExtAuthzHandler(t *testing.T) {
+	proxy := newFakeExtAuthzProxy(t)
+	token := newFakeExtAuthzToken(t)
+	check := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:43210"
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.extAuthz.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	// step: no token is a 401 handed back to the client
+	resp := check(fakeAuthAllURL+"/test", map[string]string{"X-Auth-Username": "spoofed"})
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Empty(t, resp.Header().Get("X-Auth-Username"))
+
+	// step: the identity headers are added and the spoofed ones blanked
+	resp = check(fakeAdminRoleURL, map[string]string{
+		"Authorization":   "Bearer " + token,
+		"X-Auth-Username": "spoofed",
+		"X-Auth-Spoofed":  "spoofed",
+	})
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "rjayawardene", resp.Header().Get("X-Auth-Username"))
+	assert.Equal(t, "gambol99@gmail.com", resp.Header().Get("X-Auth-Email"))
+	assert.Empty(t, resp.Header().Get("X-Auth-Spoofed"))
+	assert.Empty(t, resp.Header().Get("Authorization"))
+
+	// step: the roles are enforced
+	resp = check(fakeTestRoleURL, map[string]string{"Authorization": "Bearer " + token})
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	// step: the white listed resources are permitted
+	resp = check(fakeTestWhitelistedURL, nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestNewExtAuthzRequest(t *testing.T) {
+	encoded, err := proto.Marshal(newFakeCheckRequest("GET", "/auth_all/test?a=b", map[string]string{
+		":authority":    "app.example.com",
+		":path":         "/auth_all/test?a=b",
+		"authorization": "Bearer token",
+		"cookie":        "kc-access=token",
+	}))
+	require.NoError(t, err)
+	check := &checkRequest{}
+	require.NoError(t, proto.Unmarshal(encoded, check))
+
+	req, err := newExtAuthzRequest(check)
+	require.NoError(t, err)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "/auth_all/test", req.URL.Path)
+	assert.Equal(t, "b", req.URL.Query().Get("a"))
+	assert.Equal(t, "https", req.URL.Scheme)
+	assert.Equal(t, "app.example.com", req.Host)
+	assert.Equal(t, "10.0.0.1:43210", req.RemoteAddr)
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, "kc-access", req.Cookies()[0].Name)
+	assert.Len(t, req.Header, 2)
+
+	// step: the header map and the authority in place of the host
+	check = newFakeCheckRequest("GET", "/", nil)
+	check.Attributes.Request.HTTP.Host = ""
+	check.Attributes.Request.HTTP.HeaderMap = &headerMap{Headers: []*headerValue{
+		{Key: ":authority", Value: "raw.example.com"},
+		{Key: "authorization", RawValue: []byte("Bearer raw")},
+	}}
+	req, err = newExtAuthzRequest(check)
+	require.NoError(t, err)
+	assert.Equal(t, "raw.example.com", req.Host)
+	assert.Equal(t, "Bearer raw", req.Header.Get("Authorization"))
+
+	_, err = newExtAuthzRequest(&checkRequest{})
+	assert.Error(t, err)
+	_, err = newExtAuthzRequest(newFakeCheckRequest("GET", "", nil))
+	assert.Error(t, err)
+	assert.Error(t, proto.Unmarshal([]byte{0x0a, 0x10}, &checkRequest{}))
+}
+
+func TestCheckExtAuthz(t *testing.T) {
+	proxy := newFakeExtAuthzProxy(t)
+	token := newFakeExtAuthzToken(t)
+
+	// step: no token is a 401 handed back to the client
+	resp, err := proxy.checkExtAuthz(newFakeCheckRequest("GET", fakeAuthAllURL+"/test", map[string]string{
+		"x-auth-username": "spoofed",
+	}))
+	require.NoError(t, err)
+	assert.Nil(t, resp.OkResponse)
+	if assert.NotNil(t, resp.DeniedResponse) {
+		assert.Equal(t, int32(http.StatusUnauthorized), resp.DeniedResponse.Status.Code)
+	}
+	assert.Equal(t, int32(grpcStatusUnauthenticated), resp.Status.Code)
+
+	// step: the identity headers are added, the spoofed ones replaced and the omitted ones removed
+	proxy.config.OmitAuthorizationHeader = true
+	resp, err = proxy.checkExtAuthz(newFakeCheckRequest("GET", fakeAdminRoleURL, map[string]string{
+		"authorization":   "Bearer " + token,
+		"x-auth-username": "spoofed",
+	}))
+	require.NoError(t, err)
+	assert.Nil(t, resp.DeniedResponse)
+	assert.Equal(t, int32(grpcStatusOK), resp.Status.Code)
+	if assert.NotNil(t, resp.OkResponse) {
+		headers := make(map[string]string)
+		for _, x := range resp.OkResponse.Headers {
+			headers[x.Header.Key] = x.Header.Value
+		}
+		assert.Equal(t, "rjayawardene", headers["x-auth-username"])
+		assert.Equal(t, "gambol99@gmail.com", headers["x-auth-email"])
+		assert.NotContains(t, headers, "authorization")
+		assert.NotContains(t, headers, "x-ext-authz-allowed")
+		assert.Equal(t, []string{"authorization"}, resp.OkResponse.HeadersToRemove)
+	}
+	proxy.config.OmitAuthorizationHeader = false
+
+	// step: the roles are enforced
+	resp, err = proxy.checkExtAuthz(newFakeCheckRequest("GET", fakeTestRoleURL, map[string]string{
+		"authorization": "Bearer " + token,
+	}))
+	require.NoError(t, err)
+	if assert.NotNil(t, resp.DeniedResponse) {
+		assert.Equal(t, int32(http.StatusForbidden), resp.DeniedResponse.Status.Code)
+	}
+	assert.Equal(t, int32(grpcStatusPermissionDenied), resp.Status.Code)
+
+	// step: the white listed resources are permitted
+	resp, err = proxy.checkExtAuthz(newFakeCheckRequest("GET", fakeTestWhitelistedURL, nil))
+	require.NoError(t, err)
+	assert.NotNil(t, resp.OkResponse)
+}
+
+func TestNewHeaderValueOptions(t *testing.T) {
+	options := newHeaderValueOptions(http.Header{
+		"Set-Cookie":          []string{"a=1", "b=2"},
+		extAuthzAllowedHeader: []string{"true"},
+	})
+	if assert.Len(t, options, 2) {
+		assert.Equal(t, "set-cookie", options[1].Header.Key)
+		assert.Equal(t, "b=2", options[1].Header.Value)
+		assert.Nil(t, options[0].Append)
+		assert.True(t, options[1].Append.Value)
+	}
+}
+
+func TestExtAuthzService(t *testing.T) {
+	proxy := newFakeExtAuthzProxy(t)
+	listener, err := net.Listen("tcp", proxy.config.ExtAuthzListen)
+	require.NoError(t, err)
+	defer listener.Close()
+	require.NoError(t, proxy.createExtAuthzService(listener))
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, address string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, address)
+			},
+		},
+	}
+	location := "http://" + listener.Addr().String()
+	check := func(path string, check *checkRequest) (*http.Response, *checkResponse) {
+		encoded, err := proto.Marshal(check)
+		require.NoError(t, err)
+		req, _ := http.NewRequest("POST", location+path, bytes.NewReader(encodeGRPCMessage(encoded)))
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if len(content) <= 0 {
+			return resp, nil
+		}
+		message, err := readGRPCMessage(bytes.NewReader(content))
+		require.NoError(t, err)
+		decoded := &checkResponse{}
+		require.NoError(t, proto.Unmarshal(message, decoded))
+
+		return resp, decoded
+	}
+
+	resp, decoded := check(extAuthzCheckPath, newFakeCheckRequest("GET", fakeAdminRoleURL, map[string]string{
+		"authorization": "Bearer " + newFakeExtAuthzToken(t),
+	}))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	if assert.NotNil(t, decoded) {
+		assert.NotNil(t, decoded.OkResponse)
+	}
+
+	resp, decoded = check(extAuthzCheckPathV2, newFakeCheckRequest("GET", fakeAdminRoleURL, nil))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	if assert.NotNil(t, decoded) {
+		assert.NotNil(t, decoded.DeniedResponse)
+	}
+
+	resp, _ = check("/envoy.service.auth.v3.Authorization/Unknown", &checkRequest{})
+	assert.Equal(t, "12", resp.Trailer.Get("Grpc-Status"))
+	resp, _ = check(extAuthzCheckPath, &checkRequest{})
+	assert.Equal(t, "3", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestExtAuthzHTTPService(t *testing.T) {
+	proxy := newFakeExtAuthzProxy(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	require.NoError(t, proxy.createExtAuthzHTTPService(listener))
+
+	location := "http://" + listener.Addr().String()
+	req, _ := http.NewRequest("GET", location+fakeAdminRoleURL, nil)
+	req.Header.Set("Authorization", "Bearer "+newFakeExtAuthzToken(t))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "rjayawardene", resp.Header.Get("X-Auth-Username"))
+
+	resp, err = http.Get(location + fakeAdminRoleURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// featureUMA gates the enforcement of the keycloak authorization services
+	featureUMA = "uma"
+)
+
+// experimentalFeatures are the subsystems which ship disabled, unless enabled in the features; a feature is only
+// listed once the subsystem checks it
+var experimentalFeatures = map[string]string{
+	featureUMA: "the keycloak authorization services (uma) enforcement",
+}
+
+//
+// isFeatureEnabled checks if the experimental feature has been enabled
+//
+func (r *Config) isFeatureEnabled(feature string) bool {
+	return r.Features[feature]
+}
+
+//
+// logFeatures logs the experimental features enabled
+//
+func logFeatures(features map[string]bool) {
+	var enabled []string
+	for name, on := range features {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	for _, x := range enabled {
+		log.WithFields(log.Fields{
+			"feature": x,
+		}).Warnf("the experimental feature is enabled: %s", experimentalFeatures[x])
+	}
+}
+
+//
+// decodeFeature decodes the feature option, name[=true|false]
+//
+func decodeFeature(feature string) (string, bool, error) {
+	items := strings.SplitN(feature, "=", 2)
+	if items[0] == "" {
+		return "", false, fmt.Errorf("invalid feature '%s' should be name[=true|false]", feature)
+	}
+	if len(items) == 1 {
+		return items[0], true, nil
+	}
+	enabled, err := strconv.ParseBool(items[1])
+	if err != nil {
+		return "", false, fmt.Errorf("invalid feature '%s' should be name[=true|false]", feature)
+	}
+
+	return items[0], enabled, nil
+}
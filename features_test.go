@@ -0,0 +1,73 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsFeatureEnabled(t *testing.T) {
+	config := newDefaultConfig()
+	assert.False(t, config.isFeatureEnabled(featureUMA))
+
+	config.Features[featureUMA] = true
+	assert.True(t, config.isFeatureEnabled(featureUMA))
+	config.Features[featureUMA] = false
+	assert.False(t, config.isFeatureEnabled(featureUMA))
+}
+
+func TestUnknownFeature(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Listen = ":8080"
+	config.Upstream = "http://127.0.0.1:8081"
+	config.Features = map[string]bool{featureUMA: true}
+	assert.NoError(t, config.isValid())
+
+	config.Features["teleport"] = true
+	assert.Error(t, config.isValid())
+	delete(config.Features, "teleport")
+	config.Features["tracing"] = true
+	assert.Error(t, config.isValid())
+}
+
+func TestDecodeFeature(t *testing.T) {
+	tests := []struct {
+		Value   string
+		Name    string
+		Enabled bool
+		Ok      bool
+	}{
+		{Value: "uma", Name: "uma", Enabled: true, Ok: true},
+		{Value: "uma=true", Name: "uma", Enabled: true, Ok: true},
+		{Value: "uma=false", Name: "uma", Ok: true},
+		{Value: "uma=maybe"},
+		{Value: "=true"},
+		{Value: ""},
+	}
+	for i, c := range tests {
+		name, enabled, err := decodeFeature(c.Value)
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Name, name, "case %d", i)
+			assert.Equal(t, c.Enabled, enabled, "case %d", i)
+		}
+	}
+}
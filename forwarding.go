@@ -18,6 +18,9 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -29,16 +32,62 @@ import (
 //
 // upstreamReverseProxyHandler is responsible for handles reverse proxy request to the upstream endpoint
 //
-func (r *oauthProxy) upstreamReverseProxyHandler() gin.HandlerFunc {
+func (r *oauthProxy) upstreamReverseProxyHandler() (gin.HandlerFunc, error) {
+	// step: create the path rewriters for the resources, the resources have been validated
+	rewriters := make(map[*Resource]*pathRewriter, 0)
+	for _, resource := range r.config.Resources {
+		if rewriter, _ := newPathRewriter(resource); rewriter != nil {
+			rewriters[resource] = rewriter
+		}
+	}
+	// step: compile the canary routes
+	canaries, err := newCanaryRoutes(r.config)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range canaries {
+		x.proxy = r.createCanaryProxy(x.endpoint)
+	}
+
 	return func(cx *gin.Context) {
 		if cx.IsAborted() {
 			return
 		}
 
+		// step: the users matching a canary route are sent to the alternate upstream
+		canary := getCanaryRoute(cx, canaries)
+
+		// step: is the circuit open for the upstream?
+		if canary == nil && r.breaker != nil && !r.breaker.allow(time.Now()) {
+			log.Warnf("the circuit is open for the upstream, refusing the request")
+			r.errorResponse(cx, http.StatusServiceUnavailable, reasonUpstreamUnavailable)
+			return
+		}
+
+		// step: pick a healthy endpoint when we have multiple
+		endpoint := r.endpoint
+		upstream := r.upstream
+		switch {
+		case canary != nil:
+			endpoint, upstream = canary.endpoint, canary.proxy
+		case r.upstreams != nil:
+			endpoint = r.upstreams.pick()
+		}
+
+		// step: rewrite the path for the upstream if the resource requires
+		resource := getResource(cx)
+		if rewriter, found := rewriters[resource]; found {
+			cx.Request.URL.Path = rewriter.rewrite(cx.Request.URL.Path)
+			cx.Request.URL.RawPath = ""
+		}
+
 		// step: is this connection upgrading?
 		if isUpgradedConnection(cx.Request) {
 			log.Debugf("upgrading the connnection to %s", cx.Request.Header.Get(headerUpgrade))
-			if err := tryUpdateConnection(cx, r.endpoint); err != nil {
+			if r.socket != "" && canary == nil {
+				endpoint = &url.URL{Scheme: "unix", Path: r.socket}
+			}
+			if err := tryUpdateConnection(cx, endpoint, r.upstreamTLS); err != nil {
 				log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to upgrade the connection")
 				cx.AbortWithStatus(http.StatusInternalServerError)
 				return
@@ -50,14 +99,137 @@ func (r *oauthProxy) upstreamReverseProxyHandler() gin.HandlerFunc {
 			By default goproxy only provides a forwarding proxy, thus all requests have to be absolute
 			and we must update the host headers
 		*/
-		cx.Request.URL.Host = r.endpoint.Host
-		cx.Request.URL.Scheme = r.endpoint.Scheme
-		cx.Request.Host = r.endpoint.Host
+		cx.Request.URL.Host = endpoint.Host
+		cx.Request.URL.Scheme = endpoint.Scheme
+		cx.Request.Host = endpoint.Host
+
+		// step: the bodies are streamed, flushing the response to the client as it arrives for event streams
+		// and chunked responses, else on the flush interval if any
+		var response http.ResponseWriter = cx.Writer
+		if changes := r.responseHeaderChanges(resource); len(changes) > 0 {
+			response = newResponseHeaderWriter(cx.Writer, changes)
+		}
+		writer := newFlushWriter(response, r.config.UpstreamFlushInterval)
+		defer writer.stop()
 
-		r.upstream.ServeHTTP(cx.Writer, cx.Request)
+		upstream.ServeHTTP(writer, cx.Request)
+	}, nil
+}
+
+//
+// flushWriter flushes the response to the client on an interval, or after every write if negative or the
+// response is being streamed
+//
+type flushWriter struct {
+	sync.Mutex
+	// the underlining response writer
+	writer http.ResponseWriter
+	// the flusher for the writer
+	flusher http.Flusher
+	// the interval to flush on
+	interval time.Duration
+	// closed when the response is complete
+	done chan struct{}
+	// indicates the response is complete
+	stopped bool
+	// indicates content has been written, flushing before would send the headers without the status
+	written bool
+	// indicates every write is flushed
+	immediate bool
+}
+
+//
+// newFlushWriter creates a writer flushing the response on the interval
+//
+func newFlushWriter(writer http.ResponseWriter, interval time.Duration) *flushWriter {
+	w := &flushWriter{
+		writer:   writer,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	w.flusher, _ = writer.(http.Flusher)
+
+	if interval > 0 && w.flusher != nil {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					w.Lock()
+					if w.written && !w.stopped {
+						w.flusher.Flush()
+					}
+					w.Unlock()
+				case <-w.done:
+					return
+				}
+			}
+		}()
+	}
+
+	return w
+}
+
+// Header returns the headers of the response
+func (w *flushWriter) Header() http.Header {
+	return w.writer.Header()
+}
+
+// WriteHeader writes the status code of the response
+func (w *flushWriter) WriteHeader(code int) {
+	w.Lock()
+	defer w.Unlock()
+	w.writer.WriteHeader(code)
+}
+
+// Write writes the content to the client, flushing immediately if the interval is negative
+func (w *flushWriter) Write(content []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	// step: decide on the first write, once the headers of the response are known
+	if !w.written {
+		w.immediate = w.interval < 0 || isStreamingResponse(w.writer.Header())
+	}
+	n, err := w.writer.Write(content)
+	w.written = true
+	if err == nil && w.immediate && w.flusher != nil {
+		w.flusher.Flush()
+	}
+
+	return n, err
+}
+
+// Flush flushes the buffered content to the client
+func (w *flushWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+	if w.written && w.flusher != nil {
+		w.flusher.Flush()
 	}
 }
 
+//
+// stop halts the flushing of the response
+//
+func (w *flushWriter) stop() {
+	w.Lock()
+	defer w.Unlock()
+	w.stopped = true
+	close(w.done)
+}
+
+//
+// isStreamingResponse checks if the response is an event stream or chunked, i.e. has no content length
+//
+func isStreamingResponse(header http.Header) bool {
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+
+	return header.Get("Content-Length") == ""
+}
+
 //
 // forwardProxyHandler is responsible for signing outbound requests
 //
@@ -0,0 +1,189 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeStreamingProxy(t *testing.T, upstream http.Handler) (*oauthProxy, string) {
+	service := httptest.NewServer(upstream)
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/upload",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+		},
+	})
+	proxy.endpoint, _ = url.Parse(service.URL)
+	if err := proxy.createUpstreamProxy(proxy.endpoint); err != nil {
+		t.Fatalf("unable to create the upstream proxy, error: %s", err)
+	}
+	proxy.createEndpoints()
+
+	return proxy, httptest.NewServer(proxy.router).URL
+}
+
+func TestUpstreamStreamsRequestBody(t *testing.T) {
+	chunk := bytes.Repeat([]byte("a"), 1024*1024)
+	chunks := 64
+	received := make(chan struct{})
+
+	_, location := newFakeStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := io.ReadFull(req.Body, make([]byte, len(chunk))); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		close(received)
+		copied, _ := io.Copy(ioutil.Discard, req.Body)
+		fmt.Fprintf(w, "%d", copied+int64(len(chunk)))
+	}))
+
+	reader, writer := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", location+"/upload", reader)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			responses <- nil
+			return
+		}
+		responses <- resp
+	}()
+
+	// step: the upstream must see the first chunk before the client has finished the upload
+	writer.Write(chunk)
+	select {
+	case <-received:
+	case <-time.After(time.Duration(10) * time.Second):
+		t.Fatalf("the upstream did not receive the start of the body, the request is being buffered")
+	}
+	for i := 1; i < chunks; i++ {
+		writer.Write(chunk)
+	}
+	writer.Close()
+
+	resp := <-responses
+	if !assert.NotNil(t, resp) {
+		return
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("%d", chunks*len(chunk)), string(content))
+}
+
+func TestUpstreamFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	proxy, location := newFakeStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second"))
+	}))
+	proxy.config.UpstreamFlushInterval = -1
+	defer close(release)
+
+	resp, err := http.Get(location + "/upload")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	first := make(chan []byte, 1)
+	go func() {
+		content := make([]byte, 5)
+		io.ReadFull(resp.Body, content)
+		first <- content
+	}()
+	select {
+	case content := <-first:
+		assert.Equal(t, "first", string(content))
+	case <-time.After(time.Duration(10) * time.Second):
+		t.Fatalf("the response was not flushed to the client")
+	}
+}
+
+func TestUpstreamServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	_, location := newFakeStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer close(release)
+
+	resp, err := http.Get(location + "/upload")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	first := make(chan []byte, 1)
+	go func() {
+		content := make([]byte, 13)
+		io.ReadFull(resp.Body, content)
+		first <- content
+	}()
+	select {
+	case content := <-first:
+		assert.Equal(t, "data: first\n\n", string(content))
+	case <-time.After(time.Duration(10) * time.Second):
+		t.Fatalf("the event was not flushed to the client")
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	assert.True(t, isStreamingResponse(http.Header{}))
+	assert.True(t, isStreamingResponse(http.Header{
+		"Content-Type":   []string{"text/event-stream; charset=utf-8"},
+		"Content-Length": []string{"10"},
+	}))
+	assert.False(t, isStreamingResponse(http.Header{
+		"Content-Type":   []string{"application/json"},
+		"Content-Length": []string{"10"},
+	}))
+}
+
+func TestFlushWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newFlushWriter(recorder, -1)
+	writer.WriteHeader(http.StatusAccepted)
+	writer.Write([]byte("content"))
+	writer.stop()
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.True(t, recorder.Flushed)
+	assert.Equal(t, "content", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	writer = newFlushWriter(recorder, time.Duration(10)*time.Millisecond)
+	writer.Write([]byte("content"))
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	writer.stop()
+	assert.True(t, recorder.Flushed)
+}
@@ -17,16 +17,21 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gambol99/go-oidc/oauth2"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //
@@ -45,7 +50,7 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 			"error": err.Error(),
 		}).Errorf("failed to retrieve the oauth client for authorization")
 
-		cx.AbortWithStatus(http.StatusInternalServerError)
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 		return
 	}
 
@@ -55,8 +60,52 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		accessType = "offline"
 	}
 
+	// step: are we asking the provider to authenticate the user again, or silently?
+	prompt := ""
+	switch cx.Query("prompt") {
+	case "login":
+		prompt = "login"
+	case "none":
+		if r.config.EnableSilentAuthentication {
+			prompt = "none"
+		}
+	}
+
 	// step: generate the authorization url
-	redirectionURL := client.AuthCodeURL(cx.Query("state"), accessType, "")
+	redirectionURL := client.AuthCodeURL(cx.Query("state"), accessType, prompt)
+
+	// step: are we asking the provider for a stronger authentication or passing on any parameters?
+	if params := r.getAuthorizationParameters(cx); len(params) > 0 {
+		redirectionURL += "&" + params.Encode()
+	}
+
+	// step: are we requesting offline tokens for all the sessions?
+	if r.config.EnableOfflineTokens {
+		if redirectionURL, err = addOfflineScope(redirectionURL); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to add the offline access scope to the authorization url")
+
+			r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+			return
+		}
+	}
+
+	// step: has the user asked to be remembered? we request an offline refresh token
+	rememberURL := ""
+	if r.config.EnableRememberMe {
+		if rememberURL, err = addOfflineScope(redirectionURL); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to add the offline access scope to the authorization url")
+
+			r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+			return
+		}
+		if cx.Query(rememberMeQuery) == "true" {
+			redirectionURL = rememberURL
+		}
+	}
 
 	log.WithFields(log.Fields{
 		"client_ip":       cx.ClientIP(),
@@ -64,6 +113,17 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 		"redirection-url": redirectionURL,
 	}).Debugf("incoming authorization request from client address: %s", cx.ClientIP())
 
+	// step: a silent authentication goes straight to the provider, there is no one to interact with
+	if prompt == "none" {
+		r.redirectToURL(redirectionURL, cx)
+		return
+	}
+
+	// step: are we negotiating a kerberos ticket with the provider on behalf of the browser?
+	if r.config.EnableNegotiate && r.negotiateAuthorization(cx, redirectionURL) {
+		return
+	}
+
 	// step: if we have a custom sign in page, lets display that
 	if r.config.hasCustomSignInPage() {
 		// step: inject any custom tags into the context for the template
@@ -72,6 +132,9 @@ func (r *oauthProxy) oauthAuthorizationHandler(cx *gin.Context) {
 			model[k] = v
 		}
 		model["redirect"] = redirectionURL
+		if rememberURL != "" {
+			model["remember_redirect"] = rememberURL
+		}
 
 		cx.HTML(http.StatusOK, path.Base(r.config.SignInPage), model)
 		return
@@ -90,13 +153,35 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		return
 	}
 
+	// step: a silent authentication the provider could not complete falls back to the login
+	if isSilentAuthenticationError(cx.Query("error")) {
+		r.silentAuthenticationFailed(cx)
+		return
+	}
+
 	// step: ensure we have a authorization code to exchange
 	code := cx.Request.URL.Query().Get("code")
 	if code == "" {
-		cx.AbortWithStatus(http.StatusBadRequest)
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
 		return
 	}
 
+	// step: decode the state variable, a signed state is verified before the code is exchanged
+	state, err := r.decodeState(cx.Request.URL.Query().Get("state"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"state":     cx.Request.URL.Query().Get("state"),
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Warnf("unable to decode the state parameter")
+
+		if r.config.EnableSignedState {
+			r.errorResponse(cx, http.StatusBadRequest, reasonInvalidState)
+			return
+		}
+		state = "/"
+	}
+
 	// step: exchange the authorization for a access token
 	response, err := exchangeAuthenticationCode(r.client, code)
 	if err != nil {
@@ -104,7 +189,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 			"error": err.Error(),
 		}).Errorf("unable to exchange code for access token")
 
-		r.accessForbidden(cx)
+		r.accessForbidden(cx, reasonInvalidToken)
 		return
 	}
 
@@ -115,7 +200,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 			"error": err.Error(),
 		}).Errorf("unable to parse id token for identity")
 
-		r.accessForbidden(cx)
+		r.accessForbidden(cx, reasonInvalidToken)
 		return
 	}
 
@@ -125,7 +210,7 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 			"error": err.Error(),
 		}).Errorf("unable to verify the id token")
 
-		r.accessForbidden(cx)
+		r.accessForbidden(cx, reasonInvalidToken)
 		return
 	}
 
@@ -147,66 +232,71 @@ func (r *oauthProxy) oauthCallbackHandler(cx *gin.Context) {
 		"idle":     r.config.IdleDuration.String(),
 	}).Infof("issuing a new access token for user, email: %s", identity.Email)
 
-	// step: drop's a session cookie with the access token
-	r.dropAccessTokenCookie(cx, session.Encode(), r.config.IdleDuration)
-
-	// step: does the response has a refresh token and we are NOT ignore refresh tokens?
-	if r.config.EnableRefreshTokens && response.RefreshToken != "" {
-		// step: encrypt the refresh token
-		encrypted, err := encodeText(response.RefreshToken, r.config.EncryptionKey)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err.Error(),
-			}).Errorf("failed to encrypt the refresh token")
-
-			cx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
-		// step: create and inject the state session
-		switch r.useStore() {
-		case true:
-			if err := r.StoreRefreshToken(session, encrypted); err != nil {
+	// step: the login supersedes any previous session of the user
+	if r.config.SingleSession {
+		if user, err := extractIdentity(session, r.roles); err == nil {
+			if err := r.recordSession(user); err != nil {
 				log.WithFields(log.Fields{
 					"error": err.Error(),
-				}).Warnf("failed to save the refresh token in the store")
+				}).Errorf("failed to save the session in the store")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
 			}
-		default:
-			r.dropRefreshTokenCookie(cx, encrypted, r.config.IdleDuration*2)
 		}
 	}
 
-	// step: decode the state variable
-	state := "/"
-	if cx.Request.URL.Query().Get("state") != "" {
-		decoded, err := base64.StdEncoding.DecodeString(cx.Request.URL.Query().Get("state"))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"state": cx.Request.URL.Query().Get("state"),
-				"error": err.Error(),
-			}).Warnf("unabe to decode the state parameter")
-		} else {
-			state = string(decoded)
-		}
+	// step: the remembered sessions are given the extended cookie lifetime
+	var user *userContext
+	if u, err := extractIdentity(session, r.roles); err == nil {
+		user = u
+	}
+
+	// step: drop's a session cookie with the access token
+	r.dropAccessTokenCookie(cx, session.Encode(), r.getSessionDuration(user))
+
+	// step: the provider did not issue a refresh token, the user is redirected for authentication on expiry
+	if r.config.EnableRefreshTokens && response.RefreshToken == "" {
+		log.WithFields(log.Fields{
+			"email": identity.Email,
+		}).Warnf("refresh tokens are enabled but the provider did not return one, the user will be redirected " +
+			"for authentication on expiry; check the client in keycloak permits refresh tokens and the offline_access scope is requested")
+	}
+
+	// step: does the response has a refresh token and we are NOT ignore refresh tokens?
+	if err := r.dropRefreshToken(cx, session, response.RefreshToken, user); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to encrypt the refresh token")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+
+	if !r.isPermittedRedirect(state, cx.Request.Host) {
+		log.WithFields(log.Fields{
+			"redirect": state,
+		}).Warnf("refusing to redirect to a location which is not permitted")
+
+		state = "/"
 	}
 
 	r.redirectToURL(state, cx)
 }
 
 //
-// loginHandler provide's a generic endpoint for clients to perform a user_credentials login to the provider
+// loginHandler provide's a generic endpoint for clients to perform a user_credentials login to the provider, the
+// credentials are posted as a form or json; the session cookies are dropped as per the authorization code flow
 //
 func (r *oauthProxy) loginHandler(cx *gin.Context) {
 	// step: parse the client credentials
-	username := cx.Request.PostFormValue("username")
-	password := cx.Request.PostFormValue("password")
-
-	if username == "" || password == "" {
+	username, password, err := getLoginCredentials(cx.Request)
+	if err != nil || username == "" || password == "" {
 		log.WithFields(log.Fields{
 			"client_ip": cx.ClientIP(),
 		}).Errorf("the request does not have both username and password")
 
-		cx.AbortWithStatus(http.StatusBadRequest)
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
 		return
 	}
 
@@ -218,7 +308,7 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 			"error":     err.Error(),
 		}).Errorf("unable to create the oauth client for user_credentials request")
 
-		cx.AbortWithStatus(http.StatusInternalServerError)
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 		return
 	}
 
@@ -227,17 +317,33 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 	if err != nil {
 		log.WithFields(log.Fields{
 			"client_ip": cx.ClientIP(),
+			"username":  username,
 			"error":     err.Error(),
 		}).Errorf("unable to request the access token via grant_type 'password'")
 
-		cx.AbortWithStatus(http.StatusInternalServerError)
+		// step: the credentials were refused by the provider
+		if e, ok := err.(*oauth2.Error); ok && e.Type == oauth2.ErrorInvalidGrant {
+			r.errorResponse(cx, http.StatusUnauthorized, reasonInvalidCredentials)
+			return
+		}
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 		return
 	}
 
-	// step: drop the access token
-	r.dropAccessTokenCookie(cx, token.AccessToken, r.config.IdleDuration)
+	// step: verify the access token and drop the session cookies
+	user, err := r.establishSession(cx, token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"username":  username,
+		"expires":   user.expiresAt.Format(time.RFC822Z),
+	}).Infof("issuing a new access token for user via grant_type 'password', email: %s", user.email)
 
 	cx.JSON(http.StatusOK, tokenResponse{
+		TokenType:    token.TokenType,
 		IDToken:      token.IDToken,
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
@@ -246,6 +352,106 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 	})
 }
 
+//
+// getLoginCredentials retrieves the username and password from the json body or the form of the request
+//
+func getLoginCredentials(req *http.Request) (string, string, error) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), gin.MIMEJSON) {
+		return req.PostFormValue("username"), req.PostFormValue("password"), nil
+	}
+
+	credentials := new(loginRequest)
+	if err := json.NewDecoder(io.LimitReader(req.Body, loginRequestLimit)).Decode(credentials); err != nil {
+		return "", "", err
+	}
+
+	return credentials.Username, credentials.Password, nil
+}
+
+//
+// establishSession verifies the access token issued to a non-browser grant and drops the session cookies as per the
+// authorization code flow; on failure the error response has been sent
+//
+func (r *oauthProxy) establishSession(cx *gin.Context, accessToken, refreshToken string) (*userContext, error) {
+	// step: parse and verify the access token
+	session, _, err := parseToken(accessToken)
+	if err == nil {
+		err = verifyToken(r.client, session)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to verify the access token issued by the provider")
+
+		r.errorResponse(cx, http.StatusForbidden, reasonInvalidToken)
+		return nil, err
+	}
+	user, err := extractIdentity(session, r.roles)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Errorf("unable to extract the identity from the access token")
+
+		r.errorResponse(cx, http.StatusForbidden, reasonInvalidToken)
+		return nil, err
+	}
+
+	// step: the login supersedes any previous session of the user
+	if r.config.SingleSession {
+		if err := r.recordSession(user); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("failed to save the session in the store")
+
+			r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+			return nil, err
+		}
+	}
+
+	// step: drop the access and refresh tokens
+	r.dropAccessTokenCookie(cx, session.Encode(), r.getSessionDuration(user))
+	if err := r.dropRefreshToken(cx, session, refreshToken, user); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("failed to encrypt the refresh token")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+//
+// dropRefreshToken encrypts and places the refresh token in the store or a cookie, if refresh tokens are enabled
+//
+func (r *oauthProxy) dropRefreshToken(cx *gin.Context, session jose.JWT, refreshToken string, user *userContext) error {
+	if !r.config.EnableRefreshTokens || refreshToken == "" {
+		return nil
+	}
+	// step: encrypt the refresh token
+	encrypted, err := encodeText(refreshToken, r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	// step: create and inject the state session
+	switch r.useStore() {
+	case true:
+		if err := r.StoreRefreshToken(session, encrypted); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Warnf("failed to save the refresh token in the store")
+		}
+	default:
+		r.dropRefreshTokenCookie(cx, encrypted, r.getRefreshDuration(user))
+	}
+
+	return nil
+}
+
 //
 // logoutHandler performs a logout
 //  - if it's just a access token, the cookie is deleted
@@ -255,11 +461,19 @@ func (r *oauthProxy) loginHandler(cx *gin.Context) {
 func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 	// the user can specify a url to redirect the back to
 	redirectURL := cx.Request.URL.Query().Get("redirect")
+	if redirectURL != "" && !r.isPermittedRedirect(redirectURL, cx.Request.Host) {
+		log.WithFields(log.Fields{
+			"redirect": redirectURL,
+		}).Warnf("refusing to redirect to a location which is not permitted")
+
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return
+	}
 
 	// step: drop the access token
 	user, err := r.getIdentity(cx)
 	if err != nil {
-		cx.AbortWithStatus(http.StatusBadRequest)
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
 		return
 	}
 
@@ -289,7 +503,7 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 				"error": err.Error(),
 			}).Errorf("unable to retrieve the openid client")
 
-			cx.AbortWithStatus(http.StatusInternalServerError)
+			r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 			return
 		}
 
@@ -306,7 +520,7 @@ func (r *oauthProxy) logoutHandler(cx *gin.Context) {
 				"error": err.Error(),
 			}).Errorf("unable to construct the revocation request")
 
-			cx.AbortWithStatus(http.StatusInternalServerError)
+			r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 			return
 		}
 
@@ -391,6 +605,13 @@ func (r *oauthProxy) healthHandler(cx *gin.Context) {
 	cx.String(http.StatusOK, "OK\n")
 }
 
+//
+// metricsHandler exposes the prometheus metrics
+//
+func (r *oauthProxy) metricsHandler(cx *gin.Context) {
+	prometheus.Handler().ServeHTTP(cx.Writer, cx.Request)
+}
+
 //
 // retrieveRefreshToken retrieves the refresh token from store or cookie
 //
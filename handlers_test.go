@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,6 +107,11 @@ func TestLoginHandler(t *testing.T) {
 			Password:     "test",
 			ExpectedCode: http.StatusBadRequest,
 		},
+		{
+			Username:     "test",
+			Password:     "invalid",
+			ExpectedCode: http.StatusUnauthorized,
+		},
 		{
 			Username:     "test",
 			Password:     "test",
@@ -133,6 +139,54 @@ func TestLoginHandler(t *testing.T) {
 	}
 }
 
+func TestLoginHandlerJSON(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableRefreshTokens = true
+	_, _, u := newTestProxyService(t, config)
+	u = u + oauthURL + loginURL
+
+	cs := []struct {
+		Body         string
+		ExpectedCode int
+		Cookies      []string
+	}{
+		{
+			Body:         `{"username": "test"`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Body:         `{"username": "test"}`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Body:         `{"username": "test", "password": "invalid"}`,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Body:         `{"username": "test", "password": "test"}`,
+			ExpectedCode: http.StatusOK,
+			Cookies:      []string{config.CookieAccessName, config.CookieRefreshName},
+		},
+	}
+
+	for i, x := range cs {
+		resp, err := http.Post(u, "application/json; charset=utf-8", strings.NewReader(x.Body))
+		if err != nil {
+			t.Errorf("case %d, unable to make requets, error: %s", i, err)
+			continue
+		}
+		assert.Equal(t, x.ExpectedCode, resp.StatusCode, "case %d, expect: %v, got: %d",
+			i, x.ExpectedCode, resp.StatusCode)
+		cookies := make(map[string]bool, 0)
+		for _, c := range resp.Cookies() {
+			cookies[c.Name] = true
+		}
+		for _, name := range x.Cookies {
+			assert.True(t, cookies[name], "case %d, expected the cookie: %s", i, name)
+		}
+	}
+}
+
 func TestTokenHandler(t *testing.T) {
 	token := newFakeAccessToken()
 	_, _, u := newTestProxyService(t, nil)
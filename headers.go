@@ -0,0 +1,117 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+)
+
+//
+// apply makes the changes to the headers of the response
+//
+func (r *ResponseHeaders) apply(header http.Header) {
+	for _, x := range r.Remove {
+		header.Del(x)
+	}
+	for k, v := range r.Set {
+		header.Set(k, v)
+	}
+	for k, v := range r.Add {
+		header.Add(k, v)
+	}
+}
+
+//
+// isEmpty checks if there are no changes to the headers
+//
+func (r *ResponseHeaders) isEmpty() bool {
+	return len(r.Add) <= 0 && len(r.Set) <= 0 && len(r.Remove) <= 0
+}
+
+//
+// responseHeaderChanges returns the changes to the headers of the upstream response, the global changes
+// followed by those of the resource
+//
+func (r *oauthProxy) responseHeaderChanges(resource *Resource) []*ResponseHeaders {
+	var changes []*ResponseHeaders
+	if !r.config.ResponseHeaders.isEmpty() {
+		changes = append(changes, &r.config.ResponseHeaders)
+	}
+	if resource != nil && resource.ResponseHeaders != nil && !resource.ResponseHeaders.isEmpty() {
+		changes = append(changes, resource.ResponseHeaders)
+	}
+
+	return changes
+}
+
+//
+// responseHeaderWriter applies the changes to the headers of the response before they are written
+//
+type responseHeaderWriter struct {
+	// the underlining response writer
+	writer http.ResponseWriter
+	// the changes to the headers, in order
+	changes []*ResponseHeaders
+	// indicates the headers have been written
+	written bool
+}
+
+//
+// newResponseHeaderWriter creates a writer applying the changes to the response headers
+//
+func newResponseHeaderWriter(writer http.ResponseWriter, changes []*ResponseHeaders) *responseHeaderWriter {
+	return &responseHeaderWriter{
+		writer:  writer,
+		changes: changes,
+	}
+}
+
+// Header returns the headers of the response
+func (w *responseHeaderWriter) Header() http.Header {
+	return w.writer.Header()
+}
+
+// WriteHeader applies the changes and writes the status code of the response
+func (w *responseHeaderWriter) WriteHeader(code int) {
+	w.applyChanges()
+	w.writer.WriteHeader(code)
+}
+
+// Write writes the content to the client, applying the changes if the headers have not been written
+func (w *responseHeaderWriter) Write(content []byte) (int, error) {
+	w.applyChanges()
+	return w.writer.Write(content)
+}
+
+// Flush flushes the buffered content to the client
+func (w *responseHeaderWriter) Flush() {
+	if flusher, ok := w.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//
+// applyChanges makes the changes to the headers, once
+//
+func (w *responseHeaderWriter) applyChanges() {
+	if w.written {
+		return
+	}
+	w.written = true
+	for _, x := range w.changes {
+		x.apply(w.writer.Header())
+	}
+}
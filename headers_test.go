@@ -0,0 +1,114 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseHeadersApply(t *testing.T) {
+	header := http.Header{
+		"Server":        []string{"nginx"},
+		"Cache-Control": []string{"public"},
+		"Vary":          []string{"Accept"},
+	}
+	changes := &ResponseHeaders{
+		Add:    map[string]string{"Vary": "Origin"},
+		Set:    map[string]string{"Cache-Control": "no-store"},
+		Remove: []string{"Server"},
+	}
+	changes.apply(header)
+
+	assert.Empty(t, header.Get("Server"))
+	assert.Equal(t, []string{"no-store"}, header["Cache-Control"])
+	assert.Equal(t, []string{"Accept", "Origin"}, header["Vary"])
+}
+
+func TestUpstreamResponseHeaders(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/public",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+		},
+		{
+			URL:         "/private",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+			ResponseHeaders: &ResponseHeaders{
+				Set:    map[string]string{"Cache-Control": "no-store"},
+				Remove: []string{"X-Powered-By"},
+			},
+		},
+	})
+	proxy.config.ResponseHeaders = ResponseHeaders{
+		Add:    map[string]string{"X-Frame-Options": "SAMEORIGIN"},
+		Remove: []string{"Server"},
+	}
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("Cache-Control", "public")
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+
+	tests := []struct {
+		URI     string
+		Headers map[string]string
+	}{
+		{
+			URI: "/public",
+			Headers: map[string]string{
+				"Server":          "",
+				"X-Powered-By":    "php",
+				"Cache-Control":   "public",
+				"X-Frame-Options": "SAMEORIGIN",
+			},
+		},
+		{
+			URI: "/private/page",
+			Headers: map[string]string{
+				"Server":          "",
+				"X-Powered-By":    "",
+				"Cache-Control":   "no-store",
+				"X-Frame-Options": "SAMEORIGIN",
+			},
+		},
+	}
+	for i, c := range tests {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", c.URI))
+		assert.Equal(t, http.StatusOK, recorder.Code, "case %d", i)
+		for k, v := range c.Headers {
+			assert.Equal(t, v, recorder.Header().Get(k), "case %d, header %s", i, k)
+		}
+	}
+}
+
+func TestResponseHeaderWriterWithoutWriteHeader(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newResponseHeaderWriter(recorder, []*ResponseHeaders{{Set: map[string]string{"Cache-Control": "no-store"}}})
+	writer.Header().Set("Cache-Control", "public")
+	writer.Write([]byte("content"))
+
+	assert.Equal(t, "no-store", recorder.HeaderMap.Get("Cache-Control"))
+	assert.Equal(t, "content", recorder.Body.String())
+}
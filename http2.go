@@ -0,0 +1,163 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// hopHeaders are the hop-by-hop headers removed when proxying, note TE is kept as grpc requires "TE: trailers"
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//
+// http2Proxy is a reverse proxy to a http2 upstream, cleartext (h2c) or tls, which preserves the trailers
+// and streams the bodies, permitting grpc services to be proxied
+//
+type http2Proxy struct {
+	// the http2 transport to the upstream
+	transport http.RoundTripper
+}
+
+//
+// newHTTP2Proxy creates a http2 proxy, the dialer is used for the cleartext (h2c) connections
+//
+func newHTTP2Proxy(upstream *url.URL, dialer func(string, string) (net.Conn, error), tlsConfig *tls.Config) *http2Proxy {
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	// step: for cleartext we dial the connection ourselves, as the transport would otherwise use tls
+	if upstream == nil || upstream.Scheme != "https" {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, address string, cfg *tls.Config) (net.Conn, error) {
+			return dialer(network, address)
+		}
+	}
+
+	return &http2Proxy{transport: transport}
+}
+
+// ServeHTTP proxies the request to the upstream
+func (r *http2Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	outbound := new(http.Request)
+	*outbound = *req
+	outbound.RequestURI = ""
+	outbound.Close = false
+	outbound.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		outbound.Header[k] = v
+	}
+	removeHopHeaders(outbound.Header)
+
+	resp, err := r.transport.RoundTrip(outbound)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to proxy the request to the http2 upstream")
+
+		// step: grpc clients expect the status in the headers, else we hand back a bad gateway
+		if isGRPCRequest(req) {
+			w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+			w.Header().Set("Grpc-Status", "14")
+			w.Header().Set("Grpc-Message", "the upstream is unavailable")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// step: copy the headers and announce the trailers
+	removeHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	if len(resp.Trailer) > 0 {
+		// step: the response must be chunked for the trailers to be sent to http/1.1 clients
+		w.Header().Del("Content-Length")
+		for k := range resp.Trailer {
+			w.Header().Add("Trailer", k)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// step: stream the body, flushing every write
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, werr := w.Write(buffer[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to read the response from the http2 upstream")
+			return
+		}
+	}
+
+	// step: the trailers are only populated once the body is read
+	for k, v := range resp.Trailer {
+		w.Header()[k] = v
+	}
+}
+
+//
+// removeHopHeaders removes the hop-by-hop headers
+//
+func removeHopHeaders(headers http.Header) {
+	for _, x := range headers["Connection"] {
+		for _, name := range strings.Split(x, ",") {
+			headers.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, x := range hopHeaders {
+		headers.Del(x)
+	}
+}
+
+//
+// isGRPCRequest checks if the request is a grpc call
+//
+func isGRPCRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func newFakeHTTP2Proxy(t *testing.T, upstream string) string {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/grpc",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+		},
+	})
+	proxy.config.EnableHTTP2 = true
+	proxy.endpoint, _ = url.Parse(upstream)
+	if err := proxy.createUpstreamProxy(proxy.endpoint); err != nil {
+		t.Fatalf("unable to create the upstream proxy, error: %s", err)
+	}
+	proxy.createEndpoints()
+
+	return httptest.NewServer(proxy.router).URL
+}
+
+func TestHTTP2ProxyCleartext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	// step: a cleartext (h2c) upstream with prior knowledge
+	server := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Proto", req.Proto)
+		w.Header().Set("X-Auth-Proxy", req.Header.Get("X-Forwarded-Agent"))
+		w.Write([]byte("content"))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	location := newFakeHTTP2Proxy(t, "http://"+listener.Addr().String())
+	resp, err := http.Get(location + "/grpc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "content", string(content))
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+	assert.Equal(t, prog, resp.Header.Get("X-Auth-Proxy"))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestHTTP2ProxyUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	upstream := "http://" + listener.Addr().String()
+	listener.Close()
+	location := newFakeHTTP2Proxy(t, upstream)
+
+	req, _ := http.NewRequest("POST", location+"/grpc", nil)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(location + "/grpc")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	headers := http.Header{
+		"Connection":        []string{"keep-alive, X-Custom"},
+		"Keep-Alive":        []string{"timeout=5"},
+		"X-Custom":          []string{"value"},
+		"Upgrade":           []string{"websocket"},
+		"Te":                []string{"trailers"},
+		"Transfer-Encoding": []string{"chunked"},
+		"Content-Type":      []string{"application/grpc"},
+	}
+	removeHopHeaders(headers)
+	assert.Equal(t, http.Header{
+		"Te":           []string{"trailers"},
+		"Content-Type": []string{"application/grpc"},
+	}, headers)
+}
+
+func TestIsGRPCRequest(t *testing.T) {
+	req := newFakeHTTPRequest("POST", "/service/method")
+	assert.False(t, isGRPCRequest(req))
+	req.Header.Set("Content-Type", "application/grpc")
+	assert.True(t, isGRPCRequest(req))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	assert.True(t, isGRPCRequest(req))
+}
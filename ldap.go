@@ -0,0 +1,175 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"gopkg.in/ldap.v2"
+)
+
+//
+// ldapAuthenticator authenticates the users with a simple bind against the directory, granting the configured
+// roles to the users whose entry matches the filter
+//
+type ldapAuthenticator struct {
+	// the url of the directory, ldap:// or ldaps://
+	location *url.URL
+	// the template of the bind dn, the escaped username replaces the %s
+	bindDN string
+	// the filter the entry of the user must match to be granted the roles
+	filter string
+	// the roles granted to the authenticated users
+	roles []string
+	// the timeout on the directory
+	timeout time.Duration
+	// the tls config of the ldaps directory
+	tlsConfig *tls.Config
+}
+
+//
+// newLDAPAuthenticator creates the ldap authenticator from the config
+//
+func newLDAPAuthenticator(config *Config) (*ldapAuthenticator, error) {
+	location, err := url.Parse(config.LDAPURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: strings.Split(location.Host, ":")[0]}
+	if err := applyTLSOptions(config, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	return &ldapAuthenticator{
+		location:  location,
+		bindDN:    config.LDAPBindDN,
+		filter:    config.LDAPFilter,
+		roles:     config.LDAPRoles,
+		timeout:   config.LDAPTimeout,
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// Name returns the name of the authenticator
+func (r *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+// Authenticate binds to the directory as the user and checks the entry of the user matches the filter
+func (r *ldapAuthenticator) Authenticate(username, password string) (*userContext, error) {
+	// step: an empty password is an unauthenticated bind (RFC 4513), which the directories accept
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	client, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	dn := fmt.Sprintf(r.bindDN, escapeLDAPDN(username))
+	if err := client.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	// step: a bind only proves the password, the entry of the user must match the filter (i.e. the membership of
+	// the admin group) to be granted the roles
+	result, err := client.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, int(r.timeout/time.Second), false, r.filter, []string{"1.1"}, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &userContext{
+		id:            username,
+		name:          username,
+		preferredName: username,
+		roles:         r.roles,
+		claims: jose.Claims{
+			"sub":              username,
+			claimPreferredName: username,
+		},
+		authenticator: r.Name(),
+	}, nil
+}
+
+//
+// dial connects to the directory, the deadline bounding the whole exchange
+//
+func (r *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	address := r.location.Host
+	if !strings.Contains(address, ":") {
+		address += map[string]string{"ldap": ":389", "ldaps": ":636"}[r.location.Scheme]
+	}
+	dialer := &net.Dialer{Timeout: r.timeout}
+
+	var conn net.Conn
+	var err error
+	if r.location.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ldap.NewConn(conn, r.location.Scheme == "ldaps")
+	client.Start()
+
+	return client, nil
+}
+
+//
+// escapeLDAPDN escapes the special characters of a value in a distinguished name (RFC 4514)
+//
+func escapeLDAPDN(value string) string {
+	var escaped []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			escaped = append(escaped, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			escaped = append(escaped, []byte(fmt.Sprintf("\\%02x", c))...)
+		default:
+			escaped = append(escaped, c)
+		}
+	}
+
+	return string(escaped)
+}
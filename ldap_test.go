@@ -0,0 +1,159 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const fakeLDAPFilter = "(memberOf=cn=break-glass,ou=groups,dc=example,dc=com)"
+
+// newFakeLDAPServer creates a directory accepting the binds of the dn with the password, the entry matching the
+// filter when member is set
+func newFakeLDAPServer(t *testing.T, dn, password string, member bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to create the listener, error: %s", err)
+	}
+	response := func(id interface{}, tag ber.Tag, code int, entry string) *ber.Packet {
+		packet := ber.NewSequence("message")
+		packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "id"))
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "response")
+		if tag == ldap.ApplicationSearchResultEntry {
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry, "dn"))
+			op.AppendChild(ber.NewSequence("attributes"))
+		} else {
+			op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "code"))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "dn"))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+		}
+		packet.AppendChild(op)
+
+		return packet
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var bound string
+				for {
+					request, err := ber.ReadPacket(conn)
+					if err != nil || len(request.Children) < 2 {
+						return
+					}
+					id, op := request.Children[0].Value, request.Children[1]
+					switch op.Tag {
+					case ldap.ApplicationBindRequest:
+						code := ldap.LDAPResultInvalidCredentials
+						if op.Children[1].Value == dn && string(op.Children[2].Data.Bytes()) == password {
+							code, bound = ldap.LDAPResultSuccess, dn
+						}
+						conn.Write(response(id, ldap.ApplicationBindResponse, code, "").Bytes())
+					case ldap.ApplicationSearchRequest:
+						if member && bound != "" && op.Children[0].Value == bound {
+							conn.Write(response(id, ldap.ApplicationSearchResultEntry, 0, bound).Bytes())
+						}
+						conn.Write(response(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "").Bytes())
+					default:
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return "ldap://" + listener.Addr().String()
+}
+
+func newFakeLDAPAuthenticator(t *testing.T, location string) *ldapAuthenticator {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("invalid ldap url, error: %s", err)
+	}
+
+	return &ldapAuthenticator{
+		location: u,
+		bindDN:   "uid=%s,ou=admins,dc=example,dc=com",
+		filter:   fakeLDAPFilter,
+		roles:    []string{fakeAdminRole},
+		timeout:  time.Duration(2) * time.Second,
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	ldap := newFakeLDAPAuthenticator(t, newFakeLDAPServer(t, "uid=admin,ou=admins,dc=example,dc=com", "secret", true))
+
+	user, err := ldap.Authenticate("admin", "secret")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "admin", user.name)
+	assert.Equal(t, []string{fakeAdminRole}, user.roles)
+	assert.True(t, user.isAuthenticator())
+	assert.False(t, user.hasToken())
+
+	_, err = ldap.Authenticate("admin", "wrong")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = ldap.Authenticate("admin", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = ldap.Authenticate("admin,ou=admins,dc=example,dc=com", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestLDAPAuthenticatorNotMatched(t *testing.T) {
+	ldap := newFakeLDAPAuthenticator(t, newFakeLDAPServer(t, "uid=admin,ou=admins,dc=example,dc=com", "secret", false))
+	user, err := ldap.Authenticate("admin", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	assert.Nil(t, user)
+}
+
+func TestLDAPAuthenticatorUnreachable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	ldap := newFakeLDAPAuthenticator(t, "ldap://"+listener.Addr().String())
+	_, err := ldap.Authenticate("admin", "secret")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+}
+
+func TestEscapeLDAPDN(t *testing.T) {
+	cs := []struct {
+		Value    string
+		Expected string
+	}{
+		{Value: "admin", Expected: "admin"},
+		{Value: "a,b", Expected: `a\,b`},
+		{Value: `a+b"c\d<e>f;g=h`, Expected: `a\+b\"c\\d\<e\>f\;g\=h`},
+		{Value: "#admin", Expected: `\#admin`},
+		{Value: "ad#min", Expected: "ad#min"},
+		{Value: " admin ", Expected: `\ admin\ `},
+		{Value: "ad\x00min", Expected: `ad\00min`},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, escapeLDAPDN(c.Value), "case %d", i)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+//
+// decodeListener decodes an additional listener, listen, listen=cert:key[:ca] or listen=https to redirect to https
+//
+func decodeListener(option string) (*Listener, error) {
+	items := strings.SplitN(option, "=", 2)
+	if items[0] == "" {
+		return nil, fmt.Errorf("invalid listener '%s' should be listen or listen=cert:key[:ca]", option)
+	}
+	listener := &Listener{Listen: items[0]}
+	if len(items) == 2 && items[1] == "https" {
+		listener.RedirectHTTPS = true
+		return listener, nil
+	}
+	if len(items) == 2 {
+		files := strings.Split(items[1], ":")
+		if (len(files) != 2 && len(files) != 3) || files[0] == "" || files[1] == "" {
+			return nil, fmt.Errorf("invalid listener '%s' should be listen or listen=cert:key[:ca]", option)
+		}
+		listener.TLSCertificate, listener.TLSPrivateKey = files[0], files[1]
+		if len(files) == 3 {
+			listener.TLSCaCertificate = files[2]
+		}
+	}
+
+	return listener, nil
+}
+
+//
+// isValid validates the additional listener
+//
+func (r *Listener) isValid() error {
+	if r.Listen == "" {
+		return fmt.Errorf("the additional listeners must have a listening interface")
+	}
+	if strings.HasPrefix(r.Listen, "unix://") {
+		if strings.TrimPrefix(r.Listen, "unix://") == "" {
+			return fmt.Errorf("the listener: %s does not have a path, should be unix:///path/to/socket", r.Listen)
+		}
+	} else if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+		return fmt.Errorf("the listener: %s is invalid, error: %s", r.Listen, err)
+	}
+	if (r.TLSCertificate != "") != (r.TLSPrivateKey != "") {
+		return fmt.Errorf("the listener: %s must have both a tls certificate and private key", r.Listen)
+	}
+	if r.RedirectHTTPS && r.TLSCertificate != "" {
+		return fmt.Errorf("the listener: %s redirects to https, it cannot have a tls certificate", r.Listen)
+	}
+	if r.TLSCaCertificate != "" && r.TLSCertificate == "" {
+		return fmt.Errorf("the listener: %s requires a tls certificate for mutual tls", r.Listen)
+	}
+	for _, x := range []string{r.TLSCertificate, r.TLSPrivateKey, r.TLSCaCertificate} {
+		if x != "" && !fileExists(x) {
+			return fmt.Errorf("the tls file: %s of the listener: %s does not exist", x, r.Listen)
+		}
+	}
+
+	return nil
+}
+
+//
+// createListener creates the listener of the interface, either host:port or unix://path
+//
+func createListener(listen string) (net.Listener, error) {
+	if !strings.HasPrefix(listen, "unix://") {
+		return net.Listen("tcp", listen)
+	}
+	socket := strings.TrimPrefix(listen, "unix://")
+	// step: delete the socket if it exists
+	if exists := fileExists(socket); exists {
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("listening on unix socket: %s", listen)
+
+	return net.Listen("unix", socket)
+}
+
+//
+// createAdditionalListener starts serving the router on an additional listener, with its own tls settings
+//
+func (r *oauthProxy) createAdditionalListener(config *Listener) error {
+	listener, err := createListener(config.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    config.Listen,
+		Handler: r.router,
+	}
+	// step: are we redirecting the plain http listener to https?
+	if config.RedirectHTTPS {
+		server.Handler = http.HandlerFunc(r.httpsRedirectHandler)
+	}
+
+	if config.TLSCertificate != "" {
+		tlsConfig := &tls.Config{NextProtos: []string{"http/1.1"}}
+		if err := applyTLSOptions(r.config, tlsConfig); err != nil {
+			return err
+		}
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertificate, config.TLSPrivateKey)
+		if err != nil {
+			return fmt.Errorf("unable to load the certificate: %s, error: %s", config.TLSCertificate, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+		// step: are we doing mutual tls on the listener?
+		if config.TLSCaCertificate != "" {
+			content, err := ioutil.ReadFile(config.TLSCaCertificate)
+			if err != nil {
+				return err
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			tlsConfig.ClientCAs.AppendCertsFromPEM(content)
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		if r.config.EnableHTTP2 {
+			tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			if err := http2.ConfigureServer(server, nil); err != nil {
+				return err
+			}
+		}
+		server.TLSConfig = tlsConfig
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	go func() {
+		log.WithFields(log.Fields{
+			"redirect": config.RedirectHTTPS,
+			"tls":      config.TLSCertificate != "",
+		}).Infof("keycloak proxy service starting on additional listener %s", config.Listen)
+
+		if err := server.Serve(listener); err != nil {
+			if atomic.LoadInt32(&r.reloading) > 0 {
+				return
+			}
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("failed to start the service on listener %s", config.Listen)
+		}
+	}()
+
+	return nil
+}
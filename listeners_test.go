@@ -0,0 +1,156 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeListener(t *testing.T) {
+	cases := []struct {
+		Option   string
+		Listener *Listener
+		Ok       bool
+	}{
+		{Option: "unix:///var/run/proxy.sock", Listener: &Listener{Listen: "unix:///var/run/proxy.sock"}, Ok: true},
+		{Option: ":8443=cert.pem:key.pem", Listener: &Listener{Listen: ":8443", TLSCertificate: "cert.pem", TLSPrivateKey: "key.pem"}, Ok: true},
+		{
+			Option:   ":8443=cert.pem:key.pem:ca.pem",
+			Listener: &Listener{Listen: ":8443", TLSCertificate: "cert.pem", TLSPrivateKey: "key.pem", TLSCaCertificate: "ca.pem"},
+			Ok:       true,
+		},
+		{Option: ":8080=https", Listener: &Listener{Listen: ":8080", RedirectHTTPS: true}, Ok: true},
+		{Option: ""},
+		{Option: "=cert.pem:key.pem"},
+		{Option: ":8443=cert.pem"},
+		{Option: ":8443=:key.pem"},
+		{Option: ":8443=a:b:c:d"},
+	}
+	for i, c := range cases {
+		listener, err := decodeListener(c.Option)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			assert.Equal(t, c.Listener, listener, "case %d", i)
+		}
+	}
+}
+
+func TestListenerIsValid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pair := newFakeCertificatePair(t, dir, "127.0.0.1")
+
+	cases := []struct {
+		Listener *Listener
+		Ok       bool
+	}{
+		{Listener: &Listener{Listen: ":8443"}, Ok: true},
+		{Listener: &Listener{Listen: "unix:///var/run/proxy.sock"}, Ok: true},
+		{Listener: &Listener{Listen: ":8443", TLSCertificate: pair.Certificate, TLSPrivateKey: pair.PrivateKey}, Ok: true},
+		{Listener: &Listener{Listen: ":8443", TLSCertificate: pair.Certificate, TLSPrivateKey: pair.PrivateKey, TLSCaCertificate: pair.Certificate}, Ok: true},
+		{Listener: &Listener{Listen: ":8080", RedirectHTTPS: true}, Ok: true},
+		{Listener: &Listener{Listen: ":8080", RedirectHTTPS: true, TLSCertificate: pair.Certificate, TLSPrivateKey: pair.PrivateKey}},
+		{Listener: &Listener{}},
+		{Listener: &Listener{Listen: "8443"}},
+		{Listener: &Listener{Listen: "unix://"}},
+		{Listener: &Listener{Listen: ":8443", TLSCertificate: pair.Certificate}},
+		{Listener: &Listener{Listen: ":8443", TLSCaCertificate: pair.Certificate}},
+		{Listener: &Listener{Listen: ":8443", TLSCertificate: "/no/such/cert", TLSPrivateKey: pair.PrivateKey}},
+	}
+	for i, c := range cases {
+		err := c.Listener.isValid()
+		if c.Ok {
+			assert.NoError(t, err, "case %d", i)
+		} else {
+			assert.Error(t, err, "case %d should have failed", i)
+		}
+	}
+
+	config := newFakeKeycloakConfig()
+	config.Listen = "127.0.0.1:3000"
+	config.Upstream = "http://127.0.0.1:8080"
+	config.Listeners = []*Listener{{Listen: "127.0.0.1:3000"}}
+	assert.Error(t, config.isValid())
+	config.Listeners = []*Listener{{Listen: "127.0.0.1:3443"}}
+	assert.NoError(t, config.isValid())
+	config.Listeners = []*Listener{{Listen: "127.0.0.1:3080", RedirectHTTPS: true}}
+	assert.Error(t, config.isValid())
+	config.TLSCertificate, config.TLSPrivateKey = pair.Certificate, pair.PrivateKey
+	assert.NoError(t, config.isValid())
+	config.CanonicalHostname = "app.example.com:443"
+	assert.Error(t, config.isValid())
+	config.CanonicalHostname = "app.example.com"
+	config.EnableGracefulReload = true
+	assert.Error(t, config.isValid())
+}
+
+func TestCreateAdditionalListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pair := newFakeCertificatePair(t, dir, "127.0.0.1")
+
+	proxy := newFakeKeycloakProxy(t)
+	plain := filepath.Join(dir, "plain.sock")
+	secure := filepath.Join(dir, "tls.sock")
+	require.NoError(t, proxy.createAdditionalListener(&Listener{Listen: "unix://" + plain}))
+	require.NoError(t, proxy.createAdditionalListener(&Listener{
+		Listen:         "unix://" + secure,
+		TLSCertificate: pair.Certificate,
+		TLSPrivateKey:  pair.PrivateKey,
+	}))
+
+	cases := []struct {
+		Socket string
+		TLS    bool
+	}{
+		{Socket: plain},
+		{Socket: secure, TLS: true},
+	}
+	for i, c := range cases {
+		socket := c.Socket
+		transport := &http.Transport{
+			Dial: func(network, address string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		location := "http://127.0.0.1" + oauthURL + healthURL
+		if c.TLS {
+			location = "https://127.0.0.1" + oauthURL + healthURL
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(location)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "case %d", i)
+		assert.Equal(t, c.TLS, resp.TLS != nil, "case %d", i)
+		resp.Body.Close()
+	}
+}
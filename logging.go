@@ -0,0 +1,218 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// journaldSocket is the native journald protocol socket
+	journaldSocket = "/run/systemd/journal/socket"
+	// syslogFacility is the facility the messages are logged under (daemon)
+	syslogFacility = 3
+)
+
+//
+// createLogOutput parses the log output and sets the destination for the application and access logs
+//
+func createLogOutput(output string) error {
+	switch output {
+	case "":
+		return nil
+	case "stderr":
+		log.SetOutput(os.Stderr)
+		return nil
+	case "stdout":
+		log.SetOutput(os.Stdout)
+		return nil
+	}
+
+	hook, err := newLogOutputHook(output)
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	log.SetOutput(ioutil.Discard)
+
+	return nil
+}
+
+//
+// newLogOutputHook creates a logging hook from the output i.e. syslog+tcp://127.0.0.1:601, journald
+//
+func newLogOutputHook(output string) (log.Hook, error) {
+	if output == "journald" {
+		return &logOutputHook{network: "unixgram", address: journaldSocket, encode: encodeJournaldEntry}, nil
+	}
+
+	location, err := url.Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("the log output is invalid, error: %s", err)
+	}
+	hook := &logOutputHook{address: location.Host, encode: encodeSyslogEntry}
+
+	switch location.Scheme {
+	case "syslog", "syslog+udp":
+		hook.network = "udp"
+	case "syslog+tcp":
+		hook.network = "tcp"
+		hook.framed = true
+	case "syslog+unix":
+		hook.network = "unixgram"
+		hook.address = location.Path
+	default:
+		return nil, fmt.Errorf("unsupported log output: %s, should be stdout, stderr, journald or syslog[+udp|+tcp|+unix]://", output)
+	}
+	if hook.address == "" {
+		return nil, fmt.Errorf("the log output: %s does not have an address", output)
+	}
+
+	return hook, nil
+}
+
+//
+// logOutputHook ships the log entries to a syslog or journald socket
+//
+type logOutputHook struct {
+	sync.Mutex
+	// the network type of the socket
+	network string
+	// the address of the socket
+	address string
+	// indicates the messages are octet counted (RFC 6587) on a stream
+	framed bool
+	// the encoder for the entry
+	encode func(*log.Entry) ([]byte, error)
+	// the current connection
+	conn net.Conn
+}
+
+// Levels returns the levels the hook is fired for
+func (r *logOutputHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+}
+
+// Fire encodes and writes the entry to the socket, reconnecting once on failure
+func (r *logOutputHook) Fire(entry *log.Entry) error {
+	message, err := r.encode(entry)
+	if err != nil {
+		return err
+	}
+	if r.framed {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if r.conn == nil {
+			if r.conn, err = net.DialTimeout(r.network, r.address, time.Duration(5)*time.Second); err != nil {
+				continue
+			}
+		}
+		if _, err = r.conn.Write(message); err == nil {
+			return nil
+		}
+		r.conn.Close()
+		r.conn = nil
+	}
+
+	return err
+}
+
+//
+// encodeSyslogEntry formats the entry as a RFC 5424 syslog message
+//
+func encodeSyslogEntry(entry *log.Entry) ([]byte, error) {
+	message, err := entry.String()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		syslogFacility*8+logSeverity(entry.Level),
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		hostname, prog, os.Getpid(),
+		strings.TrimSuffix(message, "\n"))), nil
+}
+
+//
+// encodeJournaldEntry formats the entry in the journald native protocol, with the fields as journal fields
+//
+func encodeJournaldEntry(entry *log.Entry) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	writeJournaldField(buffer, "MESSAGE", entry.Message)
+	writeJournaldField(buffer, "PRIORITY", fmt.Sprintf("%d", logSeverity(entry.Level)))
+	writeJournaldField(buffer, "SYSLOG_IDENTIFIER", prog)
+
+	for k, v := range entry.Data {
+		name := strings.ToUpper(symbolsFilter.ReplaceAllString(k, "_"))
+		if name == "" || strings.HasPrefix(name, "_") {
+			continue
+		}
+		writeJournaldField(buffer, name, fmt.Sprintf("%v", v))
+	}
+
+	return buffer.Bytes(), nil
+}
+
+//
+// writeJournaldField writes a field to the buffer, using the binary form for multiline values
+//
+func writeJournaldField(buffer *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buffer, "%s=%s\n", name, value)
+		return
+	}
+	buffer.WriteString(name + "\n")
+	binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+	buffer.WriteString(value + "\n")
+}
+
+//
+// logSeverity maps the log level to the syslog severity
+//
+func logSeverity(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogOutputHook(t *testing.T) {
+	cs := []struct {
+		Output  string
+		Network string
+		Ok      bool
+	}{
+		{Output: "journald", Network: "unixgram", Ok: true},
+		{Output: "syslog://127.0.0.1:514", Network: "udp", Ok: true},
+		{Output: "syslog+udp://127.0.0.1:514", Network: "udp", Ok: true},
+		{Output: "syslog+tcp://127.0.0.1:601", Network: "tcp", Ok: true},
+		{Output: "syslog+unix:///dev/log", Network: "unixgram", Ok: true},
+		{Output: "syslog+tcp://"},
+		{Output: "file:///var/log/proxy.log"},
+		{Output: "nothing"},
+	}
+	for i, c := range cs {
+		hook, err := newLogOutputHook(c.Output)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.Equal(t, c.Network, hook.(*logOutputHook).network, "case %d", i)
+	}
+}
+
+func TestEncodeSyslogEntry(t *testing.T) {
+	entry := newFakeLogEntry(log.WarnLevel, "access denied")
+	message, err := encodeSyslogEntry(entry)
+	assert.NoError(t, err)
+	// step: daemon facility (3) * 8 + warning (4)
+	assert.Regexp(t, regexp.MustCompile(`^<28>1 \S+ \S+ keycloak-proxy \d+ - - .*access denied`), string(message))
+}
+
+func TestEncodeJournaldEntry(t *testing.T) {
+	entry := newFakeLogEntry(log.ErrorLevel, "line one\nline two")
+	entry.Data = log.Fields{"client_ip": "127.0.0.1"}
+	message, err := encodeJournaldEntry(entry)
+	assert.NoError(t, err)
+	assert.Contains(t, string(message), "PRIORITY=3\n")
+	assert.Contains(t, string(message), "CLIENT_IP=127.0.0.1\n")
+	assert.Contains(t, string(message), "SYSLOG_IDENTIFIER=keycloak-proxy\n")
+	// step: multiline messages should use the binary encoding
+	assert.True(t, strings.HasPrefix(string(message), "MESSAGE\n"))
+}
+
+func TestLogOutputHookFire(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	hook, err := newLogOutputHook("syslog://" + listener.LocalAddr().String())
+	assert.NoError(t, err)
+	assert.NoError(t, hook.Fire(newFakeLogEntry(log.InfoLevel, "hello")))
+
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := listener.ReadFrom(buffer)
+	assert.NoError(t, err)
+	assert.Contains(t, string(buffer[:n]), "<30>1 ")
+}
+
+func newFakeLogEntry(level log.Level, message string) *log.Entry {
+	logger := log.New()
+	logger.Formatter = &log.TextFormatter{DisableColors: true}
+	entry := log.NewEntry(logger)
+	entry.Level = level
+	entry.Message = message
+	entry.Time = time.Now()
+
+	return entry
+}
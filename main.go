@@ -21,6 +21,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 )
 
@@ -34,6 +35,7 @@ func main() {
 	kc.Email = email
 	kc.UsageText = "keycloak-proxy [options]"
 	kc.Flags = getOptions()
+	kc.Commands = []cli.Command{getValidateCommand()}
 	kc.Action = func(cx *cli.Context) error {
 		// step: do we have a configuration file?
 		if filename := cx.String("config"); filename != "" {
@@ -45,26 +47,76 @@ func main() {
 		if err := readOptions(cx, config); err != nil {
 			return printError(err.Error())
 		}
+		// step: read the secrets held in files
+		if err := loadSecretFiles(config); err != nil {
+			return printError(err.Error())
+		}
+		// step: retrieve the credentials held in vault
+		vault, err := loadVaultSecrets(config)
+		if err != nil {
+			return printError(err.Error())
+		}
 		// step: validate the configuration
+		config.normalize()
 		if err := config.isValid(); err != nil {
 			return printError(err.Error())
 		}
+		if config.EnableConfigReload && cx.String("config") == "" {
+			return printError("the configuration reload requires a configuration file")
+		}
+		// step: print the effective configuration if requested
+		if cx.Bool("print-config") {
+			content, err := printEffectiveConfig(config)
+			if err != nil {
+				return printError(err.Error())
+			}
+			fmt.Print(content)
+			return nil
+		}
 		// step: create the proxy
 		proxy, err := newProxy(config)
 		if err != nil {
 			return printError(err.Error())
 		}
+		proxy.vault = vault
 		// step: start the service
 		if err := proxy.Run(); err != nil {
 			return printError(err.Error())
 		}
+		// step: tell the previous process we are serving, if we were started by a reload
+		if err := signalReady(); err != nil {
+			return printError(err.Error())
+		}
+		// step: are we reloading the service when the configuration file changes?
+		if config.EnableConfigReload {
+			filename := cx.String("config")
+			log.Infof("watching the configuration file: %s for changes every %s", filename, config.ConfigReloadInterval)
+			go watchFiles(proxy.done, newFileWatcher([]string{filename}), config.ConfigReloadInterval, func() error {
+				return checkConfigFile(cx, filename)
+			})
+		}
 		// step: setup the termination signals
-		signalChannel := make(chan os.Signal)
-		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		signalChannel := make(chan os.Signal, 1)
+		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR2)
 
-		<-signalChannel
+		for {
+			if sig := <-signalChannel; sig != syscall.SIGUSR2 {
+				return nil
+			}
+			// step: are we handing the listener to a new process?
+			if !config.EnableGracefulReload {
+				log.Warnf("ignoring the reload signal, graceful reloads are not enabled")
+				continue
+			}
+			if err := proxy.Reload(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to reload the service")
+				continue
+			}
 
-		return nil
+			return nil
+		}
 	}
 	kc.Run(os.Args)
 }
@@ -0,0 +1,168 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+//
+// maintenanceSwitch holds whether the service is in maintenance, toggled at runtime
+//
+type maintenanceSwitch struct {
+	sync.RWMutex
+	// whether the service is in maintenance
+	enabled bool
+	// when the switch was last toggled
+	changed time.Time
+	// who last toggled the switch
+	changedBy string
+}
+
+//
+// newMaintenanceSwitch creates the switch, starting in maintenance if configured
+//
+func newMaintenanceSwitch(enabled bool) *maintenanceSwitch {
+	return &maintenanceSwitch{enabled: enabled, changed: time.Now()}
+}
+
+//
+// isEnabled checks if the service is in maintenance
+//
+func (r *maintenanceSwitch) isEnabled() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.enabled
+}
+
+//
+// set toggles the maintenance of the service
+//
+func (r *maintenanceSwitch) set(enabled bool, by string, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.enabled = enabled
+	r.changed = now
+	r.changedBy = by
+}
+
+//
+// status returns the state of the switch
+//
+func (r *maintenanceSwitch) status() gin.H {
+	r.RLock()
+	defer r.RUnlock()
+
+	return gin.H{
+		"enabled":    r.enabled,
+		"changed":    r.changed.Format(time.RFC3339),
+		"changed_by": r.changedBy,
+	}
+}
+
+//
+// maintenanceHandler refuses the requests to the resources which are not white-listed while the service is in
+// maintenance, the users holding a maintenance role are permitted through
+//
+func (r *oauthProxy) maintenanceHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if !r.maintenance.isEnabled() {
+			return
+		}
+		if resource := getResource(cx); resource != nil && resource.WhiteListed {
+			return
+		}
+
+		// step: the unprotected paths carry no identity, the session or bearer token is consulted and verified
+		var user *userContext
+		if uc, found := cx.Get(userContextName); found {
+			user = uc.(*userContext)
+		} else if identity, err := r.getIdentity(cx); err == nil {
+			if r.config.SkipTokenVerification || r.verifyAccessToken(identity) == nil {
+				user = identity
+			}
+		}
+		if user != nil && r.isMaintenanceUser(user) {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"path":      cx.Request.URL.Path,
+		}).Debugf("refusing the request, the service is in maintenance")
+
+		r.errorResponse(cx, http.StatusServiceUnavailable, reasonMaintenance)
+	}
+}
+
+//
+// maintenanceStatusHandler returns the state of the maintenance switch
+//
+func (r *oauthProxy) maintenanceStatusHandler(cx *gin.Context) {
+	if _, ok := r.getMaintenanceUser(cx); !ok {
+		return
+	}
+	cx.JSON(http.StatusOK, r.maintenance.status())
+}
+
+//
+// maintenanceToggleHandler toggles the service in and out of maintenance, e.g. POST /oauth/maintenance?enabled=true;
+// the sessions held in a cookie must submit the csrf token
+//
+func (r *oauthProxy) maintenanceToggleHandler(cx *gin.Context) {
+	user, ok := r.getMaintenanceUser(cx)
+	if !ok {
+		return
+	}
+	if user.isCookieSession() && !r.checkCSRFToken(cx, user) {
+		return
+	}
+	enabled, err := strconv.ParseBool(cx.Request.FormValue("enabled"))
+	if err != nil {
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return
+	}
+	r.maintenance.set(enabled, user.name, time.Now())
+
+	log.WithFields(log.Fields{
+		"enabled":  enabled,
+		"username": user.name,
+	}).Warnf("the maintenance of the service was toggled by: %s", user.name)
+
+	cx.JSON(http.StatusOK, r.maintenance.status())
+}
+
+//
+// getMaintenanceUser retrieves the verified identity of the request, refusing the users without a maintenance role
+//
+func (r *oauthProxy) getMaintenanceUser(cx *gin.Context) (*userContext, bool) {
+	return r.getPrivilegedUser(cx, r.config.MaintenanceRoles)
+}
+
+//
+// isMaintenanceUser checks if the user holds any of the maintenance roles
+//
+func (r *oauthProxy) isMaintenanceUser(user *userContext) bool {
+	return hasAnyRole(r.config.MaintenanceRoles, user.roles)
+}
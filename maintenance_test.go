@@ -0,0 +1,119 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeMaintenanceProxy(t *testing.T) *oauthProxy {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/public", Methods: []string{"ANY"}, WhiteListed: true},
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.MaintenanceRoles = []string{"role:operator"}
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+
+	return proxy
+}
+
+func newFakeMaintenanceToken(t *testing.T, roles ...string) *jose.JWT {
+	return newFakeJWTToken(t, jose.Claims{
+		"aud":                "test",
+		"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"preferred_username": "operator",
+		"exp":                time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		"realm_access": map[string]interface{}{
+			"roles": roles,
+		},
+	})
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	proxy := newFakeMaintenanceProxy(t)
+	operator := newFakeMaintenanceToken(t, "role:operator")
+	user := newFakeMaintenanceToken(t, "role:user")
+	proxy.maintenance.set(true, "test", time.Now())
+
+	cases := []struct {
+		URI   string
+		Token *jose.JWT
+		Code  int
+	}{
+		{URI: "/public/index.html", Code: http.StatusOK},
+		{URI: "/orders", Token: user, Code: http.StatusServiceUnavailable},
+		{URI: "/orders", Token: operator, Code: http.StatusOK},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", c.URI)
+		if c.Token != nil {
+			req.Header.Set("Authorization", "Bearer "+c.Token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+}
+
+func TestMaintenanceToggleHandler(t *testing.T) {
+	proxy := newFakeMaintenanceProxy(t)
+	proxy.config.CSRFCookieName = "kc-csrf"
+	proxy.config.CSRFHeader = "X-CSRF-Token"
+	cases := []struct {
+		Query   string
+		Token   *jose.JWT
+		Cookie  bool
+		CSRF    string
+		Code    int
+		Enabled bool
+	}{
+		{Query: "enabled=true", Code: http.StatusUnauthorized},
+		{Query: "enabled=true", Token: newFakeMaintenanceToken(t, "role:user"), Code: http.StatusForbidden},
+		{Query: "enabled=bad", Token: newFakeMaintenanceToken(t, "role:operator"), Code: http.StatusBadRequest},
+		{Query: "enabled=true", Token: newFakeMaintenanceToken(t, "role:operator"), Code: http.StatusOK, Enabled: true},
+		{Query: "enabled=false", Token: newFakeMaintenanceToken(t, "role:operator"), Code: http.StatusOK},
+		// step: the sessions held in a cookie must submit the csrf token
+		{Query: "enabled=true", Token: newFakeMaintenanceToken(t, "role:operator"), Cookie: true, Code: http.StatusForbidden},
+		{Query: "enabled=true", Token: newFakeMaintenanceToken(t, "role:operator"), Cookie: true, CSRF: "bad", Code: http.StatusForbidden},
+		{Query: "enabled=true", Token: newFakeMaintenanceToken(t, "role:operator"), Cookie: true, CSRF: "token", Code: http.StatusOK, Enabled: true},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("POST", oauthURL+maintenanceURL)
+		req.URL.RawQuery = c.Query
+		switch {
+		case c.Cookie:
+			req.AddCookie(&http.Cookie{Name: proxy.config.CookieAccessName, Value: c.Token.Encode()})
+			req.AddCookie(&http.Cookie{Name: proxy.config.CSRFCookieName, Value: "token"})
+			req.Header.Set(proxy.config.CSRFHeader, c.CSRF)
+		case c.Token != nil:
+			req.Header.Set("Authorization", "Bearer "+c.Token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Enabled, proxy.maintenance.isEnabled(), "case %d", i)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// resourceRequestsMetric is the number of upstream requests per resource with a latency objective
+	resourceRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_resource_requests_total",
+			Help: "The number of upstream requests for resources with a latency objective",
+		},
+		[]string{"resource"},
+	)
+	// resourceLatencyBreachesMetric is the number of upstream requests over the latency objective
+	resourceLatencyBreachesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_resource_latency_slo_breaches_total",
+			Help: "The number of upstream requests which took longer than the latency objective of the resource",
+		},
+		[]string{"resource"},
+	)
+	// resourceLatencyObjectiveMetric is the latency objective of the resource
+	resourceLatencyObjectiveMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_resource_latency_slo_seconds",
+			Help: "The latency objective of the resource in seconds",
+		},
+		[]string{"resource"},
+	)
+	// auditDenialsMetric is the number of requests permitted which the admission would have denied
+	auditDenialsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_audit_denials_total",
+			Help: "The number of requests permitted in the audit only mode which would have been denied",
+		},
+		[]string{"resource", "reason"},
+	)
+	// upstreamHealthMetric is the health of the upstream endpoints
+	upstreamHealthMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_upstream_healthy",
+			Help: "Whether the upstream endpoint is passing the health checks (1) or not (0)",
+		},
+		[]string{"upstream"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(resourceRequestsMetric)
+	prometheus.MustRegister(resourceLatencyBreachesMetric)
+	prometheus.MustRegister(resourceLatencyObjectiveMetric)
+	prometheus.MustRegister(upstreamHealthMetric)
+	prometheus.MustRegister(auditDenialsMetric)
+}
+
+//
+// recordResourceLatency records the upstream latency of a request against the objective of the resource
+//
+func recordResourceLatency(resource *Resource, latency time.Duration) {
+	resourceRequestsMetric.WithLabelValues(resource.URL).Inc()
+	if latency > resource.LatencySLO {
+		resourceLatencyBreachesMetric.WithLabelValues(resource.URL).Inc()
+	}
+}
@@ -16,7 +16,11 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
@@ -30,6 +34,10 @@ import (
 const (
 	// cxEnforce is the tag name for a request requiring
 	cxEnforce = "Enforcing"
+	// cxResource is the tag name for the resource matching the path of the request, whatever the method
+	cxResource = "Resource"
+	// cxPeerAddress is the tag name for the address of the trusted proxy which forwarded the request
+	cxPeerAddress = "PeerAddress"
 )
 
 //
@@ -53,6 +61,20 @@ func (r *oauthProxy) loggingHandler() gin.HandlerFunc {
 	}
 }
 
+//
+// clientAddressHandler replaces the address of a trusted proxy with that of the client from the forwarding headers
+//
+func (r *oauthProxy) clientAddressHandler() gin.HandlerFunc {
+	trusted, _ := parseCIDRs(r.config.TrustedProxies)
+
+	return func(cx *gin.Context) {
+		if address := getClientAddress(cx.Request, trusted); address != "" {
+			cx.Set(cxPeerAddress, cx.Request.RemoteAddr)
+			cx.Request.RemoteAddr = net.JoinHostPort(address, "0")
+		}
+	}
+}
+
 //
 // entryPointHandler checks to see if the request requires authentication
 //
@@ -63,17 +85,12 @@ func (r oauthProxy) entryPointHandler() gin.HandlerFunc {
 			return
 		}
 
-		// step: check if authentication is required - gin doesn't support wildcard url, so we have have to use prefixes
-		for _, resource := range r.config.Resources {
-			if strings.HasPrefix(cx.Request.URL.Path, resource.URL) {
-				if resource.WhiteListed {
-					break
-				}
-				// step: inject the resource into the context, saves us from doing this again
-				if containedIn("ANY", resource.Methods) || containedIn(cx.Request.Method, resource.Methods) {
-					cx.Set(cxEnforce, resource)
-				}
-				break
+		// step: check if authentication is required - gin doesn't support wildcard url, so we have have to use prefixes;
+		// the matched resource is injected into the context, saves us from doing this again
+		if resource := r.matchResource(cx.Request.URL.Path); resource != nil {
+			cx.Set(cxResource, resource)
+			if !resource.WhiteListed && resource.hasMethod(cx.Request.Method) {
+				cx.Set(cxEnforce, resource)
 			}
 		}
 		// step: pass into the authentication, admission and proxy handlers
@@ -93,13 +110,52 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 			return
 		}
 
-		// step: grab the user identity from the request
-		user, err := r.getIdentity(cx)
+		// step: move any session held in the legacy cookie names
+		if len(r.config.LegacyCookieNames) > 0 {
+			r.migrateLegacyCookies(cx)
+		}
+
+		// step: a token handed in the query is stripped from the url before the client is sent on
+		if r.hasQueryToken(cx) {
+			r.queryTokenHandler(cx)
+			return
+		}
+
+		// step: grab the user identity from a token handed in the query, else the request, else a client
+		// certificate if permitted
+		user, err := r.getIdentityFromQueryCookie(cx)
+		if err == ErrSessionNotFound {
+			user, err = r.getIdentity(cx)
+		}
+		if err == ErrSessionNotFound && r.config.EnableClientCertAuth {
+			user, err = r.getIdentityFromCertificate(cx)
+		}
+		if err == ErrSessionNotFound && r.isAPIKeyResource(cx) {
+			user, err = r.getIdentityFromAPIKey(cx)
+		}
+		if err != nil && r.isBasicAuthResource(cx) && hasBasicAuth(cx.Request) {
+			user, err = r.getIdentityFromBasicAuth(cx)
+		}
+		if err != nil && r.isBreakGlassResource(cx) && hasBasicAuth(cx.Request) {
+			user, err = r.getIdentityFromAuthenticator(cx)
+		}
+		if err == ErrSessionNotFound && r.config.EnableSignedURLs && hasURLSignature(cx.Request) {
+			user, err = r.getIdentityFromSignedURL(cx)
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err.Error(),
 			}).Errorf("no session found in request, redirecting for authorization")
 
+			// step: the tools speaking basic auth are challenged rather than redirected
+			if r.acceptsBasicCredentials(cx) && (err == ErrInvalidCredentials || !isBrowserRequest(cx.Request)) {
+				reason := reasonUnauthenticated
+				if err == ErrInvalidCredentials {
+					reason = reasonInvalidCredentials
+				}
+				r.errorResponse(cx, http.StatusUnauthorized, reason)
+				return
+			}
 			r.redirectToAuthorization(cx)
 			return
 		}
@@ -107,6 +163,55 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 		// step: inject the user into the context
 		cx.Set(userContextName, user)
 
+		// step: a client certificate has already been verified by the tls handshake, an api key by the lookup and
+		// the credentials by the authenticator
+		if !user.hasToken() {
+			return
+		}
+
+		// step: a certificate bound token must be presented with the same client certificate
+		if r.config.EnableCertificateBoundTokens && !isBoundToConnection(user.claims, cx.Request) {
+			log.WithFields(log.Fields{
+				"username":  user.name,
+				"client_ip": cx.ClientIP(),
+			}).Warnf("the access token is bound to a different client certificate")
+
+			r.errorResponse(cx, http.StatusUnauthorized, reasonCertificateMismatch)
+			return
+		}
+
+		// step: a newer login by the user ends the session
+		if r.config.SingleSession && !user.isBearer() {
+			superseded, err := r.isSessionSuperseded(user)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to retrieve the session from the store")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
+			}
+			if superseded {
+				r.sessionSuperseded(cx, user)
+				return
+			}
+		}
+
+		// step: pick up the access token refreshed in the background, recording the session as active
+		if r.refresher != nil && !user.isBearer() {
+			if refreshed, found := r.getRefreshedSession(user); found {
+				log.WithFields(log.Fields{
+					"email":   refreshed.email,
+					"expires": refreshed.expiresAt.Format(time.RFC1123),
+				}).Debugf("injecting the access token refreshed in the background")
+
+				user = refreshed
+				cx.Set(userContextName, user)
+				r.dropAccessTokenCookie(cx, user.token.Encode(), r.getSessionDuration(user))
+			}
+			r.refresher.touch(user, time.Now())
+		}
+
 		// step: verify the access token
 		if r.config.SkipTokenVerification {
 			log.Warnf("skip token verification enabled, skipping verification process - FOR TESTING ONLY")
@@ -124,7 +229,7 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 		}
 
 		// step: verify the access token
-		if err := verifyToken(r.client, user.token); err != nil {
+		if err := r.verifyAccessToken(user); err != nil {
 
 			// step: if the error post verification is anything other than a token expired error
 			// we immediately throw an access forbidden - as there is something messed up in the token
@@ -133,7 +238,23 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 					"error": err.Error(),
 				}).Errorf("verification of the access token failed")
 
-				r.accessForbidden(cx)
+				// step: a bearer token is challenged (RFC 6750) so the client can obtain a new one
+				if user.isBearer() {
+					r.errorResponse(cx, http.StatusUnauthorized, reasonInvalidToken)
+					return
+				}
+				r.accessForbidden(cx, reasonInvalidToken)
+				return
+			}
+
+			// step: an expired bearer token is challenged when we are not redirecting
+			if user.isBearer() && r.noRedirects(cx) {
+				log.WithFields(log.Fields{
+					"email":      user.name,
+					"expired_on": user.expiresAt.String(),
+				}).Errorf("the bearer token has expired")
+
+				r.errorResponse(cx, http.StatusUnauthorized, reasonTokenExpired)
 				return
 			}
 
@@ -167,10 +288,19 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 			// step: check if the user has refresh token
 			rToken, err := r.retrieveRefreshToken(cx, user)
 			if err != nil {
-				log.WithFields(log.Fields{
-					"email": user.email,
-					"error": err.Error(),
-				}).Errorf("unable to find a refresh token for the client: %s", user.email)
+				switch err {
+				case ErrSessionNotFound, ErrNoSessionStateFound:
+					// step: the session never had a refresh token, clear the session and start again
+					log.WithFields(log.Fields{
+						"email": user.email,
+					}).Warnf("the session for user: %s has no refresh token, redirecting for authentication", user.email)
+					r.clearSessionCookies(cx)
+				default:
+					log.WithFields(log.Fields{
+						"email": user.email,
+						"error": err.Error(),
+					}).Errorf("unable to find a refresh token for the client: %s", user.email)
+				}
 
 				r.redirectToAuthorization(cx)
 				return
@@ -187,7 +317,7 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 				switch err {
 				case ErrRefreshTokenExpired:
 					log.WithFields(log.Fields{"token": token}).Warningf("the refresh token has expired")
-					r.clearAllCookies(cx)
+					r.clearSessionCookies(cx)
 				default:
 					log.WithFields(log.Fields{"error": err.Error()}).Errorf("failed to refresh the access token")
 				}
@@ -203,7 +333,7 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 			}).Infof("injecting refreshed access token, expires on: %s", expires.Format(time.RFC1123))
 
 			// step: clear the cookie up
-			r.dropAccessTokenCookie(cx, token.Encode(), r.config.IdleDuration)
+			r.dropAccessTokenCookie(cx, token.Encode(), r.getSessionDuration(user))
 
 			if r.useStore() {
 				go func(t jose.JWT, rt string) {
@@ -225,7 +355,7 @@ func (r *oauthProxy) authenticationHandler() gin.HandlerFunc {
 				}(user.token, rToken)
 			} else {
 				// step: update the expiration on the refresh token
-				r.dropRefreshTokenCookie(cx, rToken, r.config.IdleDuration*2)
+				r.dropRefreshTokenCookie(cx, rToken, r.getRefreshDuration(user))
 			}
 
 			// step: update the with the new access token
@@ -248,6 +378,47 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 	for k, v := range r.config.MatchClaims {
 		claimMatches[k] = regexp.MustCompile(v)
 	}
+	// step: parse the networks for the resources, these have already been validated
+	allowed := make(map[*Resource][]*net.IPNet, 0)
+	denied := make(map[*Resource][]*net.IPNet, 0)
+	// step: compile the policies and access windows of the resources, these have already been validated
+	policies := make(map[*Resource]*policy, 0)
+	windows := make(map[*Resource][]*accessWindow, 0)
+	for _, resource := range r.config.Resources {
+		for _, x := range resource.AccessWindows {
+			if window, err := newAccessWindow(x); err == nil {
+				windows[resource] = append(windows[resource], window)
+			}
+		}
+		allowed[resource], _ = parseCIDRs(resource.AllowedCIDRs)
+		denied[resource], _ = parseCIDRs(resource.DeniedCIDRs)
+		if resource.Policy != "" {
+			policies[resource], _ = newPolicy(resource.Policy)
+		}
+	}
+	// step: create the clients for the policy services, without them the decisions are errors and denied
+	opa, err := createServiceHTTPClient(r.config, r.config.OpenPolicyAgentTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to create the client for the open policy agent")
+	}
+	authorizer, err := createServiceHTTPClient(r.config, r.config.AuthorizerTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to create the client for the external authorizers")
+	}
+	decisions := newAuthorizerCache()
+	// step: create the client for the keycloak authorization services
+	var uma *http.Client
+	if r.config.isFeatureEnabled(featureUMA) {
+		if uma, err = createHTTPClient(r.config); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to create the client for the keycloak authorization services")
+		}
+	}
 
 	return func(cx *gin.Context) {
 		// step: if authentication is required on this, grab the resource spec
@@ -265,22 +436,140 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 		resource := ur.(*Resource)
 		user := uc.(*userContext)
 
-		// step: check the audience for the token is us
-		if r.config.ClientID != "" && !user.isAudience(r.config.ClientID) {
+		// step: the authorization denials of an audited resource are logged and the remaining checks evaluated,
+		// the request permitted; the checks on the token and the client address are always enforced
+		audited := r.config.AuditOnly || resource.AuditOnly
+		deny := func(reason string) bool {
+			if audited {
+				r.auditDenial(cx, resource, reason)
+				return false
+			}
+			r.accessForbidden(cx, reason)
+			return true
+		}
+
+		// step: check the client address is permitted on the resource
+		if len(allowed[resource]) > 0 || len(denied[resource]) > 0 {
+			address := net.ParseIP(cx.ClientIP())
+			if address == nil || containsAddress(denied[resource], address) ||
+				(len(allowed[resource]) > 0 && !containsAddress(allowed[resource], address)) {
+				log.WithFields(log.Fields{
+					"access":    "denied",
+					"username":  user.name,
+					"resource":  resource.URL,
+					"client_ip": cx.ClientIP(),
+				}).Warnf("access denied, client address not permitted")
+
+				r.accessForbidden(cx, reasonAddressDenied)
+				return
+			}
+		}
+
+		// step: check the resource is accessible at this time
+		if !isWithinAccessWindows(windows[resource], time.Now()) {
+			log.WithFields(log.Fields{
+				"access":    "denied",
+				"username":  user.name,
+				"resource":  resource.URL,
+				"client_ip": cx.ClientIP(),
+			}).Warnf("access denied, the request is outside the access windows of the resource")
+
+			if deny(reasonOutsideWindow) {
+				return
+			}
+		}
+
+		// step: check the user authenticated recently enough for the resource, else the user must authenticate again
+		if resource.MaxTokenAge > 0 && user.hasToken() && !user.isAuthenticatedWithin(resource.MaxTokenAge, time.Now()) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+				"max_age":  resource.MaxTokenAge.String(),
+			}).Warnf("access denied, the user authenticated too long ago, requesting authentication")
+
+			r.redirectToReauthentication(cx, user)
+			return
+		}
+
+		// step: the remembered sessions must authenticate again for the resources requiring a fresh session
+		if resource.DisableRememberMe && r.config.EnableRememberMe && user.isOffline() {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+			}).Warnf("access denied, the resource does not accept a remembered session, requesting authentication")
+
+			r.redirectToReauthentication(cx, user)
+			return
+		}
+
+		// step: check the authentication of the user is strong enough for the resource, else ask them to step up
+		if (resource.MinimumACR != "" || len(resource.RequiredAMR) > 0) && !r.isSteppedUp(user, resource) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+				"acr":      resource.MinimumACR,
+				"amr":      strings.Join(resource.RequiredAMR, ","),
+			}).Warnf("access denied, the authentication is not strong enough, requesting a step up")
+
+			r.redirectToStepUp(cx, user, resource)
+			return
+		}
+
+		// step: check the assertion accompanying the access token
+		if resource.RequireAssertion {
+			assertion := cx.Request.Header.Get(r.config.AssertionHeader)
+			if err := verifyAssertion(assertion, user, r.assertions, getAcceptedAudiences(r.config), time.Now()); err != nil {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"username": user.name,
+					"resource": resource.URL,
+					"error":    err.Error(),
+				}).Warnf("access denied, the assertion failed verification")
+
+				r.accessForbidden(cx, reasonInvalidAssertion)
+				return
+			}
+		}
+
+		// step: check the token was issued to an accepted audience
+		if user.hasToken() && !r.isAcceptedAudience(user) {
 			log.WithFields(log.Fields{
 				"username":   user.name,
 				"expired_on": user.expiresAt.String(),
-				"issued":     user.audience,
-				"clientid":   r.config.ClientID,
+				"issued":     strings.Join(user.audiences, ","),
+				"azp":        user.authorizedParty,
+				"accepted":   strings.Join(getAcceptedAudiences(r.config), ","),
+				"validation": r.config.AudienceValidation,
 			}).Warnf("the access token audience is not us, redirecting back for authentication")
 
-			r.accessForbidden(cx)
+			r.accessForbidden(cx, reasonInvalidAudience)
 			return
 		}
 
+		// step: check the user does not hold a role denied access to the resource
+		if len(resource.DeniedRoles) > 0 && hasAnyRole(resource.DeniedRoles, user.roles) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+				"denied":   strings.Join(resource.DeniedRoles, ","),
+			}).Warnf("access denied, the user holds a denied role")
+
+			if deny(reasonRoleDenied) {
+				return
+			}
+		}
+
 		// step: we need to check the roles
 		if roles := len(resource.Roles); roles > 0 {
-			if !hasRoles(resource.Roles, user.roles) {
+			permitted := hasRoles(resource.Roles, user.roles)
+			if resource.RequireAnyRole {
+				permitted = hasAnyRole(resource.Roles, user.roles)
+			}
+			if !permitted {
 				log.WithFields(log.Fields{
 					"access":   "denied",
 					"username": user.name,
@@ -288,7 +577,22 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 					"required": resource.GetRoles(),
 				}).Warnf("access denied, invalid roles")
 
-				r.accessForbidden(cx)
+				if deny(reasonInsufficientRoles) {
+					return
+				}
+			}
+		}
+
+		// step: check the token was granted the scopes required by the resource
+		if len(resource.Scopes) > 0 && !user.hasScopes(resource.Scopes) {
+			log.WithFields(log.Fields{
+				"access":   "denied",
+				"username": user.name,
+				"resource": resource.URL,
+				"required": strings.Join(resource.Scopes, ","),
+			}).Warnf("access denied, insufficient scopes")
+
+			if deny(reasonInsufficientScope) {
 				return
 			}
 		}
@@ -305,8 +609,10 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 					"error":    err.Error(),
 				}).Errorf("unable to extract the claim from token")
 
-				r.accessForbidden(cx)
-				return
+				if deny(reasonClaimMismatch) {
+					return
+				}
+				continue
 			}
 
 			if !found {
@@ -317,8 +623,10 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 					"claim":    claimName,
 				}).Warnf("the token does not have the claim")
 
-				r.accessForbidden(cx)
-				return
+				if deny(reasonClaimMismatch) {
+					return
+				}
+				continue
 			}
 
 			// step: check the claim is the same
@@ -332,9 +640,138 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 					"required": match,
 				}).Warnf("the token claims does not match claim requirement")
 
-				r.accessForbidden(cx)
+				if deny(reasonClaimMismatch) {
+					return
+				}
+			}
+		}
+
+		// step: evaluate the policy of the resource, an error in the evaluation denies access
+		if check, found := policies[resource]; found {
+			permitted, err := check.evaluate(newPolicyEnvironment(cx, user))
+			if err != nil || !permitted {
+				fields := log.Fields{
+					"access":   "denied",
+					"username": user.name,
+					"resource": resource.URL,
+					"policy":   check.expression,
+				}
+				if err != nil {
+					fields["error"] = err.Error()
+				}
+				log.WithFields(fields).Warnf("access denied, the request does not satisfy the policy")
+
+				if deny(reasonPolicyDenied) {
+					return
+				}
+			}
+		}
+
+		// step: ask the open policy agent for a decision
+		if r.config.OpenPolicyAgentURL != "" {
+			input := newOpenPolicyAgentInput(r.config, cx, user, resource)
+			permitted, err := queryOpenPolicyAgent(opa, r.config.OpenPolicyAgentURL, input)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"username": user.name,
+					"resource": resource.URL,
+					"error":    err.Error(),
+				}).Errorf("unable to retrieve a decision from the open policy agent")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
 				return
 			}
+			if !permitted {
+				log.WithFields(log.Fields{
+					"access":   "denied",
+					"username": user.name,
+					"resource": resource.URL,
+				}).Warnf("access denied by the open policy agent")
+
+				if deny(reasonPolicyDenied) {
+					return
+				}
+			}
+		}
+
+		// step: consult the external authorizer of the resource, the decisions are cached for the ttl
+		if resource.Authorizer != "" {
+			content, err := json.Marshal(newOpenPolicyAgentInput(r.config, cx, user, resource))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to encode the input of the authorizer")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
+			}
+			key := authorizerDecisionKey(resource.Authorizer, content)
+			permitted, found := decisions.get(key, time.Now())
+			if !found {
+				permitted, err = queryAuthorizer(authorizer, resource.Authorizer, content)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"username":   user.name,
+						"resource":   resource.URL,
+						"authorizer": resource.Authorizer,
+						"error":      err.Error(),
+					}).Errorf("unable to retrieve a decision from the authorizer")
+
+					r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+					return
+				}
+				if resource.AuthorizerTTL > 0 {
+					decisions.set(key, permitted, time.Now().Add(resource.AuthorizerTTL), time.Now())
+				}
+			}
+			if !permitted {
+				log.WithFields(log.Fields{
+					"access":     "denied",
+					"username":   user.name,
+					"resource":   resource.URL,
+					"authorizer": resource.Authorizer,
+				}).Warnf("access denied by the authorizer")
+
+				if deny(reasonPolicyDenied) {
+					return
+				}
+			}
+		}
+
+		// step: check the keycloak authorization services grant the permissions
+		if len(resource.UMAPermissions) > 0 {
+			token := user.token.Encode()
+			key := umaDecisionKey(token, resource.UMAPermissions)
+			permitted, found := decisions.get(key, time.Now())
+			if !found {
+				var err error
+				permitted, err = requestUMADecision(uma, r.provider.TokenEndpoint, r.config.ClientID, token, resource.UMAPermissions)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"username": user.name,
+						"resource": resource.URL,
+						"error":    err.Error(),
+					}).Errorf("unable to retrieve a decision from the keycloak authorization services")
+
+					r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+					return
+				}
+				if r.config.UMACacheTTL > 0 {
+					decisions.set(key, permitted, time.Now().Add(r.config.UMACacheTTL), time.Now())
+				}
+			}
+			if !permitted {
+				log.WithFields(log.Fields{
+					"access":      "denied",
+					"username":    user.name,
+					"resource":    resource.URL,
+					"permissions": strings.Join(resource.UMAPermissions, ","),
+				}).Warnf("access denied by the keycloak authorization services")
+
+				if deny(reasonPolicyDenied) {
+					return
+				}
+			}
 		}
 
 		log.WithFields(log.Fields{
@@ -347,28 +784,303 @@ func (r *oauthProxy) admissionHandler() gin.HandlerFunc {
 }
 
 //
-// crossOriginResourceHandler injects the CORS headers, if set, for request made to /oauth
+// clientRateLimitHandler limits the requests made by a client address, ahead of the authentication so the clients
+// refused a session are limited too; the token of an authenticated request is handed back, as the subject is
+// limited by the rateLimitHandler
 //
-func (r *oauthProxy) crossOriginResourceHandler(c CORS) gin.HandlerFunc {
+func (r *oauthProxy) clientRateLimitHandler() gin.HandlerFunc {
+	// step: create the limiters for any resources with their own limits
+	limiters := make(map[*Resource]*rateLimiter, 0)
+	for _, resource := range r.config.Resources {
+		if resource.RateLimit != nil && resource.RateLimit.isEnabled() {
+			limiters[resource] = newRateLimiter(*resource.RateLimit)
+		}
+	}
+	var global *rateLimiter
+	if r.config.RateLimit.isEnabled() {
+		global = newRateLimiter(r.config.RateLimit)
+	}
+
 	return func(cx *gin.Context) {
-		if len(c.Origins) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Origin", strings.Join(c.Origins, ","))
+		// step: use the resource limiter if there is one, else the global
+		limiter := global
+		if ur, found := cx.Get(cxEnforce); found {
+			if x, found := limiters[ur.(*Resource)]; found {
+				limiter = x
+			}
+		}
+		if limiter == nil {
+			return
+		}
+
+		key := cx.ClientIP()
+		if allowed, wait := limiter.allow(key); !allowed {
+			log.WithFields(log.Fields{
+				"client": key,
+				"path":   cx.Request.URL.Path,
+				"wait":   wait.String(),
+			}).Warnf("rate limit exceeded for client: %s", key)
+
+			cx.Writer.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			r.errorResponse(cx, http.StatusTooManyRequests, reasonRateLimited)
+			return
+		}
+
+		cx.Next()
+
+		if _, found := cx.Get(userContextName); found {
+			limiter.release(key)
+		}
+	}
+}
+
+//
+// rateLimitHandler is responsible for limiting the requests made by an authenticated client, keyed on the subject
+//
+func (r *oauthProxy) rateLimitHandler() gin.HandlerFunc {
+	// step: create the limiters for any resources with their own limits
+	limiters := make(map[*Resource]clientLimiter, 0)
+	for _, resource := range r.config.Resources {
+		if resource.RateLimit != nil && resource.RateLimit.isEnabled() {
+			limiters[resource] = newRateLimiter(*resource.RateLimit)
+		}
+	}
+	var global clientLimiter
+	if r.config.RateLimit.isEnabled() {
+		global = newRateLimiter(r.config.RateLimit)
+	}
+	// step: create the limiters for the tiers, held in the store if we have one
+	tiers := make(map[string]clientLimiter, 0)
+	if r.config.RateLimitClaim != "" {
+		for name, limit := range r.config.RateLimitTiers {
+			if !limit.isEnabled() {
+				continue
+			}
+			if r.useStore() {
+				tiers[name] = newStoreRateLimiter(r.store, name, limit)
+			} else {
+				tiers[name] = newRateLimiter(limit)
+			}
+		}
+	}
+
+	return func(cx *gin.Context) {
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
+		}
+		user := uc.(*userContext)
+
+		// step: use the resource limiter if there is one, else the tier of the user, else the global
+		limiter := global
+		if len(tiers) > 0 {
+			if tier, found, _ := user.claims.StringClaim(r.config.RateLimitClaim); found {
+				if x, found := tiers[tier]; found {
+					limiter = x
+				}
+			}
+		}
+		if ur, found := cx.Get(cxEnforce); found {
+			if x, found := limiters[ur.(*Resource)]; found {
+				limiter = x
+			}
+		}
+		if limiter == nil {
+			return
+		}
+
+		key := user.id
+		if allowed, wait := limiter.allow(key); !allowed {
+			log.WithFields(log.Fields{
+				"client": key,
+				"path":   cx.Request.URL.Path,
+				"wait":   wait.String(),
+			}).Warnf("rate limit exceeded for client: %s", key)
+
+			cx.Writer.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			r.errorResponse(cx, http.StatusTooManyRequests, reasonRateLimited)
+			return
+		}
+	}
+}
+
+//
+// quotaHandler enforces the daily and monthly quotas of the authenticated subjects
+//
+func (r *oauthProxy) quotaHandler() gin.HandlerFunc {
+	periods := getQuotaPeriods(r.config.Quota)
+
+	return func(cx *gin.Context) {
+		if len(periods) <= 0 || !r.useStore() {
+			return
+		}
+		uc, found := cx.Get(userContextName)
+		if !found {
+			return
 		}
-		if len(c.Methods) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ","))
+		user := uc.(*userContext)
+
+		// step: key on the claim if set, else the subject
+		key := user.id
+		if r.config.Quota.Claim != "" {
+			value, found, err := user.claims.StringClaim(r.config.Quota.Claim)
+			if err != nil || !found {
+				log.WithFields(log.Fields{
+					"username": user.name,
+					"claim":    r.config.Quota.Claim,
+				}).Warnf("the quota claim is not in the token, falling back to the subject")
+			} else {
+				key = value
+			}
+		}
+
+		usage, exceeded, err := consumeQuota(r.store, periods, key, time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"client": key,
+				"error":  err.Error(),
+			}).Errorf("unable to update the quota in the store")
+
+			return
+		}
+		cx.Writer.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", usage.limit))
+		cx.Writer.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", usage.remaining))
+		cx.Writer.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", usage.reset.Unix()))
+
+		if exceeded {
+			log.WithFields(log.Fields{
+				"client": key,
+				"path":   cx.Request.URL.Path,
+				"reset":  usage.reset.String(),
+			}).Warnf("quota exceeded for client: %s", key)
+
+			cx.Writer.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(usage.reset.Sub(time.Now()).Seconds()))))
+			r.errorResponse(cx, http.StatusTooManyRequests, reasonQuotaExceeded)
+			return
+		}
+	}
+}
+
+//
+// latencyObjectiveHandler measures the upstream latency of resources with a latency objective
+//
+func (r *oauthProxy) latencyObjectiveHandler() gin.HandlerFunc {
+	for _, resource := range r.config.Resources {
+		if resource.LatencySLO > 0 {
+			resourceLatencyObjectiveMetric.WithLabelValues(resource.URL).Set(resource.LatencySLO.Seconds())
+		}
+	}
+
+	return func(cx *gin.Context) {
+		if !r.config.EnableMetrics {
+			return
+		}
+		ur, found := cx.Get(cxEnforce)
+		if !found || ur.(*Resource).LatencySLO <= 0 {
+			return
+		}
+		start := time.Now()
+		cx.Next()
+		// step: upgraded and failed connections are not counted
+		if cx.IsAborted() {
+			return
 		}
-		if len(c.Headers) > 0 {
-			cx.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ","))
+		recordResourceLatency(ur.(*Resource), time.Now().Sub(start))
+	}
+}
+
+//
+// crossOriginResourceHandler injects the CORS headers, if set, for request made to /oauth
+//
+func (r *oauthProxy) crossOriginResourceHandler(c CORS) gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		setCrossOriginHeaders(cx, c)
+		if c.Preflight && isPreflightRequest(cx.Request) {
+			answerPreflight(cx, c)
 		}
-		if len(c.ExposedHeaders) > 0 {
-			cx.Writer.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ","))
+	}
+}
+
+//
+// resourceCrossOriginHandler injects the CORS headers of the resource being accessed, if set; the headers are
+// added ahead of the authentication so the browser can read the errors
+//
+func (r *oauthProxy) resourceCrossOriginHandler() gin.HandlerFunc {
+	return func(cx *gin.Context) {
+		if resource := getResource(cx); resource != nil && resource.CrossOrigin != nil {
+			setCrossOriginHeaders(cx, *resource.CrossOrigin)
+			// step: the browsers never attach the credentials to a preflight, so it is answered here
+			if resource.CrossOrigin.Preflight && isPreflightRequest(cx.Request) {
+				answerPreflight(cx, *resource.CrossOrigin)
+			}
 		}
-		if c.Credentials {
-			cx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+//
+// isPreflightRequest checks if the request is a cors preflight
+//
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+//
+// answerPreflight answers the cors preflight, refusing the origins which are not permitted
+//
+func answerPreflight(cx *gin.Context, c CORS) {
+	if cx.Writer.Header().Get("Access-Control-Allow-Origin") == "" {
+		cx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	cx.AbortWithStatus(http.StatusNoContent)
+}
+
+//
+// getAllowedOrigin returns the origin permitted for the request, the wildcard when the credentials are not permitted,
+// else the origin of the request only when found in the list
+//
+func getAllowedOrigin(req *http.Request, origins []string, credentials bool) string {
+	origin := req.Header.Get("Origin")
+	if !credentials && containedIn("*", origins) {
+		return "*"
+	}
+	if origin != "" && containedIn(origin, origins) {
+		return origin
+	}
+
+	return ""
+}
+
+//
+// setCrossOriginHeaders adds the CORS headers to the response
+//
+func setCrossOriginHeaders(cx *gin.Context, c CORS) {
+	if len(c.Origins) > 0 {
+		// step: the response varies with the origin unless the wildcard is permitted
+		origin := getAllowedOrigin(cx.Request, c.Origins, c.Credentials)
+		if origin != "*" {
+			cx.Writer.Header().Add("Vary", "Origin")
 		}
-		if c.MaxAge > 0 {
-			cx.Writer.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.MaxAge.Seconds())))
+		if origin == "" {
+			return
 		}
+		cx.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if len(c.Methods) > 0 {
+		cx.Writer.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ","))
+	}
+	if len(c.Headers) > 0 {
+		cx.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ","))
+	}
+	if len(c.ExposedHeaders) > 0 {
+		cx.Writer.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ","))
+	}
+	if c.Credentials {
+		cx.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.MaxAge > 0 {
+		cx.Writer.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", int(c.MaxAge.Seconds())))
 	}
 }
 
@@ -377,38 +1089,138 @@ func (r *oauthProxy) crossOriginResourceHandler(c CORS) gin.HandlerFunc {
 //
 func (r *oauthProxy) upstreamHeadersHandler(custom []string) gin.HandlerFunc {
 	// step: we don't wanna do this every time, quicker to perform once
+	preset := upstreamPresets[r.config.UpstreamPreset]
+	if preset != nil {
+		custom = append(append([]string{}, custom...), preset.claims...)
+	}
 	customClaims := make(map[string]string)
 	for _, x := range custom {
-		customClaims[x] = fmt.Sprintf("X-Auth-%s", toHeader(x))
+		customClaims[x] = r.config.identityHeader(x, toHeader(x))
+	}
+	userIDHeader := r.config.identityHeader("userid", "Userid")
+	subjectHeader := r.config.identityHeader("subject", "Subject")
+	usernameHeader := r.config.identityHeader("username", "Username")
+	emailHeader := r.config.identityHeader("email", "Email")
+	expiresHeader := r.config.identityHeader("expiresin", "ExpiresIn")
+	rolesHeader := r.config.identityHeader("roles", "Roles")
+	tokenHeader := r.config.identityHeader("token", "Token")
+	claimsHeader := r.config.identityHeader("claims", "Claims")
+	identityHeaders := []string{userIDHeader, subjectHeader, usernameHeader, emailHeader, expiresHeader, rolesHeader,
+		tokenHeader, claimsHeader}
+	for _, x := range customClaims {
+		identityHeaders = append(identityHeaders, x)
+	}
+	// step: the assertion is for us to verify, it's not passed on to the upstream
+	if len(r.config.AssertionIssuers) > 0 && r.config.AssertionHeader != "" {
+		identityHeaders = append(identityHeaders, r.config.AssertionHeader)
 	}
 
 	return func(cx *gin.Context) {
+		// step: the identity headers must only come from us
+		for _, x := range identityHeaders {
+			cx.Request.Header.Del(x)
+		}
+
 		// step: add a custom headers to the request
 		for k, v := range r.config.Headers {
 			cx.Request.Header.Add(k, v)
 		}
 
+		// step: are we forwarding a reference to the claims in place of the identity?
+		user, found := cx.Get(userContextName)
+		if found && r.config.EnableReferenceTokens {
+			id := user.(*userContext)
+			reference, err := r.createReferenceToken(id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to create the reference token")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
+			}
+			cx.Request.Header.Del(authorizationHeader)
+			cx.Request.Header.Set(subjectHeader, id.id)
+			cx.Request.Header.Set(referenceHeader, reference)
+		}
+
 		// step: retrieve the user context if any
-		if user, found := cx.Get(userContextName); found {
+		if found && !r.config.EnableReferenceTokens {
 			id := user.(*userContext)
-			cx.Request.Header.Add("X-Auth-Userid", id.name)
-			cx.Request.Header.Add("X-Auth-Subject", id.id)
-			cx.Request.Header.Add("X-Auth-Username", id.name)
-			cx.Request.Header.Add("X-Auth-Email", id.email)
-			cx.Request.Header.Add("X-Auth-ExpiresIn", id.expiresAt.String())
-			cx.Request.Header.Add("X-Auth-Token", id.token.Encode())
-			cx.Request.Header.Add("X-Auth-Roles", strings.Join(id.roles, ","))
-			cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", id.token.Encode()))
+			cx.Request.Header.Add(userIDHeader, id.name)
+			cx.Request.Header.Add(subjectHeader, id.id)
+			cx.Request.Header.Add(usernameHeader, id.name)
+			cx.Request.Header.Add(emailHeader, id.email)
+			cx.Request.Header.Add(expiresHeader, id.expiresAt.String())
+			if roles := upstreamRoles(id.roles, r.config.UpstreamRoleMappings, preset); preset == nil || len(roles) > 0 {
+				cx.Request.Header.Add(rolesHeader, strings.Join(roles, ","))
+			}
+			// step: a certificate, api key or authenticator identity has no token to pass on
+			if id.hasToken() {
+				token := id.token.Encode()
+				// step: are we exchanging the token for one issued to the upstream?
+				if r.config.TokenExchangeAudience != "" {
+					exchanged, err := r.exchangeToken(id.token, time.Now())
+					if err != nil {
+						log.WithFields(log.Fields{
+							"audience": r.config.TokenExchangeAudience,
+							"error":    err.Error(),
+						}).Errorf("unable to exchange the access token for the upstream")
+
+						r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+						return
+					}
+					token = exchanged
+				}
+				cx.Request.Header.Add(tokenHeader, token)
+				cx.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			}
+
+			// step: forward all the claims in a single header?
+			if r.config.ClaimsHeader != "" && len(id.claims) > 0 {
+				if value, err := encodeClaims(id.claims, r.config.ClaimsHeader); err == nil {
+					cx.Request.Header.Set(claimsHeader, value)
+				}
+			}
 
 			// step: inject any custom claims
 			for claim, header := range customClaims {
-				if claim, found := id.claims[claim]; found {
-					cx.Request.Header.Add(header, fmt.Sprintf("%v", claim))
+				if value, found := lookupClaim(id.claims, claim); found {
+					cx.Request.Header.Add(header, formatClaim(value))
 				}
 			}
 		}
-		// step: add the default headers
-		cx.Request.Header.Add("X-Forwarded-For", cx.Request.RemoteAddr)
+		// step: remove the headers the upstream must not see
+		if r.config.OmitAuthorizationHeader {
+			cx.Request.Header.Del(authorizationHeader)
+		}
+		for _, x := range r.config.OmitIdentityHeaders {
+			cx.Request.Header.Del(x)
+		}
+		// step: are we authenticating the proxy to the upstream with the service account?
+		if r.config.EnableServiceToken {
+			token, err := r.getServiceToken(time.Now())
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Errorf("unable to obtain the service account token for the upstream")
+
+				r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+				return
+			}
+			cx.Request.Header.Set(r.config.ServiceTokenHeader, "Bearer "+token)
+		}
+		// step: add the default headers, the forwarding headers are only passed on from a trusted proxy
+		peer := cx.Request.RemoteAddr
+		if address, found := cx.Get(cxPeerAddress); found {
+			peer = address.(string)
+		} else {
+			cx.Request.Header.Del("X-Forwarded-For")
+			cx.Request.Header.Del("X-Real-IP")
+		}
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			cx.Request.Header.Add("X-Forwarded-For", host)
+		}
 		cx.Request.Header.Set("X-Forwarded-Agent", prog)
 		cx.Request.Header.Set("X-Forwarded-Host", cx.Request.Host)
 	}
@@ -418,13 +1230,23 @@ func (r *oauthProxy) upstreamHeadersHandler(custom []string) gin.HandlerFunc {
 // securityHandler performs numerous security checks on the request
 //
 func (r *oauthProxy) securityHandler() gin.HandlerFunc {
-	// step: create the security options
-	secure := secure.New(secure.Options{
-		AllowedHosts:       r.config.Hostnames,
-		BrowserXssFilter:   true,
-		ContentTypeNosniff: true,
-		FrameDeny:          true,
-	})
+	headers := r.config.SecurityHeaders
+	// step: create the security options, the strict transport header is sent on tls or behind a tls terminating proxy
+	options := secure.Options{
+		AllowedHosts:          r.config.Hostnames,
+		BrowserXssFilter:      !headers.DisableXSSFilter,
+		ContentTypeNosniff:    !headers.DisableNoSniff,
+		FrameDeny:             !headers.DisableFrameOptions,
+		ContentSecurityPolicy: headers.ContentSecurityPolicy,
+		STSSeconds:            int64(headers.HSTSMaxAge.Seconds()),
+		STSIncludeSubdomains:  headers.HSTSIncludeSubdomains,
+		STSPreload:            headers.HSTSPreload,
+		SSLProxyHeaders:       map[string]string{"X-Forwarded-Proto": "https"},
+	}
+	if !headers.DisableFrameOptions {
+		options.CustomFrameOptionsValue = headers.FrameOptions
+	}
+	secure := secure.New(options)
 
 	return func(cx *gin.Context) {
 		// step: pass through the security middleware
@@ -436,8 +1258,49 @@ func (r *oauthProxy) securityHandler() gin.HandlerFunc {
 			cx.Abort()
 			return
 		}
+		if headers.ReferrerPolicy != "" {
+			cx.Writer.Header().Set("Referrer-Policy", headers.ReferrerPolicy)
+		}
+
+		// step: override or remove any protections the resource has opted out of
+		if resource := getResource(cx); resource != nil {
+			if resource.FrameOptions != "" {
+				cx.Writer.Header().Set("X-Frame-Options", resource.FrameOptions)
+			}
+			if resource.ContentSecurityPolicy != "" {
+				cx.Writer.Header().Set("Content-Security-Policy", resource.ContentSecurityPolicy)
+			}
+			if resource.ReferrerPolicy != "" {
+				cx.Writer.Header().Set("Referrer-Policy", resource.ReferrerPolicy)
+			}
+			if resource.DisableFrameDeny {
+				cx.Writer.Header().Del("X-Frame-Options")
+			}
+			if resource.DisableNoSniff {
+				cx.Writer.Header().Del("X-Content-Type-Options")
+			}
+		}
 
 		// step: permit the request to continue
 		cx.Next()
 	}
 }
+
+//
+// auditDenial logs the request the admission of the audited resource would have denied
+//
+func (r *oauthProxy) auditDenial(cx *gin.Context, resource *Resource, reason string) {
+	fields := log.Fields{
+		"access":    "audit",
+		"resource":  resource.URL,
+		"reason":    reason,
+		"client_ip": cx.ClientIP(),
+		"path":      cx.Request.URL.Path,
+	}
+	if uc, found := cx.Get(userContextName); found {
+		fields["username"] = uc.(*userContext).name
+	}
+	log.WithFields(fields).Warnf("AUDIT ONLY: the request would have been denied, permitting")
+
+	auditDenialsMetric.WithLabelValues(resource.URL, reason).Inc()
+}
@@ -16,9 +16,14 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gambol99/go-oidc/jose"
 	"github.com/gin-gonic/gin"
@@ -178,6 +183,72 @@ func TestEntrypointHandler(t *testing.T) {
 	}
 }
 
+// TestResourceMatching pins down the matching of the requests to the resources, as documented in the readme
+func TestResourceMatching(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/admin/white_listed", WhiteListed: true, Methods: []string{"ANY"}},
+		{URL: "/admin", Methods: []string{"GET", "POST"}},
+		{URL: "/admin-panel", Methods: []string{"ANY"}},
+		{URL: "/api/*", Methods: []string{"ANY"}},
+		{URL: "/files.v[0-9]", Methods: []string{"ANY"}},
+		{URL: "/", Methods: []string{"ANY"}},
+	})
+	handler := proxy.entryPointHandler()
+
+	tests := []struct {
+		Method string
+		Path   string
+		// the resource enforced on the request, empty if the request is passed through
+		Enforced string
+		// the resource the upstream options are taken from, i.e. strip-prefix, rewrite-path
+		Matched string
+	}{
+		// the proxy handles its own endpoints, they never match a resource
+		{Method: "GET", Path: oauthURL + healthURL},
+		// the first resource which is a prefix of the path is selected
+		{Method: "GET", Path: "/", Enforced: "/", Matched: "/"},
+		{Method: "GET", Path: "/admin", Enforced: "/admin", Matched: "/admin"},
+		{Method: "POST", Path: "/admin/users", Enforced: "/admin", Matched: "/admin"},
+		// the prefix is not bounded on a path segment, a resource listed earlier can shadow a later one
+		{Method: "GET", Path: "/administrator", Enforced: "/admin", Matched: "/admin"},
+		{Method: "GET", Path: "/admin-panel", Enforced: "/admin", Matched: "/admin"},
+		// a method outside the resource is passed through, it does not fall through to the later resources
+		{Method: "DELETE", Path: "/admin", Matched: "/admin"},
+		{Method: "PUT", Path: "/admin/users", Matched: "/admin"},
+		// a white-listed resource is passed through, whatever the method
+		{Method: "GET", Path: "/admin/white_listed", Matched: "/admin/white_listed"},
+		{Method: "DELETE", Path: "/admin/white_listed/x", Matched: "/admin/white_listed"},
+		// the matching is case sensitive
+		{Method: "GET", Path: "/ADMIN", Enforced: "/", Matched: "/"},
+		// there are no glob or regex patterns, the uri is taken literally
+		{Method: "GET", Path: "/api/users", Enforced: "/", Matched: "/"},
+		{Method: "GET", Path: "/api/*/users", Enforced: "/api/*", Matched: "/api/*"},
+		{Method: "GET", Path: "/files.v1", Enforced: "/", Matched: "/"},
+		{Method: "GET", Path: "/files.v[0-9]/a", Enforced: "/files.v[0-9]", Matched: "/files.v[0-9]"},
+		// the path is matched as received, it is not cleaned
+		{Method: "GET", Path: "/admin/../public", Enforced: "/admin", Matched: "/admin"},
+	}
+
+	for i, c := range tests {
+		cx := newFakeGinContext(c.Method, c.Path)
+		handler(cx)
+		enforced := ""
+		if resource, found := cx.Get(cxEnforce); found {
+			enforced = resource.(*Resource).URL
+		}
+		assert.Equal(t, c.Enforced, enforced, "case %d, %s %s enforced", i, c.Method, c.Path)
+
+		if strings.HasPrefix(c.Path, oauthURL) {
+			continue
+		}
+		matched := ""
+		if resource := getResource(cx); resource != nil {
+			matched = resource.URL
+		}
+		assert.Equal(t, c.Matched, matched, "case %d, %s %s matched", i, c.Method, c.Path)
+	}
+}
+
 func TestSecurityHandler(t *testing.T) {
 	kc := newFakeKeycloakProxy(t)
 	handler := kc.securityHandler()
@@ -203,11 +274,129 @@ func TestSecurityHandler(t *testing.T) {
 		"we should have received a 500 not %d", context.Writer.Status())
 }
 
+func TestSecurityHandlerHeaders(t *testing.T) {
+	kc := newFakeKeycloakProxy(t)
+	kc.config.SecurityHeaders = SecurityHeaders{
+		HSTSMaxAge:            time.Duration(24) * time.Hour,
+		HSTSIncludeSubdomains: true,
+		ContentSecurityPolicy: "default-src 'self'",
+		ReferrerPolicy:        "same-origin",
+		FrameOptions:          "SAMEORIGIN",
+		DisableXSSFilter:      true,
+	}
+	handler := kc.securityHandler()
+
+	// step: the strict transport header is only sent over tls
+	context := newFakeGinContext("GET", "/")
+	handler(context)
+	assert.Empty(t, context.Writer.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "default-src 'self'", context.Writer.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "same-origin", context.Writer.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "SAMEORIGIN", context.Writer.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", context.Writer.Header().Get("X-Content-Type-Options"))
+	assert.Empty(t, context.Writer.Header().Get("X-XSS-Protection"))
+
+	context = newFakeGinContext("GET", "/")
+	context.Request.Header.Set("X-Forwarded-Proto", "https")
+	handler(context)
+	assert.Equal(t, "max-age=86400; includeSubdomains", context.Writer.Header().Get("Strict-Transport-Security"))
+
+	kc.config.SecurityHeaders = SecurityHeaders{DisableFrameOptions: true, DisableNoSniff: true}
+	handler = kc.securityHandler()
+	context = newFakeGinContext("GET", "/")
+	handler(context)
+	assert.Empty(t, context.Writer.Header().Get("X-Frame-Options"))
+	assert.Empty(t, context.Writer.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "1; mode=block", context.Writer.Header().Get("X-XSS-Protection"))
+}
+
+func TestUpstreamForwardingHeaders(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	handler := p.upstreamHeadersHandler(nil)
+
+	// step: the forwarding headers from an untrusted client are dropped
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	context.Request.Header.Set("X-Real-IP", "10.0.0.1")
+	handler(context)
+	assert.Equal(t, []string{"127.0.0.1"}, context.Request.Header["X-Forwarded-For"])
+	assert.Empty(t, context.Request.Header.Get("X-Real-IP"))
+
+	// step: the forwarding headers from a trusted proxy are extended with the proxy
+	p.config.TrustedProxies = []string{"127.0.0.0/8"}
+	context = newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	p.clientAddressHandler()(context)
+	handler(context)
+	assert.Equal(t, "10.0.0.1:0", context.Request.RemoteAddr)
+	assert.Equal(t, []string{"10.0.0.1", "127.0.0.1"}, context.Request.Header["X-Forwarded-For"])
+}
+
+func TestSecurityHandlerResourceOverrides(t *testing.T) {
+	kc := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:              "/dashboard",
+			Methods:          []string{"GET"},
+			DisableFrameDeny: true,
+		},
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	})
+	handler := kc.securityHandler()
+	entrypoint := kc.entryPointHandler()
+
+	context := newFakeGinContext("GET", "/dashboard/view")
+	entrypoint(context)
+	handler(context)
+	assert.Empty(t, context.Writer.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", context.Writer.Header().Get("X-Content-Type-Options"))
+
+	context = newFakeGinContext("GET", "/admin")
+	entrypoint(context)
+	handler(context)
+	assert.Equal(t, "DENY", context.Writer.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", context.Writer.Header().Get("X-Content-Type-Options"))
+}
+
+func TestSecurityHandlerResourceHeaders(t *testing.T) {
+	kc := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:                   "/embed",
+			Methods:               []string{"GET"},
+			WhiteListed:           true,
+			FrameOptions:          "SAMEORIGIN",
+			ContentSecurityPolicy: "frame-ancestors 'self'",
+		},
+	})
+	kc.config.SecurityHeaders = SecurityHeaders{
+		ContentSecurityPolicy: "default-src 'self'",
+		ReferrerPolicy:        "same-origin",
+	}
+	handler := kc.securityHandler()
+	entrypoint := kc.entryPointHandler()
+
+	context := newFakeGinContext("GET", "/embed/chart")
+	entrypoint(context)
+	handler(context)
+	assert.Equal(t, "SAMEORIGIN", context.Writer.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'self'", context.Writer.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "same-origin", context.Writer.Header().Get("Referrer-Policy"))
+
+	context = newFakeGinContext("GET", "/admin")
+	entrypoint(context)
+	handler(context)
+	assert.Equal(t, "DENY", context.Writer.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "default-src 'self'", context.Writer.Header().Get("Content-Security-Policy"))
+}
+
 func TestCrossSiteHandler(t *testing.T) {
 	proxy := newFakeKeycloakProxy(t)
 
 	cases := []struct {
 		Cors    CORS
+		Origin  string
 		Headers map[string]string
 	}{
 		{
@@ -220,12 +409,25 @@ func TestCrossSiteHandler(t *testing.T) {
 		},
 		{
 			Cors: CORS{
-				Origins: []string{"*", "https://examples.com"},
+				Origins: []string{"https://other.com", "https://examples.com"},
 				Methods: []string{"GET"},
 			},
+			Origin: "https://examples.com",
 			Headers: map[string]string{
-				"Access-Control-Allow-Origin":  "*,https://examples.com",
+				"Access-Control-Allow-Origin":  "https://examples.com",
 				"Access-Control-Allow-Methods": "GET",
+				"Vary":                         "Origin",
+			},
+		},
+		{
+			Cors: CORS{
+				Origins:     []string{"https://examples.com"},
+				Credentials: true,
+			},
+			Origin: "https://examples.com",
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://examples.com",
+				"Access-Control-Allow-Credentials": "true",
 			},
 		},
 	}
@@ -234,6 +436,9 @@ func TestCrossSiteHandler(t *testing.T) {
 		handler := proxy.crossOriginResourceHandler(c.Cors)
 		// call the handler and check the responses
 		context := newFakeGinContext("GET", "/oauth/test")
+		if c.Origin != "" {
+			context.Request.Header.Set("Origin", c.Origin)
+		}
 		handler(context)
 		// step: check the headers
 		for k, v := range c.Headers {
@@ -250,6 +455,102 @@ func TestCrossSiteHandler(t *testing.T) {
 	}
 }
 
+func TestGetAllowedOrigin(t *testing.T) {
+	cases := []struct {
+		Origins     []string
+		Credentials bool
+		Origin      string
+		Expected    string
+	}{
+		{Origins: []string{"*"}, Origin: "https://app.example.com", Expected: "*"},
+		{Origins: []string{"*"}, Credentials: true, Origin: "https://evil.example.com"},
+		{Origins: []string{"https://app.example.com"}, Credentials: true, Origin: "https://app.example.com", Expected: "https://app.example.com"},
+		{Origins: []string{"https://app.example.com"}, Credentials: true, Origin: "https://evil.example.com"},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", "/")
+		req.Header.Set("Origin", c.Origin)
+		assert.Equal(t, c.Expected, getAllowedOrigin(req, c.Origins, c.Credentials), "case %d", i)
+	}
+}
+
+func TestResourceCrossSiteHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/api",
+			Methods:     []string{"ANY"},
+			CrossOrigin: &CORS{Origins: []string{"https://app.example.com"}, Methods: []string{"GET", "POST"}},
+		},
+		{
+			URL:     "/admin",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	cases := []struct {
+		URI     string
+		Origin  string
+		Methods string
+	}{
+		{URI: "/api/orders", Origin: "https://app.example.com", Methods: "GET,POST"},
+		{URI: "/admin/users"},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.Header.Set("Origin", "https://app.example.com")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		// step: the headers are present on the refused requests as well
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Origin, recorder.Header().Get("Access-Control-Allow-Origin"), "case %d", i)
+		assert.Equal(t, c.Methods, recorder.Header().Get("Access-Control-Allow-Methods"), "case %d", i)
+	}
+}
+
+func TestCrossSitePreflight(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/api",
+			Methods: []string{"ANY"},
+			CrossOrigin: &CORS{
+				Origins:   []string{"https://app.example.com"},
+				Methods:   []string{"GET", "POST"},
+				Preflight: true,
+			},
+		},
+		{
+			URL:         "/legacy",
+			Methods:     []string{"ANY"},
+			CrossOrigin: &CORS{Origins: []string{"https://app.example.com"}},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.CrossOrigin = CORS{Origins: []string{"https://app.example.com"}, Preflight: true}
+	proxy.createEndpoints()
+
+	cases := []struct {
+		URI    string
+		Origin string
+		Code   int
+	}{
+		{URI: "/api/orders", Origin: "https://app.example.com", Code: http.StatusNoContent},
+		{URI: "/api/orders", Origin: "https://evil.example.com", Code: http.StatusForbidden},
+		{URI: "/legacy/orders", Origin: "https://app.example.com", Code: http.StatusUnauthorized},
+		{URI: "/oauth/token", Origin: "https://app.example.com", Code: http.StatusNoContent},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest(http.MethodOptions, c.URI)
+		req.Header.Set("Origin", c.Origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		assert.Equal(t, "Origin", recorder.Header().Get("Vary"), "case %d", i)
+	}
+}
+
 func TestCustomHeadersHandler(t *testing.T) {
 	p := newFakeKeycloakProxy(t)
 
@@ -299,6 +600,19 @@ func TestCustomHeadersHandler(t *testing.T) {
 				"X-Auth-Family-Name": []string{"Jayawardene"},
 			},
 		},
+		{
+			CustomClaims: []string{"resource_access.myapp.roles"},
+			Identity: &userContext{
+				claims: jose.Claims{
+					"resource_access": map[string]interface{}{
+						"myapp": map[string]interface{}{"roles": []interface{}{"admin", "viewer"}},
+					},
+				},
+			},
+			Expected: http.Header{
+				"X-Auth-Resource-Access-Myapp-Roles": []string{"admin,viewer"},
+			},
+		},
 	}
 	for i, x := range cases {
 		handler := p.upstreamHeadersHandler(x.CustomClaims)
@@ -318,6 +632,113 @@ func TestCustomHeadersHandler(t *testing.T) {
 	}
 }
 
+func TestIdentityHeaderNames(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.IdentityHeaderPrefix = "X-Forwarded-"
+	p.config.IdentityHeaders = map[string]string{
+		"username":   "Remote-User",
+		"given_name": "Remote-Name",
+	}
+	handler := p.upstreamHeadersHandler([]string{"given_name", "family_name"})
+
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("Remote-User", "spoofed")
+	context.Request.Header.Set("X-Forwarded-Roles", "spoofed")
+	context.Set(userContextName, &userContext{
+		id:    "test-subject",
+		name:  "rohith",
+		email: "gambol99@gmail.com",
+		roles: []string{"a", "b"},
+		claims: jose.Claims{
+			"given_name":  "Rohith",
+			"family_name": "Jayawardene",
+		},
+	})
+	handler(context)
+
+	expected := http.Header{
+		"Remote-User":             []string{"rohith"},
+		"Remote-Name":             []string{"Rohith"},
+		"X-Forwarded-Userid":      []string{"rohith"},
+		"X-Forwarded-Subject":     []string{"test-subject"},
+		"X-Forwarded-Email":       []string{"gambol99@gmail.com"},
+		"X-Forwarded-Roles":       []string{"a,b"},
+		"X-Forwarded-Family-Name": []string{"Jayawardene"},
+	}
+	for k, v := range expected {
+		assert.Equal(t, v, context.Request.Header[k], "header %s", k)
+	}
+	assert.Empty(t, context.Request.Header.Get("X-Forwarded-Username"))
+	assert.Empty(t, context.Request.Header.Get("X-Auth-Username"))
+}
+
+func TestClaimsHeader(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.ClaimsHeader = "json"
+	handler := p.upstreamHeadersHandler([]string{})
+
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Auth-Claims", "spoofed")
+	context.Set(userContextName, &userContext{
+		id:     "test-subject",
+		claims: jose.Claims{"sub": "test-subject", "email": "gambol99@gmail.com"},
+	})
+	handler(context)
+	assert.Equal(t, []string{`{"email":"gambol99@gmail.com","sub":"test-subject"}`}, context.Request.Header["X-Auth-Claims"])
+
+	// step: the header is not forwarded for an identity without claims
+	context = newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Auth-Claims", "spoofed")
+	context.Set(userContextName, &userContext{id: "api-key", apiKey: true})
+	handler(context)
+	assert.Empty(t, context.Request.Header.Get("X-Auth-Claims"))
+}
+
+func TestAssertionHeaderNotForwarded(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.AssertionHeader = "X-Assertion"
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Assertion", "assertion")
+	p.upstreamHeadersHandler([]string{})(context)
+	assert.Equal(t, "assertion", context.Request.Header.Get("X-Assertion"))
+
+	// step: once we are verifying the assertions they are not passed on
+	p.config.AssertionIssuers = []AssertionIssuer{{Issuer: fakeAssertionIssuer, PublicKey: "/etc/keys/device.pem"}}
+	context = newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Assertion", "assertion")
+	p.upstreamHeadersHandler([]string{})(context)
+	assert.Empty(t, context.Request.Header.Get("X-Assertion"))
+}
+
+func TestOmitUpstreamHeaders(t *testing.T) {
+	p := newFakeKeycloakProxy(t)
+	p.config.OmitAuthorizationHeader = true
+	p.config.OmitIdentityHeaders = []string{"X-Auth-Token", "X-Auth-Roles"}
+	handler := p.upstreamHeadersHandler([]string{})
+
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-Auth-Roles", "spoofed")
+	context.Set(userContextName, &userContext{
+		id:    "test-subject",
+		name:  "rohith",
+		roles: []string{"a", "b"},
+		token: *newFakeBearerToken(t),
+	})
+	handler(context)
+
+	assert.Empty(t, context.Request.Header.Get(authorizationHeader))
+	assert.Empty(t, context.Request.Header.Get("X-Auth-Token"))
+	assert.Empty(t, context.Request.Header.Get("X-Auth-Roles"))
+	assert.Equal(t, "test-subject", context.Request.Header.Get("X-Auth-Subject"))
+	assert.Equal(t, "rohith", context.Request.Header.Get("X-Auth-Username"))
+
+	// step: the headers presented by the client on an unprotected resource are removed as well
+	context = newFakeGinContext("GET", "/public")
+	context.Request.Header.Set(authorizationHeader, "Bearer raw")
+	handler(context)
+	assert.Empty(t, context.Request.Header.Get(authorizationHeader))
+}
+
 func TestAdmissionHandlerRoles(t *testing.T) {
 	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
 		{
@@ -335,6 +756,18 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 			Methods: []string{"ANY"},
 			Roles:   []string{"admin", "test"},
 		},
+		{
+			URL:            "/any",
+			Methods:        []string{"ANY"},
+			Roles:          []string{"admin", "test"},
+			RequireAnyRole: true,
+		},
+		{
+			URL:         "/denied",
+			Methods:     []string{"ANY"},
+			Roles:       []string{"test"},
+			DeniedRoles: []string{"suspended"},
+		},
 		{
 			URL:     "/",
 			Methods: []string{"ANY"},
@@ -350,7 +783,7 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 		{
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 			},
 			HTTPCode: http.StatusForbidden,
 		},
@@ -358,39 +791,79 @@ func TestAdmissionHandlerRoles(t *testing.T) {
 			Context:  newFakeGinContext("GET", "/admin"),
 			HTTPCode: http.StatusOK,
 			UserContext: &userContext{
-				audience: "test",
-				roles:    []string{"admin"},
+				audiences: []string{"test"},
+				roles:     []string{"admin"},
 			},
 		},
 		{
 			Context:  newFakeGinContext("GET", "/test"),
 			HTTPCode: http.StatusOK,
 			UserContext: &userContext{
-				audience: "test",
-				roles:    []string{"test"},
+				audiences: []string{"test"},
+				roles:     []string{"test"},
 			},
 		},
 		{
 			Context:  newFakeGinContext("GET", "/either"),
 			HTTPCode: http.StatusOK,
 			UserContext: &userContext{
-				audience: "test",
-				roles:    []string{"test", "admin"},
+				audiences: []string{"test"},
+				roles:     []string{"test", "admin"},
 			},
 		},
 		{
 			Context:  newFakeGinContext("GET", "/either"),
 			HTTPCode: http.StatusForbidden,
 			UserContext: &userContext{
-				audience: "test",
-				roles:    []string{"no_roles"},
+				audiences: []string{"test"},
+				roles:     []string{"no_roles"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/either"),
+			HTTPCode: http.StatusForbidden,
+			UserContext: &userContext{
+				audiences: []string{"test"},
+				roles:     []string{"test"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/any"),
+			HTTPCode: http.StatusOK,
+			UserContext: &userContext{
+				audiences: []string{"test"},
+				roles:     []string{"test"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/any"),
+			HTTPCode: http.StatusForbidden,
+			UserContext: &userContext{
+				audiences: []string{"test"},
+				roles:     []string{"no_roles"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/denied"),
+			HTTPCode: http.StatusOK,
+			UserContext: &userContext{
+				audiences: []string{"test"},
+				roles:     []string{"test"},
+			},
+		},
+		{
+			Context:  newFakeGinContext("GET", "/denied"),
+			HTTPCode: http.StatusForbidden,
+			UserContext: &userContext{
+				audiences: []string{"test"},
+				roles:     []string{"test", "suspended"},
 			},
 		},
 		{
 			Context:  newFakeGinContext("GET", "/"),
 			HTTPCode: http.StatusOK,
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 			},
 		},
 	}
@@ -435,8 +908,8 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "test"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
-				claims:   jose.Claims{},
+				audiences: []string{"test"},
+				claims:    jose.Claims{},
 			},
 			HTTPCode: http.StatusForbidden,
 		},
@@ -444,7 +917,7 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "^tes$"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 				claims: jose.Claims{
 					"aud": "test",
 					"iss": 1,
@@ -456,7 +929,7 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "^tes$"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 				claims: jose.Claims{
 					"aud": "test",
 					"iss": "bad_match",
@@ -468,7 +941,7 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "^test", "notfound": "someting"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 				claims: jose.Claims{
 					"aud": "test",
 					"iss": "test",
@@ -480,7 +953,7 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "^test", "notfound": "someting"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 				claims: jose.Claims{
 					"aud": "test",
 					"iss": "test",
@@ -492,7 +965,7 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": ".*"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
+				audiences: []string{"test"},
 				claims: jose.Claims{
 					"aud": "test",
 					"iss": "test",
@@ -504,8 +977,8 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 			Matches: map[string]string{"iss": "^t.*$"},
 			Context: newFakeGinContext("GET", "/admin"),
 			UserContext: &userContext{
-				audience: "test",
-				claims:   jose.Claims{"iss": "test"},
+				audiences: []string{"test"},
+				claims:    jose.Claims{"iss": "test"},
 			},
 			HTTPCode: http.StatusOK,
 		},
@@ -526,3 +999,301 @@ func TestAdmissionHandlerClaims(t *testing.T) {
 		assert.Equal(t, c.HTTPCode, status, "test case %d should have recieved code: %d, got %d", i, c.HTTPCode, status)
 	}
 }
+
+func TestAdmissionHandlerCIDRs(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:          "/admin",
+			Methods:      []string{"ANY"},
+			AllowedCIDRs: []string{"10.0.0.0/8"},
+			DeniedCIDRs:  []string{"10.10.0.0/16"},
+		},
+		{
+			URL:         "/",
+			Methods:     []string{"ANY"},
+			DeniedCIDRs: []string{"192.168.0.0/16"},
+		},
+	})
+	proxy.config.TrustedProxies = []string{"127.0.0.0/8"}
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	tests := []struct {
+		URI        string
+		RemoteAddr string
+		ClientIP   string
+		Denied     bool
+	}{
+		{URI: "/admin", ClientIP: "10.0.0.1"},
+		{URI: "/admin", ClientIP: "10.10.0.1", Denied: true},
+		{URI: "/admin", ClientIP: "172.16.0.1", Denied: true},
+		{URI: "/test", ClientIP: "172.16.0.1"},
+		{URI: "/test", ClientIP: "192.168.0.1", Denied: true},
+		{URI: "/admin", RemoteAddr: "10.10.0.1:8989", ClientIP: "10.0.0.1", Denied: true},
+		{URI: "/admin", RemoteAddr: "10.0.0.1:8989", ClientIP: "10.10.0.1"},
+	}
+
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", c.URI)
+		if c.RemoteAddr != "" {
+			req.RemoteAddr = c.RemoteAddr
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		req.Header.Set("X-Forwarded-For", c.ClientIP)
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Denied, recorder.Code == http.StatusForbidden, "case %d, unexpected code: %d", i, recorder.Code)
+	}
+}
+
+func TestAuthenticationHandlerClientCertificate(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.NoRedirects = true
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "machine", OrganizationalUnit: []string{"admin"}},
+		NotAfter: time.Now().Add(time.Duration(1) * time.Hour),
+	}
+
+	tests := []struct {
+		Enabled  bool
+		State    *tls.ConnectionState
+		Identity bool
+	}{
+		{Enabled: true, State: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, Identity: true},
+		{Enabled: true, State: &tls.ConnectionState{}},
+		{Enabled: true},
+		{State: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	}
+
+	for i, c := range tests {
+		proxy.config.EnableClientCertAuth = c.Enabled
+		cx := newFakeGinContext("GET", "/admin")
+		cx.Request.TLS = c.State
+		cx.Set(cxEnforce, proxy.config.Resources[0])
+		proxy.authenticationHandler()(cx)
+		uc, found := cx.Get(userContextName)
+		if !assert.Equal(t, c.Identity, found, "case %d", i) || !found {
+			assert.Equal(t, http.StatusUnauthorized, cx.Writer.Status(), "case %d", i)
+			continue
+		}
+		assert.Equal(t, "machine", uc.(*userContext).id, "case %d", i)
+		assert.Equal(t, []string{"admin"}, uc.(*userContext).roles, "case %d", i)
+	}
+}
+
+func TestLatencyObjectiveHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:        "/slow",
+			Methods:    []string{"ANY"},
+			LatencySLO: time.Duration(1),
+		},
+	})
+	proxy.config.EnableMetrics = true
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	for i := 0; i < 2; i++ {
+		req := newFakeHTTPRequest("GET", "/slow")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		proxy.router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", oauthURL+metricsURL))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `proxy_resource_requests_total{resource="/slow"} 2`)
+	assert.Contains(t, recorder.Body.String(), `proxy_resource_latency_slo_breaches_total{resource="/slow"} 2`)
+	assert.Contains(t, recorder.Body.String(), `proxy_resource_latency_slo_seconds{resource="/slow"} 1e-09`)
+}
+
+func TestAuthenticationHandlerNoRefreshToken(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableRefreshTokens = true
+	proxy, auth, _ := newTestProxyService(t, config)
+	auth.claims["exp"] = int(time.Now().Add(-time.Duration(1) * time.Hour).Unix())
+	token, err := jose.NewSignedJWT(auth.claims, auth.signer)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := newFakeHTTPRequest("GET", fakeAdminRoleURL)
+	req.AddCookie(&http.Cookie{Name: config.CookieAccessName, Value: token.Encode()})
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Set-Cookie"), config.CookieAccessName+"=;")
+}
+
+func TestAdmissionHandlerScopes(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/orders",
+			Methods: []string{"ANY"},
+			Scopes:  []string{"read:orders"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Scope  string
+		Denied bool
+	}{
+		{Scope: "openid read:orders"},
+		{Scope: "openid", Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud":   fakeClientID,
+			"sub":   "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"scope": c.Scope,
+			"exp":   time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/orders")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `scope="read:orders"`, "case %d", i)
+	}
+}
+
+func TestAdmissionHandlerPolicy(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/finance",
+			Methods: []string{"ANY"},
+			Policy:  "claims.department == 'finance' && request.method != 'DELETE'",
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Method     string
+		Department string
+		Denied     bool
+	}{
+		{Method: "GET", Department: "finance"},
+		{Method: "DELETE", Department: "finance", Denied: true},
+		{Method: "GET", Department: "hr", Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud":        fakeClientID,
+			"sub":        "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"department": c.Department,
+			"exp":        time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest(c.Method, "/finance")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+}
+
+func TestAdmissionHandlerMaxTokenAge(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/payments",
+			Methods:     []string{"ANY"},
+			MaxTokenAge: time.Duration(15) * time.Minute,
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Authenticated time.Duration
+		Denied        bool
+	}{
+		{Authenticated: time.Duration(1) * time.Minute},
+		{Authenticated: time.Duration(1) * time.Hour, Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud":       fakeClientID,
+			"sub":       "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"iat":       time.Now().Unix(),
+			"auth_time": time.Now().Add(-c.Authenticated).Unix(),
+			"exp":       time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/payments")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		req.Header.Set("Accept", "application/json")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+		assert.Contains(t, recorder.Body.String(), reasonReauthenticate, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `error="invalid_token"`, "case %d", i)
+	}
+}
+
+func TestRedirectToReauthentication(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SkipTokenVerification = false
+	cx := newFakeGinContext("GET", "/admin")
+	proxy.redirectToReauthentication(cx, &userContext{})
+	assert.Equal(t, http.StatusTemporaryRedirect, cx.Writer.Status())
+	assert.Contains(t, cx.Writer.Header().Get("Location"), "&prompt=login")
+}
+
+func TestAdmissionHandlerAuditOnly(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/reports", Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}, AuditOnly: true},
+		{URL: "/admin", Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}},
+	})
+	proxy.config.NoRedirects = true
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	cases := []struct {
+		URI  string
+		Code int
+	}{
+		{URI: "/reports/daily", Code: http.StatusOK},
+		{URI: "/admin/users", Code: http.StatusForbidden},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+
+	// step: the audit applies to all the resources when enabled globally
+	proxy.config.AuditOnly = true
+	req := newFakeHTTPRequest("GET", "/admin/users")
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// step: the audience of the token is enforced regardless of the audit
+	proxy.config.Audiences = []string{"other"}
+	req = newFakeHTTPRequest("GET", "/reports/daily")
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// negotiateScheme is the authorization scheme of the spnego (kerberos) exchange
+const negotiateScheme = "Negotiate"
+
+// negotiateTemplate is the body of the negotiate challenge, the browsers unable to negotiate fall back to the login
+var negotiateTemplate = template.Must(template.New("negotiate").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Signing In</title>
+<meta http-equiv="refresh" content="0; url={{ .Location }}">
+</head>
+<body><a href="{{ .Location }}">Continue to sign in</a></body>
+</html>
+`))
+
+//
+// negotiateAuthorization performs the spnego exchange with the provider on behalf of the browser, forwarding the
+// ticket to the authorization endpoint; once accepted the browser is handed the code via the callback, completing
+// the code flow without an interactive login. The browsers without a ticket are challenged, falling back to the
+// location; returns false if the login should proceed interactively
+//
+func (r *oauthProxy) negotiateAuthorization(cx *gin.Context, location string) bool {
+	ticket := cx.Request.Header.Get(authorizationHeader)
+	if !strings.HasPrefix(ticket, negotiateScheme+" ") {
+		r.negotiateChallenge(cx, negotiateScheme, location)
+		return true
+	}
+
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set(authorizationHeader, ticket)
+	resp, err := r.negotiator.RoundTrip(req)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to forward the negotiate ticket to the provider")
+
+		return false
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		// step: the provider hands back the code to our callback, any other redirect is the login form
+		callback := resp.Header.Get("Location")
+		if !strings.HasPrefix(callback, r.config.RedirectionURL+oauthURL+callbackURL+"?") {
+			return false
+		}
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+		}).Debugf("the provider accepted the negotiate ticket, completing the code flow")
+
+		r.redirectToURL(callback, cx)
+		return true
+	case http.StatusUnauthorized:
+		// step: the provider is continuing the exchange, relaying the next leg to the browser
+		if challenge := resp.Header.Get("WWW-Authenticate"); strings.HasPrefix(challenge, negotiateScheme+" ") {
+			r.negotiateChallenge(cx, challenge, location)
+			return true
+		}
+	}
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"status":    resp.StatusCode,
+	}).Warnf("the provider did not accept the negotiate ticket, falling back to the login")
+
+	return false
+}
+
+//
+// negotiateChallenge challenges the browser for a ticket, the body falls back to the location if it cannot negotiate
+//
+func (r *oauthProxy) negotiateChallenge(cx *gin.Context, challenge, location string) {
+	cx.Header("WWW-Authenticate", challenge)
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Content-Type", "text/html; charset=utf-8")
+	cx.Status(http.StatusUnauthorized)
+	if err := negotiateTemplate.Execute(cx.Writer, map[string]string{"Location": location}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to render the negotiate challenge")
+	}
+	cx.Abort()
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateAuthorization(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableNegotiate = true
+	_, auth, u := newTestProxyService(t, config)
+
+	cs := []struct {
+		Ticket       string
+		ExpectedCode int
+		Challenge    string
+		Location     string
+	}{
+		{
+			ExpectedCode: http.StatusUnauthorized,
+			Challenge:    negotiateScheme,
+		},
+		{
+			Ticket:       "Negotiate valid",
+			ExpectedCode: http.StatusTemporaryRedirect,
+			Location:     u + oauthURL + callbackURL + "?",
+		},
+		{
+			Ticket:       "Negotiate invalid",
+			ExpectedCode: http.StatusTemporaryRedirect,
+			Location:     auth.getLocation(),
+		},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+oauthURL+authorizationURL+"?state=Lw==", nil)
+		if c.Ticket != "" {
+			req.Header.Set(authorizationHeader, c.Ticket)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		assert.Equal(t, c.Challenge, resp.Header.Get("WWW-Authenticate"), "case %d", i)
+		if c.Location != "" {
+			location := resp.Header.Get("Location")
+			assert.True(t, strings.HasPrefix(location, c.Location), "case %d, location: %s", i, location)
+		}
+		if c.Challenge != "" {
+			assert.Contains(t, string(content), auth.getLocation(), "case %d", i)
+		}
+	}
+}
@@ -44,21 +44,35 @@ func verifyToken(client *oidc.Client, token jose.JWT) error {
 // getRefreshedToken attempts to refresh the access token, returning the parsed token and the time it expires or a error
 //
 func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, time.Time, error) {
+	token, _, expires, err := getRefreshedTokens(client, t)
+
+	return token, expires, err
+}
+
+//
+// getRefreshedTokens attempts to refresh the access token, returning the parsed token, the refresh token (the
+// provider may rotate it, else the one given) and the time the access token expires or a error
+//
+func getRefreshedTokens(client *oidc.Client, t string) (jose.JWT, string, time.Time, error) {
 	response, err := getToken(client, oauth2.GrantTypeRefreshToken, t)
 	if err != nil {
-		if strings.Contains(err.Error(), "token expired") {
-			return jose.JWT{}, time.Time{}, ErrRefreshTokenExpired
+		if isRefreshTokenExpired(err) {
+			return jose.JWT{}, "", time.Time{}, ErrRefreshTokenExpired
 		}
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
 	}
 
 	// step: parse the access token
 	token, identity, err := parseToken(response.AccessToken)
 	if err != nil {
-		return jose.JWT{}, time.Time{}, err
+		return jose.JWT{}, "", time.Time{}, err
+	}
+	refresh := response.RefreshToken
+	if refresh == "" {
+		refresh = t
 	}
 
-	return token, identity.ExpiresAt, nil
+	return token, refresh, identity.ExpiresAt, nil
 }
 
 //
@@ -68,6 +82,21 @@ func exchangeAuthenticationCode(client *oidc.Client, code string) (oauth2.TokenR
 	return getToken(client, oauth2.GrantTypeAuthCode, code)
 }
 
+//
+// isRefreshTokenExpired checks if the provider refused the refresh token as expired, or the (offline) session of the
+// refresh token is no longer active
+//
+func isRefreshTokenExpired(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, x := range []string{"token expired", "session not active", "session not found"} {
+		if strings.Contains(message, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
 //
 // getToken retrieves a code from the provider, extracts and verified the token
 //
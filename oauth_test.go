@@ -145,6 +145,7 @@ func newFakeOAuthServer(t *testing.T) *fakeOAuthServer {
 	r.GET("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
 	r.POST("auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
 	r.GET("auth/realms/hod-test/protocol/openid-connect/auth", service.authHandler)
+	r.POST("auth/realms/hod-test/protocol/openid-connect/auth/device", service.deviceHandler)
 
 	location, err := url.Parse(httptest.NewServer(r).URL)
 	if err != nil {
@@ -205,6 +206,11 @@ func (r *fakeOAuthServer) authHandler(cx *gin.Context) {
 	if state == "" {
 		state = "/"
 	}
+	// step: a refused kerberos ticket is handed the login form
+	if cx.Request.Header.Get("Authorization") == "Negotiate invalid" {
+		cx.String(http.StatusOK, "login form")
+		return
+	}
 	// step: generate a random authentication code
 	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, getRandomString(32))
 
@@ -228,13 +234,43 @@ func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 			cx.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
+		if password == "invalid" {
+			cx.JSON(http.StatusUnauthorized, gin.H{"error": oauth2.ErrorInvalidGrant})
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			IDToken:      token.Encode(),
+			AccessToken:  token.Encode(),
+			RefreshToken: token.Encode(),
+			ExpiresIn:    expiration.Second(),
+		})
+	case tokenExchangeGrantType:
+		claims := jose.Claims{}
+		for k, v := range r.claims {
+			claims[k] = v
+		}
+		claims["aud"] = cx.PostForm("audience")
+		exchanged, err := jose.NewSignedJWT(claims, r.signer)
+		if err != nil || cx.PostForm("subject_token") == "" {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": oauth2.ErrorInvalidRequest})
+			return
+		}
+		cx.JSON(http.StatusOK, tokenResponse{
+			AccessToken: exchanged.Encode(),
+			ExpiresIn:   300,
+		})
+	case deviceGrantType:
+		if cx.PostForm("device_code") != "approved" {
+			cx.JSON(http.StatusBadRequest, gin.H{"error": deviceAuthorizationPending})
+			return
+		}
 		cx.JSON(http.StatusOK, tokenResponse{
 			IDToken:      token.Encode(),
 			AccessToken:  token.Encode(),
 			RefreshToken: token.Encode(),
 			ExpiresIn:    expiration.Second(),
 		})
-	case oauth2.GrantTypeAuthCode:
+	case oauth2.GrantTypeAuthCode, oauth2.GrantTypeRefreshToken, oauth2.GrantTypeClientCreds:
 		cx.JSON(http.StatusOK, tokenResponse{
 			IDToken:      token.Encode(),
 			AccessToken:  token.Encode(),
@@ -247,6 +283,16 @@ func (r *fakeOAuthServer) tokenHandler(cx *gin.Context) {
 	}
 }
 
+func (r *fakeOAuthServer) deviceHandler(cx *gin.Context) {
+	cx.JSON(http.StatusOK, deviceAuthorization{
+		DeviceCode:      "pending",
+		UserCode:        "ABCD-EFGH",
+		VerificationURI: r.getLocation() + "/device",
+		ExpiresIn:       600,
+		Interval:        5,
+	})
+}
+
 func getRandomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
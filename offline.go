@@ -0,0 +1,87 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// offlineAccessScope is the scope requesting an offline (long lived) refresh token from keycloak
+	offlineAccessScope = "offline_access"
+	// rememberMeQuery is the query parameter of the authorization request asking to be remembered
+	rememberMeQuery = "remember_me"
+)
+
+//
+// getSessionDuration returns the lifetime of the session cookies, the offline sessions outlive the idle duration
+//
+func (r *oauthProxy) getSessionDuration(user *userContext) time.Duration {
+	if duration, found := r.getOfflineDuration(user); found {
+		return duration
+	}
+
+	return r.config.IdleDuration
+}
+
+//
+// getRefreshDuration returns the lifetime of the refresh token cookie, the offline sessions outlive the idle duration
+//
+func (r *oauthProxy) getRefreshDuration(user *userContext) time.Duration {
+	if duration, found := r.getOfflineDuration(user); found {
+		return duration
+	}
+
+	return r.config.IdleDuration * 2
+}
+
+//
+// getOfflineDuration returns the lifetime of the session cookies if the session holds an offline token
+//
+func (r *oauthProxy) getOfflineDuration(user *userContext) (time.Duration, bool) {
+	if user == nil || !user.isOffline() {
+		return 0, false
+	}
+	switch {
+	case r.config.EnableOfflineTokens:
+		return r.config.OfflineSessionDuration, true
+	case r.config.EnableRememberMe:
+		return r.config.RememberMeDuration, true
+	}
+
+	return 0, false
+}
+
+//
+// addOfflineScope adds the offline access scope to the authorization url, requesting an offline refresh token
+//
+func addOfflineScope(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	scopes := strings.Fields(query.Get("scope"))
+	if !containedIn(offlineAccessScope, scopes) {
+		scopes = append(scopes, offlineAccessScope)
+	}
+	query.Set("scope", strings.Join(scopes, " "))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddOfflineScope(t *testing.T) {
+	cases := []struct {
+		Location string
+		Expected string
+	}{
+		{
+			Location: "https://keycloak/auth?client_id=test&scope=openid+email",
+			Expected: "openid email offline_access",
+		},
+		{
+			Location: "https://keycloak/auth?client_id=test&scope=openid+offline_access",
+			Expected: "openid offline_access",
+		},
+		{
+			Location: "https://keycloak/auth?client_id=test",
+			Expected: "offline_access",
+		},
+	}
+	for i, c := range cases {
+		location, err := addOfflineScope(c.Location)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		u, _ := url.Parse(location)
+		assert.Equal(t, c.Expected, u.Query().Get("scope"), "case %d", i)
+		assert.Equal(t, "test", u.Query().Get("client_id"), "case %d", i)
+	}
+}
+
+func TestGetSessionDuration(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.IdleDuration = time.Hour
+	proxy.config.RememberMeDuration = time.Duration(720) * time.Hour
+	remembered := &userContext{claims: jose.Claims{"scope": "openid offline_access"}}
+	session := &userContext{claims: jose.Claims{"scope": "openid"}}
+
+	assert.Equal(t, time.Hour, proxy.getSessionDuration(remembered))
+	proxy.config.EnableRememberMe = true
+	assert.Equal(t, time.Duration(720)*time.Hour, proxy.getSessionDuration(remembered))
+	assert.Equal(t, time.Duration(720)*time.Hour, proxy.getRefreshDuration(remembered))
+	assert.Equal(t, time.Hour, proxy.getSessionDuration(session))
+	assert.Equal(t, time.Duration(2)*time.Hour, proxy.getRefreshDuration(session))
+	assert.Equal(t, time.Hour, proxy.getSessionDuration(nil))
+
+	// step: the offline tokens requested for all the sessions take the offline session duration
+	proxy.config.EnableRememberMe = false
+	proxy.config.EnableOfflineTokens = true
+	proxy.config.OfflineSessionDuration = time.Duration(240) * time.Hour
+	assert.Equal(t, time.Duration(240)*time.Hour, proxy.getSessionDuration(remembered))
+	assert.Equal(t, time.Duration(240)*time.Hour, proxy.getRefreshDuration(remembered))
+	assert.Equal(t, time.Hour, proxy.getSessionDuration(session))
+}
+
+func TestIsRefreshTokenExpired(t *testing.T) {
+	for _, x := range []string{"token expired", "invalid_grant: Offline session not active", "Offline user session not found"} {
+		assert.True(t, isRefreshTokenExpired(errors.New(x)), "%s should be expired", x)
+	}
+	assert.False(t, isRefreshTokenExpired(errors.New("connection refused")))
+}
+
+func TestAdmissionHandlerRememberMe(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:               "/account",
+			Methods:           []string{"ANY"},
+			DisableRememberMe: true,
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.EnableRememberMe = true
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Scope  string
+		Bearer bool
+		Denied bool
+	}{
+		{Scope: "openid email"},
+		{Scope: "openid offline_access", Denied: true},
+		{Scope: "openid offline_access", Bearer: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud":   fakeClientID,
+			"sub":   "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"scope": c.Scope,
+			"exp":   time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/account")
+		if c.Bearer {
+			req.Header.Set("Authorization", "Bearer "+token.Encode())
+		} else {
+			req.AddCookie(&http.Cookie{Name: proxy.config.CookieAccessName, Value: token.Encode()})
+		}
+		req.Header.Set("Accept", "application/json")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+		assert.Contains(t, recorder.Body.String(), reasonReauthenticate, "case %d", i)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// openPolicyAgentInput is the input document posted to the open policy agent and the external authorizers
+//
+type openPolicyAgentInput struct {
+	// Claims are the claims of the access token
+	Claims map[string]interface{} `json:"claims"`
+	// User is the identity of the user
+	User map[string]interface{} `json:"user"`
+	// Resource is the protected resource matched by the request
+	Resource map[string]interface{} `json:"resource"`
+	// Request is the metadata of the request
+	Request map[string]interface{} `json:"request"`
+}
+
+//
+// newOpenPolicyAgentInput creates the input document for the request, the headers carrying the credentials are removed
+//
+func newOpenPolicyAgentInput(cfg *Config, cx *gin.Context, user *userContext, resource *Resource) *openPolicyAgentInput {
+	credentials := []string{authorizationHeader, "Proxy-Authorization", "Cookie"}
+	for _, x := range []string{cfg.APIKeyHeader, cfg.AssertionHeader, cfg.CSRFHeader} {
+		if x != "" {
+			credentials = append(credentials, http.CanonicalHeaderKey(x))
+		}
+	}
+	headers := make(map[string]string, len(cx.Request.Header))
+	for name, values := range cx.Request.Header {
+		// step: the credentials are not passed to the policy engine
+		if containedIn(name, credentials) {
+			continue
+		}
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+
+	return &openPolicyAgentInput{
+		Claims: map[string]interface{}(user.claims),
+		User: map[string]interface{}{
+			"id":        user.id,
+			"name":      user.name,
+			"email":     user.email,
+			"audience":  strings.Join(user.audiences, ","),
+			"audiences": user.audiences,
+			"roles":     user.roles,
+		},
+		Resource: map[string]interface{}{
+			"uri":     resource.URL,
+			"methods": resource.Methods,
+			"roles":   resource.Roles,
+		},
+		Request: map[string]interface{}{
+			"method":  cx.Request.Method,
+			"path":    cx.Request.URL.Path,
+			"query":   cx.Request.URL.RawQuery,
+			"host":    cx.Request.Host,
+			"ip":      cx.ClientIP(),
+			"headers": headers,
+		},
+	}
+}
+
+//
+// queryOpenPolicyAgent posts the input to the data api of the open policy agent, the decision is the boolean
+// result or the allow field of the result; an undefined decision denies the request
+//
+func queryOpenPolicyAgent(client *http.Client, location string, input *openPolicyAgentInput) (bool, error) {
+	if client == nil {
+		return false, fmt.Errorf("the client of the open policy agent is not configured")
+	}
+	content, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Post(location, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("the open policy agent returned status: %d", resp.StatusCode)
+	}
+
+	var decision struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("invalid response from the open policy agent, error: %s", err)
+	}
+	switch x := decision.Result.(type) {
+	case bool:
+		return x, nil
+	case map[string]interface{}:
+		allow, _ := x["allow"].(bool)
+		return allow, nil
+	}
+
+	return false, nil
+}
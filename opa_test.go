@@ -0,0 +1,133 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryOpenPolicyAgent(t *testing.T) {
+	tests := []struct {
+		Status   int
+		Response string
+		Expected bool
+		Error    bool
+	}{
+		{Status: http.StatusOK, Response: `{"result": true}`, Expected: true},
+		{Status: http.StatusOK, Response: `{"result": false}`},
+		{Status: http.StatusOK, Response: `{"result": {"allow": true, "reason": "finance"}}`, Expected: true},
+		{Status: http.StatusOK, Response: `{"result": {"allow": false}}`},
+		{Status: http.StatusOK, Response: `{}`},
+		{Status: http.StatusOK, Response: `not json`, Error: true},
+		{Status: http.StatusInternalServerError, Response: `{}`, Error: true},
+	}
+	for i, c := range tests {
+		var input map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			json.NewDecoder(req.Body).Decode(&input)
+			w.WriteHeader(c.Status)
+			w.Write([]byte(c.Response))
+		}))
+		permitted, err := queryOpenPolicyAgent(http.DefaultClient, server.URL, &openPolicyAgentInput{
+			Claims: map[string]interface{}{"department": "finance"},
+		})
+		server.Close()
+		if c.Error {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, permitted, "case %d", i)
+		assert.NotNil(t, input["input"], "case %d", i)
+	}
+}
+
+func TestQueryOpenPolicyAgentNoClient(t *testing.T) {
+	_, err := queryOpenPolicyAgent(nil, "http://127.0.0.1:8181", &openPolicyAgentInput{})
+	assert.Error(t, err)
+}
+
+func TestAdmissionHandlerOpenPolicyAgent(t *testing.T) {
+	var input map[string]map[string]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&input)
+		permitted := input["input"]["claims"]["department"] == "finance" && input["input"]["request"]["method"] == "GET"
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]interface{}{"allow": permitted}})
+	}))
+	defer server.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/finance",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.OpenPolicyAgentURL = server.URL + "/v1/data/httpapi/authz"
+	proxy.config.OpenPolicyAgentTimeout = time.Duration(1) * time.Second
+	proxy.config.APIKeyHeader = "X-API-Key"
+	proxy.createEndpoints()
+
+	tests := []struct {
+		Method     string
+		Department string
+		Denied     bool
+	}{
+		{Method: "GET", Department: "finance"},
+		{Method: "POST", Department: "finance", Denied: true},
+		{Method: "GET", Department: "hr", Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud":        fakeClientID,
+			"sub":        "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"department": c.Department,
+			"exp":        time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest(c.Method, "/finance")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		req.Header.Set("X-API-Key", "secret")
+		req.Header.Set("X-Request-ID", "1")
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, "/finance", input["input"]["resource"]["uri"], "case %d", i)
+		headers := input["input"]["request"]["headers"].(map[string]interface{})
+		assert.Nil(t, headers["authorization"], "case %d", i)
+		assert.Nil(t, headers["x-api-key"], "case %d", i)
+		assert.Equal(t, "1", headers["x-request-id"], "case %d", i)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+
+	// step: the requests are denied when the policy agent is unavailable
+	server.Close()
+	token := newFakeBearerToken(t)
+	req := newFakeHTTPRequest("GET", "/finance")
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
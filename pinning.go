@@ -0,0 +1,127 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// spkiPinPrefix is the prefix of a pin on the sha256 of the subject public key info
+	spkiPinPrefix = "sha256/"
+	// certificatePinPrefix is the prefix of a pin on the sha256 of the certificate
+	certificatePinPrefix = "cert-sha256/"
+)
+
+//
+// certificatePin is a pin on the public key or certificate of the identity provider
+//
+type certificatePin struct {
+	// whether the pin is on the whole certificate rather than the public key
+	certificate bool
+	// the sha256 of the public key or certificate
+	hash []byte
+}
+
+//
+// parseCertificatePins decodes the pins, sha256/<base64> for the public key or cert-sha256/<base64> for the certificate
+//
+func parseCertificatePins(list []string) ([]*certificatePin, error) {
+	var pins []*certificatePin
+	for _, x := range list {
+		pin := &certificatePin{}
+		encoded := x
+		switch {
+		case strings.HasPrefix(x, certificatePinPrefix):
+			pin.certificate = true
+			encoded = strings.TrimPrefix(x, certificatePinPrefix)
+		case strings.HasPrefix(x, spkiPinPrefix):
+			encoded = strings.TrimPrefix(x, spkiPinPrefix)
+		default:
+			return nil, fmt.Errorf("invalid pin: %s, should be sha256/<base64> or cert-sha256/<base64>", x)
+		}
+		hash, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin: %s, should be the base64 encoded sha256", x)
+		}
+		pin.hash = hash
+		pins = append(pins, pin)
+	}
+
+	return pins, nil
+}
+
+//
+// matchCertificatePins checks if any certificate in the chain matches any of the pins, permitting the new
+// certificate to be pinned alongside the old during a rotation
+//
+func matchCertificatePins(pins []*certificatePin, chain []*x509.Certificate) bool {
+	for _, cert := range chain {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		raw := sha256.Sum256(cert.Raw)
+		for _, pin := range pins {
+			hash := spki[:]
+			if pin.certificate {
+				hash = raw[:]
+			}
+			if bytes.Equal(pin.hash, hash) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//
+// createPinnedDialer returns a tls dialer which refuses the connection unless the certificate chain of the
+// server, having passed the usual verification, matches one of the pins
+//
+func createPinnedDialer(tlsConfig *tls.Config, pins []*certificatePin, timeout time.Duration) func(string, string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		chain := conn.ConnectionState().PeerCertificates
+		if !matchCertificatePins(pins, chain) {
+			conn.Close()
+			var presented []string
+			for _, x := range chain {
+				hash := sha256.Sum256(x.RawSubjectPublicKeyInfo)
+				presented = append(presented, spkiPinPrefix+base64.StdEncoding.EncodeToString(hash[:]))
+			}
+			log.WithFields(log.Fields{
+				"address": address,
+				"pins":    strings.Join(presented, ","),
+			}).Errorf("the certificate of the identity provider does not match any of the pins")
+
+			return nil, fmt.Errorf("the certificate presented by %s does not match any of the pins", address)
+		}
+
+		return conn, nil
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCertificatePins(t *testing.T) {
+	hash := sha256.Sum256([]byte("test"))
+	encoded := base64.StdEncoding.EncodeToString(hash[:])
+
+	pins, err := parseCertificatePins([]string{"sha256/" + encoded, "cert-sha256/" + encoded})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*certificatePin{{hash: hash[:]}, {certificate: true, hash: hash[:]}}, pins)
+	}
+	for _, x := range []string{encoded, "sha256/", "sha256/bad", "md5/" + encoded, "sha256/" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err := parseCertificatePins([]string{x})
+		assert.Error(t, err, "pin: %s", x)
+	}
+}
+
+func TestPinnedDialer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	raw := sha256.Sum256(cert.Raw)
+	other := sha256.Sum256([]byte("rotated"))
+	tests := []struct {
+		Pins []string
+		Ok   bool
+	}{
+		{Pins: []string{"sha256/" + base64.StdEncoding.EncodeToString(spki[:])}, Ok: true},
+		{Pins: []string{"cert-sha256/" + base64.StdEncoding.EncodeToString(raw[:])}, Ok: true},
+		{
+			Pins: []string{
+				"sha256/" + base64.StdEncoding.EncodeToString(other[:]),
+				"sha256/" + base64.StdEncoding.EncodeToString(spki[:]),
+			},
+			Ok: true,
+		},
+		{Pins: []string{"sha256/" + base64.StdEncoding.EncodeToString(other[:])}},
+		{Pins: []string{"cert-sha256/" + base64.StdEncoding.EncodeToString(spki[:])}},
+	}
+	for i, c := range tests {
+		pins, err := parseCertificatePins(c.Pins)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		dialer := createPinnedDialer(&tls.Config{RootCAs: roots}, pins, time.Second)
+		conn, err := dialer("tcp", strings.TrimPrefix(server.URL, "https://"))
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		if assert.NoError(t, err, "case %d", i) {
+			conn.Close()
+		}
+	}
+}
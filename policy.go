@@ -0,0 +1,712 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	policyTokenIdent = iota
+	policyTokenString
+	policyTokenNumber
+	policyTokenOperator
+)
+
+// policyVariables are the variables available to the policy expressions
+var policyVariables = map[string]bool{"claims": true, "request": true, "user": true}
+
+// policyMethods are the methods of the policy expressions and the number of arguments they take
+var policyMethods = map[string]int{"startsWith": 1, "endsWith": 1, "contains": 1, "matches": 1, "size": 0}
+
+// policyKeywords are the alternatives to the operators, the resource option cannot contain a pipe
+var policyKeywords = map[string]string{"and": "&&", "or": "||", "not": "!", "in": "in"}
+
+//
+// policy is a compiled authorization policy, an expression over the claims, the request and the user, i.e.
+// claims.department == 'finance' && request.method != 'DELETE'
+//
+type policy struct {
+	// the expression of the policy
+	expression string
+	// the root of the compiled expression
+	root policyNode
+}
+
+//
+// policyNode is a node of the compiled expression
+//
+type policyNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+//
+// newPolicy compiles the policy expression
+//
+func newPolicy(expression string) (*policy, error) {
+	tokens, err := tokenizePolicy(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy '%s', error: %s", expression, err)
+	}
+	parser := &policyParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err == nil && parser.pos < len(tokens) {
+		err = fmt.Errorf("unexpected '%s'", tokens[parser.pos].value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy '%s', error: %s", expression, err)
+	}
+
+	return &policy{expression: expression, root: root}, nil
+}
+
+//
+// evaluate evaluates the policy against the environment, the expression must result in a boolean
+//
+func (r *policy) evaluate(env map[string]interface{}) (bool, error) {
+	return evalPolicyBool(r.root, env)
+}
+
+//
+// newPolicyEnvironment creates the variables of the policy expressions for the request
+//
+func newPolicyEnvironment(cx *gin.Context, user *userContext) map[string]interface{} {
+	roles := make([]interface{}, len(user.roles))
+	for i, x := range user.roles {
+		roles[i] = x
+	}
+
+	return map[string]interface{}{
+		"claims": map[string]interface{}(user.claims),
+		"request": map[string]interface{}{
+			"method":  cx.Request.Method,
+			"path":    cx.Request.URL.Path,
+			"host":    cx.Request.Host,
+			"ip":      cx.ClientIP(),
+			"headers": cx.Request.Header,
+		},
+		"user": map[string]interface{}{
+			"id":       user.id,
+			"name":     user.name,
+			"email":    user.email,
+			"audience": strings.Join(user.audiences, ","),
+			"roles":    roles,
+		},
+	}
+}
+
+//
+// policyToken is a token of the policy expression
+//
+type policyToken struct {
+	kind  int
+	value string
+}
+
+//
+// tokenizePolicy splits the expression into the tokens
+//
+func tokenizePolicy(expression string) ([]policyToken, error) {
+	var tokens []policyToken
+	for i := 0; i < len(expression); {
+		ch := expression[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '\'' || ch == '"':
+			var value []byte
+			j := i + 1
+			for ; j < len(expression) && expression[j] != ch; j++ {
+				if expression[j] == '\\' && j+1 < len(expression) {
+					j++
+				}
+				value = append(value, expression[j])
+			}
+			if j >= len(expression) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenString, value: string(value)})
+			i = j + 1
+		case ch >= '0' && ch <= '9':
+			j := i
+			for j < len(expression) && (expression[j] >= '0' && expression[j] <= '9' || expression[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenNumber, value: expression[i:j]})
+			i = j
+		case isPolicyIdent(ch, false):
+			j := i
+			for j < len(expression) && isPolicyIdent(expression[j], true) {
+				j++
+			}
+			word := expression[i:j]
+			if op, found := policyKeywords[word]; found {
+				tokens = append(tokens, policyToken{kind: policyTokenOperator, value: op})
+			} else {
+				tokens = append(tokens, policyToken{kind: policyTokenIdent, value: word})
+			}
+			i = j
+		default:
+			if i+1 < len(expression) {
+				switch op := expression[i : i+2]; op {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, policyToken{kind: policyTokenOperator, value: op})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[],.<>!", rune(ch)) {
+				return nil, fmt.Errorf("unexpected character '%c'", ch)
+			}
+			tokens = append(tokens, policyToken{kind: policyTokenOperator, value: string(ch)})
+			i++
+		}
+	}
+
+	return tokens, nil
+}
+
+//
+// isPolicyIdent checks if the character is part of an identifier
+//
+func isPolicyIdent(ch byte, digits bool) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_' || digits && ch >= '0' && ch <= '9'
+}
+
+//
+// policyParser is a recursive descent parser of the policy expressions
+//
+type policyParser struct {
+	// the tokens of the expression
+	tokens []policyToken
+	// the position of the next token
+	pos int
+}
+
+//
+// accept consumes the next token if it's the operator
+//
+func (r *policyParser) accept(op string) bool {
+	if r.pos < len(r.tokens) && r.tokens[r.pos].kind == policyTokenOperator && r.tokens[r.pos].value == op {
+		r.pos++
+		return true
+	}
+
+	return false
+}
+
+//
+// expect consumes the operator, else returns an error
+//
+func (r *policyParser) expect(op string) error {
+	if !r.accept(op) {
+		return fmt.Errorf("expected '%s'", op)
+	}
+
+	return nil
+}
+
+//
+// parseOr parses the lowest precedence, a series of expressions joined by ||
+//
+func (r *policyParser) parseOr() (policyNode, error) {
+	left, err := r.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for r.accept("||") {
+		right, err := r.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyLogical{or: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+//
+// parseAnd parses a series of expressions joined by &&
+//
+func (r *policyParser) parseAnd() (policyNode, error) {
+	left, err := r.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for r.accept("&&") {
+		right, err := r.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &policyLogical{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+//
+// parseUnary parses a negation or a comparison
+//
+func (r *policyParser) parseUnary() (policyNode, error) {
+	if r.accept("!") {
+		operand, err := r.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &policyNot{operand: operand}, nil
+	}
+
+	return r.parseComparison()
+}
+
+//
+// parseComparison parses a value optionally compared to another
+//
+func (r *policyParser) parseComparison() (policyNode, error) {
+	left, err := r.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if r.accept(op) {
+			right, err := r.parsePostfix()
+			if err != nil {
+				return nil, err
+			}
+			return &policyCompare{op: op, left: left, right: right}, nil
+		}
+	}
+
+	return left, nil
+}
+
+//
+// parsePostfix parses a value followed by any field access, index or method call
+//
+func (r *policyParser) parsePostfix() (policyNode, error) {
+	node, err := r.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case r.accept("."):
+			if r.pos >= len(r.tokens) || r.tokens[r.pos].kind != policyTokenIdent {
+				return nil, fmt.Errorf("expected a field name after '.'")
+			}
+			name := r.tokens[r.pos].value
+			r.pos++
+			if !r.accept("(") {
+				node = &policyIndex{target: node, index: &policyLiteral{value: name}}
+				continue
+			}
+			args, err := r.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			count, found := policyMethods[name]
+			if !found {
+				return nil, fmt.Errorf("unknown method '%s'", name)
+			}
+			if len(args) != count {
+				return nil, fmt.Errorf("the method '%s' takes %d arguments", name, count)
+			}
+			call := &policyCall{target: node, method: name, args: args}
+			// step: the regex is compiled once with the policy, rather than on every request
+			if name == "matches" {
+				literal, ok := args[0].(*policyLiteral)
+				expression, valid := "", false
+				if ok {
+					expression, valid = literal.value.(string)
+				}
+				if !valid {
+					return nil, fmt.Errorf("the method 'matches' takes a string literal")
+				}
+				if call.regex, err = regexp.Compile(expression); err != nil {
+					return nil, fmt.Errorf("invalid regex '%s', error: %s", expression, err)
+				}
+			}
+			node = call
+		case r.accept("["):
+			index, err := r.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := r.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &policyIndex{target: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+//
+// parsePrimary parses a literal, variable, list or parenthesized expression
+//
+func (r *policyParser) parsePrimary() (policyNode, error) {
+	if r.pos >= len(r.tokens) {
+		return nil, fmt.Errorf("unexpected end of the expression")
+	}
+	token := r.tokens[r.pos]
+	r.pos++
+
+	switch token.kind {
+	case policyTokenString:
+		return &policyLiteral{value: token.value}, nil
+	case policyTokenNumber:
+		value, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token.value)
+		}
+		return &policyLiteral{value: value}, nil
+	case policyTokenIdent:
+		switch token.value {
+		case "true", "false":
+			return &policyLiteral{value: token.value == "true"}, nil
+		case "null":
+			return &policyLiteral{}, nil
+		}
+		if !policyVariables[token.value] {
+			return nil, fmt.Errorf("unknown variable '%s', should be claims, request or user", token.value)
+		}
+		return &policyVariable{name: token.value}, nil
+	}
+
+	switch token.value {
+	case "(":
+		node, err := r.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := r.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case "[":
+		items, err := r.parseList("]")
+		if err != nil {
+			return nil, err
+		}
+		return &policyList{items: items}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected '%s'", token.value)
+}
+
+//
+// parseList parses the comma separated expressions up to the closing operator
+//
+func (r *policyParser) parseList(closing string) ([]policyNode, error) {
+	var items []policyNode
+	if r.accept(closing) {
+		return items, nil
+	}
+	for {
+		item, err := r.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if r.accept(closing) {
+			return items, nil
+		}
+		if err := r.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// policyLiteral is a string, number, boolean or null
+type policyLiteral struct {
+	value interface{}
+}
+
+func (r *policyLiteral) eval(env map[string]interface{}) (interface{}, error) {
+	return r.value, nil
+}
+
+// policyVariable is one of the variables of the environment
+type policyVariable struct {
+	name string
+}
+
+func (r *policyVariable) eval(env map[string]interface{}) (interface{}, error) {
+	return env[r.name], nil
+}
+
+// policyList is a list of values
+type policyList struct {
+	items []policyNode
+}
+
+func (r *policyList) eval(env map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, len(r.items))
+	for i, x := range r.items {
+		value, err := x.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+
+	return list, nil
+}
+
+// policyIndex is a field or index of a map, list or the headers; a missing field is null
+type policyIndex struct {
+	target policyNode
+	index  policyNode
+}
+
+func (r *policyIndex) eval(env map[string]interface{}) (interface{}, error) {
+	target, err := r.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return x[fmt.Sprintf("%v", index)], nil
+	case http.Header:
+		if values, found := x[http.CanonicalHeaderKey(fmt.Sprintf("%v", index))]; found && len(values) > 0 {
+			return values[0], nil
+		}
+		return nil, nil
+	case []interface{}:
+		position, ok := index.(float64)
+		if !ok {
+			return nil, fmt.Errorf("the index of a list must be a number")
+		}
+		if position < 0 || int(position) >= len(x) {
+			return nil, nil
+		}
+		return x[int(position)], nil
+	}
+
+	return nil, fmt.Errorf("cannot index a %T", target)
+}
+
+// policyCall is a method called on a value
+type policyCall struct {
+	target policyNode
+	method string
+	args   []policyNode
+	// the compiled regex of the matches method
+	regex *regexp.Regexp
+}
+
+func (r *policyCall) eval(env map[string]interface{}) (interface{}, error) {
+	target, err := r.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if r.method == "size" {
+		switch x := target.(type) {
+		case string:
+			return float64(len(x)), nil
+		case []interface{}:
+			return float64(len(x)), nil
+		case map[string]interface{}:
+			return float64(len(x)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("cannot call size() on a %T", target)
+	}
+
+	arg, err := r.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := target.(string)
+	if target == nil {
+		return false, nil
+	}
+	argument, valid := arg.(string)
+	if !ok || !valid {
+		return nil, fmt.Errorf("the method %s() applies to strings", r.method)
+	}
+
+	switch r.method {
+	case "startsWith":
+		return strings.HasPrefix(value, argument), nil
+	case "endsWith":
+		return strings.HasSuffix(value, argument), nil
+	case "contains":
+		return strings.Contains(value, argument), nil
+	}
+
+	return r.regex.MatchString(value), nil
+}
+
+// policyNot is the negation of a boolean
+type policyNot struct {
+	operand policyNode
+}
+
+func (r *policyNot) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := evalPolicyBool(r.operand, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return !value, nil
+}
+
+// policyLogical is the short circuited && or || of two booleans
+type policyLogical struct {
+	or    bool
+	left  policyNode
+	right policyNode
+}
+
+func (r *policyLogical) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := evalPolicyBool(r.left, env)
+	if err != nil {
+		return nil, err
+	}
+	if left == r.or {
+		return left, nil
+	}
+
+	return evalPolicyBool(r.right, env)
+}
+
+// policyCompare is the comparison of two values
+type policyCompare struct {
+	op    string
+	left  policyNode
+	right policyNode
+}
+
+func (r *policyCompare) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := r.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := r.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.op {
+	case "==":
+		return policyEqual(left, right), nil
+	case "!=":
+		return !policyEqual(left, right), nil
+	case "in":
+		switch x := right.(type) {
+		case nil:
+			return false, nil
+		case []interface{}:
+			for _, item := range x {
+				if policyEqual(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			_, found := x[fmt.Sprintf("%v", left)]
+			return found, nil
+		case string:
+			// step: in is not a substring match, i.e. 'admin' in 'superadmin', the contains() method is explicit
+			return nil, fmt.Errorf("cannot check a %T is in a string, use the contains() method for a substring", left)
+		}
+		return nil, fmt.Errorf("cannot check a %T is in a %T", left, right)
+	}
+
+	// step: the ordering comparisons are between numbers or strings
+	var compared int
+	if a, ok := left.(float64); ok {
+		b, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare a number with a %T", right)
+		}
+		switch {
+		case a < b:
+			compared = -1
+		case a > b:
+			compared = 1
+		}
+	} else if a, ok := left.(string); ok {
+		b, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare a string with a %T", right)
+		}
+		compared = strings.Compare(a, b)
+	} else {
+		return nil, fmt.Errorf("cannot compare a %T", left)
+	}
+
+	switch r.op {
+	case "<":
+		return compared < 0, nil
+	case "<=":
+		return compared <= 0, nil
+	case ">":
+		return compared > 0, nil
+	}
+
+	return compared >= 0, nil
+}
+
+//
+// evalPolicyBool evaluates the node, which must result in a boolean
+//
+func evalPolicyBool(node policyNode, env map[string]interface{}) (bool, error) {
+	value, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, not a %T", value)
+	}
+
+	return result, nil
+}
+
+//
+// policyEqual checks if the values are equal, lists and maps are never equal
+//
+func policyEqual(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, bool, string, float64:
+	default:
+		return false
+	}
+	switch b.(type) {
+	case nil, bool, string, float64:
+	default:
+		return false
+	}
+
+	return a == b
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakePolicyEnvironment() map[string]interface{} {
+	headers := make(http.Header, 0)
+	headers.Set("X-Tenant", "acme")
+
+	return map[string]interface{}{
+		"claims": map[string]interface{}{
+			"department": "finance",
+			"level":      float64(3),
+			"groups":     []interface{}{"/finance", "/auditors"},
+			"address":    map[string]interface{}{"country": "GB"},
+		},
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"path":    "/reports/2017",
+			"ip":      "10.0.0.1",
+			"headers": headers,
+		},
+		"user": map[string]interface{}{
+			"name":  "rohith",
+			"roles": []interface{}{"admin", "user"},
+		},
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	tests := []struct {
+		Expression string
+		Expected   bool
+		Error      bool
+	}{
+		{Expression: "claims.department == 'finance' && request.method != 'DELETE'", Expected: true},
+		{Expression: "claims.department == 'finance' and request.method == 'DELETE'"},
+		{Expression: "claims.department == 'hr' || 'admin' in user.roles", Expected: true},
+		{Expression: "claims.department == 'hr' or 'root' in user.roles"},
+		{Expression: "!(claims.level < 2)", Expected: true},
+		{Expression: "not claims.level >= 5", Expected: true},
+		{Expression: "claims.level <= 3.0", Expected: true},
+		{Expression: `claims.address.country in ["GB", "IE"]`, Expected: true},
+		{Expression: "claims['address']['country'] == 'GB'", Expected: true},
+		{Expression: "claims.groups[1] == '/auditors'", Expected: true},
+		{Expression: "claims.groups[5] == null", Expected: true},
+		{Expression: "claims.missing.nested == null", Expected: true},
+		{Expression: "'country' in claims.address", Expected: true},
+		{Expression: "request.headers['x-tenant'] == 'acme'", Expected: true},
+		{Expression: "request.headers['X-Missing'] == null", Expected: true},
+		{Expression: "request.path.startsWith('/reports/') && request.path.endsWith('2017')", Expected: true},
+		{Expression: "request.ip.matches('^10\\\\.')", Expected: true},
+		{Expression: "request.path.contains('admin')"},
+		{Expression: "claims.groups.size() == 2", Expected: true},
+		{Expression: "claims.missing.startsWith('x')"},
+		{Expression: "true", Expected: true},
+		{Expression: "claims.level < 'a'", Error: true},
+		{Expression: "claims.department", Error: true},
+		{Expression: "claims.department && true", Error: true},
+		{Expression: "'admin' in 'superadmin'", Error: true},
+		{Expression: "'fin' in claims.department", Error: true},
+		{Expression: "claims.department.contains('fin')", Expected: true},
+	}
+	env := newFakePolicyEnvironment()
+	for i, c := range tests {
+		p, err := newPolicy(c.Expression)
+		if !assert.NoError(t, err, "case %d, expression: %s", i, c.Expression) {
+			continue
+		}
+		result, err := p.evaluate(env)
+		if c.Error {
+			assert.Error(t, err, "case %d, expression: %s", i, c.Expression)
+			continue
+		}
+		assert.NoError(t, err, "case %d, expression: %s", i, c.Expression)
+		assert.Equal(t, c.Expected, result, "case %d, expression: %s", i, c.Expression)
+	}
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	for i, x := range []string{
+		"",
+		"claims.department ==",
+		"unknown.field == 'x'",
+		"claims.department == 'finance",
+		"(claims.level > 1",
+		"claims.name.lower() == 'x'",
+		"claims.name.startsWith() == 'x'",
+		"claims.level > 1 claims",
+		"claims.level # 1",
+		"request.ip.matches('[')",
+		"request.ip.matches(claims.pattern)",
+	} {
+		_, err := newPolicy(x)
+		assert.Error(t, err, "case %d, expression: %s", i, x)
+	}
+}
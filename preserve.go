@@ -0,0 +1,231 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// preservedRequestPrefix is the prefix for the requests held in the store
+	preservedRequestPrefix = "request:"
+	// preservedRequestDuration is the time a preserved request is replayable for
+	preservedRequestDuration = time.Duration(10) * time.Minute
+	// preservedRequestCountPrefix is the prefix for the number of requests preserved for a client address
+	preservedRequestCountPrefix = "preserved:"
+	// preservedRequestsPerClient is the number of requests a client address can preserve in the duration
+	preservedRequestsPerClient = 10
+	// formContentType is the content type of the forms we are able to replay
+	formContentType = "application/x-www-form-urlencoded"
+	// replayCookieName is the cookie binding the preserved request to the browser
+	replayCookieName = "kc-replay"
+)
+
+//
+// preservedRequest is a form submission held in the store while the user authenticates
+//
+type preservedRequest struct {
+	// Method is the method of the request
+	Method string `json:"method"`
+	// URI is the request uri
+	URI string `json:"uri"`
+	// Body is the url encoded form
+	Body string `json:"body"`
+	// Expires is the time the request is no longer replayable
+	Expires int64 `json:"exp"`
+}
+
+// replayTemplate is the page resubmitting the preserved form once authenticated, the user confirms the submission
+// unless the form carried the csrf token of the browser
+var replayTemplate = template.Must(template.New("replay").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Resubmitting</title></head>
+<body{{ if not .Confirm }} onload="document.forms[0].submit()"{{ end }}>
+<form method="{{ .Method }}" action="{{ .URI }}">
+{{- range $name, $values := .Fields }}{{ range $values }}
+<input type="hidden" name="{{ $name }}" value="{{ . }}">
+{{- end }}{{ end }}
+{{- if .Confirm }}
+<p>The form submitted to {{ .URI }} before you signed in was held, continue to submit it.</p>
+<input type="submit" value="Continue">
+{{- else }}
+<noscript><input type="submit" value="Continue"></noscript>
+{{- end }}
+</form>
+</body>
+</html>
+`))
+
+//
+// preserveRequest holds the form submitted by an unauthenticated user in the store, returning the location the user
+// is returned to after authenticating; the replay endpoint if the form was preserved, else the request uri
+//
+func (r *oauthProxy) preserveRequest(cx *gin.Context) string {
+	location := cx.Request.URL.RequestURI()
+	if !r.config.EnablePreserveRequests || !r.useStore() || cx.Request.Method != "POST" || cx.Request.Body == nil {
+		return location
+	}
+	if !strings.HasPrefix(cx.Request.Header.Get("Content-Type"), formContentType) {
+		return location
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(cx.Request.Body, r.config.PreserveRequestLimit+1))
+	if err != nil || int64(len(content)) > r.config.PreserveRequestLimit {
+		log.WithFields(log.Fields{
+			"path":  cx.Request.URL.Path,
+			"limit": r.config.PreserveRequestLimit,
+		}).Warnf("unable to preserve the request, the body could not be read or exceeds the limit")
+
+		return location
+	}
+	// step: with the csrf protection the form must carry the token of the browser, else a form posted by another
+	// site would be resubmitted from our origin once the user has authenticated
+	if r.config.EnableCSRF && !hasCSRFFormToken(cx.Request, r.config.CSRFCookieName, content) {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"path":      cx.Request.URL.Path,
+		}).Warnf("unable to preserve the request, the form has a missing or invalid csrf token")
+
+		return location
+	}
+	// step: the clients are unauthenticated, so the number of requests each can hold in the store is capped
+	count, _, err := r.store.Increment(preservedRequestCountPrefix+cx.ClientIP(), preservedRequestDuration)
+	if err != nil || count > preservedRequestsPerClient {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"path":      cx.Request.URL.Path,
+		}).Warnf("unable to preserve the request, the client has preserved too many requests")
+
+		return location
+	}
+	id, err := newCSRFToken()
+	if err != nil {
+		return location
+	}
+	encoded, err := json.Marshal(&preservedRequest{
+		Method:  cx.Request.Method,
+		URI:     location,
+		Body:    string(content),
+		Expires: time.Now().Add(preservedRequestDuration).Unix(),
+	})
+	if err != nil {
+		return location
+	}
+	if err := r.store.SetWithExpiry(preservedRequestPrefix+id, string(encoded), preservedRequestDuration); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to preserve the request in the store")
+
+		return location
+	}
+	// step: the request is bound to the browser, so a replay cannot be forced on another user
+	r.dropCookie(cx, replayCookieName, id, preservedRequestDuration)
+
+	return oauthURL + replayURL
+}
+
+//
+// replayHandler resubmits the form preserved before the user authenticated
+//
+func (r *oauthProxy) replayHandler(cx *gin.Context) {
+	cookie, err := cx.Request.Cookie(replayCookieName)
+	if err != nil || cookie.Value == "" || !r.useStore() {
+		r.redirectToURL("/", cx)
+		return
+	}
+	r.dropCookie(cx, replayCookieName, "", time.Duration(-10*time.Hour))
+
+	request, err := r.getPreservedRequest(cookie.Value, time.Now())
+	if err != nil || request == nil {
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to retrieve the preserved request from the store")
+		}
+		r.redirectToURL("/", cx)
+		return
+	}
+	fields, err := url.ParseQuery(request.Body)
+	if err != nil {
+		r.redirectToURL(request.URI, cx)
+		return
+	}
+
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Content-Type", "text/html; charset=utf-8")
+	cx.Status(http.StatusOK)
+	if err := replayTemplate.Execute(cx.Writer, map[string]interface{}{
+		"Method":  request.Method,
+		"URI":     request.URI,
+		"Fields":  fields,
+		"Confirm": !r.config.EnableCSRF,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to render the replay page")
+	}
+	cx.Abort()
+}
+
+//
+// getPreservedRequest retrieves and removes the preserved request from the store, nil if not found or expired
+//
+func (r *oauthProxy) getPreservedRequest(id string, now time.Time) (*preservedRequest, error) {
+	content, err := r.store.Get(preservedRequestPrefix + id)
+	if err != nil || content == "" {
+		return nil, err
+	}
+	if err := r.store.Delete(preservedRequestPrefix + id); err != nil {
+		return nil, err
+	}
+
+	request := new(preservedRequest)
+	if err := json.Unmarshal([]byte(content), request); err != nil {
+		return nil, err
+	}
+	if now.After(time.Unix(request.Expires, 0)) {
+		return nil, nil
+	}
+
+	return request, nil
+}
+
+//
+// hasCSRFFormToken checks the form carries the csrf token held in the cookie of the browser
+//
+func hasCSRFFormToken(req *http.Request, name string, content []byte) bool {
+	cookie, err := req.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	values, err := url.ParseQuery(string(content))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(values.Get(csrfFormField))) == 1
+}
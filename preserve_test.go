@@ -0,0 +1,209 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreserveRequest(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     fakeAdminRoleURL,
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.store = store
+	proxy.config.SkipTokenVerification = false
+	proxy.config.EnablePreserveRequests = true
+	proxy.config.PreserveRequestLimit = 1024
+	proxy.createEndpoints()
+
+	form := url.Values{"comment": []string{"<b>a long comment</b>"}, "tags": []string{"one", "two"}}
+	req := newFakeHTTPRequest("POST", fakeAdminRoleURL)
+	req.Header.Set("Content-Type", formContentType)
+	req.Body = ioutil.NopCloser(strings.NewReader(form.Encode()))
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	expected := oauthURL + authorizationURL + "?state=" + base64.StdEncoding.EncodeToString([]byte(oauthURL+replayURL))
+	assert.Equal(t, expected, recorder.Header().Get("Location"))
+	cookie := findCookie(replayCookieName, (&http.Response{Header: recorder.Header()}).Cookies())
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+
+	// step: the form is resubmitted once
+	for i, found := range []bool{true, false} {
+		req = newFakeHTTPRequest("GET", oauthURL+replayURL)
+		req.AddCookie(&http.Cookie{Name: replayCookieName, Value: cookie.Value})
+		recorder = httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !found {
+			assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusOK, recorder.Code, "case %d", i)
+		body := recorder.Body.String()
+		assert.Contains(t, body, `<form method="POST" action="`+fakeAdminRoleURL+`">`)
+		assert.Contains(t, body, `name="comment" value="&lt;b&gt;a long comment&lt;/b&gt;"`)
+		assert.Contains(t, body, `name="tags" value="one"`)
+		assert.Contains(t, body, `name="tags" value="two"`)
+		// step: without the csrf protection the user confirms the submission
+		assert.NotContains(t, body, "onload")
+		assert.Contains(t, body, `<input type="submit" value="Continue">`)
+	}
+}
+
+func TestPreserveRequestCSRF(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     fakeAdminRoleURL,
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.store = store
+	proxy.config.SkipTokenVerification = false
+	proxy.config.EnablePreserveRequests = true
+	proxy.config.PreserveRequestLimit = 1024
+	proxy.config.EnableCSRF = true
+	proxy.config.CSRFCookieName = "kc-csrf"
+	proxy.config.CSRFHeader = "X-CSRF-Token"
+	proxy.createEndpoints()
+
+	post := func(cookie, token string) *httptest.ResponseRecorder {
+		form := url.Values{"comment": []string{"transfer"}}
+		if token != "" {
+			form.Set(csrfFormField, token)
+		}
+		req := newFakeHTTPRequest("POST", fakeAdminRoleURL)
+		req.Header.Set("Content-Type", formContentType)
+		req.Body = ioutil.NopCloser(strings.NewReader(form.Encode()))
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: proxy.config.CSRFCookieName, Value: cookie})
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+	notPreserved := oauthURL + authorizationURL + "?state=" + base64.StdEncoding.EncodeToString([]byte(fakeAdminRoleURL))
+
+	// step: a form posted by another site, without the csrf token of the browser, is not preserved
+	for i, c := range [][]string{{"", ""}, {"", "guessed"}, {"token", ""}, {"token", "guessed"}} {
+		recorder := post(c[0], c[1])
+		assert.Equal(t, notPreserved, recorder.Header().Get("Location"), "case %d", i)
+		assert.Nil(t, findCookie(replayCookieName, (&http.Response{Header: recorder.Header()}).Cookies()), "case %d", i)
+	}
+
+	// step: the form of the browser is preserved and resubmitted with its own token
+	recorder := post("token", "token")
+	cookie := findCookie(replayCookieName, (&http.Response{Header: recorder.Header()}).Cookies())
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	req := newFakeHTTPRequest("GET", oauthURL+replayURL)
+	req.AddCookie(&http.Cookie{Name: replayCookieName, Value: cookie.Value})
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `onload="document.forms[0].submit()"`)
+	assert.Contains(t, recorder.Body.String(), `name="_csrf" value="token"`)
+	assert.Nil(t, findCookie(proxy.config.CSRFCookieName, (&http.Response{Header: recorder.Header()}).Cookies()))
+}
+
+func TestPreserveRequestNotPreserved(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxy(t)
+	proxy.store = store
+	proxy.config.EnablePreserveRequests = true
+	proxy.config.PreserveRequestLimit = 8
+
+	cases := []struct {
+		Method      string
+		ContentType string
+		Body        string
+	}{
+		{Method: "GET"},
+		{Method: "POST", ContentType: "application/json", Body: "{}"},
+		{Method: "POST", ContentType: formContentType, Body: "name=a+long+value"},
+	}
+	for i, c := range cases {
+		cx := newFakeGinContext(c.Method, "/admin")
+		cx.Request.Header.Set("Content-Type", c.ContentType)
+		cx.Request.Body = ioutil.NopCloser(strings.NewReader(c.Body))
+		assert.Equal(t, "/admin", proxy.preserveRequest(cx), "case %d", i)
+	}
+}
+
+func TestPreserveRequestPerClient(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     fakeAdminRoleURL,
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.store = store
+	proxy.config.SkipTokenVerification = false
+	proxy.config.EnablePreserveRequests = true
+	proxy.config.PreserveRequestLimit = 1024
+	proxy.createEndpoints()
+
+	// step: the requests beyond the limit of the client are not preserved
+	for i := 0; i <= preservedRequestsPerClient; i++ {
+		req := newFakeHTTPRequest("POST", fakeAdminRoleURL)
+		req.Header.Set("Content-Type", formContentType)
+		req.Body = ioutil.NopCloser(strings.NewReader("name=value"))
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		state := oauthURL + replayURL
+		if i >= preservedRequestsPerClient {
+			state = fakeAdminRoleURL
+		}
+		expected := oauthURL + authorizationURL + "?state=" + base64.StdEncoding.EncodeToString([]byte(state))
+		assert.Equal(t, expected, recorder.Header().Get("Location"), "case %d", i)
+	}
+}
+
+func TestGetPreservedRequestExpired(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxy(t)
+	proxy.store = store
+	assert.NoError(t, store.Set(preservedRequestPrefix+"id", `{"method":"POST","uri":"/","body":"","exp":1}`))
+
+	request, err := proxy.getPreservedRequest("id", time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, request)
+	content, _ := store.Get(preservedRequestPrefix + "id")
+	assert.Empty(t, content)
+}
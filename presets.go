@@ -0,0 +1,118 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// upstreamPreset is the identity headers expected by a self-hosted application, a named set of the identity
+// header renames (--identity-header)
+//
+type upstreamPreset struct {
+	// the identity headers of the application, keyed as the identity header renames
+	headers map[string]string
+	// the claims forwarded in addition to the identity, named in the headers
+	claims []string
+	// whether the application accepts multiple roles, else the first mapped role is used
+	multipleRoles bool
+}
+
+// upstreamPresets are the identity headers of the common self-hosted applications
+var upstreamPresets = map[string]*upstreamPreset{
+	"grafana": {
+		headers: map[string]string{
+			"username": "X-WEBAUTH-USER",
+			"email":    "X-WEBAUTH-EMAIL",
+			"name":     "X-WEBAUTH-NAME",
+			"roles":    "X-WEBAUTH-ROLE",
+		},
+		claims: []string{"name"},
+	},
+	"gitea": {
+		headers: map[string]string{
+			"username": "X-WEBAUTH-USER",
+			"email":    "X-WEBAUTH-EMAIL",
+			"name":     "X-WEBAUTH-FULLNAME",
+		},
+		claims:        []string{"name"},
+		multipleRoles: true,
+	},
+	"kibana": {
+		headers: map[string]string{
+			"username": "X-Proxy-User",
+			"roles":    "X-Proxy-Roles",
+		},
+		multipleRoles: true,
+	},
+	"jenkins": {
+		headers: map[string]string{
+			"username": "X-Forwarded-User",
+			"email":    "X-Forwarded-Email",
+			"roles":    "X-Forwarded-Groups",
+		},
+		multipleRoles: true,
+	},
+}
+
+//
+// upstreamRoles returns the roles forwarded to the upstream, mapped to the roles of the application; an application
+// taking a single role is only passed the first mapped role, as the roles are only meaningful to it when mapped
+//
+func upstreamRoles(roles []string, mappings []RoleMapping, preset *upstreamPreset) []string {
+	if preset != nil && !preset.multipleRoles && len(mappings) <= 0 {
+		return nil
+	}
+	roles = mapRoles(roles, mappings)
+	if preset != nil && !preset.multipleRoles && len(roles) > 1 {
+		roles = roles[:1]
+	}
+
+	return roles
+}
+
+//
+// mapRoles maps the roles to the roles of the application in the order of the mappings, without mappings
+// the roles are passed as is
+//
+func mapRoles(roles []string, mappings []RoleMapping) []string {
+	if len(mappings) <= 0 {
+		return roles
+	}
+
+	var list []string
+	for _, x := range mappings {
+		if containedIn(x.Role, roles) && !containedIn(x.Value, list) {
+			list = append(list, x.Value)
+		}
+	}
+
+	return list
+}
+
+//
+// decodeRoleMapping decodes the role mapping option, role=value
+//
+func decodeRoleMapping(mapping string) (RoleMapping, error) {
+	items := strings.SplitN(mapping, "=", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return RoleMapping{}, fmt.Errorf("invalid role mapping '%s' should be role=value", mapping)
+	}
+
+	return RoleMapping{Role: items[0], Value: items[1]}, nil
+}
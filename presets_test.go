@@ -0,0 +1,98 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamPresetHeaders(t *testing.T) {
+	user := &userContext{
+		name:  "rohith",
+		email: "gambol99@gmail.com",
+		roles: []string{"grafana:viewer", "grafana:editor"},
+		claims: jose.Claims{
+			"preferred_username": "rohith",
+			"email":              "gambol99@gmail.com",
+			"name":               "Rohith Jayawardene",
+		},
+	}
+	mappings := []RoleMapping{
+		{Role: "grafana:admin", Value: "Admin"},
+		{Role: "grafana:editor", Value: "Editor"},
+		{Role: "grafana:viewer", Value: "Viewer"},
+	}
+
+	p := newFakeKeycloakProxy(t)
+	p.config.UpstreamPreset = "grafana"
+	p.config.UpstreamRoleMappings = mappings
+	handler := p.upstreamHeadersHandler(nil)
+	context := newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-WEBAUTH-ROLE", "Admin")
+	context.Set(userContextName, user)
+	handler(context)
+	assert.Equal(t, "rohith", context.Request.Header.Get("X-WEBAUTH-USER"))
+	assert.Equal(t, "gambol99@gmail.com", context.Request.Header.Get("X-WEBAUTH-EMAIL"))
+	assert.Equal(t, "Rohith Jayawardene", context.Request.Header.Get("X-WEBAUTH-NAME"))
+	assert.Equal(t, []string{"Editor"}, context.Request.Header["X-Webauth-Role"])
+	assert.Empty(t, context.Request.Header.Get("X-Auth-Username"))
+
+	// step: the client cannot supply the headers
+	context = newFakeGinContext("GET", "/nothing")
+	context.Request.Header.Set("X-WEBAUTH-USER", "admin")
+	handler(context)
+	assert.Empty(t, context.Request.Header.Get("X-WEBAUTH-USER"))
+
+	// step: multiple roles are passed as is without mappings
+	p.config.UpstreamPreset = "kibana"
+	p.config.UpstreamRoleMappings = nil
+	handler = p.upstreamHeadersHandler(nil)
+	context = newFakeGinContext("GET", "/nothing")
+	context.Set(userContextName, user)
+	handler(context)
+	assert.Equal(t, "rohith", context.Request.Header.Get("X-Proxy-User"))
+	assert.Equal(t, "grafana:viewer,grafana:editor", context.Request.Header.Get("X-Proxy-Roles"))
+}
+
+func TestUpstreamRoles(t *testing.T) {
+	mappings := []RoleMapping{{Role: "a", Value: "A"}, {Role: "c", Value: "C"}}
+	assert.Equal(t, []string{"a", "b"}, upstreamRoles([]string{"a", "b"}, nil, nil))
+	assert.Equal(t, []string{"A", "C"}, upstreamRoles([]string{"c", "a"}, mappings, nil))
+	assert.Equal(t, []string{"a", "b"}, upstreamRoles([]string{"a", "b"}, nil, upstreamPresets["kibana"]))
+	assert.Empty(t, upstreamRoles([]string{"a", "b"}, nil, upstreamPresets["grafana"]))
+	assert.Equal(t, []string{"A"}, upstreamRoles([]string{"c", "a"}, mappings, upstreamPresets["grafana"]))
+}
+
+func TestMapRoles(t *testing.T) {
+	mappings := []RoleMapping{{Role: "a", Value: "A"}, {Role: "b", Value: "A"}, {Role: "c", Value: "C"}}
+	assert.Equal(t, []string{"a", "b"}, mapRoles([]string{"a", "b"}, nil))
+	assert.Equal(t, []string{"A", "C"}, mapRoles([]string{"c", "b", "a"}, mappings))
+	assert.Empty(t, mapRoles([]string{"d"}, mappings))
+}
+
+func TestDecodeRoleMapping(t *testing.T) {
+	mapping, err := decodeRoleMapping("grafana:admin=Admin")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleMapping{Role: "grafana:admin", Value: "Admin"}, mapping)
+
+	for _, x := range []string{"", "admin", "=Admin", "admin="} {
+		_, err := decodeRoleMapping(x)
+		assert.Error(t, err, "mapping: %s", x)
+	}
+}
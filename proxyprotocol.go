@@ -0,0 +1,250 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// proxyProtocolTimeout is the time permitted for the client to send the proxy protocol header
+	proxyProtocolTimeout = time.Duration(5) * time.Second
+	// proxyProtocolV1MaxLength is the maximum length of a v1 header, including the crlf
+	proxyProtocolV1MaxLength = 107
+)
+
+// proxyProtocolV2Signature is the signature which starts a v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//
+// proxyProtocolListener reads the proxy protocol (v1 or v2) header of the accepted connections, the headers are
+// read in the background so a slow client does not hold up the accept loop of the server. It replaces the vendored
+// armon/go-proxyproto, which reads v1 only, and reads the header on the first read of the connection, i.e. after
+// the tls handshake has already failed on it
+//
+type proxyProtocolListener struct {
+	net.Listener
+	// the connections with a header
+	conns chan net.Conn
+	// the temporary errors from the listener
+	errs chan error
+	// closed when the listener fails
+	done chan struct{}
+	// the error which failed the listener
+	err error
+	// starts the accept loop on the first accept
+	once sync.Once
+}
+
+//
+// newProxyProtocolListener wraps the listener in the proxy protocol
+//
+func newProxyProtocolListener(listener net.Listener) *proxyProtocolListener {
+	return &proxyProtocolListener{
+		Listener: listener,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept returns the next connection which has sent a valid header
+func (r *proxyProtocolListener) Accept() (net.Conn, error) {
+	r.once.Do(func() { go r.acceptLoop() })
+
+	select {
+	case conn := <-r.conns:
+		return conn, nil
+	case err := <-r.errs:
+		return nil, err
+	case <-r.done:
+		return nil, r.err
+	}
+}
+
+//
+// acceptLoop accepts the connections from the listener, reading the header of each in the background
+//
+func (r *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := r.Listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				r.errs <- err
+				continue
+			}
+			r.err = err
+			close(r.done)
+			return
+		}
+		go r.handshake(conn)
+	}
+}
+
+//
+// handshake reads the header from the connection, closing the connection if it is invalid
+//
+func (r *proxyProtocolListener) handshake(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	source, err := readProxyProtocolHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"address": conn.RemoteAddr().String(),
+			"error":   err.Error(),
+		}).Warnf("invalid proxy protocol header, closing the connection")
+
+		conn.Close()
+		return
+	}
+
+	select {
+	case r.conns <- &proxyProtocolConn{Conn: conn, reader: reader, source: source}:
+	case <-r.done:
+		conn.Close()
+	}
+}
+
+//
+// proxyProtocolConn is a connection with the source address from the proxy protocol header
+//
+type proxyProtocolConn struct {
+	net.Conn
+	// the reader holding any content read after the header
+	reader *bufio.Reader
+	// the source address of the client, nil if the header did not have one
+	source net.Addr
+}
+
+// Read reads from the connection after the header
+func (r *proxyProtocolConn) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client from the header, else the address of the peer
+func (r *proxyProtocolConn) RemoteAddr() net.Addr {
+	if r.source != nil {
+		return r.source
+	}
+
+	return r.Conn.RemoteAddr()
+}
+
+//
+// readProxyProtocolHeader reads a v1 or v2 header, returning the source address if any
+//
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(signature, proxyProtocolV2Signature):
+		return readProxyProtocolV2Header(reader)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyProtocolV1Header(reader)
+	}
+
+	return nil, fmt.Errorf("the connection did not start with a proxy protocol header")
+}
+
+//
+// readProxyProtocolV1Header reads the human readable header, i.e. PROXY TCP4 192.0.2.1 192.0.2.2 56324 443
+//
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, fmt.Errorf("the v1 header exceeds %d bytes", proxyProtocolV1MaxLength)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header: %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid source address in v1 header: %s", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid source port in v1 header: %s", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+//
+// readProxyProtocolV2Header reads the binary header, the local command and unspecified families have no address
+//
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	version, command, family := header[12]>>4, header[12]&0x0f, header[13]
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version: %d", version)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x00:
+		return nil, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command: %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("the v2 header is too short for an ipv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21, 0x22:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("the v2 header is too short for an ipv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	return nil, nil
+}
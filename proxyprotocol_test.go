@@ -0,0 +1,153 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeProxyProtocolV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(payload)>>8), byte(len(payload)))
+
+	return append(header, payload...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		Header  []byte
+		Address string
+		Ok      bool
+	}{
+		{Header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), Address: "192.0.2.1:56324", Ok: true},
+		{Header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), Address: "[2001:db8::1]:56324", Ok: true},
+		{Header: []byte("PROXY UNKNOWN\r\n"), Ok: true},
+		{Header: newFakeProxyProtocolV2Header(0x01, 0x11, ipv4), Address: "192.0.2.1:56324", Ok: true},
+		{Header: newFakeProxyProtocolV2Header(0x01, 0x21, ipv6), Address: "[2001:db8::1]:56324", Ok: true},
+		{Header: newFakeProxyProtocolV2Header(0x00, 0x00, nil), Ok: true},
+		{Header: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{Header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2\r\n")},
+		{Header: []byte("PROXY TCP4 bad 192.0.2.2 56324 443\r\n")},
+		{Header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{Header: []byte("PROXY TCP6 192.0.2.1 192.0.2.2 56324 443\r\n")},
+		{Header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n")},
+		{Header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n")},
+		{Header: newFakeProxyProtocolV2Header(0x01, 0x11, ipv4[:8])},
+		{Header: newFakeProxyProtocolV2Header(0x02, 0x11, ipv4)},
+	}
+	for i, c := range tests {
+		address, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(c.Header)))
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		if c.Address == "" {
+			assert.Nil(t, address, "case %d", i)
+			continue
+		}
+		if assert.NotNil(t, address, "case %d", i) {
+			assert.Equal(t, c.Address, address.String(), "case %d", i)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeaderFuzz(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	seeds := [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"),
+		[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+		newFakeProxyProtocolV2Header(0x01, 0x11, ipv4),
+		newFakeProxyProtocolV2Header(0x01, 0x21, make([]byte, 36)),
+	}
+	// step: the mutated and truncated headers must be refused or parsed, never panic or read past the v1 limit
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		header := append([]byte{}, seeds[random.Intn(len(seeds))]...)
+		for j := random.Intn(4); j >= 0; j-- {
+			header[random.Intn(len(header))] = byte(random.Intn(256))
+		}
+		if random.Intn(4) == 0 {
+			header = header[:random.Intn(len(header))]
+		}
+		input := append(header, strings.Repeat("GET / HTTP/1.1\r\n", 10)...)
+		reader := bufio.NewReader(bytes.NewReader(input))
+
+		address, err := readProxyProtocolHeader(reader)
+		remainder, _ := ioutil.ReadAll(reader)
+		if bytes.HasPrefix(input, []byte("PROXY ")) {
+			assert.True(t, len(input)-len(remainder) <= proxyProtocolV1MaxLength, "case %d, header: %q", i, header)
+		}
+		if err != nil || address == nil {
+			continue
+		}
+		tcp, ok := address.(*net.TCPAddr)
+		if assert.True(t, ok, "case %d, header: %q", i, header) {
+			assert.True(t, tcp.Port >= 0 && tcp.Port <= 65535, "case %d, header: %q", i, header)
+			assert.NotNil(t, tcp.IP, "case %d, header: %q", i, header)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxied := newProxyProtocolListener(listener)
+	defer proxied.Close()
+
+	// step: a connection without a header is refused, the one with a header accepted
+	invalid, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer invalid.Close()
+	invalid.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+	client.Close()
+
+	conn, err := proxied.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	content, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	// step: the invalid connection was closed
+	_, err = invalid.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
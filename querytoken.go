@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// queryTokenCookieName is the cookie carrying the token handed in the query across the redirect stripping it
+	queryTokenCookieName = "kc-query-token"
+	// queryTokenCookieDuration is the longest the cookie carrying the token handed in the query is kept
+	queryTokenCookieDuration = time.Duration(1) * time.Minute
+)
+
+//
+// getQueryTokenParameter returns the name of the query parameter the resource accepts the access token from
+//
+func (r *oauthProxy) getQueryTokenParameter(cx *gin.Context) string {
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).TokenParameter
+	}
+
+	return ""
+}
+
+//
+// hasQueryToken checks if the resource accepts the access token from the query and one was handed
+//
+func (r *oauthProxy) hasQueryToken(cx *gin.Context) bool {
+	name := r.getQueryTokenParameter(cx)
+
+	return name != "" && cx.Request.URL.Query().Get(name) != ""
+}
+
+//
+// queryTokenHandler verifies the access token handed in the query and redirects the client to the url stripped of
+// it, so it is not left in the address bar, the history nor the referer; the token is carried across the redirect in
+// a short lived cookie scoped to the path, rather than the session cookie, so the link is not turned into a session
+//
+func (r *oauthProxy) queryTokenHandler(cx *gin.Context) {
+	name := r.getQueryTokenParameter(cx)
+	query := cx.Request.URL.Query()
+	value := query.Get(name)
+	query.Del(name)
+
+	token, err := jose.ParseJWT(value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to parse the access token handed in the query")
+
+		r.errorResponse(cx, http.StatusUnauthorized, reasonInvalidToken)
+		return
+	}
+	user, err := extractIdentity(token, r.roles)
+	if err != nil {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonInvalidToken)
+		return
+	}
+	if !r.config.SkipTokenVerification {
+		if err := r.verifyAccessToken(user); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("verification of the access token handed in the query failed")
+
+			reason := reasonInvalidToken
+			if err == ErrAccessTokenExpired {
+				reason = reasonTokenExpired
+			}
+			r.errorResponse(cx, http.StatusUnauthorized, reason)
+			return
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"email":     user.email,
+		"client_ip": cx.ClientIP(),
+		"resource":  cx.Request.URL.Path,
+	}).Debugf("stripping the access token handed in the query from the url")
+
+	duration := queryTokenCookieDuration
+	if expires := user.expiresAt.Sub(time.Now()); expires < duration {
+		duration = expires
+	}
+	http.SetCookie(cx.Writer, &http.Cookie{
+		Name:     queryTokenCookieName,
+		Value:    token.Encode(),
+		Domain:   strings.Split(cx.Request.Host, ":")[0],
+		Path:     cx.Request.URL.Path,
+		Expires:  time.Now().Add(duration),
+		MaxAge:   int(duration.Seconds()),
+		Secure:   r.config.SecureCookie,
+		HttpOnly: true,
+	})
+
+	location := cx.Request.URL.Path
+	if encoded := query.Encode(); encoded != "" {
+		location += "?" + encoded
+	}
+	r.redirectToURL(location, cx)
+}
+
+//
+// getIdentityFromQueryCookie retrieves the user identity from the cookie carrying the token handed in the query; the
+// token is accepted for the resource only, never moved into a session, and the cookie is not passed upstream
+//
+func (r *oauthProxy) getIdentityFromQueryCookie(cx *gin.Context) (*userContext, error) {
+	if r.getQueryTokenParameter(cx) == "" {
+		return nil, ErrSessionNotFound
+	}
+	cookie, err := cx.Request.Cookie(queryTokenCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrSessionNotFound
+	}
+	removeRequestCookie(cx.Request, queryTokenCookieName)
+
+	token, err := jose.ParseJWT(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	user, err := extractIdentity(token, r.roles)
+	if err != nil {
+		return nil, err
+	}
+	user.bearerToken = true
+
+	log.WithFields(log.Fields{
+		"email":     user.email,
+		"client_ip": cx.ClientIP(),
+		"resource":  cx.Request.URL.Path,
+	}).Debugf("found the user identity: %s handed in the query", user.email)
+
+	return user, nil
+}
+
+//
+// removeRequestCookie removes the cookie from the request
+//
+func removeRequestCookie(req *http.Request, name string) {
+	var kept []string
+	for _, x := range req.Cookies() {
+		if x.Name != name {
+			kept = append(kept, x.Name+"="+x.Value)
+		}
+	}
+	req.Header.Del("Cookie")
+	if len(kept) > 0 {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
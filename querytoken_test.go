@@ -0,0 +1,107 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryTokenRedirect(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/downloads", Methods: []string{"ANY"}, TokenParameter: "access_token"},
+		{URL: "/admin", Methods: []string{"ANY"}},
+	})
+	proxy.config.NoRedirects = true
+	var query, cookies string
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, cookies = req.URL.RawQuery, req.Header.Get("Cookie")
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	// step: the client is redirected to the url stripped of the token, carried in a cookie scoped to the path
+	req := newFakeHTTPRequest("GET", "/downloads/report.pdf")
+	req.URL.RawQuery = "access_token=" + token.Encode() + "&inline=true"
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	assert.Equal(t, "/downloads/report.pdf?inline=true", recorder.Header().Get("Location"))
+	responseCookies := (&http.Response{Header: recorder.Header()}).Cookies()
+	assert.Len(t, responseCookies, 1)
+	cookie := findCookie(queryTokenCookieName, responseCookies)
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	assert.Equal(t, token.Encode(), cookie.Value)
+	assert.Equal(t, "/downloads/report.pdf", cookie.Path)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.MaxAge > 0 && cookie.MaxAge <= int(queryTokenCookieDuration.Seconds()))
+
+	// step: the redirected request is accepted with the cookie, which is not passed upstream
+	req = newFakeHTTPRequest("GET", "/downloads/report.pdf")
+	req.URL.RawQuery = "inline=true"
+	req.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: queryTokenCookieName, Value: cookie.Value})
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "inline=true", query)
+	assert.Equal(t, "app=1", cookies)
+	assert.Empty(t, recorder.Header().Get("Set-Cookie"))
+
+	// step: the resources without the option ignore the query and the cookie
+	req = newFakeHTTPRequest("GET", "/admin/report.pdf")
+	req.URL.RawQuery = "access_token=" + token.Encode()
+	req.AddCookie(&http.Cookie{Name: queryTokenCookieName, Value: cookie.Value})
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Set-Cookie"))
+}
+
+func TestRemoveRequestCookie(t *testing.T) {
+	req := newFakeHTTPRequest("GET", "/")
+	req.AddCookie(&http.Cookie{Name: queryTokenCookieName, Value: "token"})
+	removeRequestCookie(req, queryTokenCookieName)
+	assert.Empty(t, req.Header.Get("Cookie"))
+
+	req.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: queryTokenCookieName, Value: "token"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+	removeRequestCookie(req, queryTokenCookieName)
+	assert.Equal(t, "a=1; b=2", req.Header.Get("Cookie"))
+}
+
+func TestQueryTokenInvalid(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/downloads", Methods: []string{"ANY"}, TokenParameter: "access_token"},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	req := newFakeHTTPRequest("GET", "/downloads/report.pdf")
+	req.URL.RawQuery = "access_token=bad"
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Set-Cookie"))
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+//
+// quotaPeriod is a calendar period a quota is counted over
+//
+type quotaPeriod struct {
+	// the name of the period, used in the counter key
+	name string
+	// the number of requests permitted in the period
+	limit int64
+	// returns the end of the period
+	end func(time.Time) time.Time
+}
+
+//
+// quotaUsage is the usage of the most restrictive period
+//
+type quotaUsage struct {
+	// the limit of the period
+	limit int64
+	// the requests remaining in the period
+	remaining int64
+	// the time the period resets
+	reset time.Time
+}
+
+//
+// getQuotaPeriods returns the periods which have been set in the quota
+//
+func getQuotaPeriods(quota Quota) []*quotaPeriod {
+	var periods []*quotaPeriod
+	if quota.Daily > 0 {
+		periods = append(periods, &quotaPeriod{name: "daily", limit: quota.Daily, end: endOfDay})
+	}
+	if quota.Monthly > 0 {
+		periods = append(periods, &quotaPeriod{name: "monthly", limit: quota.Monthly, end: endOfMonth})
+	}
+
+	return periods
+}
+
+//
+// consumeQuota increments the counters for the client, returning the usage of the most restrictive period and
+// if the quota has been exceeded
+//
+func consumeQuota(store storage, periods []*quotaPeriod, key string, now time.Time) (*quotaUsage, bool, error) {
+	var usage *quotaUsage
+	var exceeded bool
+	for _, period := range periods {
+		reset := period.end(now)
+		count, _, err := store.Increment("quota:"+period.name+":"+key, reset.Sub(now))
+		if err != nil {
+			return nil, false, err
+		}
+		if count > period.limit {
+			exceeded = true
+		}
+		remaining := period.limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		// step: on a tie the period which resets last is the more restrictive
+		if usage == nil || remaining < usage.remaining || (remaining == usage.remaining && reset.After(usage.reset)) {
+			usage = &quotaUsage{limit: period.limit, remaining: remaining, reset: reset}
+		}
+	}
+
+	return usage, exceeded, nil
+}
+
+//
+// endOfDay returns the start of the next day (UTC)
+//
+func endOfDay(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+//
+// endOfMonth returns the start of the next month (UTC)
+//
+func endOfMonth(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+//
+// isEnabled checks if any quota has been set
+//
+func (r Quota) isEnabled() bool {
+	return r.Daily > 0 || r.Monthly > 0
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaPeriodEnd(t *testing.T) {
+	now := time.Date(2016, time.December, 31, 13, 10, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), endOfDay(now))
+	assert.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), endOfMonth(now))
+
+	now = time.Date(2016, time.February, 10, 23, 59, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2016, time.February, 11, 0, 0, 0, 0, time.UTC), endOfDay(now))
+	assert.Equal(t, time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC), endOfMonth(now))
+}
+
+func TestConsumeQuota(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	periods := getQuotaPeriods(Quota{Daily: 2, Monthly: 10})
+	assert.Equal(t, 2, len(periods))
+	now := time.Now()
+
+	cs := []struct {
+		Remaining int64
+		Exceeded  bool
+	}{
+		{Remaining: 1},
+		{Remaining: 0},
+		{Remaining: 0, Exceeded: true},
+	}
+	for i, c := range cs {
+		usage, exceeded, err := consumeQuota(store, periods, "subject", now)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Exceeded, exceeded, "case %d", i)
+		assert.Equal(t, c.Remaining, usage.remaining, "case %d", i)
+		assert.Equal(t, int64(2), usage.limit, "case %d", i)
+		assert.Equal(t, endOfDay(now), usage.reset, "case %d", i)
+	}
+}
+
+func TestQuotaHandler(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	proxy := newFakeKeycloakProxy(t)
+	proxy.store = store
+	proxy.config.Quota = Quota{Daily: 1, Claim: "azp"}
+	handler := proxy.quotaHandler()
+
+	// step: the quota is shared by the subjects of the client
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		cx := newFakeGinContext("GET", "/")
+		cx.Set(userContextName, &userContext{
+			id:     fmt.Sprintf("subject-%d", i),
+			claims: jose.Claims{"azp": "client"},
+		})
+		handler(cx)
+		assert.Equal(t, expected, cx.Writer.Status(), "case %d", i)
+		assert.Equal(t, "1", cx.Writer.Header().Get("X-RateLimit-Limit"), "case %d", i)
+		assert.Equal(t, "0", cx.Writer.Header().Get("X-RateLimit-Remaining"), "case %d", i)
+		assert.NotEmpty(t, cx.Writer.Header().Get("X-RateLimit-Reset"), "case %d", i)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// rateLimitPruneInterval is how often we sweep the idle buckets
+	rateLimitPruneInterval = time.Duration(1) * time.Minute
+)
+
+//
+// clientLimiter is the contract for a rate limiter
+//
+type clientLimiter interface {
+	// allow checks if the client is permitted a request, else the time to wait
+	allow(string) (bool, time.Duration)
+}
+
+//
+// tokenBucket is the state for a single client
+//
+type tokenBucket struct {
+	// the tokens currently available
+	tokens float64
+	// the last time the bucket was refilled
+	updated time.Time
+}
+
+//
+// rateLimiter is a token bucket limiter keyed on a client identifier
+//
+type rateLimiter struct {
+	sync.Mutex
+	// the number of tokens added per second
+	rate float64
+	// the maximum size of the bucket
+	burst float64
+	// the buckets keyed on client
+	buckets map[string]*tokenBucket
+	// the last time we pruned the buckets
+	pruned time.Time
+}
+
+//
+// newRateLimiter creates a new rate limiter from the limits
+//
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+
+	return &rateLimiter{
+		rate:    limit.Rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket, 0),
+		pruned:  time.Now(),
+	}
+}
+
+//
+// allow takes a token from the bucket of the client, returning false and the time to wait if the bucket is empty
+//
+func (r *rateLimiter) allow(key string) (bool, time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+
+	bucket, found := r.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: r.burst, updated: now}
+		r.buckets[key] = bucket
+	}
+
+	// step: refill the bucket from the time elapsed
+	bucket.tokens = math.Min(r.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*r.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / r.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+
+	return true, 0
+}
+
+//
+// release hands back the token taken from the bucket of the client
+//
+func (r *rateLimiter) release(key string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if bucket, found := r.buckets[key]; found {
+		bucket.tokens = math.Min(r.burst, bucket.tokens+1)
+	}
+}
+
+//
+// prune removes any buckets which would have been refilled, else the map grows for every client seen
+//
+func (r *rateLimiter) prune(now time.Time) {
+	if now.Sub(r.pruned) < rateLimitPruneInterval {
+		return
+	}
+	r.pruned = now
+
+	refill := time.Duration(r.burst / r.rate * float64(time.Second))
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.updated) > refill {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+//
+// storeRateLimiter is a fixed window limiter with the counters held in the store, so the limit is
+// shared across all the replicas of the proxy
+//
+type storeRateLimiter struct {
+	// the store holding the counters
+	store storage
+	// the prefix for the counter keys
+	prefix string
+	// the number of requests permitted in the window
+	limit int64
+	// the duration of the window
+	window time.Duration
+}
+
+//
+// newStoreRateLimiter creates a limiter permitting the burst over the time taken to refill it
+//
+func newStoreRateLimiter(store storage, name string, limit RateLimit) *storeRateLimiter {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+
+	return &storeRateLimiter{
+		store:  store,
+		prefix: fmt.Sprintf("ratelimit:%s:", name),
+		limit:  int64(burst),
+		window: time.Duration(float64(burst) / limit.Rate * float64(time.Second)),
+	}
+}
+
+//
+// allow increments the counter for the client, we fail open if the store is unavailable
+//
+func (r *storeRateLimiter) allow(key string) (bool, time.Duration) {
+	count, remaining, err := r.store.Increment(r.prefix+key, r.window)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client": key,
+			"error":  err.Error(),
+		}).Errorf("unable to increment the rate limit counter in the store")
+
+		return true, 0
+	}
+	if count > r.limit {
+		return false, remaining
+	}
+
+	return true, 0
+}
+
+//
+// isEnabled checks if the rate limit has been set
+//
+func (r RateLimit) isEnabled() bool {
+	return r.Rate > 0
+}
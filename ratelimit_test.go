@@ -0,0 +1,199 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 1, Burst: 2})
+
+	allowed, _ := limiter.allow("client")
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("client")
+	assert.True(t, allowed)
+	allowed, wait := limiter.allow("client")
+	assert.False(t, allowed)
+	assert.True(t, wait > 0 && wait <= time.Second, "the wait should be under a second, got: %s", wait)
+
+	// step: a different client has its own bucket
+	allowed, _ = limiter.allow("another")
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 0.5})
+	allowed, _ := limiter.allow("client")
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("client")
+	assert.False(t, allowed)
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 10, Burst: 1})
+	limiter.allow("client")
+	limiter.buckets["client"].updated = time.Now().Add(-time.Hour)
+	limiter.pruned = time.Now().Add(-time.Hour)
+	limiter.allow("another")
+	_, found := limiter.buckets["client"]
+	assert.False(t, found, "the idle bucket should have been pruned")
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:       "/limited",
+			Methods:   []string{"ANY"},
+			RateLimit: &RateLimit{Rate: 1, Burst: 1},
+		},
+	})
+	proxy.config.RateLimit = RateLimit{Rate: 1, Burst: 3}
+	handler := proxy.rateLimitHandler()
+
+	// step: the resource limit should take precedence
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		cx := newFakeGinContext("GET", "/limited")
+		cx.Set(cxEnforce, proxy.config.Resources[0])
+		cx.Set(userContextName, &userContext{id: "test-subject"})
+		handler(cx)
+		assert.Equal(t, expected, cx.Writer.Status(), "case %d, expected: %d, got: %d", i, expected, cx.Writer.Status())
+	}
+
+	// step: the global limit is keyed on the client address
+	proxy.createEndpoints()
+	for i, limited := range []bool{false, false, false, true} {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", "/"))
+		assert.Equal(t, limited, recorder.Code == http.StatusTooManyRequests, "case %d, unexpected code: %d", i, recorder.Code)
+		if limited {
+			assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestClientRateLimitHandler(t *testing.T) {
+	newProxy := func() *oauthProxy {
+		proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+			{
+				URL:     "/protected",
+				Methods: []string{"ANY"},
+			},
+		})
+		proxy.config.NoRedirects = true
+		proxy.config.RateLimit = RateLimit{Rate: 1, Burst: 2}
+		proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		proxy.createEndpoints()
+
+		return proxy
+	}
+
+	// step: the unauthenticated requests are limited on the client address ahead of the authentication
+	proxy := newProxy()
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", "/protected"))
+		assert.Equal(t, expected, recorder.Code, "case %d", i)
+	}
+
+	// step: the authenticated requests hand back the token of the client address, as they are limited on the subject
+	proxy = newProxy()
+	for i := 0; i < 4; i++ {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud": "test",
+			"sub": fmt.Sprintf("subject-%d", i),
+			"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/protected")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code, "case %d", i)
+	}
+}
+
+func TestRateLimiterRelease(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 1, Burst: 1})
+	allowed, _ := limiter.allow("client")
+	assert.True(t, allowed)
+	limiter.release("client")
+	limiter.release("client")
+	assert.Equal(t, float64(1), limiter.buckets["client"].tokens, "the bucket should not exceed the burst")
+	allowed, _ = limiter.allow("client")
+	assert.True(t, allowed)
+}
+
+func TestStoreRateLimiterAllow(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	limiter := newStoreRateLimiter(store, "test", RateLimit{Rate: 1, Burst: 2})
+	assert.Equal(t, time.Duration(2)*time.Second, limiter.window)
+	for i, expected := range []bool{true, true, false} {
+		allowed, wait := limiter.allow("client")
+		assert.Equal(t, expected, allowed, "case %d", i)
+		if !allowed {
+			assert.True(t, wait > 0 && wait <= limiter.window, "unexpected wait: %s", wait)
+		}
+	}
+}
+
+func TestRateLimitHandlerTiers(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	proxy := newFakeKeycloakProxy(t)
+	proxy.store = store
+	proxy.config.RateLimit = RateLimit{Rate: 1, Burst: 1}
+	proxy.config.RateLimitClaim = "tier"
+	proxy.config.RateLimitTiers = map[string]RateLimit{"premium": {Rate: 1, Burst: 3}}
+	handler := proxy.rateLimitHandler()
+
+	cs := []struct {
+		Tier    string
+		Allowed int
+	}{
+		{Tier: "premium", Allowed: 3},
+		{Tier: "free", Allowed: 1},
+		{Allowed: 1},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		if c.Tier != "" {
+			claims["tier"] = c.Tier
+		}
+		user := &userContext{id: fmt.Sprintf("subject-%d", i), claims: claims}
+		for j := 0; j <= c.Allowed; j++ {
+			cx := newFakeGinContext("GET", "/")
+			cx.Set(userContextName, user)
+			handler(cx)
+			expected := http.StatusOK
+			if j == c.Allowed {
+				expected = http.StatusTooManyRequests
+			}
+			assert.Equal(t, expected, cx.Writer.Status(), "case %d, request %d", i, j)
+		}
+	}
+}
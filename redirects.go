@@ -0,0 +1,165 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// isPermittedRedirect checks the post authentication or logout redirect is a path on this host, or an absolute url
+// to the request host, the redirection url, a sso domain or an allowed redirect; preventing an open redirect
+//
+func (r *oauthProxy) isPermittedRedirect(target, host string) bool {
+	if target == "" || strings.IndexFunc(target, isUnsafeRedirectRune) >= 0 {
+		return false
+	}
+	// step: a relative path, browsers treat // and /\ as the start of a host
+	if strings.HasPrefix(target, "/") {
+		return len(target) == 1 || (target[1] != '/' && target[1] != '\\')
+	}
+
+	location, err := url.Parse(target)
+	if err != nil || location.Host == "" || location.User != nil {
+		return false
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return false
+	}
+	hostname := getHostname(location.Host)
+	if hostname == getHostname(host) || r.isSSODomain(hostname) {
+		return true
+	}
+	if r.config.RedirectionURL != "" {
+		if u, err := url.Parse(r.config.RedirectionURL); err == nil && hostname == getHostname(u.Host) {
+			return true
+		}
+	}
+	for _, x := range r.config.AllowedRedirects {
+		if matchAllowedRedirect(x, hostname, location.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// matchAllowedRedirect checks the host and path match the allowed redirect, a host (*.domain for the subdomains)
+// with an optional path prefix i.e. *.example.com/app
+//
+func matchAllowedRedirect(allowed, hostname, path string) bool {
+	allowed = strings.TrimPrefix(strings.TrimPrefix(allowed, "https://"), "http://")
+	pattern, prefix := allowed, ""
+	if i := strings.Index(allowed, "/"); i >= 0 {
+		pattern, prefix = allowed[:i], allowed[i:]
+	}
+	pattern = getHostname(pattern)
+
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		if !strings.HasSuffix(hostname, pattern[1:]) {
+			return false
+		}
+	case hostname != pattern:
+		return false
+	}
+	if prefix == "" || prefix == "/" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+//
+// decodeAllowedRedirect validates the allowed redirect, a host with an optional path prefix
+//
+func decodeAllowedRedirect(allowed string) error {
+	location, err := url.Parse("https://" + strings.TrimPrefix(strings.TrimPrefix(allowed, "https://"), "http://"))
+	if err != nil || location.Host == "" || location.User != nil || location.RawQuery != "" || location.Fragment != "" {
+		return fmt.Errorf("invalid allowed redirect '%s' should be a host with an optional path, i.e. *.example.com/app", allowed)
+	}
+	if strings.Contains(strings.TrimPrefix(location.Host, "*."), "*") {
+		return fmt.Errorf("invalid allowed redirect '%s', the wildcard is only permitted as the first label", allowed)
+	}
+
+	return nil
+}
+
+//
+// canonicalHostHandler redirects (301) the requests for any host bar the canonical hostname to it, the health
+// endpoint is exempt for the probes
+//
+func (r *oauthProxy) canonicalHostHandler() gin.HandlerFunc {
+	canonical := strings.ToLower(r.config.CanonicalHostname)
+
+	return func(cx *gin.Context) {
+		if getHostname(cx.Request.Host) == canonical || cx.Request.URL.Path == oauthURL+healthURL {
+			return
+		}
+		scheme := "http"
+		if cx.Request.TLS != nil {
+			scheme = "https"
+		}
+		host := canonical
+		if _, port, err := net.SplitHostPort(cx.Request.Host); err == nil {
+			host = net.JoinHostPort(canonical, port)
+		}
+
+		cx.Redirect(http.StatusMovedPermanently, fmt.Sprintf("%s://%s%s", scheme, host, cx.Request.URL.RequestURI()))
+		cx.Abort()
+	}
+}
+
+//
+// httpsRedirectHandler redirects (301) the requests of a plain http listener to https, on the canonical hostname
+// if set and the port of the service listener
+//
+func (r *oauthProxy) httpsRedirectHandler(w http.ResponseWriter, req *http.Request) {
+	host := getHostname(req.Host)
+	if r.config.CanonicalHostname != "" {
+		host = strings.ToLower(r.config.CanonicalHostname)
+	}
+	if _, port, err := net.SplitHostPort(r.config.Listen); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(w, req, fmt.Sprintf("https://%s%s", host, req.URL.RequestURI()), http.StatusMovedPermanently)
+}
+
+//
+// getHostname returns the lowercased host without the port
+//
+func getHostname(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.ToLower(host)
+}
+
+//
+// isUnsafeRedirectRune checks for the whitespace and control characters browsers strip or mishandle in a location
+//
+func isUnsafeRedirectRune(c rune) bool {
+	return c <= ' ' || c == 0x7f
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermittedRedirect(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.RedirectionURL = "https://auth.example.com"
+	proxy.config.SSODomains = []string{"example.org"}
+	proxy.config.AllowedRedirects = []string{"*.example.net", "apps.example.io/portal", "https://other.example.io"}
+
+	cases := []struct {
+		Target    string
+		Permitted bool
+	}{
+		{Target: "/", Permitted: true},
+		{Target: "/admin?name=test", Permitted: true},
+		{Target: "https://127.0.0.1/admin", Permitted: true},
+		{Target: "http://127.0.0.1:8080/admin", Permitted: true},
+		{Target: "https://AUTH.example.com/admin", Permitted: true},
+		{Target: "https://www.example.org/", Permitted: true},
+		{Target: "https://www.example.net/", Permitted: true},
+		{Target: "https://apps.example.io/portal", Permitted: true},
+		{Target: "https://apps.example.io/portal/page", Permitted: true},
+		{Target: "https://other.example.io/anything", Permitted: true},
+		{Target: ""},
+		{Target: "//evil.com"},
+		{Target: "/\\evil.com"},
+		{Target: "/\t/evil.com"},
+		{Target: "https://evil.com"},
+		{Target: "https://127.0.0.1.evil.com/"},
+		{Target: "https://127.0.0.1@evil.com/"},
+		{Target: "https://user@127.0.0.1/"},
+		{Target: "javascript:alert(1)"},
+		{Target: "ftp://127.0.0.1/"},
+		{Target: "https://example.net/"},
+		{Target: "https://apps.example.io/"},
+		{Target: "https://apps.example.io/portalx"},
+		{Target: "evil.com"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Permitted, proxy.isPermittedRedirect(c.Target, "127.0.0.1"), "case %d, target: %s", i, c.Target)
+	}
+}
+
+func TestDecodeAllowedRedirect(t *testing.T) {
+	for _, x := range []string{"example.com", "*.example.com", "example.com/app", "https://example.com:8443/app"} {
+		assert.NoError(t, decodeAllowedRedirect(x), "%s should be valid", x)
+	}
+	for _, x := range []string{"", "/app", "user@example.com", "example.com/app?q=1", "app.*.example.com"} {
+		assert.Error(t, decodeAllowedRedirect(x), "%s should be invalid", x)
+	}
+}
+
+func TestCallbackRedirectNotPermitted(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SSOBrokerURL = "https://sso.example.com"
+	proxy.createEndpoints()
+	transfer, err := encodeTransferToken(newFakeBearerToken(t).Encode(), proxy.config.EncryptionKey, time.Now().Add(ssoTransferDuration))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := newFakeHTTPRequest("GET", oauthURL+ssoCallbackURL)
+	req.URL.RawQuery = url.Values{
+		"token": []string{transfer},
+		"state": []string{base64.StdEncoding.EncodeToString([]byte("https://evil.com/"))},
+	}.Encode()
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	assert.Equal(t, "/", recorder.Header().Get("Location"))
+}
+
+func TestLogoutRedirectNotPermitted(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.createEndpoints()
+	req := newFakeHTTPRequest("GET", oauthURL+logoutURL)
+	req.URL.RawQuery = url.Values{"redirect": []string{"https://evil.com/"}}.Encode()
+	req.Header.Set(authorizationHeader, "Bearer "+newFakeBearerToken(t).Encode())
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestCanonicalHostHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.CanonicalHostname = "App.Example.com"
+	proxy.createEndpoints()
+
+	cases := []struct {
+		Host     string
+		URI      string
+		Code     int
+		Location string
+	}{
+		{Host: "www.example.com", URI: "/path?a=b", Code: http.StatusMovedPermanently, Location: "http://app.example.com/path?a=b"},
+		{Host: "10.0.0.1:3000", URI: "/", Code: http.StatusMovedPermanently, Location: "http://app.example.com:3000/"},
+		{Host: "app.example.com", URI: oauthURL + healthURL, Code: http.StatusOK},
+		{Host: "app.example.com:3000", URI: oauthURL + healthURL, Code: http.StatusOK},
+		{Host: "10.0.0.1:3000", URI: oauthURL + healthURL, Code: http.StatusOK},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest("GET", "http://"+c.Host+c.URI, nil)
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Location, recorder.Header().Get("Location"), "case %d", i)
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	cases := []struct {
+		Listen    string
+		Canonical string
+		Host      string
+		Location  string
+	}{
+		{Listen: ":443", Host: "app.example.com", Location: "https://app.example.com/path?a=b"},
+		{Listen: ":443", Host: "app.example.com:80", Location: "https://app.example.com/path?a=b"},
+		{Listen: "0.0.0.0:8443", Host: "app.example.com:8080", Location: "https://app.example.com:8443/path?a=b"},
+		{Listen: ":443", Canonical: "app.example.com", Host: "www.example.com", Location: "https://app.example.com/path?a=b"},
+	}
+	for i, c := range cases {
+		proxy.config.Listen = c.Listen
+		proxy.config.CanonicalHostname = c.Canonical
+		req, _ := http.NewRequest("POST", "http://"+c.Host+"/path?a=b", nil)
+		recorder := httptest.NewRecorder()
+		proxy.httpsRedirectHandler(recorder, req)
+		assert.Equal(t, http.StatusMovedPermanently, recorder.Code, "case %d", i)
+		assert.Equal(t, c.Location, recorder.Header().Get("Location"), "case %d", i)
+	}
+}
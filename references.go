@@ -0,0 +1,178 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// referenceStorePrefix is the prefix for the claims held in the store
+	referenceStorePrefix = "claims:"
+	// referenceHeader is the header holding the reference token
+	referenceHeader = "X-Auth-Reference"
+	// referenceTokenDuration is the lifetime of a reference for identities without an expiration
+	referenceTokenDuration = time.Duration(1) * time.Hour
+)
+
+//
+// referenceToken is the signed reference to the claims held in the store
+//
+type referenceToken struct {
+	// Subject is the subject of the identity
+	Subject string `json:"sub"`
+	// Roles is the digest of the roles of the identity
+	Roles string `json:"roles"`
+	// Key is the store key of the claims
+	Key string `json:"key"`
+	// Expires is the expiration of the reference
+	Expires int64 `json:"exp"`
+}
+
+//
+// createReferenceToken places the claims of the user in the store until the reference expires, returning the
+// signed reference
+//
+func (r *oauthProxy) createReferenceToken(user *userContext) (string, error) {
+	content, err := json.Marshal(user.claims)
+	if err != nil {
+		return "", err
+	}
+	expires := user.expiresAt
+	if expires.IsZero() {
+		expires = time.Now().Add(referenceTokenDuration)
+	}
+	// step: the claims are no use once the reference has expired, so they're dropped with it
+	ttl := expires.Sub(time.Now())
+	if ttl <= 0 {
+		return "", ErrAccessTokenExpired
+	}
+	hash := sha256.Sum256(content)
+	key := hex.EncodeToString(hash[:])
+	if err := r.store.SetWithExpiry(referenceStorePrefix+key, string(content), ttl); err != nil {
+		return "", err
+	}
+
+	return encodeReferenceToken(&referenceToken{
+		Subject: user.id,
+		Roles:   digestRoles(user.roles),
+		Key:     key,
+		Expires: expires.Unix(),
+	}, r.config.EncryptionKey)
+}
+
+//
+// userInfoHandler hands back the claims for the reference token, permitting the upstream to retrieve the
+// claims which were not forwarded
+//
+func (r *oauthProxy) userInfoHandler(cx *gin.Context) {
+	reference := cx.Request.Header.Get(referenceHeader)
+	if reference == "" {
+		reference = cx.Query("reference")
+	}
+	token, err := decodeReferenceToken(reference, r.config.EncryptionKey, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("invalid reference token presented to the userinfo endpoint")
+
+		r.errorResponse(cx, http.StatusUnauthorized, reasonInvalidToken)
+		return
+	}
+
+	claims, err := r.store.Get(referenceStorePrefix + token.Key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to retrieve the claims from the store")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+	if claims == "" {
+		cx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	cx.Data(http.StatusOK, "application/json; charset=utf-8", []byte(claims))
+}
+
+//
+// encodeReferenceToken encodes and signs the reference with the key
+//
+func encodeReferenceToken(token *referenceToken, key string) (string, error) {
+	content, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(content)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signData([]byte(payload), key)), nil
+}
+
+//
+// decodeReferenceToken verifies the signature and expiration of the reference
+//
+func decodeReferenceToken(token, key string, now time.Time) (*referenceToken, error) {
+	items := strings.Split(token, ".")
+	if len(items) != 2 {
+		return nil, ErrInvalidReferenceToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(items[1])
+	if err != nil {
+		return nil, ErrInvalidReferenceToken
+	}
+	if !hmac.Equal(signature, signData([]byte(items[0]), key)) {
+		return nil, ErrInvalidReferenceToken
+	}
+	content, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return nil, ErrInvalidReferenceToken
+	}
+
+	reference := new(referenceToken)
+	if err := json.Unmarshal(content, reference); err != nil {
+		return nil, ErrInvalidReferenceToken
+	}
+	if now.After(time.Unix(reference.Expires, 0)) {
+		return nil, ErrReferenceTokenExpired
+	}
+
+	return reference, nil
+}
+
+//
+// digestRoles returns the hex encoded sha256 of the sorted roles, permitting the upstream to compare role sets
+//
+func digestRoles(roles []string) string {
+	sorted := make([]string, len(roles))
+	copy(sorted, roles)
+	sort.Strings(sorted)
+	hash := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferenceTokens(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/",
+			Methods: []string{"ANY"},
+		},
+	})
+	proxy.store = store
+	proxy.config.EnableReferenceTokens = true
+	proxy.config.AddClaims = []string{"email"}
+	forwarded := make(chan http.Header, 1)
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded <- req.Header
+	})
+	proxy.createEndpoints()
+
+	token := newFakeBearerToken(t)
+	req := newFakeHTTPRequest("GET", "/")
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	proxy.router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var headers http.Header
+	select {
+	case headers = <-forwarded:
+	default:
+		t.Fatalf("the request was not forwarded to the upstream")
+	}
+	reference := headers.Get(referenceHeader)
+	assert.NotEmpty(t, reference)
+	assert.Empty(t, headers.Get("Authorization"))
+	assert.Empty(t, headers.Get("X-Auth-Token"))
+	assert.Empty(t, headers.Get("X-Auth-Email"))
+	assert.NotEmpty(t, headers.Get("X-Auth-Subject"))
+
+	// step: exchange the reference for the claims
+	req = newFakeHTTPRequest("GET", oauthURL+userInfoURL)
+	req.Header.Set(referenceHeader, reference)
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	claims := make(map[string]interface{}, 0)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &claims))
+	assert.Equal(t, headers.Get("X-Auth-Subject"), claims["sub"])
+
+	req = newFakeHTTPRequest("GET", oauthURL+userInfoURL)
+	req.Header.Set(referenceHeader, reference+"a")
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestReferenceTokenClaimsExpire(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy := newFakeKeycloakProxy(t)
+	proxy.store = store
+
+	user := &userContext{
+		id:        "test-subject",
+		claims:    jose.Claims{"sub": "test-subject"},
+		expiresAt: time.Now().Add(time.Duration(1) * time.Hour),
+	}
+	encoded, err := proxy.createReferenceToken(user)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reference, err := decodeReferenceToken(encoded, proxy.config.EncryptionKey, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	claims, err := store.Get(referenceStorePrefix + reference.Key)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, claims)
+
+	// step: the claims are removed from the store along with the expiry of the token
+	err = store.(*boltdbStore).client.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(expiryBucketName)).Get([]byte(referenceStorePrefix + reference.Key))
+		expiry, _ := strconv.ParseInt(string(value), 10, 64)
+		assert.WithinDuration(t, user.expiresAt, time.Unix(0, expiry), time.Duration(1)*time.Second)
+		return nil
+	})
+	assert.NoError(t, err)
+	user.expiresAt = time.Now().Add(-time.Duration(1) * time.Minute)
+	_, err = proxy.createReferenceToken(user)
+	assert.Equal(t, ErrAccessTokenExpired, err)
+}
+
+func TestEncodeReferenceToken(t *testing.T) {
+	key := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	now := time.Now()
+	reference := &referenceToken{
+		Subject: "subject",
+		Roles:   digestRoles([]string{"b", "a"}),
+		Key:     "key",
+		Expires: now.Add(time.Duration(1) * time.Minute).Unix(),
+	}
+	encoded, err := encodeReferenceToken(reference, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	decoded, err := decodeReferenceToken(encoded, key, now)
+	assert.NoError(t, err)
+	assert.Equal(t, reference, decoded)
+	assert.Equal(t, digestRoles([]string{"a", "b"}), decoded.Roles)
+
+	_, err = decodeReferenceToken(encoded, "another key", now)
+	assert.Equal(t, ErrInvalidReferenceToken, err)
+	_, err = decodeReferenceToken(encoded, key, now.Add(time.Duration(2)*time.Minute))
+	assert.Equal(t, ErrReferenceTokenExpired, err)
+	_, err = decodeReferenceToken("invalid", key, now)
+	assert.Equal(t, ErrInvalidReferenceToken, err)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+)
+
+const (
+	// refreshedTokenPrefix is the prefix of the access tokens refreshed in the background, keyed on the previous token
+	refreshedTokenPrefix = "refreshed:"
+	// refresherSessionsSize is the number of active sessions tracked for a background refresh
+	refresherSessionsSize = 10000
+)
+
+//
+// activeSession is a session seen recently, whose access token is refreshed ahead of the expiry
+//
+type activeSession struct {
+	// the access token of the session
+	token jose.JWT
+	// the expiration of the access token
+	expires time.Time
+	// the last time the session was used
+	seen time.Time
+}
+
+//
+// sessionRefresher tracks the active sessions, refreshing their access tokens shortly before expiry
+//
+type sessionRefresher struct {
+	sync.Mutex
+	// the sessions keyed on the hash of the access token
+	sessions map[string]*activeSession
+}
+
+//
+// newSessionRefresher creates a session refresher
+//
+func newSessionRefresher() *sessionRefresher {
+	return &sessionRefresher{sessions: make(map[string]*activeSession, 0)}
+}
+
+//
+// touch records the session as active
+//
+func (r *sessionRefresher) touch(user *userContext, now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	key := getHashKey(&user.token)
+	if session, found := r.sessions[key]; found {
+		session.seen = now
+		return
+	}
+	if len(r.sessions) >= refresherSessionsSize {
+		log.Warnf("tracking the maximum %d sessions, the session will be refreshed on expiry", refresherSessionsSize)
+		return
+	}
+	r.sessions[key] = &activeSession{token: user.token, expires: user.expiresAt, seen: now}
+}
+
+//
+// due removes and returns the active sessions expiring within the period, dropping the sessions idle for longer
+// than the idle duration
+//
+func (r *sessionRefresher) due(ahead, idle time.Duration, now time.Time) []*activeSession {
+	r.Lock()
+	defer r.Unlock()
+	var list []*activeSession
+	for key, x := range r.sessions {
+		switch {
+		case now.Sub(x.seen) > idle || now.After(x.expires):
+			delete(r.sessions, key)
+		case x.expires.Sub(now) <= ahead:
+			list = append(list, x)
+			delete(r.sessions, key)
+		}
+	}
+
+	return list
+}
+
+//
+// runBackgroundRefresh refreshes the access tokens of the active sessions ahead of their expiry, until done is closed
+//
+func (r *oauthProxy) runBackgroundRefresh(done <-chan struct{}) {
+	interval := r.config.RefreshAhead / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		for _, x := range r.refresher.due(r.config.RefreshAhead, r.config.IdleDuration, time.Now()) {
+			if err := r.refreshSession(x.token); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Warnf("unable to refresh the session in the background, it will be refreshed on expiry")
+			}
+		}
+	}
+}
+
+//
+// refreshSession refreshes the access token, placing it in the store for the next request of the session to pick up
+//
+func (r *oauthProxy) refreshSession(token jose.JWT) error {
+	encrypted, err := r.GetRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	refresh, err := decodeText(encrypted, r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	refreshed, rotated, expires, err := getRefreshedTokens(r.client, refresh)
+	if err != nil {
+		return err
+	}
+	if encrypted, err = encodeText(rotated, r.config.EncryptionKey); err != nil {
+		return err
+	}
+	// step: the refresh token is placed against the new access token first, so the session is never without one
+	if err := r.StoreRefreshToken(refreshed, encrypted); err != nil {
+		return err
+	}
+	// step: the refreshed token is of no use past its expiry, a session not seen by then is refreshed on its own
+	ttl := expires.Sub(time.Now())
+	if ttl <= 0 {
+		return ErrAccessTokenExpired
+	}
+
+	return r.store.SetWithExpiry(refreshedTokenPrefix+getHashKey(&token), refreshed.Encode(), ttl)
+}
+
+//
+// getRefreshedSession returns the session with the access token refreshed in the background, if any; the previous
+// refresh token is left in place for the concurrent requests still holding the previous access token
+//
+func (r *oauthProxy) getRefreshedSession(user *userContext) (*userContext, bool) {
+	key := refreshedTokenPrefix + getHashKey(&user.token)
+	encoded, err := r.store.Get(key)
+	if err != nil || encoded == "" {
+		return nil, false
+	}
+	token, err := jose.ParseJWT(encoded)
+	if err != nil {
+		return nil, false
+	}
+	refreshed, err := extractIdentity(token, r.roles)
+	if err != nil {
+		return nil, false
+	}
+	if err := r.store.Delete(key); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("unable to remove the refreshed access token from the store")
+	}
+	refreshed.bearerToken = user.bearerToken
+
+	return refreshed, true
+}
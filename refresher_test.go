@@ -0,0 +1,107 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionRefresherDue(t *testing.T) {
+	refresher := newSessionRefresher()
+	now := time.Now()
+	sessions := map[string]*userContext{
+		"expiring": {token: *newFakeJWTToken(t, jose.Claims{"sub": "expiring"}), expiresAt: now.Add(time.Minute)},
+		"valid":    {token: *newFakeJWTToken(t, jose.Claims{"sub": "valid"}), expiresAt: now.Add(time.Hour)},
+		"expired":  {token: *newFakeJWTToken(t, jose.Claims{"sub": "expired"}), expiresAt: now.Add(-time.Minute)},
+	}
+	for _, x := range sessions {
+		refresher.touch(x, now)
+	}
+	idle := &userContext{token: *newFakeJWTToken(t, jose.Claims{"sub": "idle"}), expiresAt: now.Add(time.Minute)}
+	refresher.touch(idle, now.Add(-time.Duration(2)*time.Hour))
+
+	due := refresher.due(time.Duration(5)*time.Minute, time.Hour, now)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, sessions["expiring"].token.Encode(), due[0].token.Encode())
+	}
+	assert.Len(t, refresher.sessions, 1, "only the valid session should still be tracked")
+	assert.Empty(t, refresher.due(time.Duration(5)*time.Minute, time.Hour, now))
+}
+
+func TestRefreshSession(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	proxy, _, _ := newTestProxyService(t, nil)
+	proxy.store = store
+
+	token := newFakeJWTToken(t, jose.Claims{
+		"aud": fakeClientID,
+		"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	encrypted, err := encodeText("refresh", proxy.config.EncryptionKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, proxy.StoreRefreshToken(*token, encrypted))
+	if !assert.NoError(t, proxy.refreshSession(*token)) {
+		return
+	}
+	// step: the refreshed token expires from the store
+	err = store.(*boltdbStore).client.View(func(tx *bolt.Tx) error {
+		assert.NotNil(t, tx.Bucket([]byte(expiryBucketName)).Get([]byte(refreshedTokenPrefix+getHashKey(token))))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	refreshed, found := proxy.getRefreshedSession(&userContext{token: *token})
+	if !assert.True(t, found) {
+		return
+	}
+	assert.NotEqual(t, token.Encode(), refreshed.token.Encode())
+	// step: the refresh token rotated by the provider is stored against the refreshed token
+	content, err := proxy.GetRefreshToken(refreshed.token)
+	assert.NoError(t, err)
+	assert.NotEqual(t, encrypted, content)
+	rotated, err := decodeText(content, proxy.config.EncryptionKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "refresh", rotated)
+
+	// step: the refreshed token is only picked up once
+	_, found = proxy.getRefreshedSession(&userContext{token: *token})
+	assert.False(t, found)
+}
+
+func TestRunBackgroundRefreshStops(t *testing.T) {
+	proxy := &oauthProxy{config: &Config{RefreshAhead: time.Hour}, refresher: newSessionRefresher()}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		proxy.runBackgroundRefresh(done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("the background refresh should have stopped")
+	}
+}
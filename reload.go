@@ -0,0 +1,231 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// listenerFDEnv is the environment variable holding the descriptor of the inherited listener
+	listenerFDEnv = "PROXY_LISTENER_FD"
+	// inheritedListenerFD is the descriptor of the listener passed to the new process, after stdin, stdout and stderr
+	inheritedListenerFD = 3
+	// readyFDEnv is the environment variable holding the descriptor the new process signals its readiness on
+	readyFDEnv = "PROXY_READY_FD"
+	// readyFD is the descriptor of the readiness pipe passed to the new process, after the listener
+	readyFD = 4
+	// reloadReadyTimeout is the time permitted for the new process to start serving
+	reloadReadyTimeout = time.Duration(60) * time.Second
+)
+
+//
+// connectionTracker tracks the state of the connections to the server, permitting them to be drained
+//
+type connectionTracker struct {
+	sync.Mutex
+	// the connections and their current state
+	connections map[net.Conn]http.ConnState
+}
+
+//
+// newConnectionTracker creates a connection tracker
+//
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{connections: make(map[net.Conn]http.ConnState, 0)}
+}
+
+//
+// track records the state of the connection, used as the ConnState hook of the server
+//
+func (r *connectionTracker) track(conn net.Conn, state http.ConnState) {
+	r.Lock()
+	defer r.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(r.connections, conn)
+	default:
+		r.connections[conn] = state
+	}
+}
+
+//
+// closeIdle closes the idle connections, returning the number of connections remaining
+//
+func (r *connectionTracker) closeIdle() int {
+	r.Lock()
+	defer r.Unlock()
+	for conn, state := range r.connections {
+		if state == http.StateIdle {
+			conn.Close()
+			delete(r.connections, conn)
+		}
+	}
+
+	return len(r.connections)
+}
+
+//
+// drain waits for the active connections to complete, closing them as they become idle
+//
+func (r *connectionTracker) drain(timeout time.Duration) error {
+	expires := time.Now().Add(timeout)
+	for {
+		remaining := r.closeIdle()
+		if remaining <= 0 {
+			return nil
+		}
+		if time.Now().After(expires) {
+			return fmt.Errorf("%d connections remain active after %s", remaining, timeout)
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
+
+//
+// inheritedListener returns the listener passed by the previous process, if any
+//
+func inheritedListener() (net.Listener, error) {
+	value := os.Getenv(listenerFDEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenerFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inherited listener descriptor: %s", value)
+	}
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+//
+// signalReady tells the previous process, if any, that we are serving and it can stop accepting
+//
+func signalReady() error {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid readiness descriptor: %s", value)
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	_, err = file.Write([]byte{1})
+
+	return err
+}
+
+//
+// waitForReady waits on the new process to signal its readiness on the pipe; the pipe closing without a signal
+// means the process has exited
+//
+func waitForReady(reader io.Reader, timeout time.Duration) error {
+	signalled := make(chan error, 1)
+	go func() {
+		if _, err := reader.Read(make([]byte, 1)); err != nil {
+			signalled <- fmt.Errorf("the new process exited before it was ready")
+			return
+		}
+		signalled <- nil
+	}()
+
+	select {
+	case err := <-signalled:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("the new process was not ready after %s", timeout)
+	}
+}
+
+//
+// Reload hands the listener to a new process of the binary and, once the process is serving, drains the
+// connections of this one; the caller should exit once it returns without error
+//
+func (r *oauthProxy) Reload() error {
+	listener, ok := r.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("the listener cannot be handed off, only tcp listeners are supported")
+	}
+	file, err := listener.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// step: start the new process with the listener, it accepts alongside us until we close ours
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file, writer}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenerFDEnv, inheritedListenerFD),
+		fmt.Sprintf("%s=%d", readyFDEnv, readyFD))
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		return err
+	}
+
+	// step: keep serving until the new process is, else we would leave no one accepting
+	if err := waitForReady(reader, reloadReadyTimeout); err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	log.WithFields(log.Fields{
+		"pid": cmd.Process.Pid,
+	}).Infof("handed the listener to the new process, draining the connections")
+
+	// step: stop accepting and the background loops, then wait on the requests in flight
+	atomic.StoreInt32(&r.reloading, 1)
+	close(r.done)
+	r.server.SetKeepAlivesEnabled(false)
+	if err := r.listener.Close(); err != nil {
+		return err
+	}
+	if err := r.connections.drain(r.config.ReloadDrainTimeout); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("the connections did not drain in time")
+	}
+
+	return nil
+}
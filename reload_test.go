@@ -0,0 +1,119 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInheritedListener(t *testing.T) {
+	listener, err := inheritedListener()
+	assert.NoError(t, err)
+	assert.Nil(t, listener)
+
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer original.Close()
+	file, err := original.(*net.TCPListener).File()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+
+	os.Setenv(listenerFDEnv, fmt.Sprintf("%d", file.Fd()))
+	listener, err = inheritedListener()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	assert.Equal(t, original.Addr().String(), listener.Addr().String())
+	assert.Empty(t, os.Getenv(listenerFDEnv))
+
+	os.Setenv(listenerFDEnv, "bad")
+	_, err = inheritedListener()
+	assert.Error(t, err)
+}
+
+func TestConnectionTrackerDrain(t *testing.T) {
+	tracker := newConnectionTracker()
+	active, _ := net.Pipe()
+	idle, _ := net.Pipe()
+	tracker.track(active, http.StateNew)
+	tracker.track(active, http.StateActive)
+	tracker.track(idle, http.StateIdle)
+
+	assert.Error(t, tracker.drain(time.Duration(150)*time.Millisecond))
+	assert.Equal(t, 1, len(tracker.connections))
+
+	go func() {
+		time.Sleep(time.Duration(50) * time.Millisecond)
+		tracker.track(active, http.StateIdle)
+	}()
+	assert.NoError(t, tracker.drain(time.Second))
+	assert.Empty(t, tracker.connections)
+}
+
+func TestSignalReady(t *testing.T) {
+	assert.NoError(t, signalReady())
+
+	reader, writer, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	// step: the descriptor is handed over and closed by the signal, as in the new process
+	fd, err := syscall.Dup(int(writer.Fd()))
+	writer.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	os.Setenv(readyFDEnv, fmt.Sprintf("%d", fd))
+	assert.NoError(t, signalReady())
+	assert.Empty(t, os.Getenv(readyFDEnv))
+	assert.NoError(t, waitForReady(reader, time.Second))
+
+	os.Setenv(readyFDEnv, "bad")
+	assert.Error(t, signalReady())
+}
+
+func TestWaitForReady(t *testing.T) {
+	// step: the pipe closing without a signal is an exited process
+	reader, writer, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	writer.Close()
+	assert.Error(t, waitForReady(reader, time.Second))
+	reader.Close()
+
+	reader, writer, err = os.Pipe()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	defer writer.Close()
+	assert.Error(t, waitForReady(reader, time.Duration(50)*time.Millisecond))
+}
@@ -17,8 +17,10 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func newResource() *Resource {
@@ -35,9 +37,9 @@ func (r *Resource) Parse(resource string) (*Resource, error) {
 
 	for _, x := range strings.Split(resource, "|") {
 		// step: split up the keypair
-		kp := strings.Split(x, "=")
+		kp := strings.SplitN(x, "=", 2)
 		if len(kp) != 2 {
-			return nil, fmt.Errorf("invalid resource keypair, should be (uri|roles|method|white-listed)=comma_values")
+			return nil, fmt.Errorf("invalid resource keypair, should be (uri|roles|denied-roles|require-any-role|scopes|methods|white-listed|rate-limit|rate-limit-burst|cors-origins|cors-methods|cors-headers|cors-preflight|allowed-cidrs|denied-cidrs|latency-slo|disable-frame-deny|disable-nosniff|frame-options|content-security-policy|referrer-policy|enable-api-key|enable-basic-auth|break-glass|api-mode|audit-only|negotiate-errors|token-param|max-token-age|disable-remember-me|access-window|minimum-acr|required-amr|require-assertion|policy|authorizer|authorizer-ttl|uma-permissions|strip-prefix|rewrite-path|add-response-header|set-response-header|remove-response-header)=comma_values")
 		}
 		switch kp[0] {
 		case "uri":
@@ -46,12 +48,179 @@ func (r *Resource) Parse(resource string) (*Resource, error) {
 			r.Methods = strings.Split(kp[1], ",")
 		case "roles":
 			r.Roles = strings.Split(kp[1], ",")
+		case "denied-roles":
+			r.DeniedRoles = strings.Split(kp[1], ",")
+		case "require-any-role":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of require-any-role must be true|TRUE|T or it's false equivilant")
+			}
+			r.RequireAnyRole = value
+		case "scopes":
+			r.Scopes = strings.Split(kp[1], ",")
 		case "white-listed":
 			value, err := strconv.ParseBool(kp[1])
 			if err != nil {
 				return nil, fmt.Errorf("the value of whitelisted must be true|TRUE|T or it's false equivilant")
 			}
 			r.WhiteListed = value
+		case "rate-limit":
+			value, err := strconv.ParseFloat(kp[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("the rate limit must be a number of requests per second")
+			}
+			r.getRateLimit().Rate = value
+		case "rate-limit-burst":
+			value, err := strconv.Atoi(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the rate limit burst must be a integer")
+			}
+			r.getRateLimit().Burst = value
+		case "cors-origins":
+			r.getCrossOrigin().Origins = strings.Split(kp[1], ",")
+		case "cors-methods":
+			r.getCrossOrigin().Methods = strings.Split(kp[1], ",")
+		case "cors-headers":
+			r.getCrossOrigin().Headers = strings.Split(kp[1], ",")
+		case "cors-preflight":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of cors-preflight must be true|TRUE|T or it's false equivilant")
+			}
+			r.getCrossOrigin().Preflight = value
+		case "allowed-cidrs":
+			r.AllowedCIDRs = strings.Split(kp[1], ",")
+		case "denied-cidrs":
+			r.DeniedCIDRs = strings.Split(kp[1], ",")
+		case "latency-slo":
+			value, err := time.ParseDuration(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the latency slo must be a duration i.e. 250ms")
+			}
+			r.LatencySLO = value
+		case "disable-frame-deny":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of disable-frame-deny must be true|TRUE|T or it's false equivilant")
+			}
+			r.DisableFrameDeny = value
+		case "disable-nosniff":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of disable-nosniff must be true|TRUE|T or it's false equivilant")
+			}
+			r.DisableNoSniff = value
+		case "frame-options":
+			r.FrameOptions = kp[1]
+		case "content-security-policy":
+			r.ContentSecurityPolicy = kp[1]
+		case "referrer-policy":
+			r.ReferrerPolicy = kp[1]
+		case "enable-api-key":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of enable-api-key must be true|TRUE|T or it's false equivilant")
+			}
+			r.EnableAPIKey = value
+		case "enable-basic-auth":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of enable-basic-auth must be true|TRUE|T or it's false equivilant")
+			}
+			r.EnableBasicAuth = value
+		case "api-mode":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of api-mode must be true|TRUE|T or it's false equivilant")
+			}
+			r.APIMode = value
+		case "token-param":
+			r.TokenParameter = kp[1]
+		case "audit-only":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of audit-only must be true|TRUE|T or it's false equivilant")
+			}
+			r.AuditOnly = value
+		case "negotiate-errors":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of negotiate-errors must be true|TRUE|T or it's false equivilant")
+			}
+			r.NegotiateErrors = value
+		case "break-glass":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of break-glass must be true|TRUE|T or it's false equivilant")
+			}
+			r.BreakGlass = value
+		case "max-token-age":
+			value, err := time.ParseDuration(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the max token age must be a duration i.e. 15m")
+			}
+			r.MaxTokenAge = value
+		case "disable-remember-me":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of disable-remember-me must be true|TRUE|T or it's false equivilant")
+			}
+			r.DisableRememberMe = value
+		case "require-assertion":
+			value, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of require-assertion must be true|TRUE|T or it's false equivilant")
+			}
+			r.RequireAssertion = value
+		case "policy":
+			r.Policy = kp[1]
+		case "authorizer":
+			r.Authorizer = kp[1]
+		case "authorizer-ttl":
+			value, err := time.ParseDuration(kp[1])
+			if err != nil {
+				return nil, err
+			}
+			r.AuthorizerTTL = value
+		case "uma-permissions":
+			r.UMAPermissions = strings.Split(kp[1], ",")
+		case "access-window":
+			window, err := decodeAccessWindow(kp[1])
+			if err != nil {
+				return nil, err
+			}
+			r.AccessWindows = append(r.AccessWindows, window)
+		case "minimum-acr":
+			r.MinimumACR = kp[1]
+		case "required-amr":
+			r.RequiredAMR = strings.Split(kp[1], ",")
+		case "strip-prefix":
+			r.StripPrefix = kp[1]
+		case "rewrite-path":
+			rule, err := decodePathRewrite(kp[1])
+			if err != nil {
+				return nil, err
+			}
+			r.RewritePath = append(r.RewritePath, rule)
+		case "add-response-header", "set-response-header":
+			items := strings.SplitN(kp[1], ":", 2)
+			if len(items) != 2 || items[0] == "" {
+				return nil, fmt.Errorf("the response header must be name:value")
+			}
+			headers := r.getResponseHeaders()
+			if kp[0] == "add-response-header" {
+				if headers.Add == nil {
+					headers.Add = make(map[string]string, 0)
+				}
+				headers.Add[items[0]] = items[1]
+			} else {
+				if headers.Set == nil {
+					headers.Set = make(map[string]string, 0)
+				}
+				headers.Set[items[0]] = items[1]
+			}
+		case "remove-response-header":
+			r.getResponseHeaders().Remove = append(r.getResponseHeaders().Remove, strings.Split(kp[1], ",")...)
 		default:
 			return nil, fmt.Errorf("invalid identifier, should be roles, uri or methods")
 		}
@@ -91,9 +260,94 @@ func (r *Resource) IsValid() error {
 		}
 	}
 
+	// step: check the authorizer is a http url
+	if r.Authorizer != "" {
+		if u, err := url.Parse(r.Authorizer); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("the authorizer must be a http or https url")
+		}
+	}
+	if r.AuthorizerTTL < 0 {
+		return fmt.Errorf("the authorizer ttl must be positive")
+	}
+
+	// step: check the access windows
+	for _, x := range r.AccessWindows {
+		if _, err := newAccessWindow(x); err != nil {
+			return err
+		}
+	}
+
+	// step: check the policy compiles
+	if r.Policy != "" {
+		if _, err := newPolicy(r.Policy); err != nil {
+			return err
+		}
+	}
+
+	// step: check the rate limits are sane
+	if r.RateLimit != nil && (r.RateLimit.Rate < 0 || r.RateLimit.Burst < 0) {
+		return fmt.Errorf("the rate limit and burst must be positive")
+	}
+
+	// step: check the latency objective is sane
+	if r.LatencySLO < 0 {
+		return fmt.Errorf("the latency slo must be positive")
+	}
+	if r.MaxTokenAge < 0 {
+		return fmt.Errorf("the max token age must be positive")
+	}
+
+	// step: check the networks are valid
+	if _, err := parseCIDRs(r.AllowedCIDRs); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs(r.DeniedCIDRs); err != nil {
+		return err
+	}
+
+	// step: check the path rewriting is valid
+	if r.StripPrefix != "" && !strings.HasPrefix(r.StripPrefix, "/") {
+		return fmt.Errorf("the strip prefix must start with a /")
+	}
+	if _, err := newPathRewriter(r); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// getRateLimit returns the rate limit for the resource, creating it if required
+func (r *Resource) getRateLimit() *RateLimit {
+	if r.RateLimit == nil {
+		r.RateLimit = &RateLimit{}
+	}
+
+	return r.RateLimit
+}
+
+// getCrossOrigin returns the cors headers of the resource, creating them if required
+func (r *Resource) getCrossOrigin() *CORS {
+	if r.CrossOrigin == nil {
+		r.CrossOrigin = &CORS{}
+	}
+
+	return r.CrossOrigin
+}
+
+// getResponseHeaders returns the response headers for the resource, creating them if required
+func (r *Resource) getResponseHeaders() *ResponseHeaders {
+	if r.ResponseHeaders == nil {
+		r.ResponseHeaders = &ResponseHeaders{}
+	}
+
+	return r.ResponseHeaders
+}
+
+// hasMethod checks if the method is one of the methods of the resource
+func (r *Resource) hasMethod(method string) bool {
+	return containedIn("ANY", r.Methods) || containedIn(method, r.Methods)
+}
+
 // GetRoles gets a list of roles
 func (r Resource) GetRoles() string {
 	return strings.Join(r.Roles, ",")
@@ -110,11 +364,18 @@ func (r Resource) String() string {
 
 	if len(r.Roles) > 0 {
 		roles = strings.Join(r.Roles, ",")
+		if r.RequireAnyRole {
+			roles = "any of " + roles
+		}
 	}
 
 	if len(r.Methods) > 0 {
 		methods = strings.Join(r.Methods, ",")
 	}
 
+	if len(r.Scopes) > 0 {
+		return fmt.Sprintf("uri: %s, methods: %s, required: %s, scopes: %s", r.URL, methods, roles, strings.Join(r.Scopes, ","))
+	}
+
 	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
 }
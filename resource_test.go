@@ -18,6 +18,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDecodeResource(t *testing.T) {
@@ -65,6 +66,261 @@ func TestDecodeResource(t *testing.T) {
 				WhiteListed: true,
 			},
 		},
+		{
+			Option: "uri=/dashboard|disable-frame-deny=true|disable-nosniff=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:              "/dashboard",
+				DisableFrameDeny: true,
+				DisableNoSniff:   true,
+			},
+		},
+		{
+			Option: "uri=/embed|frame-options=SAMEORIGIN|referrer-policy=no-referrer",
+			Ok:     true,
+			Resource: &Resource{
+				URL:            "/embed",
+				FrameOptions:   "SAMEORIGIN",
+				ReferrerPolicy: "no-referrer",
+			},
+		},
+		{
+			Option: "uri=/api|rate-limit=10|rate-limit-burst=20",
+			Ok:     true,
+			Resource: &Resource{
+				URL:       "/api",
+				RateLimit: &RateLimit{Rate: 10, Burst: 20},
+			},
+		},
+		{
+			Option: "uri=/admin|allowed-cidrs=10.0.0.0/8,192.168.0.0/16|denied-cidrs=10.10.0.0/16",
+			Ok:     true,
+			Resource: &Resource{
+				URL:          "/admin",
+				AllowedCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"},
+				DeniedCIDRs:  []string{"10.10.0.0/16"},
+			},
+		},
+		{
+			Option: "uri=/admin|roles=admin|denied-roles=suspended,contractor",
+			Ok:     true,
+			Resource: &Resource{
+				URL:         "/admin",
+				Roles:       []string{"admin"},
+				DeniedRoles: []string{"suspended", "contractor"},
+			},
+		},
+		{
+			Option: "uri=/reports|roles=admin,auditor|require-any-role=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:            "/reports",
+				Roles:          []string{"admin", "auditor"},
+				RequireAnyRole: true,
+			},
+		},
+		{
+			Option: "uri=/finance|policy=claims.department == 'finance' and request.method != 'DELETE'",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/finance",
+				Policy: "claims.department == 'finance' and request.method != 'DELETE'",
+			},
+		},
+		{
+			Option: "uri=/entitled|authorizer=http://127.0.0.1:8080/authorize?app=billing|authorizer-ttl=30s",
+			Ok:     true,
+			Resource: &Resource{
+				URL:           "/entitled",
+				Authorizer:    "http://127.0.0.1:8080/authorize?app=billing",
+				AuthorizerTTL: time.Duration(30) * time.Second,
+			},
+		},
+		{
+			Option: "uri=/orders|uma-permissions=orders#read,orders#write",
+			Ok:     true,
+			Resource: &Resource{
+				URL:            "/orders",
+				UMAPermissions: []string{"orders#read", "orders#write"},
+			},
+		},
+		{
+			Option: "uri=/payments|minimum-acr=2|required-amr=pwd,otp",
+			Ok:     true,
+			Resource: &Resource{
+				URL:         "/payments",
+				MinimumACR:  "2",
+				RequiredAMR: []string{"pwd", "otp"},
+			},
+		},
+		{
+			Option: "uri=/admin|access-window=mon-fri 09:00-17:00 Europe/London|access-window=sat 10:00-12:00",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/admin",
+				AccessWindows: []AccessWindow{
+					{Days: []string{"mon-fri"}, Hours: "09:00-17:00", Timezone: "Europe/London"},
+					{Days: []string{"sat"}, Hours: "10:00-12:00"},
+				},
+			},
+		},
+		{
+			Option: "uri=/orders|scopes=read:orders,write:orders",
+			Ok:     true,
+			Resource: &Resource{
+				URL:    "/orders",
+				Scopes: []string{"read:orders", "write:orders"},
+			},
+		},
+		{
+			Option: "uri=/payments|max-token-age=15m",
+			Ok:     true,
+			Resource: &Resource{
+				URL:         "/payments",
+				MaxTokenAge: time.Duration(15) * time.Minute,
+			},
+		},
+		{
+			Option: "uri=/payments|max-token-age=bad",
+		},
+		{
+			Option: "uri=/account|disable-remember-me=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:               "/account",
+				DisableRememberMe: true,
+			},
+		},
+		{
+			Option: "uri=/account|disable-remember-me=bad",
+		},
+		{
+			Option: "uri=/git|enable-basic-auth=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:             "/git",
+				EnableBasicAuth: true,
+			},
+		},
+		{
+			Option: "uri=/git|enable-basic-auth=bad",
+		},
+		{
+			Option: "uri=/admin|break-glass=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:        "/admin",
+				BreakGlass: true,
+			},
+		},
+		{
+			Option: "uri=/admin|break-glass=bad",
+		},
+		{
+			Option: "uri=/api|api-mode=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:     "/api",
+				APIMode: true,
+			},
+		},
+		{
+			Option: "uri=/api|api-mode=bad",
+		},
+		{
+			Option: "uri=/reports|roles=reports:read|audit-only=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:       "/reports",
+				Roles:     []string{"reports:read"},
+				AuditOnly: true,
+			},
+		},
+		{
+			Option: "uri=/reports|audit-only=bad",
+		},
+		{
+			Option: "uri=/app|negotiate-errors=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:             "/app",
+				NegotiateErrors: true,
+			},
+		},
+		{
+			Option: "uri=/app|negotiate-errors=bad",
+		},
+		{
+			Option: "uri=/api|cors-origins=https://app.example.com,https://admin.example.com|cors-methods=GET,POST",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/api",
+				CrossOrigin: &CORS{
+					Origins: []string{"https://app.example.com", "https://admin.example.com"},
+					Methods: []string{"GET", "POST"},
+				},
+			},
+		},
+		{
+			Option: "uri=/api|cors-origins=https://app.example.com|cors-preflight=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/api",
+				CrossOrigin: &CORS{
+					Origins:   []string{"https://app.example.com"},
+					Preflight: true,
+				},
+			},
+		},
+		{
+			Option: "uri=/api|cors-preflight=bad",
+		},
+		{
+			Option: "uri=/downloads|token-param=access_token",
+			Ok:     true,
+			Resource: &Resource{
+				URL:            "/downloads",
+				TokenParameter: "access_token",
+			},
+		},
+		{
+			Option: "uri=/transfers|require-assertion=true",
+			Ok:     true,
+			Resource: &Resource{
+				URL:              "/transfers",
+				RequireAssertion: true,
+			},
+		},
+		{
+			Option: "uri=/transfers|require-assertion=maybe",
+		},
+		{
+			Option: "uri=/service-a|strip-prefix=/service-a|rewrite-path=^/v1/(.*)$ /api/$1",
+			Ok:     true,
+			Resource: &Resource{
+				URL:         "/service-a",
+				StripPrefix: "/service-a",
+				RewritePath: []PathRewrite{{Pattern: "^/v1/(.*)$", Replacement: "/api/$1"}},
+			},
+		},
+		{
+			Option: "uri=/service-a|rewrite-path=^/v1/(.*)$",
+		},
+		{
+			Option: "uri=/private|set-response-header=Cache-Control:no-store|add-response-header=Link:<https://cdn>|remove-response-header=Server,X-Powered-By",
+			Ok:     true,
+			Resource: &Resource{
+				URL: "/private",
+				ResponseHeaders: &ResponseHeaders{
+					Add:    map[string]string{"Link": "<https://cdn>"},
+					Set:    map[string]string{"Cache-Control": "no-store"},
+					Remove: []string{"Server", "X-Powered-By"},
+				},
+			},
+		},
+		{
+			Option: "uri=/private|set-response-header=Cache-Control",
+		},
 		{
 			Option: "",
 		},
@@ -107,6 +363,13 @@ func TestIsValid(t *testing.T) {
 				Methods: []string{"NO_SUCH_METHOD"},
 			},
 		},
+		{
+			Resource: &Resource{URL: "/test", AllowedCIDRs: []string{"10.0.0.0/8"}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", DeniedCIDRs: []string{"10.0.0.1"}},
+		},
 	}
 
 	for i, c := range testCases {
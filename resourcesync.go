@@ -0,0 +1,197 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//
+// resourceSync holds the protected resources pulled from the authorization services of the client in keycloak
+//
+type resourceSync struct {
+	sync.RWMutex
+	// the resources, the most specific first
+	resources []*Resource
+}
+
+//
+// get returns the synced resources
+//
+func (r *resourceSync) get() []*Resource {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.resources
+}
+
+//
+// set replaces the synced resources
+//
+func (r *resourceSync) set(resources []*Resource) {
+	r.Lock()
+	defer r.Unlock()
+	r.resources = resources
+}
+
+//
+// keycloakResource is a resource of the authorization services, the older releases have a single uri
+//
+type keycloakResource struct {
+	Name string   `json:"name"`
+	URI  string   `json:"uri"`
+	URIs []string `json:"uris"`
+}
+
+// resourcesByURL sorts the resources on the length of the url, the most specific first
+type resourcesByURL []*Resource
+
+func (r resourcesByURL) Len() int           { return len(r) }
+func (r resourcesByURL) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r resourcesByURL) Less(i, j int) bool { return len(r[i].URL) > len(r[j].URL) }
+
+//
+// runResourceSync pulls the resources from keycloak on the interval, until done is closed
+//
+func (r *oauthProxy) runResourceSync(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(r.config.ResourceSyncInterval):
+		}
+		if err := r.syncResources(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to sync the resources from keycloak, keeping the previous resources")
+		}
+	}
+}
+
+//
+// syncResources retrieves the resources of the client from the admin api, using the service account of the client
+//
+func (r *oauthProxy) syncResources() error {
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return err
+	}
+	token, err := client.ClientCredsToken(nil)
+	if err != nil {
+		return err
+	}
+	hc, err := createHTTPClient(r.config)
+	if err != nil {
+		return err
+	}
+	resources, err := fetchKeycloakResources(hc, getAdminURL(r.config.DiscoveryURL), r.config.ClientID, token.AccessToken)
+	if err != nil {
+		return err
+	}
+	r.synced.set(resources)
+
+	log.WithFields(log.Fields{
+		"resources": len(resources),
+	}).Debugf("synced the resources from keycloak")
+
+	return nil
+}
+
+//
+// fetchKeycloakResources retrieves the resources of the client from the admin api, each uri being a resource
+// which requires the permission of the keycloak resource, a trailing wildcard is a prefix
+//
+func fetchKeycloakResources(client *http.Client, adminURL, clientID, token string) ([]*Resource, error) {
+	var clients []struct {
+		ID string `json:"id"`
+	}
+	if err := getAdminResource(client, adminURL+"/clients?clientId="+url.QueryEscape(clientID), token, &clients); err != nil {
+		return nil, err
+	}
+	if len(clients) != 1 {
+		return nil, fmt.Errorf("the client: %s was not found in the realm", clientID)
+	}
+
+	var items []keycloakResource
+	location := fmt.Sprintf("%s/clients/%s/authz/resource-server/resource?deep=true&max=-1", adminURL, url.QueryEscape(clients[0].ID))
+	if err := getAdminResource(client, location, token, &items); err != nil {
+		return nil, err
+	}
+
+	var resources []*Resource
+	for _, x := range items {
+		uris := x.URIs
+		if x.URI != "" {
+			uris = append(uris, x.URI)
+		}
+		for _, uri := range uris {
+			uri = strings.TrimSuffix(uri, "*")
+			if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, oauthURL) {
+				continue
+			}
+			resources = append(resources, &Resource{
+				URL:            uri,
+				Methods:        []string{"ANY"},
+				Roles:          []string{},
+				UMAPermissions: []string{x.Name},
+			})
+		}
+	}
+	sort.Stable(resourcesByURL(resources))
+
+	return resources, nil
+}
+
+//
+// getAdminResource retrieves and decodes the resource from the admin api
+//
+func getAdminResource(client *http.Client, location, token string, v interface{}) error {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(authorizationHeader, "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the admin api returned status: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//
+// getAdminURL returns the admin api of the realm from the discovery url, i.e.
+// https://keycloak/auth/realms/hod-test -> https://keycloak/auth/admin/realms/hod-test
+//
+func getAdminURL(discoveryURL string) string {
+	discoveryURL = strings.TrimSuffix(discoveryURL, "/.well-known/openid-configuration")
+
+	return strings.Replace(strings.TrimSuffix(discoveryURL, "/"), "/realms/", "/admin/realms/", 1)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAdminURL(t *testing.T) {
+	tests := []struct {
+		Discovery string
+		Expected  string
+	}{
+		{Discovery: "https://keycloak/auth/realms/hod-test", Expected: "https://keycloak/auth/admin/realms/hod-test"},
+		{Discovery: "https://keycloak/auth/realms/hod-test/", Expected: "https://keycloak/auth/admin/realms/hod-test"},
+		{
+			Discovery: "https://keycloak/realms/hod-test/.well-known/openid-configuration",
+			Expected:  "https://keycloak/admin/realms/hod-test",
+		},
+	}
+	for i, c := range tests {
+		assert.Equal(t, c.Expected, getAdminURL(c.Discovery), "case %d", i)
+	}
+}
+
+func TestFetchKeycloakResources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/admin/realms/test/clients":
+			if req.URL.Query().Get("clientId") != fakeClientID {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"id":"6ca2b6d4-6c1d-4d6b-8e43-8a7d0b6c7a12"}]`))
+		case "/admin/realms/test/clients/6ca2b6d4-6c1d-4d6b-8e43-8a7d0b6c7a12/authz/resource-server/resource":
+			w.Write([]byte(`[
+				{"name":"orders","uris":["/orders/*"]},
+				{"name":"order-items","uris":["/orders/items","/items"]},
+				{"name":"legacy","uri":"/legacy"},
+				{"name":"invalid","uris":["orders","/oauth/callback"]}
+			]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resources, err := fetchKeycloakResources(http.DefaultClient, server.URL+"/admin/realms/test", fakeClientID, "token")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var urls []string
+	for _, x := range resources {
+		urls = append(urls, x.URL)
+		assert.Equal(t, []string{"ANY"}, x.Methods)
+		assert.Equal(t, 1, len(x.UMAPermissions))
+	}
+	assert.Equal(t, []string{"/orders/items", "/orders/", "/legacy", "/items"}, urls)
+	assert.Equal(t, []string{"order-items"}, resources[0].UMAPermissions)
+
+	_, err = fetchKeycloakResources(http.DefaultClient, server.URL+"/admin/realms/test", "missing", "token")
+	assert.Error(t, err)
+	_, err = fetchKeycloakResources(http.DefaultClient, server.URL+"/admin/realms/test", fakeClientID, "bad")
+	assert.Error(t, err)
+}
+
+func TestEntryPointSyncedResources(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/orders/public",
+			Methods:     []string{"ANY"},
+			WhiteListed: true,
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.synced = new(resourceSync)
+	proxy.createEndpoints()
+
+	tests := []struct {
+		URI  string
+		Code int
+	}{
+		{URI: "/orders/1", Code: http.StatusNotFound},
+		{URI: "/orders/public", Code: http.StatusNotFound},
+	}
+	for i, c := range tests {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", c.URI))
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+
+	// step: the configured resources take precedence over the synced resources
+	proxy.synced.set([]*Resource{{URL: "/orders/", Methods: []string{"ANY"}, UMAPermissions: []string{"orders"}}})
+	tests[0].Code = http.StatusUnauthorized
+	for i, c := range tests {
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", c.URI))
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+}
+
+func TestMatchResourceSynced(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{{URL: "/orders/public", Methods: []string{"ANY"}}})
+	assert.Nil(t, proxy.matchResource("/orders/1"))
+
+	proxy.synced = new(resourceSync)
+	synced := &Resource{URL: "/orders/", Methods: []string{"GET"}, UMAPermissions: []string{"orders"}}
+	proxy.synced.set([]*Resource{synced})
+	assert.Equal(t, synced, proxy.matchResource("/orders/1"))
+	assert.Equal(t, "/orders/public", proxy.matchResource("/orders/public/1").URL)
+	assert.True(t, synced.hasMethod("GET"))
+	assert.False(t, synced.hasMethod("POST"))
+}
+
+func TestRunResourceSyncStops(t *testing.T) {
+	proxy := &oauthProxy{config: &Config{ResourceSyncInterval: time.Hour}}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		proxy.runResourceSync(done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("the resource sync should have stopped")
+	}
+}
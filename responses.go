@@ -0,0 +1,294 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// problemContentType is the media type for the problem details (RFC 7807)
+	problemContentType = "application/problem+json"
+
+	reasonUnauthenticated     = "unauthenticated"
+	reasonInvalidToken        = "invalid_token"
+	reasonTokenExpired        = "token_expired"
+	reasonInvalidAudience     = "invalid_audience"
+	reasonInsufficientRoles   = "insufficient_roles"
+	reasonInsufficientScope   = "insufficient_scope"
+	reasonRoleDenied          = "role_denied"
+	reasonPolicyDenied        = "policy_denied"
+	reasonClaimMismatch       = "claim_mismatch"
+	reasonAddressDenied       = "address_denied"
+	reasonOutsideWindow       = "outside_access_window"
+	reasonRateLimited         = "rate_limited"
+	reasonQuotaExceeded       = "quota_exceeded"
+	reasonClientBlocked       = "client_blocked"
+	reasonInvalidRequest      = "invalid_request"
+	reasonServerError         = "server_error"
+	reasonUpstreamUnavailable = "upstream_unavailable"
+	reasonSessionSuperseded   = "session_superseded"
+	reasonReauthenticate      = "reauthentication_required"
+	reasonInvalidAssertion    = "invalid_assertion"
+	reasonInvalidCSRFToken    = "invalid_csrf_token"
+	reasonCertificateMismatch = "certificate_mismatch"
+	reasonStepUpRequired      = "insufficient_user_authentication"
+	reasonInvalidCredentials  = "invalid_credentials"
+	reasonInvalidState        = "invalid_state"
+	reasonMaintenance         = "maintenance"
+)
+
+// reasonDetails is the human readable explanation of the reason codes
+var reasonDetails = map[string]string{
+	reasonUnauthenticated:     "the request does not have a valid session or bearer token",
+	reasonInvalidToken:        "the access token failed verification",
+	reasonTokenExpired:        "the access token has expired",
+	reasonInvalidAudience:     "the access token was not issued for this service",
+	reasonInsufficientRoles:   "the access token does not have the roles required by the resource",
+	reasonInsufficientScope:   "the access token was not granted the scopes required by the resource",
+	reasonRoleDenied:          "the access token has a role which is denied access to the resource",
+	reasonPolicyDenied:        "the request was denied by the authorization policy of the resource",
+	reasonClaimMismatch:       "the access token does not have the claims required by the resource",
+	reasonAddressDenied:       "the client address is not permitted to access the resource",
+	reasonOutsideWindow:       "the resource is not accessible at this time",
+	reasonRateLimited:         "the client has exceeded the rate limit, retry after the period indicated",
+	reasonQuotaExceeded:       "the client has exceeded the request quota, retry after the period indicated",
+	reasonClientBlocked:       "the client has been blocked after repeated authentication failures, retry after the period indicated",
+	reasonInvalidRequest:      "the request is invalid or missing required parameters",
+	reasonServerError:         "the service was unable to handle the request",
+	reasonUpstreamUnavailable: "the service is currently unavailable, retry later",
+	reasonSessionSuperseded:   "the session was ended by a newer login for the same user",
+	reasonReauthenticate:      "the resource requires a recent authentication, the access token was issued too long ago",
+	reasonInvalidAssertion:    "the resource requires a valid assertion for the subject alongside the access token",
+	reasonStepUpRequired:      "the resource requires a stronger authentication than the access token was issued for",
+	reasonInvalidCSRFToken:    "the request is missing the csrf token of the session, or it does not match",
+	reasonCertificateMismatch: "the access token is bound to a client certificate which was not presented",
+	reasonInvalidCredentials:  "the username or password was refused by the provider",
+	reasonInvalidState:        "the state parameter of the authorization is invalid or has expired",
+	reasonMaintenance:         "the service is down for planned maintenance, retry later",
+}
+
+// bearerErrors are the error codes (RFC 6750) of the reasons in the bearer challenge
+var bearerErrors = map[string]string{
+	reasonInvalidToken:        "invalid_token",
+	reasonTokenExpired:        "invalid_token",
+	reasonReauthenticate:      "invalid_token",
+	reasonCertificateMismatch: "invalid_token",
+	reasonInvalidAudience:     "invalid_token",
+	reasonInsufficientRoles:   "insufficient_scope",
+	reasonInsufficientScope:   "insufficient_scope",
+	reasonClaimMismatch:       "insufficient_scope",
+	reasonInvalidRequest:      "invalid_request",
+	reasonStepUpRequired:      "insufficient_user_authentication",
+}
+
+//
+// problemDetails is the error response for api clients (RFC 7807)
+//
+type problemDetails struct {
+	// Type is a uri reference identifying the problem type
+	Type string `json:"type"`
+	// Title is a short summary of the problem type
+	Title string `json:"title"`
+	// Status is the http status code
+	Status int `json:"status"`
+	// Detail is the explanation specific to this occurrence
+	Detail string `json:"detail,omitempty"`
+	// Instance is the uri of the request which produced the problem
+	Instance string `json:"instance,omitempty"`
+	// Reason is the code for the reason the request was denied
+	Reason string `json:"reason,omitempty"`
+}
+
+//
+// errorResponse aborts the request, negotiating the format of the response on the accept header; clients
+// not stating a preference receive the status code (or forbidden page) as before
+//
+func (r *oauthProxy) errorResponse(cx *gin.Context, code int, reason string) {
+	r.bearerChallenge(cx, code, reason)
+
+	// step: the api clients always receive the json error
+	if r.isAPIRequest(cx) {
+		problemResponse(cx, code, reason)
+		return
+	}
+	if cx.Request.Header.Get("Accept") == "" {
+		r.defaultErrorResponse(cx, code, reason)
+		return
+	}
+
+	switch cx.NegotiateFormat(problemContentType, gin.MIMEJSON, gin.MIMEHTML, gin.MIMEPlain) {
+	case problemContentType, gin.MIMEJSON:
+		problemResponse(cx, code, reason)
+	case gin.MIMEPlain:
+		cx.String(code, "%d %s: %s\n", code, http.StatusText(code), reasonDetails[reason])
+		cx.Abort()
+	default:
+		r.defaultErrorResponse(cx, code, reason)
+	}
+}
+
+//
+// problemResponse aborts the request with the problem details of the reason
+//
+func problemResponse(cx *gin.Context, code int, reason string) {
+	content, err := json.Marshal(&problemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   reasonDetails[reason],
+		Instance: cx.Request.URL.RequestURI(),
+		Reason:   reason,
+	})
+	if err != nil {
+		cx.AbortWithStatus(code)
+		return
+	}
+	cx.Data(code, problemContentType, content)
+	cx.Abort()
+}
+
+//
+// isAPIMode checks if the clients are never redirected, globally or on the resource being accessed
+//
+func (r *oauthProxy) isAPIMode(cx *gin.Context) bool {
+	if r.config.EnableAPIMode {
+		return true
+	}
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).APIMode
+	}
+
+	return false
+}
+
+//
+// isErrorNegotiation checks if the errors are negotiated, globally or on the resource being accessed
+//
+func (r *oauthProxy) isErrorNegotiation(cx *gin.Context) bool {
+	if r.config.EnableErrorNegotiation {
+		return true
+	}
+	if resource, found := cx.Get(cxEnforce); found {
+		return resource.(*Resource).NegotiateErrors
+	}
+
+	return false
+}
+
+//
+// isAPIRequest checks if the client is handed the json errors, in the api mode or a negotiated api client
+//
+func (r *oauthProxy) isAPIRequest(cx *gin.Context) bool {
+	return r.isAPIMode(cx) || (r.isErrorNegotiation(cx) && isAPIClient(cx))
+}
+
+//
+// isAPIClient checks if the request was made by a script (xhr) or prefers json to html
+//
+func isAPIClient(cx *gin.Context) bool {
+	if cx.Request.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	if cx.Request.Header.Get("Accept") == "" {
+		return false
+	}
+	switch cx.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON, problemContentType) {
+	case gin.MIMEJSON, problemContentType:
+		return true
+	}
+
+	return false
+}
+
+//
+// noRedirects checks if the client is handed the error rather than redirected to authenticate
+//
+func (r *oauthProxy) noRedirects(cx *gin.Context) bool {
+	return r.config.NoRedirects || r.isAPIRequest(cx)
+}
+
+//
+// defaultErrorResponse renders the forbidden, maintenance, unavailable or blocked page if configured, else just the status code
+//
+func (r *oauthProxy) defaultErrorResponse(cx *gin.Context, code int, reason string) {
+	var page string
+	switch {
+	case code == http.StatusForbidden && r.config.hasCustomForbiddenPage():
+		page = r.config.ForbiddenPage
+	case reason == reasonMaintenance && r.config.MaintenancePage != "":
+		page = r.config.MaintenancePage
+	case code == http.StatusServiceUnavailable && r.config.UnavailablePage != "":
+		page = r.config.UnavailablePage
+	case reason == reasonClientBlocked && r.config.BlockedPage != "":
+		page = r.config.BlockedPage
+	}
+	if page != "" {
+		model := make(map[string]string, 0)
+		for k, v := range r.config.TagData {
+			model[k] = v
+		}
+		model["reason"] = reason
+		model["detail"] = reasonDetails[reason]
+
+		cx.HTML(code, path.Base(page), model)
+		cx.Abort()
+		return
+	}
+
+	cx.AbortWithStatus(code)
+}
+
+//
+// bearerChallenge adds the bearer challenge (RFC 6750) to an unauthorized response, or a forbidden response to a
+// bearer token, permitting the oauth client libraries to tell an expired token from insufficient scope
+//
+func (r *oauthProxy) bearerChallenge(cx *gin.Context, code int, reason string) {
+	bearer := strings.HasPrefix(cx.Request.Header.Get(authorizationHeader), "Bearer ") || r.isAPIRequest(cx)
+	if code != http.StatusUnauthorized && (code != http.StatusForbidden || !bearer) {
+		return
+	}
+
+	var attributes []string
+	if realm := getRealmName(r.config.DiscoveryURL); realm != "" {
+		attributes = append(attributes, fmt.Sprintf("realm=%q", realm))
+	}
+	if e, found := bearerErrors[reason]; found {
+		attributes = append(attributes, fmt.Sprintf("error=%q", e), fmt.Sprintf("error_description=%q", reasonDetails[reason]))
+	} else if code == http.StatusForbidden {
+		return
+	}
+	// step: the scopes or authentication required by the resource are indicated to the client
+	if resource, found := cx.Get(cxEnforce); found && reason == reasonInsufficientScope {
+		attributes = append(attributes, fmt.Sprintf("scope=%q", strings.Join(resource.(*Resource).Scopes, " ")))
+	}
+	if resource, found := cx.Get(cxEnforce); found && reason == reasonStepUpRequired && resource.(*Resource).MinimumACR != "" {
+		attributes = append(attributes, fmt.Sprintf("acr_values=%q", resource.(*Resource).MinimumACR))
+	}
+	challenge := "Bearer"
+	if len(attributes) > 0 {
+		challenge += " " + strings.Join(attributes, ", ")
+	}
+
+	cx.Header("WWW-Authenticate", challenge)
+	r.basicAuthChallenge(cx, code)
+}
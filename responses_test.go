@@ -0,0 +1,235 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	tests := []struct {
+		Accept      string
+		Token       bool
+		Code        int
+		ContentType string
+		Body        string
+	}{
+		{Code: http.StatusUnauthorized},
+		{Accept: "*/*", Code: http.StatusUnauthorized},
+		{Accept: "text/html", Code: http.StatusUnauthorized},
+		{
+			Accept:      "text/plain",
+			Code:        http.StatusUnauthorized,
+			ContentType: "text/plain",
+			Body:        "401 Unauthorized: " + reasonDetails[reasonUnauthenticated],
+		},
+		{
+			Accept:      "application/problem+json",
+			Code:        http.StatusUnauthorized,
+			ContentType: problemContentType,
+			Body:        `"reason":"unauthenticated"`,
+		},
+		{
+			Accept:      "application/json, text/plain",
+			Token:       true,
+			Code:        http.StatusForbidden,
+			ContentType: problemContentType,
+			Body:        `"reason":"insufficient_roles"`,
+		},
+	}
+
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", fakeAdminRoleURL)
+		if c.Accept != "" {
+			req.Header.Set("Accept", c.Accept)
+		}
+		if c.Token {
+			req.Header.Set("Authorization", "Bearer "+token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		if c.ContentType == "" {
+			assert.Empty(t, recorder.Body.String(), "case %d", i)
+			continue
+		}
+		assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), c.ContentType), "case %d", i)
+		assert.Contains(t, recorder.Body.String(), c.Body, "case %d", i)
+	}
+}
+
+func TestErrorResponseProblemDetails(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	req := newFakeHTTPRequest("GET", fakeAdminRoleURL)
+	req.Header.Set("Accept", problemContentType)
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+
+	problem := new(problemDetails)
+	if !assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), problem)) {
+		return
+	}
+	assert.Equal(t, &problemDetails{
+		Type:     "about:blank",
+		Title:    "Unauthorized",
+		Status:   http.StatusUnauthorized,
+		Detail:   reasonDetails[reasonUnauthenticated],
+		Instance: fakeAdminRoleURL,
+		Reason:   reasonUnauthenticated,
+	}, problem)
+}
+
+func TestErrorResponseAPIMode(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/api", Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}, APIMode: true},
+		{URL: "/app", Methods: []string{"ANY"}},
+	})
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	tests := []struct {
+		URL       string
+		Token     bool
+		Code      int
+		Reason    string
+		Challenge string
+	}{
+		{URL: "/api/orders", Code: http.StatusUnauthorized, Reason: reasonUnauthenticated, Challenge: "Bearer"},
+		{URL: "/api/orders", Token: true, Code: http.StatusForbidden, Reason: reasonInsufficientRoles, Challenge: `error="insufficient_scope"`},
+		{URL: "/app/orders", Code: http.StatusForbidden},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", c.URL)
+		req.Header.Set("Accept", "text/html")
+		if c.Token {
+			req.Header.Set("Authorization", "Bearer "+token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		if c.Reason == "" {
+			assert.Empty(t, recorder.Body.String(), "case %d", i)
+			continue
+		}
+		assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"), "case %d", i)
+		assert.Contains(t, recorder.Body.String(), `"reason":"`+c.Reason+`"`, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), c.Challenge, "case %d", i)
+	}
+
+	// step: the global api mode applies to every resource
+	proxy.config.EnableAPIMode = true
+	req := newFakeHTTPRequest("GET", "/app/orders")
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"))
+}
+
+func TestBearerChallenge(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.DiscoveryURL = "https://keycloak.example.com/auth/realms/commons"
+
+	tests := []struct {
+		Code      int
+		Reason    string
+		Bearer    bool
+		Challenge string
+	}{
+		{Code: http.StatusUnauthorized, Reason: reasonUnauthenticated, Challenge: `Bearer realm="commons"`},
+		{
+			Code:      http.StatusUnauthorized,
+			Reason:    reasonTokenExpired,
+			Bearer:    true,
+			Challenge: `Bearer realm="commons", error="invalid_token", error_description="the access token has expired"`,
+		},
+		{
+			Code:   http.StatusForbidden,
+			Reason: reasonInsufficientRoles,
+			Bearer: true,
+			Challenge: `Bearer realm="commons", error="insufficient_scope", ` +
+				`error_description="the access token does not have the roles required by the resource"`,
+		},
+		{Code: http.StatusForbidden, Reason: reasonInsufficientRoles},
+		{Code: http.StatusForbidden, Reason: reasonAddressDenied, Bearer: true},
+		{Code: http.StatusTooManyRequests, Reason: reasonRateLimited, Bearer: true},
+	}
+
+	for i, c := range tests {
+		cx := newFakeGinContext("GET", fakeAdminRoleURL)
+		if c.Bearer {
+			cx.Request.Header.Set("Authorization", "Bearer "+newFakeBearerToken(t).Encode())
+		}
+		proxy.errorResponse(cx, c.Code, c.Reason)
+		assert.Equal(t, c.Code, cx.Writer.Status(), "case %d", i)
+		assert.Equal(t, c.Challenge, cx.Writer.Header().Get("WWW-Authenticate"), "case %d", i)
+	}
+}
+
+func TestErrorResponseNegotiation(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{URL: "/app", Methods: []string{"ANY"}, Roles: []string{fakeAdminRole}, NegotiateErrors: true},
+	})
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	tests := []struct {
+		Accept      string
+		XHR         bool
+		Token       bool
+		Code        int
+		ContentType string
+	}{
+		{Accept: "application/json", Code: http.StatusUnauthorized, ContentType: problemContentType},
+		{Accept: "*/*", XHR: true, Code: http.StatusUnauthorized, ContentType: problemContentType},
+		{Accept: "application/json", Token: true, Code: http.StatusForbidden, ContentType: problemContentType},
+		// step: the browsers are sent on to the login, here refused as the verification is switched off
+		{Accept: "text/html,application/xhtml+xml,*/*;q=0.8", Code: http.StatusForbidden},
+		{Code: http.StatusForbidden},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", "/app/orders")
+		if c.Accept != "" {
+			req.Header.Set("Accept", c.Accept)
+		}
+		if c.XHR {
+			req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}
+		if c.Token {
+			req.Header.Set("Authorization", "Bearer "+token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+		assert.Equal(t, c.ContentType, recorder.Header().Get("Content-Type"), "case %d", i)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//
+// pathRewriter rewrites the path of the requests to the upstream for a resource
+//
+type pathRewriter struct {
+	// the prefix removed from the path
+	prefix string
+	// the patterns of the rewrite rules
+	patterns []*regexp.Regexp
+	// the replacements of the rewrite rules
+	replacements []string
+}
+
+//
+// newPathRewriter creates the path rewriter for the resource, nil if the resource does not rewrite the path
+//
+func newPathRewriter(resource *Resource) (*pathRewriter, error) {
+	if resource.StripPrefix == "" && len(resource.RewritePath) <= 0 {
+		return nil, nil
+	}
+
+	rewriter := &pathRewriter{prefix: resource.StripPrefix}
+	for _, x := range resource.RewritePath {
+		pattern, err := regexp.Compile(x.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern '%s', error: %s", x.Pattern, err)
+		}
+		rewriter.patterns = append(rewriter.patterns, pattern)
+		rewriter.replacements = append(rewriter.replacements, x.Replacement)
+	}
+
+	return rewriter, nil
+}
+
+//
+// rewrite strips the prefix from the path and applies the first matching rewrite rule
+//
+func (r *pathRewriter) rewrite(path string) string {
+	if r.prefix != "" && strings.HasPrefix(path, r.prefix) {
+		path = strings.TrimPrefix(path, r.prefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	for i, x := range r.patterns {
+		if x.MatchString(path) {
+			return x.ReplaceAllString(path, r.replacements[i])
+		}
+	}
+
+	return path
+}
+
+//
+// decodePathRewrite decodes the rewrite rule option, the pattern and replacement separated by a space
+//
+func decodePathRewrite(rule string) (PathRewrite, error) {
+	items := strings.Fields(rule)
+	if len(items) != 2 {
+		return PathRewrite{}, fmt.Errorf("invalid rewrite rule '%s' should be 'pattern replacement'", rule)
+	}
+
+	return PathRewrite{Pattern: items[0], Replacement: items[1]}, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRewriterRewrite(t *testing.T) {
+	tests := []struct {
+		Resource *Resource
+		Path     string
+		Expected string
+	}{
+		{
+			Resource: &Resource{StripPrefix: "/service-a"},
+			Path:     "/service-a/api/v1/x",
+			Expected: "/api/v1/x",
+		},
+		{
+			Resource: &Resource{StripPrefix: "/service-a"},
+			Path:     "/service-a",
+			Expected: "/",
+		},
+		{
+			Resource: &Resource{StripPrefix: "/service-a/"},
+			Path:     "/service-a/api",
+			Expected: "/api",
+		},
+		{
+			Resource: &Resource{StripPrefix: "/service-a"},
+			Path:     "/service-b/api",
+			Expected: "/service-b/api",
+		},
+		{
+			Resource: &Resource{RewritePath: []PathRewrite{{Pattern: "^/old/(.*)$", Replacement: "/new/$1"}}},
+			Path:     "/old/api/v1",
+			Expected: "/new/api/v1",
+		},
+		{
+			Resource: &Resource{
+				StripPrefix: "/service-a",
+				RewritePath: []PathRewrite{
+					{Pattern: "^/api/v1/(.*)$", Replacement: "/v1/$1"},
+					{Pattern: "^/api/(.*)$", Replacement: "/latest/$1"},
+				},
+			},
+			Path:     "/service-a/api/v1/x",
+			Expected: "/v1/x",
+		},
+		{
+			Resource: &Resource{RewritePath: []PathRewrite{{Pattern: "^/old/(.*)$", Replacement: "/new/$1"}}},
+			Path:     "/other",
+			Expected: "/other",
+		},
+	}
+	for i, c := range tests {
+		rewriter, err := newPathRewriter(c.Resource)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, rewriter.rewrite(c.Path), "case %d", i)
+	}
+}
+
+func TestNewPathRewriter(t *testing.T) {
+	rewriter, err := newPathRewriter(&Resource{URL: "/"})
+	assert.NoError(t, err)
+	assert.Nil(t, rewriter)
+
+	_, err = newPathRewriter(&Resource{RewritePath: []PathRewrite{{Pattern: "^/(bad", Replacement: "/"}}})
+	assert.Error(t, err)
+}
+
+func TestDecodePathRewrite(t *testing.T) {
+	rule, err := decodePathRewrite("^/old/(.*)$ /new/$1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, PathRewrite{Pattern: "^/old/(.*)$", Replacement: "/new/$1"}, rule)
+	}
+	for _, x := range []string{"", "^/old/(.*)$", "^/old/(.*)$ /new/$1 /other"} {
+		_, err := decodePathRewrite(x)
+		assert.Error(t, err, x)
+	}
+}
+
+func TestUpstreamPathRewriting(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/service-a",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+			StripPrefix: "/service-a",
+		},
+		{
+			URL:         "/legacy",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+			RewritePath: []PathRewrite{{Pattern: "^/legacy/(.*)$", Replacement: "/v2/$1"}},
+		},
+	})
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Upstream-Path", req.URL.Path)
+		w.Header().Set("X-Upstream-Query", req.URL.RawQuery)
+	})
+	proxy.createEndpoints()
+
+	tests := []struct {
+		URI      string
+		Path     string
+		RawQuery string
+	}{
+		{URI: "/service-a/api/v1/x", RawQuery: "page=1", Path: "/api/v1/x"},
+		{URI: "/legacy/users", Path: "/v2/users"},
+		{URI: "/other/path", Path: "/other/path"},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.URL.RawQuery = c.RawQuery
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Path, recorder.Header().Get("X-Upstream-Path"), "case %d", i)
+		assert.Equal(t, c.RawQuery, recorder.Header().Get("X-Upstream-Query"), "case %d", i)
+	}
+}
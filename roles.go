@@ -0,0 +1,100 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//
+// roleRewriter renames the roles extracted from the access token, permitting the resources to use the roles
+// without the naming conventions of the realm
+//
+type roleRewriter struct {
+	// the patterns of the rewrite rules
+	patterns []*regexp.Regexp
+	// the replacements of the rewrite rules
+	replacements []string
+	// whether the roles are lowercased after the rules
+	lowercase bool
+}
+
+//
+// newRoleRewriter creates the role rewriter from the config, nil if the roles are not rewritten
+//
+func newRoleRewriter(config *Config) (*roleRewriter, error) {
+	if len(config.RoleRewrites) <= 0 && !config.LowercaseRoles {
+		return nil, nil
+	}
+
+	rewriter := &roleRewriter{lowercase: config.LowercaseRoles}
+	for _, x := range config.RoleRewrites {
+		pattern, err := regexp.Compile(x.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid role rewrite pattern '%s', error: %s", x.Pattern, err)
+		}
+		rewriter.patterns = append(rewriter.patterns, pattern)
+		rewriter.replacements = append(rewriter.replacements, x.Replacement)
+	}
+
+	return rewriter, nil
+}
+
+//
+// rewrite applies the first matching rule to each of the roles and lowercases them if required; the roles
+// mapped to an empty name are dropped and the duplicates removed
+//
+func (r *roleRewriter) rewrite(roles []string) []string {
+	if r == nil {
+		return roles
+	}
+
+	var list []string
+	for _, role := range roles {
+		for i, x := range r.patterns {
+			if x.MatchString(role) {
+				role = x.ReplaceAllString(role, r.replacements[i])
+				break
+			}
+		}
+		if r.lowercase {
+			role = strings.ToLower(role)
+		}
+		if role != "" && !containedIn(role, list) {
+			list = append(list, role)
+		}
+	}
+
+	return list
+}
+
+//
+// decodeRoleRewrite decodes the role rewrite option, the pattern and replacement separated by a space, the
+// replacement may be omitted to strip the match
+//
+func decodeRoleRewrite(rule string) (RoleRewrite, error) {
+	items := strings.Fields(rule)
+	if len(items) < 1 || len(items) > 2 {
+		return RoleRewrite{}, fmt.Errorf("invalid role rewrite '%s' should be 'pattern [replacement]'", rule)
+	}
+	if len(items) == 1 {
+		items = append(items, "")
+	}
+
+	return RoleRewrite{Pattern: items[0], Replacement: items[1]}, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleRewriterRewrite(t *testing.T) {
+	tests := []struct {
+		Config   *Config
+		Roles    []string
+		Expected []string
+	}{
+		{
+			Config:   &Config{RoleRewrites: []RoleRewrite{{Pattern: "^kc-client:admin$", Replacement: "admin"}}},
+			Roles:    []string{"kc-client:admin", "kc-client:viewer"},
+			Expected: []string{"admin", "kc-client:viewer"},
+		},
+		{
+			Config:   &Config{RoleRewrites: []RoleRewrite{{Pattern: "^kc-client:"}}},
+			Roles:    []string{"kc-client:admin", "kc-client:viewer", "user"},
+			Expected: []string{"admin", "viewer", "user"},
+		},
+		{
+			Config:   &Config{LowercaseRoles: true},
+			Roles:    []string{"Admin", "ADMIN", "Viewer"},
+			Expected: []string{"admin", "viewer"},
+		},
+		{
+			Config: &Config{
+				RoleRewrites: []RoleRewrite{
+					{Pattern: "^realm-(.*)$", Replacement: "$1"},
+					{Pattern: "^realm-.*$", Replacement: "never"},
+				},
+				LowercaseRoles: true,
+			},
+			Roles:    []string{"realm-Admin", "Other"},
+			Expected: []string{"admin", "other"},
+		},
+		{
+			Config:   &Config{RoleRewrites: []RoleRewrite{{Pattern: "^offline_access$"}}},
+			Roles:    []string{"offline_access", "user"},
+			Expected: []string{"user"},
+		},
+	}
+	for i, c := range tests {
+		rewriter, err := newRoleRewriter(c.Config)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, rewriter.rewrite(c.Roles), "case %d", i)
+	}
+}
+
+func TestNewRoleRewriter(t *testing.T) {
+	rewriter, err := newRoleRewriter(&Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, rewriter)
+	assert.Equal(t, []string{"a", "b"}, rewriter.rewrite([]string{"a", "b"}))
+
+	_, err = newRoleRewriter(&Config{RoleRewrites: []RoleRewrite{{Pattern: "^(bad"}}})
+	assert.Error(t, err)
+}
+
+func TestDecodeRoleRewrite(t *testing.T) {
+	tests := []struct {
+		Rule     string
+		Expected RoleRewrite
+		Ok       bool
+	}{
+		{Rule: "^kc-client:admin$ admin", Expected: RoleRewrite{Pattern: "^kc-client:admin$", Replacement: "admin"}, Ok: true},
+		{Rule: "^kc-client:", Expected: RoleRewrite{Pattern: "^kc-client:"}, Ok: true},
+		{Rule: ""},
+		{Rule: "a b c"},
+	}
+	for i, c := range tests {
+		rule, err := decodeRoleRewrite(c.Rule)
+		if !c.Ok {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, rule, "case %d", i)
+	}
+}
+
+func TestExtractIdentityRoleRewrites(t *testing.T) {
+	rewriter, err := newRoleRewriter(&Config{
+		RoleRewrites:   []RoleRewrite{{Pattern: "^openvpn:"}},
+		LowercaseRoles: true,
+	})
+	assert.NoError(t, err)
+	user, err := extractIdentity(getFakeRealmAccessToken(t), rewriter)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dsp-dev-vpn", "vpn-user", "dsp-prod-vpn", "dev-vpn"}, user.roles)
+}
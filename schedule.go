@@ -0,0 +1,171 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the abbreviated names of the days of the week
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+//
+// accessWindow is a compiled access window of a resource
+//
+type accessWindow struct {
+	// the days of the week the window is open
+	days [7]bool
+	// the minute of the day the window opens
+	start int
+	// the minute of the day the window closes, before the start if the window spans midnight
+	end int
+	// the timezone of the window
+	location *time.Location
+}
+
+//
+// newAccessWindow compiles the access window, without days it's every day and without hours it's all day
+//
+func newAccessWindow(window AccessWindow) (*accessWindow, error) {
+	compiled := &accessWindow{end: 24 * 60, location: time.UTC}
+	if window.Timezone != "" {
+		location, err := time.LoadLocation(window.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access window timezone '%s', error: %s", window.Timezone, err)
+		}
+		compiled.location = location
+	}
+
+	if len(window.Days) <= 0 {
+		for i := range compiled.days {
+			compiled.days[i] = true
+		}
+	}
+	for _, x := range window.Days {
+		items := strings.SplitN(strings.ToLower(x), "-", 2)
+		first, found := weekdays[items[0]]
+		if !found {
+			return nil, fmt.Errorf("invalid access window day '%s', should be mon, tue, wed, thu, fri, sat or sun", x)
+		}
+		last := first
+		if len(items) == 2 {
+			if last, found = weekdays[items[1]]; !found {
+				return nil, fmt.Errorf("invalid access window days '%s', should be a range i.e. mon-fri", x)
+			}
+		}
+		// step: the range may wrap around the end of the week, i.e. fri-mon
+		for day := first; ; day = (day + 1) % 7 {
+			compiled.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	if window.Hours != "" {
+		items := strings.Split(window.Hours, "-")
+		if len(items) != 2 {
+			return nil, fmt.Errorf("invalid access window hours '%s', should be hh:mm-hh:mm", window.Hours)
+		}
+		var err error
+		if compiled.start, err = parseClock(items[0]); err != nil {
+			return nil, err
+		}
+		if compiled.end, err = parseClock(items[1]); err != nil {
+			return nil, err
+		}
+		if compiled.start == compiled.end {
+			return nil, fmt.Errorf("invalid access window hours '%s', the window is empty", window.Hours)
+		}
+	}
+
+	return compiled, nil
+}
+
+//
+// isOpen checks if the window is open at the time; a window spanning midnight is open on the day it opens
+// until the close on the following day
+//
+func (r *accessWindow) isOpen(now time.Time) bool {
+	now = now.In(r.location)
+	minute := now.Hour()*60 + now.Minute()
+	if r.start < r.end {
+		return r.days[now.Weekday()] && minute >= r.start && minute < r.end
+	}
+	if minute >= r.start {
+		return r.days[now.Weekday()]
+	}
+
+	return minute < r.end && r.days[(now.Weekday()+6)%7]
+}
+
+//
+// isWithinAccessWindows checks if any of the windows is open, a resource without windows is always open
+//
+func isWithinAccessWindows(windows []*accessWindow, now time.Time) bool {
+	if len(windows) <= 0 {
+		return true
+	}
+	for _, x := range windows {
+		if x.isOpen(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// parseClock parses the time of day, hh:mm, into the minute of the day
+//
+func parseClock(clock string) (int, error) {
+	value, err := time.Parse("15:04", clock)
+	if err != nil {
+		if clock == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid access window time '%s', should be hh:mm", clock)
+	}
+
+	return value.Hour()*60 + value.Minute(), nil
+}
+
+//
+// decodeAccessWindow decodes the access window option, the days, hours and optional timezone separated by spaces,
+// i.e. 'mon-fri 09:00-17:00 Europe/London'
+//
+func decodeAccessWindow(window string) (AccessWindow, error) {
+	items := strings.Fields(window)
+	if len(items) < 2 || len(items) > 3 {
+		return AccessWindow{}, fmt.Errorf("invalid access window '%s' should be 'days hh:mm-hh:mm [timezone]'", window)
+	}
+	decoded := AccessWindow{Days: strings.Split(items[0], ","), Hours: items[1]}
+	if len(items) == 3 {
+		decoded.Timezone = items[2]
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessWindowIsOpen(t *testing.T) {
+	// step: 2017-01-02 is a monday
+	monday := func(clock string) time.Time {
+		value, _ := time.Parse("2006-01-02 15:04", "2017-01-02 "+clock)
+		return value
+	}
+	tests := []struct {
+		Window   AccessWindow
+		Time     time.Time
+		Expected bool
+	}{
+		{Window: AccessWindow{}, Time: monday("03:00"), Expected: true},
+		{Window: AccessWindow{Days: []string{"mon-fri"}, Hours: "09:00-17:00"}, Time: monday("09:00"), Expected: true},
+		{Window: AccessWindow{Days: []string{"mon-fri"}, Hours: "09:00-17:00"}, Time: monday("16:59"), Expected: true},
+		{Window: AccessWindow{Days: []string{"mon-fri"}, Hours: "09:00-17:00"}, Time: monday("17:00")},
+		{Window: AccessWindow{Days: []string{"mon-fri"}, Hours: "09:00-17:00"}, Time: monday("08:59")},
+		{Window: AccessWindow{Days: []string{"sat", "sun"}}, Time: monday("12:00")},
+		{Window: AccessWindow{Days: []string{"fri-mon"}}, Time: monday("12:00"), Expected: true},
+		{Window: AccessWindow{Days: []string{"Tue"}}, Time: monday("12:00")},
+		{Window: AccessWindow{Days: []string{"sun"}, Hours: "22:00-06:00"}, Time: monday("05:00"), Expected: true},
+		{Window: AccessWindow{Days: []string{"mon"}, Hours: "22:00-06:00"}, Time: monday("05:00")},
+		{Window: AccessWindow{Days: []string{"mon"}, Hours: "22:00-06:00"}, Time: monday("23:00"), Expected: true},
+		{Window: AccessWindow{Hours: "00:00-24:00"}, Time: monday("23:59"), Expected: true},
+		{
+			Window:   AccessWindow{Days: []string{"mon"}, Hours: "09:00-17:00", Timezone: "America/New_York"},
+			Time:     monday("15:00"),
+			Expected: true,
+		},
+		{Window: AccessWindow{Days: []string{"mon"}, Hours: "09:00-17:00", Timezone: "America/New_York"}, Time: monday("12:00")},
+	}
+	for i, c := range tests {
+		window, err := newAccessWindow(c.Window)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, c.Expected, window.isOpen(c.Time), "case %d", i)
+	}
+}
+
+func TestNewAccessWindowInvalid(t *testing.T) {
+	for i, x := range []AccessWindow{
+		{Days: []string{"monday"}},
+		{Days: []string{"mon-friday"}},
+		{Hours: "09:00"},
+		{Hours: "9am-5pm"},
+		{Hours: "09:00-09:00"},
+		{Timezone: "Mars/Olympus_Mons"},
+	} {
+		_, err := newAccessWindow(x)
+		assert.Error(t, err, "case %d", i)
+	}
+}
+
+func TestIsWithinAccessWindows(t *testing.T) {
+	now := time.Date(2017, 1, 2, 12, 0, 0, 0, time.UTC)
+	weekend, _ := newAccessWindow(AccessWindow{Days: []string{"sat-sun"}})
+	lunch, _ := newAccessWindow(AccessWindow{Hours: "12:00-13:00"})
+	assert.True(t, isWithinAccessWindows(nil, now))
+	assert.False(t, isWithinAccessWindows([]*accessWindow{weekend}, now))
+	assert.True(t, isWithinAccessWindows([]*accessWindow{weekend, lunch}, now))
+}
+
+func TestDecodeAccessWindow(t *testing.T) {
+	window, err := decodeAccessWindow("mon-fri,sat 09:00-17:00 Europe/London")
+	assert.NoError(t, err)
+	assert.Equal(t, AccessWindow{Days: []string{"mon-fri", "sat"}, Hours: "09:00-17:00", Timezone: "Europe/London"}, window)
+
+	_, err = decodeAccessWindow("mon-fri")
+	assert.Error(t, err)
+}
+
+func TestAdmissionHandlerAccessWindows(t *testing.T) {
+	// step: the window of the closed resource is open the day after tomorrow
+	closed := strings.ToLower(time.Now().UTC().Add(time.Duration(48) * time.Hour).Weekday().String()[:3])
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:           "/closed",
+			Methods:       []string{"ANY"},
+			AccessWindows: []AccessWindow{{Days: []string{closed}}},
+		},
+		{
+			URL:           "/open",
+			Methods:       []string{"ANY"},
+			AccessWindows: []AccessWindow{{Hours: "00:00-24:00"}},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	token := newFakeBearerToken(t)
+	for i, c := range []struct {
+		URI    string
+		Denied bool
+	}{
+		{URI: "/closed", Denied: true},
+		{URI: "/open"},
+	} {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//
+// secretFile is an option of the configuration read from a file
+//
+type secretFile struct {
+	// the name of the option
+	name string
+	// the path of the file
+	path string
+	// the option read into
+	value *string
+}
+
+//
+// getSecretFiles returns the options of the configuration which are read from a file
+//
+func getSecretFiles(config *Config) []secretFile {
+	var list []secretFile
+	for _, x := range []secretFile{
+		{name: "client-secret", path: config.ClientSecretFile, value: &config.ClientSecret},
+		{name: "encryption-key", path: config.EncryptionKeyFile, value: &config.EncryptionKey},
+		{name: "forwarding-password", path: config.ForwardingPasswordFile, value: &config.ForwardingPassword},
+		{name: "vault-token", path: config.VaultTokenFile, value: &config.VaultToken},
+	} {
+		if x.path != "" {
+			list = append(list, x)
+		}
+	}
+
+	return list
+}
+
+//
+// loadSecretFiles reads the options of the configuration held in files, i.e. the mounted docker or kubernetes secrets
+//
+func loadSecretFiles(config *Config) error {
+	for _, x := range getSecretFiles(config) {
+		if *x.value != "" {
+			return fmt.Errorf("you cannot specify both the %s and %s-file options", x.name, x.name)
+		}
+		value, err := readSecretFile(x.path)
+		if err != nil {
+			return fmt.Errorf("unable to read the %s-file, %s", x.name, err)
+		}
+		*x.value = value
+	}
+
+	return nil
+}
+
+//
+// readSecretFile reads a secret from the file, trimming the surrounding whitespace i.e. the trailing newline
+//
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("the file: %s is empty", path)
+	}
+
+	return value, nil
+}
+
+//
+// newSecretWatcher creates a watcher of the secret files of the configuration
+//
+func newSecretWatcher(config *Config) *fileWatcher {
+	var files []string
+	for _, x := range getSecretFiles(config) {
+		files = append(files, x.path)
+	}
+
+	return newFileWatcher(files)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeSecretFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "secret")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	require.NoError(t, err)
+
+	return file.Name()
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	secret := newFakeSecretFile(t, "client-secret\n")
+	defer os.Remove(secret)
+	key := newFakeSecretFile(t, "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j")
+	defer os.Remove(key)
+	empty := newFakeSecretFile(t, " \n")
+	defer os.Remove(empty)
+
+	config := &Config{ClientSecretFile: secret, EncryptionKeyFile: key}
+	assert.NoError(t, loadSecretFiles(config))
+	assert.Equal(t, "client-secret", config.ClientSecret)
+	assert.Equal(t, "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", config.EncryptionKey)
+	assert.Empty(t, config.ForwardingPassword)
+
+	cs := []*Config{
+		{ClientSecret: "secret", ClientSecretFile: secret},
+		{ForwardingPasswordFile: "/does/not/exist"},
+		{EncryptionKeyFile: empty},
+	}
+	for i, c := range cs {
+		assert.Error(t, loadSecretFiles(c), "case %d should have failed", i)
+	}
+}
+
+func TestSecretWatcherChanged(t *testing.T) {
+	secret := newFakeSecretFile(t, "first")
+	defer os.Remove(secret)
+
+	config := &Config{ClientSecretFile: secret}
+	require.NoError(t, loadSecretFiles(config))
+	watcher := newSecretWatcher(config)
+	assert.Empty(t, watcher.changed())
+
+	// step: the empty files are ignored while the secret is updated
+	require.NoError(t, ioutil.WriteFile(secret, []byte(""), 0600))
+	assert.Empty(t, watcher.changed())
+
+	require.NoError(t, ioutil.WriteFile(secret, []byte("second\n"), 0600))
+	assert.Equal(t, []string{secret}, watcher.changed())
+}
+
+func TestSecretReloadConfig(t *testing.T) {
+	secret := newFakeSecretFile(t, "secret")
+	defer os.Remove(secret)
+
+	config := newFakeValidateConfig()
+	config.EnableSecretReload = true
+	config.SecretReloadInterval = 10
+	assert.Error(t, config.isValid(), "the graceful reloads should be required")
+
+	config.EnableGracefulReload = true
+	config.ReloadDrainTimeout = 10
+	assert.Error(t, config.isValid(), "a secret file should be required")
+
+	config.ClientSecretFile = secret
+	assert.NoError(t, config.isValid())
+}
@@ -18,24 +18,22 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/armon/go-proxyproto"
 	"github.com/gambol99/go-oidc/jose"
 	"github.com/gambol99/go-oidc/oidc"
 	"github.com/elazarl/goproxy"
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
 )
 
 type oauthProxy struct {
@@ -43,6 +41,8 @@ type oauthProxy struct {
 	config *Config
 	// the gin service
 	router *gin.Engine
+	// the admission of the envoy external authorization checks, if enabled
+	extAuthz *gin.Engine
 	// the opened client
 	client *oidc.Client
 	// the openid provider configuration
@@ -51,8 +51,58 @@ type oauthProxy struct {
 	upstream reverseProxy
 	// the upstream endpoint url
 	endpoint *url.URL
+	// the tls configuration of the upstream, used by the upgraded connections too
+	upstreamTLS *tls.Config
+	// the unix socket of the upstream endpoint, if any
+	socket string
+	// the upstream endpoints balanced across when multiple are configured
+	upstreams *upstreamPool
+	// the circuit breaker for the upstream, if any
+	breaker *circuitBreaker
+	// the verifiers of the assertions, keyed on the issuer
+	assertions map[string]jose.Verifier
+	// the rewriter of the roles extracted from the tokens, if any
+	roles *roleRewriter
+	// the resources synced from keycloak, if enabled
+	synced *resourceSync
+	// the refresher of the active sessions, if refreshing ahead of the expiry
+	refresher *sessionRefresher
+	// the service account token injected into the upstream requests, if enabled
+	service *serviceToken
+	// the tokens exchanged for the audience of the upstream, if enabled
+	exchanged *tokenCache
+	// the tokens obtained for the basic credentials, if any resource permits them
+	basicTokens *tokenCache
+	// the transport forwarding the negotiate tickets to the provider, if enabled
+	negotiator http.RoundTripper
+	// the clients verifying the tokens issued to the other accepted audiences, keyed on the audience
+	verifiers map[string]*oidc.Client
+	// the signing keys of the provider, verifying the tokens when only the authorized party is checked
+	keys *providerKeys
+	// the secondary authenticator of the break glass resources, if any
+	authenticator authenticator
+	// the reachability of the provider, permitting the secondary authenticator
+	probe *providerProbe
+	// the maintenance switch of the service
+	maintenance *maintenanceSwitch
+	// the vault client renewing the leases of the credentials, if any
+	vault *vaultClient
+	// the authentication failures of the clients, if the brute force protection is enabled
+	failures *failureTracker
+	// the custom templates, if any
+	templates *templateRender
 	// the store interface
 	store storage
+	// the http server
+	server *http.Server
+	// the listener of the server, prior to any tls or proxy protocol
+	listener net.Listener
+	// the connections to the server, tracked when graceful reloads are enabled
+	connections *connectionTracker
+	// whether the listener has been handed to a new process
+	reloading int32
+	// closed to stop the background loops
+	done chan struct{}
 }
 
 type reverseProxy interface {
@@ -78,16 +128,95 @@ func newProxy(config *Config) (*oauthProxy, error) {
 	if config.Verbose {
 		log.SetLevel(log.DebugLevel)
 	}
+	if err := createLogOutput(config.LogOutput); err != nil {
+		return nil, err
+	}
 
 	log.Infof("starting %s, author: %s, version: %s, ", prog, author, version)
+	logFeatures(config.Features)
 
-	service := &oauthProxy{config: config}
+	service := &oauthProxy{config: config, done: make(chan struct{})}
+
+	// step: the development mode stands in for keycloak with an embedded provider
+	if config.DevMode {
+		provider, err := newDevProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		provider.run()
+		config.DiscoveryURL = provider.issuer
+	}
 
 	// step: parse the upstream endpoint
 	service.endpoint, err = url.Parse(config.Upstream)
 	if err != nil {
 		return nil, err
 	}
+	if len(config.UpstreamEndpoints) > 0 {
+		endpoints := []*url.URL{service.endpoint}
+		for _, x := range config.UpstreamEndpoints {
+			endpoint, err := url.Parse(x)
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		service.upstreams = newUpstreamPool(endpoints)
+	}
+
+	// step: load the public keys of the assertion issuers
+	if len(config.AssertionIssuers) > 0 {
+		if service.assertions, err = loadAssertionVerifiers(config.AssertionIssuers); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: the resources synced from keycloak are held apart from the configured resources
+	if config.EnableResourceSync {
+		service.synced = new(resourceSync)
+	}
+
+	// step: the service account token is requested on the first upstream request
+	if config.EnableServiceToken {
+		service.service = new(serviceToken)
+	}
+
+	// step: the tokens exchanged for the upstream are cached until close to expiry
+	if config.TokenExchangeAudience != "" {
+		service.exchanged = newTokenCache()
+	}
+
+	// step: the tokens obtained for the basic credentials are cached until close to expiry
+	service.basicTokens = newTokenCache()
+
+	// step: the negotiate tickets are forwarded to the provider without following the redirects
+	if config.EnableNegotiate {
+		client, err := createHTTPClient(config)
+		if err != nil {
+			return nil, err
+		}
+		service.negotiator = client.Transport
+	}
+
+	// step: the break glass resources are authenticated by the directory while the provider is unreachable
+	if config.LDAPURL != "" {
+		if service.authenticator, err = newLDAPAuthenticator(config); err != nil {
+			return nil, err
+		}
+		if service.probe, err = newProviderProbe(config.DiscoveryURL, config.LDAPTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	// step: the active sessions are tracked for a refresh ahead of the expiry
+	if config.RefreshAhead > 0 {
+		service.refresher = newSessionRefresher()
+	}
+
+	// step: create the rewriter of the roles
+	if service.roles, err = newRoleRewriter(config); err != nil {
+		return nil, err
+	}
 
 	// step: initialize the store if any
 	if config.StoreURL != "" {
@@ -102,6 +231,16 @@ func newProxy(config *Config) (*oauthProxy, error) {
 		if err != nil {
 			return nil, err
 		}
+		if service.verifiers, err = createAudienceVerifiers(config); err != nil {
+			return nil, err
+		}
+		if config.AudienceValidation == audienceValidationAzp {
+			client, err := createHTTPClient(config)
+			if err != nil {
+				return nil, err
+			}
+			service.keys = newProviderKeys(client, service.provider.KeysEndpoint.String())
+		}
 	} else {
 		log.Warnf("TESTING ONLY CONFIG - the verification of the token have been disabled")
 	}
@@ -178,11 +317,17 @@ func createForwardingProxy(config *Config, service *oauthProxy) error {
 		gin.SetMode(gin.DebugMode)
 	}
 	engine := gin.New()
+	engine.ForwardedByClientIP = false
 
 	// step: default to release mode, only go debug on verbose logging
 	engine.Use(gin.Recovery())
 	service.router = engine
 
+	// step: are we taking the client address from the forwarding headers of a trusted proxy?
+	if len(config.TrustedProxies) > 0 {
+		engine.Use(service.clientAddressHandler())
+	}
+
 	// step: are we logging the traffic?
 	if config.LogRequests {
 		engine.Use(service.loggingHandler())
@@ -198,6 +343,12 @@ func createForwardingProxy(config *Config, service *oauthProxy) error {
 //
 func (r *oauthProxy) Run() (err error) {
 	tlsConfig := &tls.Config{}
+	if err := applyTLSOptions(r.config, tlsConfig); err != nil {
+		return err
+	}
+	if len(tlsConfig.CipherSuites) > 0 {
+		tlsConfig.PreferServerCipherSuites = true
+	}
 
 	// step: are we doing mutual tls?
 	if r.config.TLSCaCertificate != "" {
@@ -211,6 +362,9 @@ func (r *oauthProxy) Run() (err error) {
 		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.ClientCAs = caCertPool
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if r.config.TLSClientAuth == "optional" {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 	}
 
 	server := &http.Server{
@@ -218,57 +372,154 @@ func (r *oauthProxy) Run() (err error) {
 		Handler: r.router,
 	}
 
-	// step: create the listener
-	var listener net.Listener
-	switch strings.HasPrefix(r.config.Listen, "unix://") {
-	case true:
-		socket := strings.Trim(r.config.Listen, "unix://")
-		// step: delete the socket if it exists
-		if exists := fileExists(socket); exists {
-			if err := os.Remove(socket); err != nil {
-				return err
-			}
-		}
-
-		log.Infof("listening on unix socket: %s", r.config.Listen)
-		if listener, err = net.Listen("unix", socket); err != nil {
-			return err
-		}
-
+	// step: create the listener, unless one was handed to us by the previous process or systemd
+	listener, err := inheritedListener()
+	if err != nil {
+		return err
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+	if activated[extAuthzSocketName] != nil && r.config.ExtAuthzListen == "" {
+		return fmt.Errorf("systemd passed the %s socket, but the ext-authz-listen is not set", extAuthzSocketName)
+	}
+	if activated[extAuthzHTTPSocketName] != nil && r.config.ExtAuthzHTTPListen == "" {
+		return fmt.Errorf("systemd passed the %s socket, but the ext-authz-http-listen is not set", extAuthzHTTPSocketName)
+	}
+	switch {
+	case listener != nil:
+		log.Infof("using the listener inherited from the previous process on %s", listener.Addr())
+	case activated[proxySocketName] != nil:
+		listener = activated[proxySocketName]
+		log.Infof("using the listener activated by systemd on %s", listener.Addr())
 	default:
-		listener, err = net.Listen("tcp", r.config.Listen)
-		if err != nil {
+		if listener, err = createListener(r.config.Listen); err != nil {
 			return err
 		}
 	}
 
+	r.listener = listener
+	r.server = server
+
+	// step: are we tracking the connections so they can be drained on a reload?
+	if r.config.EnableGracefulReload {
+		r.connections = newConnectionTracker()
+		server.ConnState = r.connections.track
+	}
+
+	// step: wrap the listener in the proxy protocol, the header precedes any tls handshake
+	if r.config.EnableProxyProtocol {
+		log.Infof("enabling the proxy protocol on listener: %s", r.config.Listen)
+		listener = newProxyProtocolListener(listener)
+	}
+
 	// step: configure tls
-	if r.config.TLSCertificate != "" && r.config.TLSPrivateKey != "" {
+	if r.config.EnableAcme || len(r.config.TLSCertificates) > 0 || (r.config.TLSCertificate != "" && r.config.TLSPrivateKey != "") || r.hasVaultCertificate() {
 		server.TLSConfig = tlsConfig
 		if tlsConfig.NextProtos == nil {
 			tlsConfig.NextProtos = []string{"http/1.1"}
 		}
-		if len(tlsConfig.Certificates) == 0 || r.config.TLSCertificate != "" || r.config.TLSPrivateKey != "" {
-			var err error
-			tlsConfig.Certificates = make([]tls.Certificate, 1)
-			if tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(r.config.TLSCertificate, r.config.TLSPrivateKey); err != nil {
+		// step: are we permitting http2 on the listener, required for grpc clients
+		if r.config.EnableHTTP2 {
+			tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			if err := http2.ConfigureServer(server, nil); err != nil {
 				return err
 			}
 		}
-		log.Infof("tls enabled, certificate: %s, key: %s", r.config.TLSCertificate, r.config.TLSPrivateKey)
+		switch r.config.EnableAcme {
+		case true:
+			// step: the certificates are obtained and renewed on demand for the hostnames
+			tlsConfig.GetCertificate = r.createAcmeManager().GetCertificate
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, acmeTLSProtocol)
+			log.Infof("tls enabled, acme certificates for hostnames: %s", strings.Join(r.config.Hostnames, ","))
+		default:
+			// step: load the certificates, selected on the server name (SNI) when we have multiple
+			if tlsConfig.Certificates, tlsConfig.NameToCertificate, err = loadCertificates(r.config); err != nil {
+				return err
+			}
+			// step: the certificate held in vault is the default, the name mapping is rebuilt to include it
+			if r.hasVaultCertificate() {
+				tlsConfig.Certificates = append([]tls.Certificate{*r.vault.certificate}, tlsConfig.Certificates...)
+				tlsConfig.NameToCertificate = nil
+				tlsConfig.BuildNameToCertificate()
+				log.Infof("tls enabled, certificate from vault: %s", r.config.VaultTLS)
+			}
+			if r.config.TLSCertificate != "" {
+				log.Infof("tls enabled, certificate: %s, key: %s", r.config.TLSCertificate, r.config.TLSPrivateKey)
+			}
+			for _, x := range r.config.TLSCertificates {
+				log.Infof("tls enabled, sni certificate: %s, key: %s", x.Certificate, x.PrivateKey)
+			}
+		}
 
 		listener = tls.NewListener(listener, tlsConfig)
 	}
 
-	// step: wrap the listen in a proxy protocol
-	if r.config.EnableProxyProtocol {
-		log.Infof("enabling the proxy protocol on listener: %s", r.config.Listen)
-		listener = &proxyproto.Listener{listener}
+	// step: are we reloading the custom templates on change?
+	if r.templates != nil && r.config.EnableTemplateReload {
+		log.Infof("watching the custom templates for changes every %s", r.config.TemplateReloadInterval)
+		go r.templates.watch(r.done, r.config.TemplateReloadInterval)
+	}
+
+	// step: are we renewing the leases of the credentials held in vault?
+	if r.vault != nil {
+		go r.vault.renew(r.done)
+	}
+
+	// step: are we reloading the service when the secret files change?
+	if r.config.EnableSecretReload {
+		log.Infof("watching the secret files for changes every %s", r.config.SecretReloadInterval)
+		go watchFiles(r.done, newSecretWatcher(r.config), r.config.SecretReloadInterval, nil)
+	}
+
+	// step: are we syncing the resources from keycloak? the first sync must succeed, else the paths would be
+	// served unprotected until it did
+	if r.config.EnableResourceSync {
+		if err := r.syncResources(); err != nil {
+			return fmt.Errorf("unable to sync the resources from keycloak, error: %s", err)
+		}
+		log.Infof("syncing the protected resources from keycloak every %s", r.config.ResourceSyncInterval)
+		go r.runResourceSync(r.done)
+	}
+
+	// step: are we refreshing the sessions ahead of the expiry?
+	if r.refresher != nil {
+		log.Infof("refreshing the access tokens of the active sessions %s ahead of the expiry", r.config.RefreshAhead)
+		go r.runBackgroundRefresh(r.done)
+	}
+
+	// step: are we serving on the additional listeners?
+	for _, x := range r.config.Listeners {
+		if err := r.createAdditionalListener(x); err != nil {
+			return err
+		}
+	}
+
+	// step: are we answering the external authorization checks of envoy?
+	if r.config.ExtAuthzListen != "" {
+		if err := r.createExtAuthzService(activated[extAuthzSocketName]); err != nil {
+			return err
+		}
+	}
+	if r.config.ExtAuthzHTTPListen != "" {
+		if err := r.createExtAuthzHTTPService(activated[extAuthzHTTPSocketName]); err != nil {
+			return err
+		}
+	}
+
+	// step: are we health checking the upstream endpoints?
+	if r.upstreams != nil {
+		log.Infof("health checking the upstream endpoints every %s", r.config.UpstreamHealthInterval)
+		go r.runUpstreamHealthChecks(r.done)
 	}
 
 	go func() {
 		log.Infof("keycloak proxy service starting on %s", r.config.Listen)
 		if err = server.Serve(listener); err != nil {
+			if atomic.LoadInt32(&r.reloading) > 0 {
+				return
+			}
 			log.WithFields(log.Fields{
 				"error": err.Error(),
 			}).Fatalf("failed to start the service")
@@ -295,20 +546,62 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 		dialer = func(network, address string) (net.Conn, error) {
 			return net.Dial("unix", socketPath)
 		}
+		r.socket = socketPath
 		upstream.Path = ""
 		upstream.Host = "domain-sock"
 		upstream.Scheme = "http"
 	}
 
+	// step: update the tls configuration of the reverse proxy
+	tlsConfig, err := createUpstreamTLSConfig(r.config)
+	if err != nil {
+		return err
+	}
+	if r.config.UpstreamCA != "" && r.config.SkipUpstreamTLSVerify {
+		log.Warnf("the upstream ca has been set but skip-upstream-tls-verify is on, the certificate is not verified")
+	}
+	r.upstreamTLS = tlsConfig
+
+	// step: are we retrying the upstream requests or breaking the circuit on failure?
+	var wrapper *upstreamTransport
+	if upstream != nil && (r.config.UpstreamRetries > 0 || r.config.UpstreamCircuitThreshold > 0) {
+		wrapper = &upstreamTransport{retries: r.config.UpstreamRetries}
+		if r.config.UpstreamCircuitThreshold > 0 {
+			r.breaker = newCircuitBreaker(r.config.UpstreamCircuitThreshold, r.config.UpstreamCircuitTimeout)
+			wrapper.breaker = r.breaker
+		}
+	}
+
+	// step: are we using http2 to the upstream, cleartext (h2c) unless https
+	if r.config.EnableHTTP2 {
+		log.Infof("using http2 for the upstream, preserving trailers for grpc")
+		proxy := newHTTP2Proxy(upstream, dialer, tlsConfig)
+		if wrapper != nil {
+			wrapper.transport = proxy.transport
+			proxy.transport = wrapper
+		}
+		r.upstream = proxy
+		return nil
+	}
+
 	// step: create the forwarding proxy
 	proxy := goproxy.NewProxyHttpServer()
-	// step: update the tls configuration of the reverse proxy
 	proxy.Tr = &http.Transport{
-		Dial: dialer,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: r.config.SkipUpstreamTLSVerify,
-		},
-		DisableKeepAlives: !r.config.UpstreamKeepalives,
+		Dial:                  dialer,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
+		MaxIdleConnsPerHost:   r.config.UpstreamMaxIdleConnections,
+		DisableKeepAlives:     !r.config.UpstreamKeepalives,
+	}
+	if wrapper != nil {
+		wrapper.transport = proxy.Tr
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				return wrapper.RoundTrip(req)
+			})
+			return req, nil
+		})
 	}
 	r.upstream = proxy
 
@@ -324,40 +617,128 @@ func (r *oauthProxy) createEndpoints() error {
 		gin.SetMode(gin.DebugMode)
 	}
 	engine := gin.New()
+	engine.ForwardedByClientIP = false
 	engine.Use(gin.Recovery())
 
+	// step: are we taking the client address from the forwarding headers of a trusted proxy?
+	if len(r.config.TrustedProxies) > 0 {
+		engine.Use(r.clientAddressHandler())
+	}
+
 	// step: are we logging the traffic?
 	if r.config.LogRequests {
 		engine.Use(r.loggingHandler())
 	}
 
+	// step: match the resource of the request, consulted by the handlers which follow
+	engine.Use(r.entryPointHandler())
+
 	// step: enabling the security filter?
 	if r.config.EnableSecurityFilter {
 		engine.Use(r.securityHandler())
 	}
+
+	// step: are we redirecting the other hosts to the canonical hostname?
+	if r.config.CanonicalHostname != "" {
+		engine.Use(r.canonicalHostHandler())
+	}
+
+	// step: are we blocking the clients with repeated authentication failures?
+	if r.config.BruteForce.isEnabled() {
+		r.failures = newFailureTracker(r.config.BruteForce)
+		engine.Use(r.bruteForceHandler())
+	}
+	// step: the service starts in maintenance if configured; the switch is held by the process, so a toggle is kept
+	// when the endpoints are recreated but lost on a reload or restart
+	if r.maintenance == nil {
+		r.maintenance = newMaintenanceSwitch(r.config.MaintenanceMode)
+	}
 	// step: add the routing
 	oauth := engine.Group(oauthURL).Use(
 		r.crossOriginResourceHandler(r.config.CrossOrigin),
 	)
 	{
-		oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
-		oauth.GET(callbackURL, r.oauthCallbackHandler)
+		if r.config.CrossOrigin.Preflight {
+			oauth.OPTIONS("/*path", func(cx *gin.Context) {})
+		}
+		// step: the sidecar is reached by its peers with bearer tokens, there is no login flow
+		if !r.config.Sidecar {
+			oauth.GET(authorizationURL, r.oauthAuthorizationHandler)
+			oauth.GET(callbackURL, r.oauthCallbackHandler)
+			oauth.GET(logoutURL, r.logoutHandler)
+			oauth.POST(loginURL, r.loginHandler)
+		}
 		oauth.GET(healthURL, r.healthHandler)
 		oauth.GET(tokenURL, r.tokenHandler)
 		oauth.GET(expiredURL, r.expirationHandler)
-		oauth.GET(logoutURL, r.logoutHandler)
-		oauth.POST(loginURL, r.loginHandler)
+		if r.config.EnableMetrics {
+			oauth.GET(metricsURL, r.metricsHandler)
+		}
+		if len(r.config.SSODomains) > 0 {
+			oauth.GET(ssoURL, r.ssoHandler)
+		}
+		if r.config.SSOBrokerURL != "" {
+			oauth.GET(ssoCallbackURL, r.ssoCallbackHandler)
+		}
+		if r.config.EnableReferenceTokens {
+			oauth.GET(userInfoURL, r.userInfoHandler)
+		}
+		if r.config.EnablePreserveRequests {
+			oauth.GET(replayURL, r.replayHandler)
+		}
+		if r.config.EnableSilentAuthentication {
+			oauth.GET(silentURL, r.silentHandler)
+		}
+		if r.config.EnableSignedURLs {
+			oauth.POST(signURL, r.signURLHandler)
+		}
+		if len(r.config.MaintenanceRoles) > 0 {
+			oauth.GET(maintenanceURL, r.maintenanceStatusHandler)
+			oauth.POST(maintenanceURL, r.maintenanceToggleHandler)
+		}
+		if len(r.config.AdminRoles) > 0 {
+			oauth.GET(configURL, r.configHandler)
+		}
+		if r.config.EnableDeviceFlow {
+			oauth.GET(deviceURL, r.deviceHandler)
+			oauth.POST(deviceURL, r.deviceAuthorizationHandler)
+			oauth.POST(deviceTokenURL, r.deviceTokenHandler)
+		}
 	}
 
-	engine.Use(
-		r.entryPointHandler(),
+	// step: the admission of the requests, shared with the envoy external authorization checks
+	admission := []gin.HandlerFunc{
+		r.resourceCrossOriginHandler(),
+		r.clientRateLimitHandler(),
 		r.authenticationHandler(),
+		r.maintenanceHandler(),
+		r.bruteForceSubjectHandler(),
+		r.csrfHandler(),
+		r.rateLimitHandler(),
+		r.quotaHandler(),
 		r.admissionHandler(),
 		r.upstreamHeadersHandler(r.config.AddClaims),
-		r.upstreamReverseProxyHandler())
+	}
+	proxy, err := r.upstreamReverseProxyHandler()
+	if err != nil {
+		return err
+	}
+	engine.Use(append(admission, r.latencyObjectiveHandler(), proxy)...)
 
 	r.router = engine
 
+	// step: are we answering the external authorization checks of envoy?
+	if r.config.ExtAuthzListen != "" || r.config.ExtAuthzHTTPListen != "" {
+		authz := gin.New()
+		authz.ForwardedByClientIP = false
+		authz.Use(gin.Recovery())
+		if len(r.config.TrustedProxies) > 0 {
+			authz.Use(r.clientAddressHandler())
+		}
+		authz.Use(append([]gin.HandlerFunc{r.extAuthzHandler(), r.entryPointHandler()}, admission...)...)
+		r.extAuthz = authz
+	}
+
 	return nil
 }
 
@@ -377,9 +758,34 @@ func (r *oauthProxy) createTemplates() error {
 		list = append(list, r.config.ForbiddenPage)
 	}
 
+	if r.config.UnavailablePage != "" {
+		log.Debugf("loading the custom unavailable page: %s", r.config.UnavailablePage)
+		list = append(list, r.config.UnavailablePage)
+	}
+
+	if r.config.SessionEndedPage != "" {
+		log.Debugf("loading the custom session ended page: %s", r.config.SessionEndedPage)
+		list = append(list, r.config.SessionEndedPage)
+	}
+
+	if r.config.BlockedPage != "" {
+		log.Debugf("loading the custom blocked page: %s", r.config.BlockedPage)
+		list = append(list, r.config.BlockedPage)
+	}
+
+	if r.config.MaintenancePage != "" {
+		log.Debugf("loading the custom maintenance page: %s", r.config.MaintenancePage)
+		list = append(list, r.config.MaintenancePage)
+	}
+
 	if len(list) > 0 {
 		log.Infof("loading the custom templates: %s", strings.Join(list, ","))
-		r.router.LoadHTMLFiles(list...)
+		templates, err := newTemplateRender(list)
+		if err != nil {
+			return err
+		}
+		r.router.HTMLRender = templates
+		r.templates = templates
 	}
 
 	return nil
@@ -444,14 +850,8 @@ func (r *oauthProxy) CloseStore() error {
 //
 // accessForbidden redirects the user to the forbidden page
 //
-func (r *oauthProxy) accessForbidden(cx *gin.Context) {
-	if r.config.hasCustomForbiddenPage() {
-		cx.HTML(http.StatusForbidden, path.Base(r.config.ForbiddenPage), r.config.TagData)
-		cx.Abort()
-		return
-	}
-
-	cx.AbortWithStatus(http.StatusForbidden)
+func (r *oauthProxy) accessForbidden(cx *gin.Context, reason string) {
+	r.errorResponse(cx, http.StatusForbidden, reason)
 }
 
 //
@@ -466,21 +866,101 @@ func (r *oauthProxy) redirectToURL(url string, cx *gin.Context) {
 // redirectToAuthorization redirects the user to authorization handler
 //
 func (r *oauthProxy) redirectToAuthorization(cx *gin.Context) {
-	if r.config.NoRedirects {
-		cx.AbortWithStatus(http.StatusUnauthorized)
-		return
+	// step: the redirect carries unique state, crawlers are handed a 401 which a cdn can cache instead
+	if len(r.config.CrawlerUserAgents) > 0 {
+		cx.Header("Vary", "Accept, User-Agent, Cookie, Authorization")
+		if r.isCrawler(cx.Request.UserAgent()) {
+			cx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(r.config.CrawlerCacheDuration.Seconds())))
+			cx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		cx.Header("Cache-Control", "private, no-store")
 	}
 
-	// step: add a state referrer to the authorization page
-	authQuery := fmt.Sprintf("?state=%s", base64.StdEncoding.EncodeToString([]byte(cx.Request.URL.RequestURI())))
+	if r.noRedirects(cx) {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonUnauthenticated)
+		return
+	}
 
 	// step: if verification is switched off, we can't authorization
 	if r.config.SkipTokenVerification {
 		log.Errorf("refusing to redirection to authorization endpoint, skip token verification switched on")
 
-		cx.AbortWithStatus(http.StatusForbidden)
+		r.errorResponse(cx, http.StatusForbidden, reasonUnauthenticated)
 		return
 	}
 
+	// step: add a state referrer to the authorization page, the replay of the form if it was preserved
+	location := r.preserveRequest(cx)
+	authQuery := fmt.Sprintf("?state=%s", r.encodeState(location))
+
+	// step: if we have a sso broker, the session is obtained from the primary domain
+	if r.config.SSOBrokerURL != "" {
+		r.redirectToBroker(cx, location)
+		return
+	}
+
+	// step: an expired session is first authenticated silently, the provider may still hold a session
+	if r.config.EnableSilentAuthentication && hasSessionCookie(cx, r.config.CookieAccessName) {
+		authQuery += "&prompt=none"
+	}
+
 	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
 }
+
+//
+// redirectToReauthentication redirects the user to authenticate again, prompting the provider to do so rather than
+// reuse the single sign on session; bearer tokens are challenged instead
+//
+func (r *oauthProxy) redirectToReauthentication(cx *gin.Context, user *userContext) {
+	if r.noRedirects(cx) || r.config.SkipTokenVerification || user.isBearer() {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonReauthenticate)
+		return
+	}
+	authQuery := fmt.Sprintf("?state=%s&prompt=login", r.encodeState(cx.Request.URL.RequestURI()))
+
+	r.redirectToURL(oauthURL+authorizationURL+authQuery, cx)
+}
+
+//
+// isCrawler checks if the user agent matches one of the crawler user agents
+//
+func (r *oauthProxy) isCrawler(agent string) bool {
+	agent = strings.ToLower(agent)
+	for _, x := range r.config.CrawlerUserAgents {
+		if x != "" && strings.Contains(agent, strings.ToLower(x)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// matchResource returns the first resource matching the path, regardless of the method, else nil; the resources
+// synced from keycloak are consulted after the configured resources
+//
+func (r *oauthProxy) matchResource(path string) *Resource {
+	resources := r.config.Resources
+	if r.synced != nil {
+		resources = append(resources[:len(resources):len(resources)], r.synced.get()...)
+	}
+	for _, resource := range resources {
+		if strings.HasPrefix(path, resource.URL) {
+			return resource
+		}
+	}
+
+	return nil
+}
+
+//
+// getResource returns the resource matched by the entrypoint for the request, else nil
+//
+func getResource(cx *gin.Context) *Resource {
+	if resource, found := cx.Get(cxResource); found {
+		return resource.(*Resource)
+	}
+
+	return nil
+}
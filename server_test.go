@@ -23,9 +23,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/elazarl/goproxy"
 	"github.com/gambol99/go-oidc/jose"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -67,6 +71,7 @@ func newFakeKeycloakConfig() *Config {
 		SecureCookie:          false,
 		CookieAccessName:      "kc-access",
 		CookieRefreshName:     "kc-state",
+		IdentityHeaderPrefix:  "X-Auth-",
 		Resources: []*Resource{
 			{
 				URL:     fakeAdminRoleURL,
@@ -190,6 +195,38 @@ func TestRedirectToAuthorizationUnauthorized(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, context.Writer.Status())
 }
 
+func TestRedirectToAuthorizationCrawler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SkipTokenVerification = false
+	proxy.config.CrawlerUserAgents = []string{"Googlebot"}
+	proxy.config.CrawlerCacheDuration = time.Duration(5) * time.Minute
+
+	tests := []struct {
+		Agent        string
+		Expected     int
+		CacheControl string
+	}{
+		{
+			Agent:        "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Expected:     http.StatusUnauthorized,
+			CacheControl: "public, max-age=300",
+		},
+		{
+			Agent:        "Mozilla/5.0 (X11; Linux x86_64) Firefox/50.0",
+			Expected:     http.StatusTemporaryRedirect,
+			CacheControl: "private, no-store",
+		},
+	}
+	for i, c := range tests {
+		context := newFakeGinContext("GET", "/admin")
+		context.Request.Header.Set("User-Agent", c.Agent)
+		proxy.redirectToAuthorization(context)
+		assert.Equal(t, c.Expected, context.Writer.Status(), "case %d", i)
+		assert.Equal(t, c.CacheControl, context.Writer.Header().Get("Cache-Control"), "case %d", i)
+		assert.Equal(t, "Accept, User-Agent, Cookie, Authorization", context.Writer.Header().Get("Vary"), "case %d", i)
+	}
+}
+
 func TestCreateReverseProxy(t *testing.T) {
 	proxy, _, _ := newTestProxyService(t, nil)
 	err := createReverseProxy(proxy.config, proxy)
@@ -197,6 +234,59 @@ func TestCreateReverseProxy(t *testing.T) {
 	assert.NotNil(t, proxy.router)
 }
 
+func TestCreateUpstreamProxyTransport(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.UpstreamResponseHeaderTimeout = time.Duration(5) * time.Second
+	proxy.config.UpstreamTLSHandshakeTimeout = time.Duration(3) * time.Second
+	proxy.config.UpstreamMaxIdleConnections = 50
+	proxy.config.UpstreamKeepalives = true
+	if !assert.NoError(t, proxy.createUpstreamProxy(proxy.endpoint)) {
+		return
+	}
+
+	transport := proxy.upstream.(*goproxy.ProxyHttpServer).Tr
+	assert.Equal(t, time.Duration(5)*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, time.Duration(3)*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 50, transport.MaxIdleConnsPerHost)
+	assert.False(t, transport.DisableKeepAlives)
+}
+
+func TestCreateUpstreamProxyUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "upstream.sock")
+	listener, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("unix upstream"))
+	}))
+
+	proxy := newFakeKeycloakProxy(t)
+	proxy.endpoint, _ = url.Parse("unix://" + socket)
+	if !assert.NoError(t, proxy.createUpstreamProxy(proxy.endpoint)) {
+		return
+	}
+	assert.Equal(t, socket, proxy.socket)
+	proxy.createEndpoints()
+
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, newFakeHTTPRequest("GET", fakeTestWhitelistedURL))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "unix upstream", recorder.Body.String())
+
+	conn, err := tryDialEndpoint(&url.URL{Scheme: "unix", Path: socket}, nil)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
 func TestCreateForwardProxy(t *testing.T) {
 	proxy, _, _ := newTestProxyService(t, nil)
 	err := createForwardingProxy(proxy.config, proxy)
@@ -222,16 +312,59 @@ func TestAccessForbidden(t *testing.T) {
 	proxy := newFakeKeycloakProxy(t)
 
 	proxy.config.SkipTokenVerification = false
-	if proxy.accessForbidden(context); context.Writer.Status() != http.StatusForbidden {
+	if proxy.accessForbidden(context, reasonInsufficientRoles); context.Writer.Status() != http.StatusForbidden {
 		t.Errorf("we should have recieved a forbidden access")
 	}
 
 	proxy.config.SkipTokenVerification = true
-	if proxy.accessForbidden(context); context.Writer.Status() != http.StatusForbidden {
+	if proxy.accessForbidden(context, reasonInsufficientRoles); context.Writer.Status() != http.StatusForbidden {
 		t.Errorf("we should have recieved a forbidden access")
 	}
 }
 
+func TestSidecarEndpoints(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.Sidecar = true
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	token := newFakeJWTToken(t, jose.Claims{
+		"aud":                "test",
+		"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"preferred_username": "peer",
+		"exp":                time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		"realm_access": map[string]interface{}{
+			"roles": []string{},
+		},
+	}).Encode()
+	cases := []struct {
+		URI    string
+		Bearer bool
+		Cookie bool
+		Code   int
+	}{
+		{URI: oauthURL + authorizationURL, Code: http.StatusNotFound},
+		{URI: oauthURL + callbackURL, Code: http.StatusNotFound},
+		{URI: oauthURL + healthURL, Code: http.StatusOK},
+		{URI: fakeAuthAllURL + "/test", Code: http.StatusUnauthorized},
+		{URI: fakeAuthAllURL + "/test", Cookie: true, Code: http.StatusUnauthorized},
+		// step: the fake upstream does not write a response, hence the 404 once permitted
+		{URI: fakeAuthAllURL + "/test", Bearer: true, Code: http.StatusNotFound},
+	}
+	for i, c := range cases {
+		req := newFakeHTTPRequest("GET", c.URI)
+		if c.Bearer {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if c.Cookie {
+			req.AddCookie(&http.Cookie{Name: proxy.config.CookieAccessName, Value: token})
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+}
+
 func newFakeResponse() *fakeResponse {
 	return &fakeResponse{
 		status:  http.StatusOK,
@@ -257,6 +390,21 @@ func newFakeGinContext(method, uri string) *gin.Context {
 	}
 }
 
+func newFakeHTTPRequest(method, uri string) *http.Request {
+	return &http.Request{
+		Method:     method,
+		Host:       "127.0.0.1",
+		RequestURI: uri,
+		URL: &url.URL{
+			Scheme: "http",
+			Host:   "127.0.0.1",
+			Path:   uri,
+		},
+		Header:     make(http.Header, 0),
+		RemoteAddr: "127.0.0.1:8989",
+	}
+}
+
 func newFakeGinContextWithCookies(method, url string, cookies []*http.Cookie) *gin.Context {
 	cx := newFakeGinContext(method, url)
 	for _, x := range cookies {
@@ -266,6 +414,15 @@ func newFakeGinContextWithCookies(method, url string, cookies []*http.Cookie) *g
 	return cx
 }
 
+func newFakeBearerToken(t *testing.T) *jose.JWT {
+	return newFakeJWTToken(t, jose.Claims{
+		"aud":                "test",
+		"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"preferred_username": "test",
+		"exp":                time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+	})
+}
+
 func newFakeJWTToken(t *testing.T, claims jose.Claims) *jose.JWT {
 	token, err := jose.NewJWT(
 		jose.JOSEHeader{"alg": "RS256"}, claims,
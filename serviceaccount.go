@@ -0,0 +1,85 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+)
+
+const (
+	// serviceTokenMargin is the time before expiry the service account token is renewed
+	serviceTokenMargin = time.Duration(30) * time.Second
+	// serviceTokenDuration is the lifetime assumed for a service account token without an expiration
+	serviceTokenDuration = time.Duration(1) * time.Minute
+)
+
+//
+// serviceToken is the access token of the service account of the client, injected into the upstream requests
+//
+type serviceToken struct {
+	sync.Mutex
+	// the access token
+	token string
+	// the expiration of the access token
+	expires time.Time
+}
+
+//
+// getServiceToken returns the access token of the service account, requesting a new token via the client
+// credentials grant when it's close to expiry
+//
+func (r *oauthProxy) getServiceToken(now time.Time) (string, error) {
+	r.service.Lock()
+	defer r.service.Unlock()
+	if r.service.token != "" && now.Add(serviceTokenMargin).Before(r.service.expires) {
+		return r.service.token, nil
+	}
+
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return "", err
+	}
+	response, err := client.ClientCredsToken(nil)
+	if err != nil {
+		return "", err
+	}
+	r.service.token = response.AccessToken
+	r.service.expires = getServiceTokenExpiry(response.AccessToken, response.Expires, now)
+
+	return r.service.token, nil
+}
+
+//
+// getServiceTokenExpiry returns the expiration of the token from the expires in of the response, else the claims;
+// also used for the exchanged tokens
+//
+func getServiceTokenExpiry(token string, expiresIn int, now time.Time) time.Time {
+	if expiresIn > 0 {
+		return now.Add(time.Duration(expiresIn) * time.Second)
+	}
+	if jwt, err := jose.ParseJWT(token); err == nil {
+		if claims, err := jwt.Claims(); err == nil {
+			if expires, found, err := claims.TimeClaim("exp"); err == nil && found {
+				return expires
+			}
+		}
+	}
+
+	return now.Add(serviceTokenDuration)
+}
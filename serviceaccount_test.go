@@ -0,0 +1,84 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetServiceTokenExpiry(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, now.Add(time.Duration(300)*time.Second), getServiceTokenExpiry("", 300, now))
+	assert.Equal(t, now.Add(serviceTokenDuration), getServiceTokenExpiry("invalid", 0, now))
+
+	expires := now.Add(time.Hour).Truncate(time.Second)
+	token := newFakeJWTToken(t, jose.Claims{"exp": expires.Unix()})
+	assert.Equal(t, expires.Unix(), getServiceTokenExpiry(token.Encode(), 0, now).Unix())
+}
+
+func TestGetServiceToken(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableServiceToken = true
+	proxy, _, _ := newTestProxyService(t, config)
+	now := time.Now()
+	token, err := proxy.getServiceToken(now)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, token)
+
+	// step: the token is reused until close to the expiry
+	proxy.service.token = "cached"
+	proxy.service.expires = now.Add(time.Hour)
+	token, err = proxy.getServiceToken(now)
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", token)
+	proxy.service.expires = now.Add(serviceTokenMargin / 2)
+	token, err = proxy.getServiceToken(now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "cached", token)
+}
+
+func TestUpstreamHeadersServiceToken(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.EnableServiceToken = true
+	proxy.service = &serviceToken{token: "service", expires: time.Now().Add(time.Hour)}
+	user := &userContext{id: "test-subject", name: "test", token: *newFakeBearerToken(t)}
+
+	cases := []struct {
+		Header        string
+		Authorization string
+		Service       string
+	}{
+		{Header: authorizationHeader, Authorization: "Bearer service"},
+		{Header: "X-Service-Token", Authorization: "Bearer " + user.token.Encode(), Service: "Bearer service"},
+	}
+	for i, c := range cases {
+		proxy.config.ServiceTokenHeader = c.Header
+		cx := newFakeGinContext("GET", "/admin")
+		cx.Set(userContextName, user)
+		proxy.upstreamHeadersHandler([]string{})(cx)
+		assert.Equal(t, c.Authorization, cx.Request.Header.Get(authorizationHeader), "case %d", i)
+		assert.Equal(t, user.token.Encode(), cx.Request.Header.Get("X-Auth-Token"), "case %d", i)
+		if c.Service != "" {
+			assert.Equal(t, c.Service, cx.Request.Header.Get(c.Header), "case %d", i)
+		}
+	}
+}
@@ -16,6 +16,9 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"path"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -23,13 +26,21 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// sessionStorePrefix is the prefix for the current session of a subject held in the store
+const sessionStorePrefix = "session:"
+
 //
 // getIdentity retrieves the user identity from a request, either from a session cookie or a bearer token
 //
 func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 	// step: check for a bearer token or cookie with jwt token
 	isBearer := false
-	token, err := r.getAccessTokenFromCookie(cx)
+	var token jose.JWT
+	err := ErrSessionNotFound
+	// step: the sidecar assumes bearer tokens, the cookies are never consulted
+	if !r.config.Sidecar {
+		token, err = r.getAccessTokenFromCookie(cx)
+	}
 	if err != nil {
 		if err != ErrSessionNotFound {
 			return nil, err
@@ -43,7 +54,7 @@ func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 	}
 
 	// step: parse the access token and extract the user identity
-	user, err := extractIdentity(token)
+	user, err := extractIdentity(token, r.roles)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +71,27 @@ func (r oauthProxy) getIdentity(cx *gin.Context) (*userContext, error) {
 	return user, nil
 }
 
+//
+// getIdentityFromCertificate retrieves the user identity from a verified client certificate
+//
+func (r oauthProxy) getIdentityFromCertificate(cx *gin.Context) (*userContext, error) {
+	state := cx.Request.TLS
+	if state == nil || len(state.VerifiedChains) <= 0 || len(state.VerifiedChains[0]) <= 0 {
+		return nil, ErrSessionNotFound
+	}
+	user := extractCertificateIdentity(state.VerifiedChains[0][0])
+	if user.id == "" {
+		return nil, ErrNoCertificateName
+	}
+
+	log.WithFields(log.Fields{
+		"id":    user.id,
+		"roles": strings.Join(user.roles, ","),
+	}).Debugf("found the client certificate identity: %s in the request", user.id)
+
+	return user, nil
+}
+
 //
 // getTokenFromBearer attempt to retrieve token from bearer token
 //
@@ -100,3 +132,81 @@ func (r oauthProxy) getRefreshTokenFromCookie(cx *gin.Context) (string, error) {
 
 	return cookie.Value, nil
 }
+
+//
+// getSessionID returns the identifier of the login session of the user, which remains the same across a refresh
+//
+func getSessionID(user *userContext) string {
+	if state, found, err := user.claims.StringClaim(claimSessionState); err == nil && found {
+		return state
+	}
+	if authTime, found := user.claims[claimAuthTime]; found {
+		return fmt.Sprintf("%v", authTime)
+	}
+
+	return ""
+}
+
+//
+// recordSession places the session of the user in the store, superseding any previous session
+//
+func (r *oauthProxy) recordSession(user *userContext) error {
+	id := getSessionID(user)
+	if id == "" {
+		log.WithFields(log.Fields{
+			"id": user.id,
+		}).Warnf("the token has no session state or auth time, unable to enforce a single session")
+
+		return nil
+	}
+
+	return r.store.Set(sessionStorePrefix+user.id, id)
+}
+
+//
+// isSessionSuperseded checks if a newer login for the user has superseded the session
+//
+func (r *oauthProxy) isSessionSuperseded(user *userContext) (bool, error) {
+	id := getSessionID(user)
+	if id == "" {
+		return false, nil
+	}
+	current, err := r.store.Get(sessionStorePrefix + user.id)
+	if err != nil {
+		return false, err
+	}
+
+	return current != "" && current != id, nil
+}
+
+//
+// sessionSuperseded clears the session and redirects the user to login, via the session ended page if any
+//
+func (r *oauthProxy) sessionSuperseded(cx *gin.Context, user *userContext) {
+	log.WithFields(log.Fields{
+		"id":    user.id,
+		"email": user.email,
+	}).Warnf("the session for user: %s was superseded by a newer login", user.email)
+
+	r.clearAllCookies(cx)
+	if r.noRedirects(cx) {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonSessionSuperseded)
+		return
+	}
+	if r.config.SessionEndedPage == "" {
+		r.redirectToAuthorization(cx)
+		return
+	}
+
+	model := make(map[string]string, 0)
+	for k, v := range r.config.TagData {
+		model[k] = v
+	}
+	model["reason"] = reasonSessionSuperseded
+	model["detail"] = reasonDetails[reasonSessionSuperseded]
+	model["redirect"] = fmt.Sprintf("%s%s?state=%s", oauthURL, authorizationURL,
+		r.encodeState(cx.Request.URL.RequestURI()))
+
+	cx.HTML(http.StatusUnauthorized, path.Base(r.config.SessionEndedPage), model)
+	cx.Abort()
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/gambol99/go-oidc/jose"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -146,3 +147,45 @@ func TestGetRefreshTokenFromCookie(t *testing.T) {
 		assert.Equal(t, x.Expected, token, "case %d, expected token: %v, got: %v", x.Expected, token)
 	}
 }
+
+func TestGetSessionID(t *testing.T) {
+	assert.Equal(t, "abc", getSessionID(&userContext{claims: jose.Claims{"session_state": "abc", "auth_time": 1}}))
+	assert.Equal(t, "1464187442", getSessionID(&userContext{claims: jose.Claims{"auth_time": 1464187442}}))
+	assert.Empty(t, getSessionID(&userContext{claims: jose.Claims{}}))
+}
+
+func TestSingleSession(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+	p := newFakeKeycloakProxy(t)
+	p.store = store
+	p.config.SingleSession = true
+	p.config.NoRedirects = true
+
+	first := &userContext{id: "test", claims: jose.Claims{"session_state": "first"}}
+	second := &userContext{id: "test", claims: jose.Claims{"session_state": "second"}}
+
+	// step: the session is not superseded until a login is recorded
+	superseded, err := p.isSessionSuperseded(first)
+	assert.NoError(t, err)
+	assert.False(t, superseded)
+
+	assert.NoError(t, p.recordSession(first))
+	superseded, err = p.isSessionSuperseded(first)
+	assert.NoError(t, err)
+	assert.False(t, superseded)
+
+	assert.NoError(t, p.recordSession(second))
+	superseded, err = p.isSessionSuperseded(first)
+	assert.NoError(t, err)
+	assert.True(t, superseded)
+	superseded, err = p.isSessionSuperseded(second)
+	assert.NoError(t, err)
+	assert.False(t, superseded)
+
+	// step: the superseded session is cleared
+	cx := newFakeGinContext("GET", "/admin")
+	p.sessionSuperseded(cx, first)
+	assert.Equal(t, http.StatusUnauthorized, cx.Writer.Status())
+	assert.Contains(t, cx.Writer.Header().Get("Set-Cookie"), p.config.CookieAccessName+"=;")
+}
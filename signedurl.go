@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// signedURLExpires is the query parameter holding the expiration (unix) of the signed url
+	signedURLExpires = "kc-expires"
+	// signedURLSubject is the query parameter holding the subject who minted the signed url
+	signedURLSubject = "kc-subject"
+	// signedURLRoles is the query parameter holding the roles the signed url carries
+	signedURLRoles = "kc-roles"
+	// signedURLSignature is the query parameter holding the signature of the url
+	signedURLSignature = "kc-signature"
+	// signedURLKeyLabel is the label the signing key of the urls is derived from the encryption key with
+	signedURLKeyLabel = "keycloak-proxy signed urls"
+)
+
+//
+// signURLHandler mints a signed temporary url of the path and method for the authenticated user, the url carries
+// the roles of the user which the resource requires
+//
+func (r *oauthProxy) signURLHandler(cx *gin.Context) {
+	user, err := r.getIdentity(cx)
+	if err == nil && !r.config.SkipTokenVerification {
+		err = r.verifyAccessToken(user)
+	}
+	if err != nil {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonUnauthenticated)
+		return
+	}
+
+	// step: only the paths of the proxy can be signed
+	location, err := url.Parse(cx.PostForm("url"))
+	if err != nil || location.Scheme != "" || location.Host != "" || !strings.HasPrefix(location.Path, "/") ||
+		strings.HasPrefix(location.Path, "//") || strings.HasPrefix(location.Path, oauthURL) {
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return
+	}
+	method := strings.ToUpper(cx.DefaultPostForm("method", http.MethodGet))
+	if !isValidMethod(method) || method == "ANY" {
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+		return
+	}
+	duration := r.config.SignedURLDuration
+	if value := cx.PostForm("duration"); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested <= 0 {
+			r.errorResponse(cx, http.StatusBadRequest, reasonInvalidRequest)
+			return
+		}
+		if requested < duration {
+			duration = requested
+		}
+	}
+
+	// step: the url carries only the roles of the user the resource requires
+	var roles []string
+	if resource := r.matchResource(location.Path); resource != nil && resource.hasMethod(method) {
+		for _, role := range resource.Roles {
+			if containedIn(role, user.roles) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	expires := time.Now().Add(duration)
+	signed := encodeSignedURL(method, location, user.id, roles, expires, getSignedURLKey(r.config.EncryptionKey))
+
+	log.WithFields(log.Fields{
+		"email":   user.email,
+		"method":  method,
+		"url":     location.Path,
+		"expires": expires.Format(time.RFC1123),
+	}).Infof("minted a signed url for the user: %s", user.email)
+
+	cx.JSON(http.StatusOK, gin.H{
+		"url":        signed,
+		"expires_at": expires.Unix(),
+	})
+}
+
+//
+// getIdentityFromSignedURL verifies the signature of the url and retrieves the identity it carries, the
+// signature is removed from the request so it is not passed upstream
+//
+func (r *oauthProxy) getIdentityFromSignedURL(cx *gin.Context) (*userContext, error) {
+	query := cx.Request.URL.Query()
+	subject := query.Get(signedURLSubject)
+	roles := query.Get(signedURLRoles)
+	signature := query.Get(signedURLSignature)
+	unix, err := strconv.ParseInt(query.Get(signedURLExpires), 10, 64)
+	for _, x := range []string{signedURLExpires, signedURLSubject, signedURLRoles, signedURLSignature} {
+		query.Del(x)
+	}
+	cx.Request.URL.RawQuery = query.Encode()
+	if err != nil || subject == "" {
+		return nil, ErrInvalidSignedURL
+	}
+
+	expected := computeURLSignature(cx.Request.Method, cx.Request.URL.Path, query, subject, roles, unix,
+		getSignedURLKey(r.config.EncryptionKey))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"url":       cx.Request.URL.Path,
+		}).Warnf("the signature of the signed url is invalid")
+
+		return nil, ErrInvalidSignedURL
+	}
+	expires := time.Unix(unix, 0)
+	if time.Now().After(expires) {
+		return nil, ErrSignedURLExpired
+	}
+
+	user := &userContext{
+		id:            subject,
+		name:          subject,
+		preferredName: subject,
+		expiresAt:     expires,
+		claims: jose.Claims{
+			"sub":              subject,
+			claimPreferredName: subject,
+		},
+		signedURL: true,
+	}
+	if roles != "" {
+		user.roles = strings.Split(roles, ",")
+	}
+
+	log.WithFields(log.Fields{
+		"id":      user.id,
+		"url":     cx.Request.URL.Path,
+		"expires": expires.Format(time.RFC1123),
+	}).Debugf("found the signed url identity: %s in the request", user.id)
+
+	return user, nil
+}
+
+//
+// hasURLSignature checks if the request carries the signature of a signed url
+//
+func hasURLSignature(req *http.Request) bool {
+	return req.URL.Query().Get(signedURLSignature) != ""
+}
+
+//
+// getSignedURLKey derives the key the urls are signed with from the encryption key, so the same key is never used
+// for both the encryption and the signatures
+//
+func getSignedURLKey(key string) string {
+	return string(signData([]byte(signedURLKeyLabel), key))
+}
+
+//
+// encodeSignedURL returns the location with the expiration, subject, roles and signature of the method added to
+// the query
+//
+func encodeSignedURL(method string, location *url.URL, subject string, roles []string, expires time.Time, key string) string {
+	query := location.Query()
+	for _, x := range []string{signedURLExpires, signedURLSubject, signedURLRoles, signedURLSignature} {
+		query.Del(x)
+	}
+	signature := computeURLSignature(method, location.Path, query, subject, strings.Join(roles, ","), expires.Unix(), key)
+
+	query.Set(signedURLExpires, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(signedURLSubject, subject)
+	query.Set(signedURLRoles, strings.Join(roles, ","))
+	query.Set(signedURLSignature, signature)
+
+	return location.Path + "?" + query.Encode()
+}
+
+//
+// computeURLSignature signs the method, path, the remaining query, the subject, roles and expiration with the key
+//
+func computeURLSignature(method, path string, query url.Values, subject, roles string, expires int64, key string) string {
+	content := strings.Join([]string{
+		method, path, query.Encode(), subject, roles, strconv.FormatInt(expires, 10),
+	}, "\n")
+
+	return base64.RawURLEncoding.EncodeToString(signData([]byte(content), key))
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeSignedURLProxy(t *testing.T) *oauthProxy {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:     "/reports",
+			Methods: []string{"ANY"},
+			Roles:   []string{fakeAdminRole},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.EnableSignedURLs = true
+	proxy.config.SignedURLDuration = time.Duration(15) * time.Minute
+	proxy.config.EncryptionKey = "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Query", req.URL.RawQuery)
+		w.WriteHeader(http.StatusOK)
+	})
+	proxy.createEndpoints()
+
+	return proxy
+}
+
+func TestSignURLHandler(t *testing.T) {
+	proxy := newFakeSignedURLProxy(t)
+	token := newFakeJWTToken(t, jose.Claims{
+		"aud": "test",
+		"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		"realm_access": map[string]interface{}{
+			"roles": []string{fakeAdminRole, "other"},
+		},
+	})
+
+	req := newFakeSignRequest("url=" + url.QueryEscape("/reports/q3?format=pdf") + "&duration=5m")
+	req.Header.Set("Authorization", "Bearer "+token.Encode())
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var minted struct {
+		URL       string `json:"url"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &minted))
+	assert.True(t, minted.ExpiresAt <= time.Now().Add(time.Duration(5)*time.Minute).Unix())
+	location, err := url.Parse(minted.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "/reports/q3", location.Path)
+	assert.Equal(t, fakeAdminRole, location.Query().Get(signedURLRoles))
+
+	// step: the signed url is honored without a session, the signature is not passed upstream
+	req = newFakeHTTPRequest("GET", location.Path)
+	req.URL.RawQuery = location.RawQuery
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "format=pdf", recorder.Header().Get("X-Query"))
+
+	// step: the tampered url is refused, as is another method
+	req = newFakeHTTPRequest("GET", "/reports/q4")
+	req.URL.RawQuery = location.RawQuery
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	req = newFakeHTTPRequest("DELETE", location.Path)
+	req.URL.RawQuery = location.RawQuery
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func newFakeSignRequest(form string) *http.Request {
+	req := newFakeHTTPRequest("POST", oauthURL+signURL)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = ioutil.NopCloser(strings.NewReader(form))
+
+	return req
+}
+
+func TestSignedURLKey(t *testing.T) {
+	key := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	assert.NotEqual(t, key, getSignedURLKey(key))
+	assert.Equal(t, getSignedURLKey(key), getSignedURLKey(key))
+	signature := computeURLSignature("GET", "/", url.Values{}, "test", "", 1, getSignedURLKey(key))
+	assert.NotEqual(t, signature, computeURLSignature("POST", "/", url.Values{}, "test", "", 1, getSignedURLKey(key)))
+	assert.NotEqual(t, signature, computeURLSignature("GET", "/", url.Values{}, "test", "", 1, key))
+}
+
+func TestSignURLHandlerRefused(t *testing.T) {
+	proxy := newFakeSignedURLProxy(t)
+	token := newFakeBearerToken(t)
+	cases := []struct {
+		URL    string
+		Method string
+		Token  bool
+		Code   int
+	}{
+		{URL: "/reports/q3", Code: http.StatusUnauthorized},
+		{URL: "https://evil.example.com/", Token: true, Code: http.StatusBadRequest},
+		{URL: "//evil.example.com/", Token: true, Code: http.StatusBadRequest},
+		{URL: "/oauth/token", Token: true, Code: http.StatusBadRequest},
+		{URL: "/reports/q3", Token: true, Code: http.StatusOK},
+		{URL: "/reports/q3", Method: "ANY", Token: true, Code: http.StatusBadRequest},
+		{URL: "/reports/q3", Method: "POST", Token: true, Code: http.StatusOK},
+	}
+	for i, c := range cases {
+		form := "url=" + url.QueryEscape(c.URL)
+		if c.Method != "" {
+			form += "&method=" + c.Method
+		}
+		req := newFakeSignRequest(form)
+		if c.Token {
+			req.Header.Set("Authorization", "Bearer "+token.Encode())
+		}
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, c.Code, recorder.Code, "case %d", i)
+	}
+}
+
+func TestSignedURLExpired(t *testing.T) {
+	proxy := newFakeSignedURLProxy(t)
+	location, err := url.Parse(encodeSignedURL("GET", &url.URL{Path: "/reports/q3"}, "test", []string{fakeAdminRole},
+		time.Now().Add(-time.Minute), getSignedURLKey(proxy.config.EncryptionKey)))
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(location.RawQuery, signedURLSignature))
+
+	req := newFakeHTTPRequest("GET", location.Path)
+	req.URL.RawQuery = location.RawQuery
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
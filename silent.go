@@ -0,0 +1,121 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// silentResultSuccess is the result of a silent authentication which established a session
+	silentResultSuccess = "success"
+	// silentResultLoginRequired is the result of a silent authentication which requires the user to login
+	silentResultLoginRequired = "login_required"
+)
+
+// silentErrors are the errors of a prompt=none authorization the user must interact with the provider to resolve
+var silentErrors = []string{"login_required", "interaction_required", "consent_required", "account_selection_required"}
+
+// silentTemplate is the page rendered in the iframe, posting the result of the silent authentication to the application
+var silentTemplate = template.Must(template.New("silent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Silent Authentication</title>
+</head>
+<body>
+<script>
+window.parent.postMessage({type: "kc-silent-authentication", result: {{ .Result }}}, window.location.origin);
+</script>
+</body>
+</html>
+`))
+
+//
+// silentHandler performs a prompt=none authorization within an iframe of the application, the provider returns to
+// the same endpoint which posts the result (success or login_required) to the parent window
+//
+func (r *oauthProxy) silentHandler(cx *gin.Context) {
+	result := cx.Query("result")
+	if result == "" {
+		state := r.encodeState(oauthURL + silentURL + "?result=" + silentResultSuccess)
+		r.redirectToURL(oauthURL+authorizationURL+"?prompt=none&state="+url.QueryEscape(state), cx)
+		return
+	}
+	if result != silentResultSuccess {
+		result = silentResultLoginRequired
+	}
+
+	// step: the page is framed by the application
+	cx.Header("X-Frame-Options", "SAMEORIGIN")
+	cx.Header("Cache-Control", "no-store")
+	cx.Header("Content-Type", "text/html; charset=utf-8")
+	cx.Status(http.StatusOK)
+	if err := silentTemplate.Execute(cx.Writer, map[string]string{"Result": result}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to render the silent authentication page")
+	}
+	cx.Abort()
+}
+
+//
+// silentAuthenticationFailed handles the provider refusing a silent authentication, the iframe is handed the
+// result while a browser is sent to the login with the same state
+//
+func (r *oauthProxy) silentAuthenticationFailed(cx *gin.Context) {
+	log.WithFields(log.Fields{
+		"client_ip": cx.ClientIP(),
+		"error":     cx.Query("error"),
+	}).Debugf("the provider was unable to authenticate the user silently")
+
+	state := cx.Query("state")
+	location, err := r.decodeState(state)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"state": state,
+			"error": err.Error(),
+		}).Warnf("unable to decode the state parameter")
+
+		r.errorResponse(cx, http.StatusBadRequest, reasonInvalidState)
+		return
+	}
+	if strings.HasPrefix(location, oauthURL+silentURL) {
+		r.redirectToURL(oauthURL+silentURL+"?result="+silentResultLoginRequired, cx)
+		return
+	}
+
+	r.redirectToURL(oauthURL+authorizationURL+"?state="+url.QueryEscape(state), cx)
+}
+
+//
+// isSilentAuthenticationError checks if the error of the callback is the refusal of a silent authentication
+//
+func isSilentAuthenticationError(name string) bool {
+	return name != "" && containedIn(name, silentErrors)
+}
+
+//
+// hasSessionCookie checks if the request holds a session cookie, expired or otherwise
+//
+func hasSessionCookie(cx *gin.Context, name string) bool {
+	return findCookie(name, cx.Request.Cookies()) != nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSilentAuthentication(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSilentAuthentication = true
+	proxy, _, u := newTestProxyService(t, config)
+
+	request := func(location string, cookie *http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", u+location, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+
+	// step: an expired session is authenticated silently, without a session the user is sent to login
+	resp := request(fakeAdminRoleURL, &http.Cookie{Name: config.CookieAccessName, Value: "expired"})
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Location"), "prompt=none")
+	resp = request(fakeAdminRoleURL, nil)
+	assert.NotContains(t, resp.Header.Get("Location"), "prompt=none")
+
+	// step: the authorization is passed to the provider with prompt=none
+	resp = request(oauthURL+authorizationURL+"?prompt=none&state=L2FkbWlu", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "none", location.Query().Get("prompt"))
+
+	// step: a refused silent authentication falls back to the login with the same state
+	resp = request(oauthURL+callbackURL+"?error=login_required&state=L2FkbWlu", nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, oauthURL+authorizationURL+"?state=L2FkbWlu", resp.Header.Get("Location"))
+
+	// step: the iframe is handed the result
+	resp = request(oauthURL+silentURL, nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, oauthURL+authorizationURL, location.Path)
+	assert.Equal(t, "none", location.Query().Get("prompt"))
+	state := location.Query().Get("state")
+	decoded, err := proxy.decodeState(state)
+	assert.NoError(t, err)
+	assert.Equal(t, oauthURL+silentURL+"?result="+silentResultSuccess, decoded)
+
+	resp = request(oauthURL+callbackURL+"?error=interaction_required&state="+url.QueryEscape(state), nil)
+	assert.Equal(t, oauthURL+silentURL+"?result="+silentResultLoginRequired, resp.Header.Get("Location"))
+
+	for _, result := range []string{silentResultSuccess, silentResultLoginRequired, "<script>"} {
+		resp = request(oauthURL+silentURL+"?result="+url.QueryEscape(result), nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		expected := silentResultLoginRequired
+		if result == silentResultSuccess {
+			expected = silentResultSuccess
+		}
+		assert.Contains(t, string(content), `result: "`+expected+`"`)
+	}
+}
+
+func TestIsSilentAuthenticationError(t *testing.T) {
+	assert.True(t, isSilentAuthenticationError("login_required"))
+	assert.True(t, isSilentAuthenticationError("consent_required"))
+	assert.False(t, isSilentAuthenticationError("access_denied"))
+	assert.False(t, isSilentAuthenticationError(""))
+}
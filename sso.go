@@ -0,0 +1,214 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ssoTransferDuration is the lifetime of a transfer token, it only has to survive the redirect
+	ssoTransferDuration = time.Duration(30) * time.Second
+)
+
+//
+// ssoHandler is called on the primary domain, it hands the session to a permitted sibling domain via a
+// signed, short-lived transfer token
+//
+func (r *oauthProxy) ssoHandler(cx *gin.Context) {
+	location, err := url.Parse(cx.Query("redirect"))
+	if err != nil || location.Host == "" || !r.isSSODomain(location.Host) {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"redirect":  cx.Query("redirect"),
+		}).Warnf("refusing to broker a session to a domain not in the sso domains")
+
+		r.errorResponse(cx, http.StatusForbidden, reasonInvalidRequest)
+		return
+	}
+
+	// step: the user must have a valid session on this domain, else we authenticate and come back here
+	user, err := r.getIdentity(cx)
+	if err == nil && !r.config.SkipTokenVerification {
+		err = verifyToken(r.client, user.token)
+	}
+	if err != nil {
+		r.redirectToAuthorization(cx)
+		return
+	}
+
+	token, err := encodeTransferToken(user.token.Encode(), r.config.EncryptionKey, time.Now().Add(ssoTransferDuration))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to create the sso transfer token")
+
+		r.errorResponse(cx, http.StatusInternalServerError, reasonServerError)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"email":  user.email,
+		"domain": location.Host,
+	}).Infof("brokering the session for user: %s to domain: %s", user.email, location.Host)
+
+	query := location.Query()
+	query.Set("token", token)
+	location.RawQuery = query.Encode()
+
+	r.redirectToURL(location.String(), cx)
+}
+
+//
+// ssoCallbackHandler is called on the sibling domain, it exchanges the transfer token for a session cookie
+//
+func (r *oauthProxy) ssoCallbackHandler(cx *gin.Context) {
+	encoded, err := decodeTransferToken(cx.Query("token"), r.config.EncryptionKey, time.Now())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"client_ip": cx.ClientIP(),
+			"error":     err.Error(),
+		}).Warnf("unable to decode the sso transfer token")
+
+		r.accessForbidden(cx, reasonInvalidToken)
+		return
+	}
+
+	token, err := jose.ParseJWT(encoded)
+	if err == nil && !r.config.SkipTokenVerification {
+		err = verifyToken(r.client, token)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("the access token in the sso transfer token is invalid")
+
+		r.accessForbidden(cx, reasonInvalidToken)
+		return
+	}
+
+	// step: drop the session cookie for this domain
+	r.dropAccessTokenCookie(cx, token.Encode(), r.config.IdleDuration)
+
+	// step: decode the state variable
+	state, err := r.decodeState(cx.Query("state"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("unable to decode the state parameter")
+
+		state = "/"
+	}
+	if !r.isPermittedRedirect(state, cx.Request.Host) {
+		log.WithFields(log.Fields{
+			"redirect": state,
+		}).Warnf("refusing to redirect to a location which is not permitted")
+
+		state = "/"
+	}
+
+	r.redirectToURL(state, cx)
+}
+
+//
+// redirectToBroker redirects the client to the sso broker on the primary domain, returning to the location
+//
+func (r *oauthProxy) redirectToBroker(cx *gin.Context, location string) {
+	callback := fmt.Sprintf("%s%s%s?state=%s", r.config.RedirectionURL, oauthURL, ssoCallbackURL,
+		url.QueryEscape(r.encodeState(location)))
+
+	r.redirectToURL(fmt.Sprintf("%s%s%s?redirect=%s", strings.TrimSuffix(r.config.SSOBrokerURL, "/"),
+		oauthURL, ssoURL, url.QueryEscape(callback)), cx)
+}
+
+//
+// isSSODomain checks if the host is one of, or a subdomain of, the sso domains
+//
+func (r *oauthProxy) isSSODomain(host string) bool {
+	host = getHostname(host)
+	for _, domain := range r.config.SSODomains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// encodeTransferToken encrypts the access token and expiration, signing the result with the key
+//
+func encodeTransferToken(token, key string, expires time.Time) (string, error) {
+	cipherText, err := encryptDataBlock([]byte(fmt.Sprintf("%d|%s", expires.Unix(), token)), []byte(key))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s.%s",
+		base64.RawURLEncoding.EncodeToString(cipherText),
+		base64.RawURLEncoding.EncodeToString(signData(cipherText, key))), nil
+}
+
+//
+// decodeTransferToken verifies the signature and expiration of the transfer token, returning the access token
+//
+func decodeTransferToken(token, key string, now time.Time) (string, error) {
+	items := strings.Split(token, ".")
+	if len(items) != 2 {
+		return "", ErrInvalidTransferToken
+	}
+	cipherText, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return "", ErrInvalidTransferToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(items[1])
+	if err != nil {
+		return "", ErrInvalidTransferToken
+	}
+	if !hmac.Equal(signature, signData(cipherText, key)) {
+		return "", ErrInvalidTransferToken
+	}
+
+	plainText, err := decryptDataBlock(cipherText, []byte(key))
+	if err != nil {
+		return "", ErrInvalidTransferToken
+	}
+	items = strings.SplitN(string(plainText), "|", 2)
+	if len(items) != 2 {
+		return "", ErrInvalidTransferToken
+	}
+	expires, err := strconv.ParseInt(items[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidTransferToken
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return "", ErrTransferTokenExpired
+	}
+
+	return items[1], nil
+}
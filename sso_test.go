@@ -0,0 +1,146 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferToken(t *testing.T) {
+	key := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	now := time.Now()
+	token, err := encodeTransferToken("access.token.value", key, now.Add(ssoTransferDuration))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	decoded, err := decodeTransferToken(token, key, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "access.token.value", decoded)
+
+	_, err = decodeTransferToken(token, key, now.Add(time.Duration(1)*time.Minute))
+	assert.Equal(t, ErrTransferTokenExpired, err)
+	_, err = decodeTransferToken(token, "vGcLt8ZUdPX5fXhtLZaPHZkGWHZrT6T8", now)
+	assert.Equal(t, ErrInvalidTransferToken, err)
+	_, err = decodeTransferToken("A"+token, key, now)
+	assert.Equal(t, ErrInvalidTransferToken, err)
+	_, err = decodeTransferToken("bad", key, now)
+	assert.Equal(t, ErrInvalidTransferToken, err)
+}
+
+func TestIsSSODomain(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SSODomains = []string{"example.org", "Example.NET"}
+
+	tests := []struct {
+		Host     string
+		Expected bool
+	}{
+		{Host: "example.org", Expected: true},
+		{Host: "www.example.org:8443", Expected: true},
+		{Host: "example.net", Expected: true},
+		{Host: "badexample.org"},
+		{Host: "example.org.evil.com"},
+		{Host: "example.com"},
+	}
+	for i, c := range tests {
+		assert.Equal(t, c.Expected, proxy.isSSODomain(c.Host), "case %d, host: %s", i, c.Host)
+	}
+}
+
+func TestSSOHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SSODomains = []string{"example.org"}
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+
+	tests := []struct {
+		Redirect string
+		Expected int
+	}{
+		{Redirect: "https://www.example.org/oauth/sso/callback?state=Lw==", Expected: http.StatusTemporaryRedirect},
+		{Redirect: "https://example.com/oauth/sso/callback", Expected: http.StatusForbidden},
+		{Redirect: "/oauth/sso/callback", Expected: http.StatusForbidden},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", oauthURL+ssoURL)
+		req.URL.RawQuery = url.Values{"redirect": []string{c.Redirect}}.Encode()
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !assert.Equal(t, c.Expected, recorder.Code, "case %d", i) || c.Expected != http.StatusTemporaryRedirect {
+			continue
+		}
+
+		location, err := url.Parse(recorder.Header().Get("Location"))
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		assert.Equal(t, "www.example.org", location.Host, "case %d", i)
+		assert.Equal(t, "Lw==", location.Query().Get("state"), "case %d", i)
+		decoded, err := decodeTransferToken(location.Query().Get("token"), proxy.config.EncryptionKey, time.Now())
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, token.Encode(), decoded, "case %d", i)
+	}
+}
+
+func TestSSOCallbackHandler(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SSOBrokerURL = "https://sso.example.com"
+	proxy.createEndpoints()
+	token := newFakeBearerToken(t)
+	transfer, err := encodeTransferToken(token.Encode(), proxy.config.EncryptionKey, time.Now().Add(ssoTransferDuration))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := newFakeHTTPRequest("GET", oauthURL+ssoCallbackURL)
+	req.URL.RawQuery = url.Values{
+		"token": []string{transfer},
+		"state": []string{base64.StdEncoding.EncodeToString([]byte(fakeAdminRoleURL))},
+	}.Encode()
+	recorder := httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, recorder.Code)
+	assert.Equal(t, fakeAdminRoleURL, recorder.Header().Get("Location"))
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Set-Cookie"), proxy.config.CookieAccessName+"="+token.Encode()))
+
+	// step: the state must be a path on this host
+	for _, x := range []string{"https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com/"} {
+		req = newFakeHTTPRequest("GET", oauthURL+ssoCallbackURL)
+		req.URL.RawQuery = url.Values{
+			"token": []string{transfer},
+			"state": []string{base64.StdEncoding.EncodeToString([]byte(x))},
+		}.Encode()
+		recorder = httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		assert.Equal(t, "/", recorder.Header().Get("Location"), "state %s", x)
+	}
+
+	req = newFakeHTTPRequest("GET", oauthURL+ssoCallbackURL)
+	req.URL.RawQuery = url.Values{"token": []string{"invalid"}}.Encode()
+	recorder = httptest.NewRecorder()
+	proxy.router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// stateClockSkew is the tolerance on the issued time of the state
+const stateClockSkew = time.Duration(1) * time.Minute
+
+//
+// authorizationState is the signed state parameter of the authorization, the location to return to
+//
+type authorizationState struct {
+	// Location is the location the user is returned to
+	Location string `json:"u"`
+	// Issued is the time the state was issued
+	Issued int64 `json:"t"`
+}
+
+//
+// encodeState encodes the location as the state parameter, signed (and encrypted) when enabled
+//
+func (r *oauthProxy) encodeState(location string) string {
+	if !r.config.EnableSignedState {
+		return base64.StdEncoding.EncodeToString([]byte(location))
+	}
+	state, err := encodeAuthorizationState(&authorizationState{
+		Location: location,
+		Issued:   time.Now().Unix(),
+	}, r.config.EncryptionKey, r.config.EnableEncryptedState)
+	if err != nil {
+		// step: the location is lost, the user is returned to the root after authenticating
+		return ""
+	}
+
+	return state
+}
+
+//
+// decodeState decodes the location from the state parameter, verifying the signature and age when signed
+//
+func (r *oauthProxy) decodeState(state string) (string, error) {
+	if state == "" {
+		return "/", nil
+	}
+	if !r.config.EnableSignedState {
+		decoded, err := base64.StdEncoding.DecodeString(state)
+		if err != nil {
+			return "", err
+		}
+		return string(decoded), nil
+	}
+	decoded, err := decodeAuthorizationState(state, r.config.EncryptionKey, r.config.EnableEncryptedState,
+		r.config.StateDuration, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return decoded.Location, nil
+}
+
+//
+// encodeAuthorizationState encodes, encrypts if required and signs the state
+//
+func encodeAuthorizationState(state *authorizationState, key string, encrypt bool) (string, error) {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	if encrypt {
+		if content, err = encryptDataBlock(content, []byte(key)); err != nil {
+			return "", err
+		}
+	}
+	payload := base64.RawURLEncoding.EncodeToString(content)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signData([]byte(payload), key)), nil
+}
+
+//
+// decodeAuthorizationState verifies the signature and age of the state, decrypting if required
+//
+func decodeAuthorizationState(state, key string, encrypted bool, duration time.Duration, now time.Time) (*authorizationState, error) {
+	items := strings.Split(state, ".")
+	if len(items) != 2 {
+		return nil, ErrInvalidState
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(items[1])
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	if !hmac.Equal(signature, signData([]byte(items[0]), key)) {
+		return nil, ErrInvalidState
+	}
+	content, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	if encrypted {
+		if content, err = decryptDataBlock(content, []byte(key)); err != nil {
+			return nil, ErrInvalidState
+		}
+	}
+
+	decoded := new(authorizationState)
+	if err := json.Unmarshal(content, decoded); err != nil {
+		return nil, ErrInvalidState
+	}
+	issued := time.Unix(decoded.Issued, 0)
+	if now.Sub(issued) > duration || issued.Sub(now) > stateClockSkew {
+		return nil, ErrStateExpired
+	}
+
+	return decoded, nil
+}
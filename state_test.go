@@ -0,0 +1,92 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationState(t *testing.T) {
+	key := "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"
+	now := time.Now()
+	for _, encrypt := range []bool{false, true} {
+		state, err := encodeAuthorizationState(&authorizationState{Location: "/admin?a=b", Issued: now.Unix()}, key, encrypt)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, !encrypt, strings.Contains(state, "L2FkbWlu"))
+		assert.Equal(t, url.QueryEscape(state), state, "the state should be url safe")
+
+		decoded, err := decodeAuthorizationState(state, key, encrypt, time.Minute, now)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "/admin?a=b", decoded.Location)
+		}
+		_, err = decodeAuthorizationState(state, key, encrypt, time.Minute, now.Add(2*time.Minute))
+		assert.Equal(t, ErrStateExpired, err)
+		_, err = decodeAuthorizationState(state, "other", encrypt, time.Minute, now)
+		assert.Equal(t, ErrInvalidState, err)
+		_, err = decodeAuthorizationState("x"+state, key, encrypt, time.Minute, now)
+		assert.Equal(t, ErrInvalidState, err)
+	}
+
+	// step: a state issued in the future is refused
+	state, _ := encodeAuthorizationState(&authorizationState{Location: "/", Issued: now.Add(time.Hour).Unix()}, key, false)
+	_, err := decodeAuthorizationState(state, key, false, time.Minute, now)
+	assert.Equal(t, ErrStateExpired, err)
+
+	for _, x := range []string{"", "a", "a.b.c", "!!.!!"} {
+		_, err := decodeAuthorizationState(x, key, false, time.Minute, now)
+		assert.Equal(t, ErrInvalidState, err, "state: %s", x)
+	}
+}
+
+func TestCallbackSignedState(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableSignedState = true
+	config.StateDuration = time.Minute
+	proxy, _, u := newTestProxyService(t, config)
+	expired, _ := encodeAuthorizationState(&authorizationState{
+		Location: "/admin",
+		Issued:   time.Now().Add(-time.Hour).Unix(),
+	}, config.EncryptionKey, false)
+
+	cs := []struct {
+		State        string
+		ExpectedCode int
+	}{
+		{State: proxy.encodeState("/admin"), ExpectedCode: http.StatusTemporaryRedirect},
+		{State: "L2FkbWlu", ExpectedCode: http.StatusBadRequest},
+		{State: expired, ExpectedCode: http.StatusBadRequest},
+	}
+	for i, c := range cs {
+		req, _ := http.NewRequest("GET", u+oauthURL+callbackURL+"?code=fake&state="+url.QueryEscape(c.State), nil)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(t, err, "case %d", i) {
+			continue
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.ExpectedCode, resp.StatusCode, "case %d", i)
+		if c.ExpectedCode == http.StatusTemporaryRedirect {
+			assert.Equal(t, "/admin", resp.Header.Get("Location"), "case %d", i)
+		}
+	}
+}
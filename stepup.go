@@ -0,0 +1,130 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// claimACR is the authentication context class reference of the authentication
+	claimACR = "acr"
+	// claimAMR are the methods used in the authentication
+	claimAMR = "amr"
+)
+
+//
+// hasAuthenticationLevel checks the acr is at least the minimum; the values are ranked by the order of the levels
+// if given, else compared as numbers, else they must be equal
+//
+func hasAuthenticationLevel(acr, minimum string, levels []string) bool {
+	if minimum == "" {
+		return true
+	}
+	if len(levels) > 0 {
+		have, required := -1, -1
+		for i, x := range levels {
+			if x == acr {
+				have = i
+			}
+			if x == minimum {
+				required = i
+			}
+		}
+		return have >= 0 && required >= 0 && have >= required
+	}
+	have, err := strconv.ParseFloat(acr, 64)
+	if err != nil {
+		return acr == minimum
+	}
+	required, err := strconv.ParseFloat(minimum, 64)
+	if err != nil {
+		return acr == minimum
+	}
+
+	return have >= required
+}
+
+//
+// hasAuthenticationMethods checks the amr claim holds all the methods
+//
+func hasAuthenticationMethods(claims jose.Claims, methods []string) bool {
+	if len(methods) <= 0 {
+		return true
+	}
+	list, _ := claims[claimAMR].([]interface{})
+	var amr []string
+	for _, x := range list {
+		if method, ok := x.(string); ok {
+			amr = append(amr, method)
+		}
+	}
+
+	return hasRoles(methods, amr)
+}
+
+//
+// isSteppedUp checks the authentication of the user satisfies the acr and amr required by the resource
+//
+func (r *oauthProxy) isSteppedUp(user *userContext, resource *Resource) bool {
+	acr, _, _ := user.claims.StringClaim(claimACR)
+
+	return hasAuthenticationLevel(acr, resource.MinimumACR, r.config.ACRLevels) &&
+		hasAuthenticationMethods(user.claims, resource.RequiredAMR)
+}
+
+//
+// getStepUpParameters returns the parameters of the authorization request asking for the acr and amr required
+// by the resource
+//
+func getStepUpParameters(resource *Resource) url.Values {
+	values := url.Values{}
+	if resource.MinimumACR != "" {
+		values.Set("acr_values", resource.MinimumACR)
+	}
+	if len(resource.RequiredAMR) > 0 {
+		claims, _ := json.Marshal(map[string]interface{}{
+			"id_token": map[string]interface{}{
+				claimAMR: map[string]interface{}{"essential": true, "values": resource.RequiredAMR},
+			},
+		})
+		values.Set("claims", string(claims))
+	}
+
+	return values
+}
+
+//
+// redirectToStepUp redirects the user to authenticate with the acr and amr required by the resource; bearer
+// tokens are challenged (insufficient_user_authentication) instead
+//
+func (r *oauthProxy) redirectToStepUp(cx *gin.Context, user *userContext, resource *Resource) {
+	if r.noRedirects(cx) || r.config.SkipTokenVerification || user.isBearer() {
+		r.errorResponse(cx, http.StatusUnauthorized, reasonStepUpRequired)
+		return
+	}
+	values := getStepUpParameters(resource)
+	values.Set("state", r.encodeState(cx.Request.URL.RequestURI()))
+
+	r.redirectToURL(fmt.Sprintf("%s%s?%s", oauthURL, authorizationURL, values.Encode()), cx)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gambol99/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasAuthenticationLevel(t *testing.T) {
+	tests := []struct {
+		ACR      string
+		Minimum  string
+		Levels   []string
+		Expected bool
+	}{
+		{ACR: "1", Minimum: "", Expected: true},
+		{ACR: "2", Minimum: "1", Expected: true},
+		{ACR: "1", Minimum: "1", Expected: true},
+		{ACR: "0", Minimum: "1"},
+		{ACR: "", Minimum: "1"},
+		{ACR: "gold", Minimum: "gold", Expected: true},
+		{ACR: "silver", Minimum: "gold"},
+		{ACR: "gold", Minimum: "silver", Levels: []string{"bronze", "silver", "gold"}, Expected: true},
+		{ACR: "bronze", Minimum: "silver", Levels: []string{"bronze", "silver", "gold"}},
+		{ACR: "platinum", Minimum: "silver", Levels: []string{"bronze", "silver", "gold"}},
+	}
+	for i, c := range tests {
+		assert.Equal(t, c.Expected, hasAuthenticationLevel(c.ACR, c.Minimum, c.Levels), "case %d", i)
+	}
+}
+
+func TestHasAuthenticationMethods(t *testing.T) {
+	claims := jose.Claims{claimAMR: []interface{}{"pwd", "otp"}}
+	assert.True(t, hasAuthenticationMethods(claims, nil))
+	assert.True(t, hasAuthenticationMethods(claims, []string{"otp"}))
+	assert.True(t, hasAuthenticationMethods(claims, []string{"pwd", "otp"}))
+	assert.False(t, hasAuthenticationMethods(claims, []string{"hwk"}))
+	assert.False(t, hasAuthenticationMethods(jose.Claims{}, []string{"otp"}))
+}
+
+func TestGetStepUpParameters(t *testing.T) {
+	values := getStepUpParameters(&Resource{MinimumACR: "2", RequiredAMR: []string{"otp"}})
+	assert.Equal(t, "2", values.Get("acr_values"))
+	assert.Equal(t, `{"id_token":{"amr":{"essential":true,"values":["otp"]}}}`, values.Get("claims"))
+	assert.Empty(t, getStepUpParameters(&Resource{}))
+}
+
+func TestRedirectToStepUp(t *testing.T) {
+	proxy := newFakeKeycloakProxy(t)
+	proxy.config.SkipTokenVerification = false
+	cx := newFakeGinContext("GET", "/payments")
+	proxy.redirectToStepUp(cx, &userContext{}, &Resource{MinimumACR: "2"})
+	assert.Equal(t, http.StatusTemporaryRedirect, cx.Writer.Status())
+	location, err := url.Parse(cx.Writer.Header().Get("Location"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, oauthURL+authorizationURL, location.Path)
+	assert.Equal(t, "2", location.Query().Get("acr_values"))
+	assert.NotEmpty(t, location.Query().Get("state"))
+}
+
+func TestAdmissionHandlerStepUp(t *testing.T) {
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/payments",
+			Methods:     []string{"ANY"},
+			MinimumACR:  "2",
+			RequiredAMR: []string{"otp"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.createEndpoints()
+
+	tests := []struct {
+		ACR    string
+		AMR    []interface{}
+		Denied bool
+	}{
+		{ACR: "2", AMR: []interface{}{"pwd", "otp"}},
+		{ACR: "1", AMR: []interface{}{"pwd", "otp"}, Denied: true},
+		{ACR: "2", AMR: []interface{}{"pwd"}, Denied: true},
+	}
+	for i, c := range tests {
+		token := newFakeJWTToken(t, jose.Claims{
+			"aud": fakeClientID,
+			"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			"acr": c.ACR,
+			"amr": c.AMR,
+			"exp": time.Now().Add(time.Duration(1) * time.Hour).Unix(),
+		})
+		req := newFakeHTTPRequest("GET", "/payments")
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`, "case %d", i)
+		assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), `acr_values="2"`, "case %d", i)
+	}
+}
+
+func TestAuthorizationStepUpParameters(t *testing.T) {
+	_, _, u := newTestProxyService(t, nil)
+	req, _ := http.NewRequest("GET", u+"/oauth/authorize?state=L2FkbWlu&acr_values=2&claims="+url.QueryEscape(`{"id_token":{}}`), nil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "2", location.Query().Get("acr_values"))
+	assert.Equal(t, `{"id_token":{}}`, location.Query().Get("claims"))
+	assert.Equal(t, "L2FkbWlu", location.Query().Get("state"))
+}
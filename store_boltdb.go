@@ -17,7 +17,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +29,8 @@ import (
 
 const (
 	dbName = "keycloak"
+	// expiryBucketName is the bucket holding the expiration of the keys set with one
+	expiryBucketName = "expiry"
 )
 
 var (
@@ -53,9 +57,12 @@ func newBoltDBStore(location *url.URL) (storage, error) {
 		return nil, err
 	}
 
-	// step: create the bucket
+	// step: create the buckets
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, e := tx.CreateBucketIfNotExists([]byte(dbName))
+		if _, e := tx.CreateBucketIfNotExists([]byte(dbName)); e != nil {
+			return e
+		}
+		_, e := tx.CreateBucketIfNotExists([]byte(expiryBucketName))
 		return e
 	})
 
@@ -76,11 +83,52 @@ func (r boltdbStore) Set(key, value string) error {
 		if bucket == nil {
 			return ErrNoBoltdbBucket
 		}
+		// step: the key no longer expires
+		if expiry := tx.Bucket([]byte(expiryBucketName)); expiry != nil {
+			if err := expiry.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
 		return bucket.Put([]byte(key), []byte(value))
 	})
 }
 
-// Get retrieves a token from the store
+// SetWithExpiry adds the key to the store with the expiration held in the expiry bucket, the expired keys are
+// removed as the keys are set
+func (r boltdbStore) SetWithExpiry(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s in store", key)
+
+	now := time.Now()
+	return r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dbName))
+		expiry := tx.Bucket([]byte(expiryBucketName))
+		if bucket == nil || expiry == nil {
+			return ErrNoBoltdbBucket
+		}
+		// step: remove the keys which have expired
+		var expired [][]byte
+		expiry.ForEach(func(k, v []byte) error {
+			if e, _ := strconv.ParseInt(string(v), 10, 64); time.Unix(0, e).Before(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			bucket.Delete(k)
+			expiry.Delete(k)
+		}
+		if err := expiry.Put([]byte(key), []byte(fmt.Sprintf("%d", now.Add(expiration).UnixNano()))); err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(key), []byte(value))
+	})
+}
+
+// Get retrieves a token from the store, a key which has expired is not found
 func (r boltdbStore) Get(key string) (string, error) {
 	log.WithFields(log.Fields{
 		"key": key,
@@ -92,6 +140,13 @@ func (r boltdbStore) Get(key string) (string, error) {
 		if bucket == nil {
 			return ErrNoBoltdbBucket
 		}
+		if expiry := tx.Bucket([]byte(expiryBucketName)); expiry != nil {
+			if v := expiry.Get([]byte(key)); v != nil {
+				if e, _ := strconv.ParseInt(string(v), 10, 64); time.Unix(0, e).Before(time.Now()) {
+					return nil
+				}
+			}
+		}
 		value = string(bucket.Get([]byte(key)))
 		return nil
 	})
@@ -110,10 +165,42 @@ func (r boltdbStore) Delete(key string) error {
 		if bucket == nil {
 			return ErrNoBoltdbBucket
 		}
+		if expiry := tx.Bucket([]byte(expiryBucketName)); expiry != nil {
+			if err := expiry.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
 		return bucket.Delete([]byte(key))
 	})
 }
 
+// Increment increments the counter, the expiration is held alongside the count i.e. count:expires
+func (r boltdbStore) Increment(key string, expiration time.Duration) (int64, time.Duration, error) {
+	var count int64
+	var expires time.Time
+	now := time.Now()
+
+	err := r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dbName))
+		if bucket == nil {
+			return ErrNoBoltdbBucket
+		}
+		count, expires = 0, now.Add(expiration)
+		if items := strings.SplitN(string(bucket.Get([]byte(key))), ":", 2); len(items) == 2 {
+			c, _ := strconv.ParseInt(items[0], 10, 64)
+			e, _ := strconv.ParseInt(items[1], 10, 64)
+			if time.Unix(0, e).After(now) {
+				count, expires = c, time.Unix(0, e)
+			}
+		}
+		count++
+
+		return bucket.Put([]byte(key), []byte(fmt.Sprintf("%d:%d", count, expires.UnixNano())))
+	})
+
+	return count, expires.Sub(now), err
+}
+
 // Close closes of any open resources
 func (r boltdbStore) Close() error {
 	log.Infof("closing the resourcese for boltdb store")
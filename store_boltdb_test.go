@@ -0,0 +1,95 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBoltDBStore(t *testing.T) (storage, func()) {
+	dir, err := ioutil.TempDir("", "keycloak-proxy")
+	if err != nil {
+		t.Fatalf("unable to create a temporary directory, error: %s", err)
+	}
+	// step: the store drops the leading slash from the path
+	store, err := newBoltDBStore(&url.URL{Path: "/" + dir + "/store.db"})
+	if err != nil {
+		t.Fatalf("unable to create the boltdb store, error: %s", err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltDBStoreIncrement(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	for i := int64(1); i <= 3; i++ {
+		count, remaining, err := store.Increment("counter", time.Duration(1)*time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+		assert.True(t, remaining > 0 && remaining <= time.Minute, "unexpected remaining: %s", remaining)
+	}
+
+	// step: an expired counter should be reset
+	count, _, err := store.Increment("expired", time.Duration(1)*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	count, _, err = store.Increment("expired", time.Duration(1)*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestBoltDBStoreSetWithExpiry(t *testing.T) {
+	store, cleanup := newTestBoltDBStore(t)
+	defer cleanup()
+
+	assert.NoError(t, store.SetWithExpiry("short", "value", time.Duration(1)*time.Millisecond))
+	assert.NoError(t, store.SetWithExpiry("long", "value", time.Duration(1)*time.Minute))
+	value, err := store.Get("long")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	value, err = store.Get("short")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	// step: the expired keys are removed as the keys are set, and a key set without an expiry keeps it
+	assert.NoError(t, store.SetWithExpiry("other", "value", time.Duration(1)*time.Minute))
+	assert.NoError(t, store.SetWithExpiry("long", "value", time.Duration(1)*time.Millisecond))
+	assert.NoError(t, store.Set("long", "value"))
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	value, err = store.Get("long")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	err = store.(*boltdbStore).client.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(dbName)).Get([]byte("short")))
+		return nil
+	})
+	assert.NoError(t, err)
+}
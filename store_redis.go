@@ -63,6 +63,16 @@ func (r redisStore) Set(key, value string) error {
 	return nil
 }
 
+// SetWithExpiry adds the key to the store, expired by redis after the duration
+func (r redisStore) SetWithExpiry(key, value string, expiration time.Duration) error {
+	log.WithFields(log.Fields{
+		"key":        key,
+		"expiration": expiration.String(),
+	}).Debugf("adding the key: %s to the store", key)
+
+	return r.client.Set(key, value, expiration).Err()
+}
+
 // Get retrieves a token from the store
 func (r redisStore) Get(key string) (string, error) {
 	log.WithFields(log.Fields{
@@ -70,11 +80,14 @@ func (r redisStore) Get(key string) (string, error) {
 	}).Debugf("retrieving the key: %s from store", key)
 
 	result := r.client.Get(key)
+	if result.Err() == redis.Nil {
+		return "", nil
+	}
 	if result.Err() != nil {
 		return "", result.Err()
 	}
 
-	return result.String(), nil
+	return result.Val(), nil
 }
 
 // Delete remove the key
@@ -86,6 +99,30 @@ func (r redisStore) Delete(key string) error {
 	return r.client.Del(key).Err()
 }
 
+// Increment increments the counter, setting the expiration if the counter has none
+func (r redisStore) Increment(key string, expiration time.Duration) (int64, time.Duration, error) {
+	var incr *redis.IntCmd
+	var ttl *redis.DurationCmd
+	if _, err := r.client.Pipelined(func(pipe *redis.Pipeline) error {
+		incr = pipe.Incr(key)
+		ttl = pipe.PTTL(key)
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	// step: a new counter or one which lost its expiration
+	remaining := ttl.Val()
+	if remaining < 0 {
+		if err := r.client.PExpire(key, expiration).Err(); err != nil {
+			return 0, 0, err
+		}
+		remaining = expiration
+	}
+
+	return incr.Val(), remaining, nil
+}
+
 // Close closes of any open resources
 func (r redisStore) Close() error {
 	log.Infof("closing the resourcese for redis store")
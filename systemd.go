@@ -0,0 +1,102 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// systemdListenPIDEnv is the pid the sockets were passed to by systemd
+	systemdListenPIDEnv = "LISTEN_PID"
+	// systemdListenFDsEnv is the number of sockets passed by systemd
+	systemdListenFDsEnv = "LISTEN_FDS"
+	// systemdListenFDNamesEnv are the names of the sockets passed by systemd, colon separated
+	systemdListenFDNamesEnv = "LISTEN_FDNAMES"
+	// systemdListenFDsStart is the descriptor of the first socket passed by systemd
+	systemdListenFDsStart = 3
+	// proxySocketName is the name of the socket activated listener of the service
+	proxySocketName = "proxy"
+	// extAuthzSocketName is the name (FileDescriptorName) of the socket of the external authorization service
+	extAuthzSocketName = "ext-authz"
+	// extAuthzHTTPSocketName is the name of the socket of the external authorization service of the http mode
+	extAuthzHTTPSocketName = "ext-authz-http"
+)
+
+//
+// activatedListeners returns the listeners passed by systemd (socket activation), keyed on the socket name
+//
+func activatedListeners() (map[string]net.Listener, error) {
+	if os.Getenv(systemdListenPIDEnv) != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv(systemdListenFDsEnv))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid number of sockets passed by systemd: %s", os.Getenv(systemdListenFDsEnv))
+	}
+	var names []string
+	if value := os.Getenv(systemdListenFDNamesEnv); value != "" {
+		names = strings.Split(value, ":")
+	}
+	// step: the sockets are not passed on to any process we start, i.e. on a reload
+	for _, x := range []string{systemdListenPIDEnv, systemdListenFDsEnv, systemdListenFDNamesEnv} {
+		os.Unsetenv(x)
+	}
+
+	var files []*os.File
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "socket"))
+	}
+
+	return createActivatedListeners(files, names)
+}
+
+//
+// createActivatedListeners creates the listeners of the sockets, the sockets named ext-authz and ext-authz-http
+// are the external authorization services and any other is the service
+//
+func createActivatedListeners(files []*os.File, names []string) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener, 0)
+	for i, file := range files {
+		name := proxySocketName
+		if i < len(names) && (names[i] == extAuthzSocketName || names[i] == extAuthzHTTPSocketName) {
+			name = names[i]
+		}
+		if _, found := listeners[name]; found {
+			for _, x := range listeners {
+				x.Close()
+			}
+			return nil, fmt.Errorf("systemd passed multiple sockets for the %s, name them with the FileDescriptorName", name)
+		}
+		listener, err := net.FileListener(file)
+		if err != nil {
+			for _, x := range listeners {
+				x.Close()
+			}
+			return nil, fmt.Errorf("unable to use the socket passed by systemd, error: %s", err)
+		}
+		file.Close()
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
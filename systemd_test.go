@@ -0,0 +1,102 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeSocketFile(t *testing.T) (*os.File, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	return file, listener.Addr().String()
+}
+
+func TestActivatedListenersNotActivated(t *testing.T) {
+	defer os.Unsetenv(systemdListenPIDEnv)
+	defer os.Unsetenv(systemdListenFDsEnv)
+
+	listeners, err := activatedListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, listeners)
+
+	// step: the sockets were passed to another process
+	os.Setenv(systemdListenPIDEnv, strconv.Itoa(os.Getpid()+1))
+	os.Setenv(systemdListenFDsEnv, "1")
+	listeners, err = activatedListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, listeners)
+
+	os.Setenv(systemdListenPIDEnv, strconv.Itoa(os.Getpid()))
+	os.Setenv(systemdListenFDsEnv, "bad")
+	_, err = activatedListeners()
+	assert.Error(t, err)
+}
+
+func TestCreateActivatedListeners(t *testing.T) {
+	proxy, proxyAddress := newFakeSocketFile(t)
+	authz, authzAddress := newFakeSocketFile(t)
+	authzHTTP, authzHTTPAddress := newFakeSocketFile(t)
+
+	listeners, err := createActivatedListeners([]*os.File{proxy, authz, authzHTTP},
+		[]string{"keycloak-proxy.socket", extAuthzSocketName, extAuthzHTTPSocketName})
+	require.NoError(t, err)
+	if assert.Len(t, listeners, 3) {
+		assert.Equal(t, proxyAddress, listeners[proxySocketName].Addr().String())
+		assert.Equal(t, authzAddress, listeners[extAuthzSocketName].Addr().String())
+		assert.Equal(t, authzHTTPAddress, listeners[extAuthzHTTPSocketName].Addr().String())
+		for _, x := range listeners {
+			x.Close()
+		}
+	}
+
+	first, _ := newFakeSocketFile(t)
+	second, _ := newFakeSocketFile(t)
+	_, err = createActivatedListeners([]*os.File{first, second}, nil)
+	assert.Error(t, err)
+}
+
+func TestActivatedListenerServes(t *testing.T) {
+	file, address := newFakeSocketFile(t)
+	listeners, err := createActivatedListeners([]*os.File{file}, nil)
+	require.NoError(t, err)
+	listener := listeners[proxySocketName]
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Write([]byte("activated"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	content := make([]byte, 9)
+	_, err = conn.Read(content)
+	assert.NoError(t, err)
+	assert.Equal(t, "activated", string(content))
+}
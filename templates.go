@@ -0,0 +1,141 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin/render"
+)
+
+//
+// templateRender renders the custom templates, permitting them to be replaced while serving
+//
+type templateRender struct {
+	sync.RWMutex
+	// the template files
+	files []string
+	// the parsed templates
+	template *template.Template
+	// the modification time of the files when last parsed
+	modified map[string]time.Time
+}
+
+//
+// newTemplateRender parses the template files
+//
+func newTemplateRender(files []string) (*templateRender, error) {
+	r := &templateRender{files: files}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Instance returns the renderer of the named template
+func (r *templateRender) Instance(name string, data interface{}) render.Render {
+	r.RLock()
+	defer r.RUnlock()
+
+	return render.HTML{
+		Template: r.template,
+		Name:     name,
+		Data:     data,
+	}
+}
+
+//
+// reload parses the template files if any have changed since last parsed, the previous templates are kept if
+// the files fail validation
+//
+func (r *templateRender) reload() (bool, error) {
+	modified := make(map[string]time.Time, 0)
+	changed := false
+	for _, x := range r.files {
+		stat, err := os.Stat(x)
+		if err != nil {
+			return false, err
+		}
+		modified[x] = stat.ModTime()
+		if !stat.ModTime().Equal(r.modified[x]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	tmpl, err := parseTemplates(r.files)
+	if err != nil {
+		return false, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.template = tmpl
+	r.modified = modified
+
+	return true, nil
+}
+
+//
+// watch reloads the templates on the interval when the files have changed, until done is closed
+//
+func (r *templateRender) watch(done <-chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		reloaded, err := r.reload()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to reload the custom templates, keeping the previous version")
+			continue
+		}
+		if reloaded {
+			log.Infof("reloaded the custom templates")
+		}
+	}
+}
+
+//
+// parseTemplates parses the template files and checks each will render
+//
+func parseTemplates(files []string) (*template.Template, error) {
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range files {
+		name := path.Base(x)
+		if err := tmpl.ExecuteTemplate(ioutil.Discard, name, make(map[string]interface{}, 0)); err != nil {
+			return nil, fmt.Errorf("the template: %s failed to render, error: %s", name, err)
+		}
+	}
+
+	return tmpl, nil
+}
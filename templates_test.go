@@ -0,0 +1,121 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFakeTemplate(t *testing.T, filename, content string, modified time.Time) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write the template, error: %s", err)
+	}
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatalf("unable to change the modification time, error: %s", err)
+	}
+}
+
+func renderFakeTemplate(t *testing.T, templates *templateRender, name string) string {
+	recorder := httptest.NewRecorder()
+	if err := templates.Instance(name, map[string]interface{}{"title": "Sign In"}).Render(recorder); err != nil {
+		t.Fatalf("unable to render the template, error: %s", err)
+	}
+
+	return recorder.Body.String()
+}
+
+func TestTemplateRenderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("unable to create the temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "sign_in.html.tmpl")
+	modified := time.Now().Add(-time.Hour)
+
+	writeFakeTemplate(t, filename, "<h1>{{ .title }}</h1>", modified)
+	templates, err := newTemplateRender([]string{filename})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "<h1>Sign In</h1>", renderFakeTemplate(t, templates, "sign_in.html.tmpl"))
+
+	// step: the templates are not parsed again unless the files have changed
+	reloaded, err := templates.reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// step: a change to the file is picked up
+	modified = modified.Add(time.Minute)
+	writeFakeTemplate(t, filename, "<h2>{{ .title }}</h2>", modified)
+	reloaded, err = templates.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "<h2>Sign In</h2>", renderFakeTemplate(t, templates, "sign_in.html.tmpl"))
+
+	// step: an invalid template is refused, keeping the previous version
+	modified = modified.Add(time.Minute)
+	writeFakeTemplate(t, filename, "<h2>{{ .title </h2>", modified)
+	reloaded, err = templates.reload()
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "<h2>Sign In</h2>", renderFakeTemplate(t, templates, "sign_in.html.tmpl"))
+
+	// step: a removed file is refused, keeping the previous version
+	os.Remove(filename)
+	_, err = templates.reload()
+	assert.Error(t, err)
+	assert.Equal(t, "<h2>Sign In</h2>", renderFakeTemplate(t, templates, "sign_in.html.tmpl"))
+}
+
+func TestNewTemplateRenderInvalid(t *testing.T) {
+	file, err := ioutil.TempFile("", "template")
+	if err != nil {
+		t.Fatalf("unable to create the temporary file, error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{{ template "missing" }}`)
+	file.Close()
+
+	_, err = newTemplateRender([]string{file.Name()})
+	assert.Error(t, err)
+
+	_, err = newTemplateRender([]string{"/does/not/exist.html.tmpl"})
+	assert.Error(t, err)
+}
+
+func TestTemplateRenderWatchStops(t *testing.T) {
+	templates := &templateRender{}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		templates.watch(done, time.Hour)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("the template watch should have stopped")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// umaGrantType is the grant type requesting the permissions of the keycloak authorization services
+const umaGrantType = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+//
+// umaDecisionKey is the key of the cached decision, the digest of the access token and permissions
+//
+func umaDecisionKey(token string, permissions []string) string {
+	hash := sha256.Sum256([]byte(token + "|" + strings.Join(permissions, ",")))
+
+	return "uma|" + hex.EncodeToString(hash[:])
+}
+
+//
+// requestUMADecision asks the token endpoint if the permissions, resource#scope, are granted to the access
+// token by the policies of the keycloak authorization services; a 401 or 403 is a denial
+//
+func requestUMADecision(client *http.Client, endpoint *url.URL, audience, token string, permissions []string) (bool, error) {
+	if client == nil {
+		return false, fmt.Errorf("there is no client for the token endpoint")
+	}
+	if endpoint == nil {
+		return false, fmt.Errorf("the provider does not have a token endpoint")
+	}
+	values := url.Values{}
+	values.Set("grant_type", umaGrantType)
+	values.Set("audience", audience)
+	values.Set("response_mode", "decision")
+	for _, x := range permissions {
+		values.Add("permission", x)
+	}
+
+	req, err := http.NewRequest("POST", endpoint.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(authorizationHeader, "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var decision struct {
+			Result bool `json:"result"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+			return false, fmt.Errorf("invalid response from the token endpoint, error: %s", err)
+		}
+		return decision.Result, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("the token endpoint returned status: %d", resp.StatusCode)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeUMAServer(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		req.ParseForm()
+		if req.PostForm.Get("grant_type") != umaGrantType || req.PostForm.Get("response_mode") != "decision" ||
+			req.PostForm.Get("audience") != fakeClientID || req.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, x := range req.PostForm["permission"] {
+			if x != "orders#read" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error":"access_denied","error_description":"not_authorized"}`))
+				return
+			}
+		}
+		w.Write([]byte(`{"result":true}`))
+	}))
+}
+
+func TestRequestUMADecision(t *testing.T) {
+	var calls int32
+	server := newFakeUMAServer(t, &calls)
+	defer server.Close()
+	endpoint, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		Permissions []string
+		Audience    string
+		Expected    bool
+		Error       bool
+	}{
+		{Permissions: []string{"orders#read"}, Audience: fakeClientID, Expected: true},
+		{Permissions: []string{"orders#read", "orders#write"}, Audience: fakeClientID},
+		{Permissions: []string{"orders#read"}, Audience: "other", Error: true},
+	}
+	for i, c := range tests {
+		permitted, err := requestUMADecision(http.DefaultClient, endpoint, c.Audience, "token", c.Permissions)
+		if c.Error {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, permitted, "case %d", i)
+	}
+
+	_, err := requestUMADecision(http.DefaultClient, nil, fakeClientID, "token", []string{"orders#read"})
+	assert.Error(t, err)
+}
+
+func TestUMARequiresFeature(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.Listen = ":8080"
+	config.Upstream = "http://127.0.0.1:8081"
+	config.Resources = []*Resource{{URL: "/orders", Methods: []string{"GET"}, UMAPermissions: []string{"orders#read"}}}
+	assert.Error(t, config.isValid())
+
+	config.Features = map[string]bool{featureUMA: true}
+	assert.NoError(t, config.isValid())
+}
+
+func TestAdmissionHandlerUMA(t *testing.T) {
+	var calls int32
+	server := newFakeUMAServer(t, &calls)
+	defer server.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:            "/orders",
+			Methods:        []string{"ANY"},
+			UMAPermissions: []string{"orders#read"},
+		},
+		{
+			URL:            "/invoices",
+			Methods:        []string{"ANY"},
+			UMAPermissions: []string{"invoices#read"},
+		},
+	})
+	proxy.config.NoRedirects = true
+	proxy.config.Features = map[string]bool{featureUMA: true}
+	proxy.config.UMACacheTTL = time.Duration(1) * time.Minute
+	proxy.provider.TokenEndpoint, _ = url.Parse(server.URL)
+	proxy.createEndpoints()
+
+	token := newFakeBearerToken(t)
+	tests := []struct {
+		URI    string
+		Denied bool
+	}{
+		{URI: "/orders"},
+		{URI: "/orders"},
+		{URI: "/invoices", Denied: true},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", c.URI)
+		req.Header.Set("Authorization", "Bearer "+token.Encode())
+		recorder := httptest.NewRecorder()
+		proxy.router.ServeHTTP(recorder, req)
+		if !c.Denied {
+			assert.NotEqual(t, http.StatusForbidden, recorder.Code, "case %d", i)
+			continue
+		}
+		assert.Equal(t, http.StatusForbidden, recorder.Code, "case %d", i)
+	}
+	// step: the second request to /orders was served from the cache
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
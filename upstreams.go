@@ -0,0 +1,193 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// errUpstreamRedirect is returned to stop the health check following a redirect
+var errUpstreamRedirect = errors.New("the health check does not follow redirects")
+
+//
+// upstreamPool balances the requests across the healthy upstream endpoints
+//
+type upstreamPool struct {
+	sync.RWMutex
+	// the upstream endpoints
+	endpoints []*url.URL
+	// the health of the endpoints
+	healthy []bool
+	// the next endpoint in the rotation
+	next int
+}
+
+//
+// newUpstreamPool creates a pool of upstream endpoints, all of which are initially healthy
+//
+func newUpstreamPool(endpoints []*url.URL) *upstreamPool {
+	pool := &upstreamPool{
+		endpoints: endpoints,
+		healthy:   make([]bool, len(endpoints)),
+	}
+	for i, x := range endpoints {
+		pool.healthy[i] = true
+		upstreamHealthMetric.WithLabelValues(x.Host).Set(1)
+	}
+
+	return pool
+}
+
+//
+// pick returns the next healthy endpoint in the rotation, if none are healthy the requests are spread across
+// them all rather than refused
+//
+func (r *upstreamPool) pick() *url.URL {
+	r.Lock()
+	defer r.Unlock()
+	for i := 0; i < len(r.endpoints); i++ {
+		index := (r.next + i) % len(r.endpoints)
+		if r.healthy[index] {
+			r.next = index + 1
+			return r.endpoints[index]
+		}
+	}
+	endpoint := r.endpoints[r.next%len(r.endpoints)]
+	r.next++
+
+	return endpoint
+}
+
+//
+// setHealth updates the health of the endpoint
+//
+func (r *upstreamPool) setHealth(index int, healthy bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.healthy[index] != healthy {
+		log.WithFields(log.Fields{
+			"upstream": r.endpoints[index].String(),
+			"healthy":  healthy,
+		}).Warnf("the health of the upstream endpoint has changed")
+	}
+	r.healthy[index] = healthy
+
+	value := float64(0)
+	if healthy {
+		value = 1
+	}
+	upstreamHealthMetric.WithLabelValues(r.endpoints[index].Host).Set(value)
+}
+
+//
+// isHealthy checks if the endpoint is healthy
+//
+func (r *upstreamPool) isHealthy(index int) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.healthy[index]
+}
+
+//
+// checkUpstreams checks the health of the upstream endpoints, via a tcp connection or a http request to the path
+//
+func (r *oauthProxy) checkUpstreams(client *http.Client) {
+	var wg sync.WaitGroup
+	for i, x := range r.upstreams.endpoints {
+		wg.Add(1)
+		go func(index int, endpoint *url.URL) {
+			defer wg.Done()
+			err := checkUpstream(client, endpoint, r.config.UpstreamHealthCheck, r.config.UpstreamTimeout)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"upstream": endpoint.String(),
+					"error":    err.Error(),
+				}).Debugf("the upstream endpoint failed the health check")
+			}
+			r.upstreams.setHealth(index, err == nil)
+		}(i, x)
+	}
+	wg.Wait()
+}
+
+//
+// runUpstreamHealthChecks checks the health of the upstream endpoints on the interval, until done is closed
+//
+func (r *oauthProxy) runUpstreamHealthChecks(done <-chan struct{}) {
+	tlsConfig, err := createUpstreamTLSConfig(r.config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("unable to create the tls config for the upstream health checks")
+		return
+	}
+	client := &http.Client{
+		Timeout:   r.config.UpstreamTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		// step: a redirect is a healthy response, we don't follow it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errUpstreamRedirect
+		},
+	}
+
+	for {
+		r.checkUpstreams(client)
+		select {
+		case <-done:
+			return
+		case <-time.After(r.config.UpstreamHealthInterval):
+		}
+	}
+}
+
+//
+// checkUpstream checks the health of the endpoint, a tcp connection unless the check is a http path
+//
+func checkUpstream(client *http.Client, endpoint *url.URL, check string, timeout time.Duration) error {
+	if check == "" || check == "tcp" {
+		conn, err := net.DialTimeout("tcp", dialAddress(endpoint), timeout)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	location := *endpoint
+	location.Path = check
+	resp, err := client.Get(location.String())
+	if err != nil {
+		if e, ok := err.(*url.Error); ok && e.Err == errUpstreamRedirect {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("the health check returned status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
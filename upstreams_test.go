@@ -0,0 +1,149 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamPoolPick(t *testing.T) {
+	var endpoints []*url.URL
+	for _, x := range []string{"http://127.0.0.1:81", "http://127.0.0.1:82", "http://127.0.0.1:83"} {
+		endpoint, _ := url.Parse(x)
+		endpoints = append(endpoints, endpoint)
+	}
+	pool := newUpstreamPool(endpoints)
+	assert.Equal(t, endpoints[0], pool.pick())
+	assert.Equal(t, endpoints[1], pool.pick())
+	assert.Equal(t, endpoints[2], pool.pick())
+	assert.Equal(t, endpoints[0], pool.pick())
+
+	// step: the unhealthy endpoint is removed from the rotation
+	pool.setHealth(1, false)
+	assert.False(t, pool.isHealthy(1))
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(t, endpoints[1], pool.pick())
+	}
+
+	// step: with none healthy the requests are spread across them all
+	pool.setHealth(0, false)
+	pool.setHealth(2, false)
+	picked := make(map[string]bool, 0)
+	for i := 0; i < 3; i++ {
+		picked[pool.pick().Host] = true
+	}
+	assert.Len(t, picked, 3)
+}
+
+func TestCheckUpstream(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/redirect":
+			http.Redirect(w, req, "/login", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer service.Close()
+	endpoint, _ := url.Parse(service.URL)
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errUpstreamRedirect
+		},
+	}
+	timeout := time.Duration(1) * time.Second
+
+	assert.NoError(t, checkUpstream(client, endpoint, "tcp", timeout))
+	assert.NoError(t, checkUpstream(client, endpoint, "/health", timeout))
+	assert.NoError(t, checkUpstream(client, endpoint, "/redirect", timeout))
+	assert.Error(t, checkUpstream(client, endpoint, "/unavailable", timeout))
+
+	// step: a closed port fails the tcp check
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed, _ := url.Parse("http://" + listener.Addr().String())
+	listener.Close()
+	assert.Error(t, checkUpstream(client, closed, "tcp", timeout))
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("healthy"))
+	}))
+	defer healthy.Close()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	unhealthy := "http://" + listener.Addr().String()
+	listener.Close()
+
+	proxy := newFakeKeycloakProxyWithResources(t, []*Resource{
+		{
+			URL:         "/",
+			WhiteListed: true,
+			Methods:     []string{"ANY"},
+		},
+	})
+	proxy.config.UpstreamHealthCheck = "tcp"
+	proxy.config.UpstreamTimeout = time.Duration(1) * time.Second
+	proxy.endpoint, _ = url.Parse(unhealthy)
+	endpoint, _ := url.Parse(healthy.URL)
+	proxy.upstreams = newUpstreamPool([]*url.URL{proxy.endpoint, endpoint})
+	if err := proxy.createUpstreamProxy(proxy.endpoint); !assert.NoError(t, err) {
+		return
+	}
+	proxy.createEndpoints()
+	proxy.checkUpstreams(http.DefaultClient)
+	assert.False(t, proxy.upstreams.isHealthy(0))
+	assert.True(t, proxy.upstreams.isHealthy(1))
+
+	location := httptest.NewServer(proxy.router).URL
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(location + "/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestRunUpstreamHealthChecksStops(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	endpoint, _ := url.Parse("http://" + listener.Addr().String())
+	listener.Close()
+	proxy := &oauthProxy{
+		config:    &Config{UpstreamHealthInterval: time.Hour, UpstreamTimeout: time.Second},
+		upstreams: newUpstreamPool([]*url.URL{endpoint}),
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		proxy.runUpstreamHealthChecks(done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Errorf("the upstream health checks should have stopped")
+	}
+}
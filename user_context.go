@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
 	"strings"
 	"time"
@@ -40,30 +41,51 @@ type userContext struct {
 	expiresAt time.Time
 	// a set of roles associated
 	roles []string
-	// the audience for the token
-	audience string
+	// the audiences of the token
+	audiences []string
+	// the authorized party (azp), the client the token was issued to
+	authorizedParty string
 	// the access token itself
 	token jose.JWT
 	// the claims associated to the token
 	claims jose.Claims
 	// whether the context is from a session cookie or authorization header
 	bearerToken bool
+	// whether the context is from a verified client certificate
+	certificate bool
+	// whether the context is from a pre-shared api key
+	apiKey bool
+	// the name of the secondary authenticator which verified the credentials, if any
+	authenticator string
+	// whether the context is from a signed temporary url
+	signedURL bool
+	// whether the token is a service account (client credentials) token
+	serviceAccount bool
 }
 
 //
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
 //
-func extractIdentity(token jose.JWT) (*userContext, error) {
+func extractIdentity(token jose.JWT, rewriter *roleRewriter) (*userContext, error) {
 	// step: decode the claims from the tokens
 	claims, err := token.Claims()
 	if err != nil {
 		return nil, err
 	}
 
-	// step: extract the identity
+	// step: check if this is a service account (client credentials) token
+	clientID, isService := getServiceAccountClient(claims)
+
+	// step: extract the identity, service account tokens may not have a subject
 	identity, err := oidc.IdentityFromClaims(claims)
 	if err != nil {
-		return nil, err
+		if !isService {
+			return nil, err
+		}
+		identity = &oidc.Identity{ID: clientID}
+		if expires, found, err := claims.TimeClaim("exp"); err == nil && found {
+			identity.ExpiresAt = expires
+		}
 	}
 
 	// step: ensure we have and can extract the preferred name of the user, if not, we set to the ID
@@ -71,12 +93,18 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	if err != nil || !found {
 		// choice: set the preferredName to the Email if claim not found
 		preferredName = identity.Email
+		if isService {
+			preferredName = clientID
+		}
 	}
 
-	// step: retrieve the audience from access token
-	audience, found, err := claims.StringClaim(claimAudience)
-	if err != nil || !found {
-		return nil, ErrNoTokenAudience
+	// step: retrieve the audiences from access token, service accounts fall back to the client
+	audiences, found := getAudiences(claims)
+	if !found {
+		if !isService {
+			return nil, ErrNoTokenAudience
+		}
+		audiences = []string{clientID}
 	}
 	var list []string
 
@@ -102,29 +130,106 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 	}
 
 	return &userContext{
-		id:            identity.ID,
-		name:          preferredName,
-		audience:      audience,
-		preferredName: preferredName,
-		email:         identity.Email,
-		expiresAt:     identity.ExpiresAt,
-		roles:         list,
-		token:         token,
-		claims:        claims,
+		id:              identity.ID,
+		name:            preferredName,
+		audiences:       audiences,
+		authorizedParty: getAuthorizedParty(claims),
+		preferredName:   preferredName,
+		email:           identity.Email,
+		expiresAt:       identity.ExpiresAt,
+		roles:           rewriter.rewrite(list),
+		token:           token,
+		claims:          claims,
+		serviceAccount:  isService,
 	}, nil
 }
 
+//
+// getServiceAccountClient checks if the claims are from a service account token, returning the client
+//
+func getServiceAccountClient(claims jose.Claims) (string, bool) {
+	if client, found, err := claims.StringClaim(claimClientID); err == nil && found && client != "" {
+		return client, true
+	}
+	// step: older tokens only have the authorized party and the service account username
+	name, _, _ := claims.StringClaim(claimPreferredName)
+	if client, found, err := claims.StringClaim(claimAuthorizedParty); err == nil && found && strings.HasPrefix(name, "service-account-") {
+		return client, true
+	}
+
+	return "", false
+}
+
+//
+// extractCertificateIdentity constructs the identity from a verified client certificate; the common name is
+// the subject and the organizational units are the roles
+//
+func extractCertificateIdentity(cert *x509.Certificate) *userContext {
+	var email string
+	if len(cert.EmailAddresses) > 0 {
+		email = cert.EmailAddresses[0]
+	}
+	name := cert.Subject.CommonName
+
+	return &userContext{
+		id:            name,
+		name:          name,
+		preferredName: name,
+		email:         email,
+		expiresAt:     cert.NotAfter,
+		roles:         cert.Subject.OrganizationalUnit,
+		claims: jose.Claims{
+			"sub":              name,
+			"email":            email,
+			claimPreferredName: name,
+		},
+		certificate: true,
+	}
+}
+
 //
 // isAudience checks the audience
 //
 func (r userContext) isAudience(aud string) bool {
-	if r.audience == aud {
-		return true
+	return containedIn(aud, r.audiences)
+}
+
+//
+// hasAnyAudience checks the token was issued to any of the audiences
+//
+func (r userContext) hasAnyAudience(audiences []string) bool {
+	for _, x := range audiences {
+		if r.isAudience(x) {
+			return true
+		}
 	}
 
 	return false
 }
 
+//
+// getAuthorizedParty retrieves the authorized party of the claims, if any
+//
+func getAuthorizedParty(claims jose.Claims) string {
+	party, _, _ := claims.StringClaim(claimAuthorizedParty)
+
+	return party
+}
+
+//
+// getAudiences retrieves the audiences of the claims, the aud claim is either a string or an array of strings
+//
+func getAudiences(claims jose.Claims) ([]string, bool) {
+	if audience, found, err := claims.StringClaim(claimAudience); err == nil && found {
+		return []string{audience}, true
+	}
+	if audiences, found, err := claims.StringsClaim(claimAudience); err == nil && found && len(audiences) > 0 {
+		return audiences, true
+	}
+
+	return nil, false
+}
+
 //
 // getRoles returns a list of roles
 //
@@ -132,6 +237,33 @@ func (r userContext) getRoles() string {
 	return strings.Join(r.roles, ",")
 }
 
+//
+// hasScopes checks the token was granted all the scopes, either in the space separated scope claim or the scp list
+//
+func (r userContext) hasScopes(required []string) bool {
+	var granted []string
+	if scope, found, err := r.claims.StringClaim("scope"); err == nil && found {
+		granted = strings.Fields(scope)
+	} else if scopes, found, err := r.claims.StringsClaim("scp"); err == nil && found {
+		granted = scopes
+	}
+	for _, x := range required {
+		if !containedIn(x, granted) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+// isOffline checks if the session was granted an offline refresh token, the user asked to be remembered or offline
+// tokens are requested for all the sessions
+//
+func (r userContext) isOffline() bool {
+	return !r.bearerToken && r.hasScopes([]string{offlineAccessScope})
+}
+
 //
 // isExpired checks if the token has expired
 //
@@ -139,6 +271,19 @@ func (r userContext) isExpired() bool {
 	return r.expiresAt.Before(time.Now())
 }
 
+//
+// isAuthenticatedWithin checks if the user authenticated (auth_time) within the age; the refreshed tokens are issued
+// anew, so the issued time says nothing of the authentication. A token without an authentication time is not
+//
+func (r userContext) isAuthenticatedWithin(age time.Duration, now time.Time) bool {
+	authenticated, found, err := r.claims.TimeClaim(claimAuthTime)
+	if err != nil || !found {
+		return false
+	}
+
+	return now.Sub(authenticated) <= age
+}
+
 //
 // isBearerToken checks if the token
 //
@@ -146,6 +291,56 @@ func (r userContext) isBearer() bool {
 	return r.bearerToken
 }
 
+//
+// isCertificate checks if the identity came from a client certificate
+//
+func (r userContext) isCertificate() bool {
+	return r.certificate
+}
+
+//
+// isAPIKey checks if the identity came from an api key
+//
+func (r userContext) isAPIKey() bool {
+	return r.apiKey
+}
+
+//
+// isAuthenticator checks if the identity came from a secondary authenticator
+//
+func (r userContext) isAuthenticator() bool {
+	return r.authenticator != ""
+}
+
+//
+// isSignedURL checks if the identity came from a signed temporary url
+//
+func (r userContext) isSignedURL() bool {
+	return r.signedURL
+}
+
+//
+// hasToken checks if the identity holds an access token, a certificate, api key, authenticator or signed url
+// identity does not
+//
+func (r userContext) hasToken() bool {
+	return !r.isCertificate() && !r.isAPIKey() && !r.isAuthenticator() && !r.isSignedURL()
+}
+
+//
+// isCookieSession checks if the identity came from the session cookie, rather than a credential of the request
+//
+func (r userContext) isCookieSession() bool {
+	return r.hasToken() && !r.isBearer()
+}
+
+//
+// isServiceAccount checks if the identity is a service account
+//
+func (r userContext) isServiceAccount() bool {
+	return r.serviceAccount
+}
+
 //
 // String returns a string representation of the user context
 //
@@ -16,6 +16,8 @@ limitations under the License.
 package main
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"reflect"
 	"testing"
 	"time"
@@ -106,7 +108,7 @@ func getFakeRealmAccessToken(t *testing.T) jose.JWT {
 
 func TestIsAudience(t *testing.T) {
 	user := &userContext{
-		audience: "test",
+		audiences: []string{"test"},
 	}
 	if !user.isAudience("test") {
 		t.Errorf("return should not have been false")
@@ -116,6 +118,38 @@ func TestIsAudience(t *testing.T) {
 	}
 }
 
+func TestHasAnyAudience(t *testing.T) {
+	user := &userContext{
+		audiences: []string{"account", "billing"},
+	}
+	assert.True(t, user.hasAnyAudience([]string{"test", "billing"}))
+	assert.False(t, user.hasAnyAudience([]string{"test"}))
+	assert.False(t, user.hasAnyAudience(nil))
+}
+
+func TestGetAudiences(t *testing.T) {
+	cs := []struct {
+		Audience interface{}
+		Expected []string
+		Ok       bool
+	}{
+		{Audience: "test", Expected: []string{"test"}, Ok: true},
+		{Audience: []interface{}{"account", "test"}, Expected: []string{"account", "test"}, Ok: true},
+		{Audience: []interface{}{}},
+		{Audience: 10},
+		{},
+	}
+	for i, c := range cs {
+		claims := jose.Claims{}
+		if c.Audience != nil {
+			claims["aud"] = c.Audience
+		}
+		audiences, found := getAudiences(claims)
+		assert.Equal(t, c.Ok, found, "case %d", i)
+		assert.Equal(t, c.Expected, audiences, "case %d", i)
+	}
+}
+
 func TestGetUserRoles(t *testing.T) {
 	user := &userContext{
 		roles: []string{"1", "2", "3"},
@@ -146,8 +180,83 @@ func TestIsBearerToken(t *testing.T) {
 	}
 }
 
+func TestExtractCertificateIdentity(t *testing.T) {
+	expires := time.Now().Add(time.Duration(1) * time.Hour)
+	user := extractCertificateIdentity(&x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "billing-service",
+			OrganizationalUnit: []string{"billing", "admin"},
+		},
+		EmailAddresses: []string{"billing@example.com"},
+		NotAfter:       expires,
+	})
+	assert.True(t, user.isCertificate())
+	assert.Equal(t, "billing-service", user.id)
+	assert.Equal(t, "billing-service", user.name)
+	assert.Equal(t, "billing@example.com", user.email)
+	assert.Equal(t, []string{"billing", "admin"}, user.roles)
+	assert.Equal(t, expires, user.expiresAt)
+	assert.Equal(t, "billing-service", user.claims["sub"])
+}
+
+func TestGetServiceAccountContext(t *testing.T) {
+	cs := []struct {
+		Claims   jose.Claims
+		ID       string
+		Name     string
+		Audience string
+		Ok       bool
+	}{
+		{
+			Claims: jose.Claims{
+				"clientId": "billing",
+				"azp":      "billing",
+				"exp":      time.Now().Add(time.Hour).Unix(),
+				"resource_access": map[string]interface{}{
+					"billing": map[string]interface{}{"roles": []interface{}{"uma_protection"}},
+				},
+			},
+			ID:       "billing",
+			Name:     "billing",
+			Audience: "billing",
+			Ok:       true,
+		},
+		{
+			Claims: jose.Claims{
+				"sub":                "c7d2e4b6-8e01-4ab5-9d8b-2f6a4c1b0f3e",
+				"azp":                "billing",
+				"preferred_username": "service-account-billing",
+			},
+			ID:       "c7d2e4b6-8e01-4ab5-9d8b-2f6a4c1b0f3e",
+			Name:     "service-account-billing",
+			Audience: "billing",
+			Ok:       true,
+		},
+		{
+			Claims: jose.Claims{
+				"sub": "c7d2e4b6-8e01-4ab5-9d8b-2f6a4c1b0f3e",
+				"azp": "billing",
+			},
+		},
+	}
+	for i, c := range cs {
+		user, err := extractIdentity(*newFakeJWTToken(t, c.Claims), nil)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		if !assert.NoError(t, err, "case %d should not have failed", i) {
+			continue
+		}
+		assert.True(t, user.isServiceAccount(), "case %d", i)
+		assert.Equal(t, c.ID, user.id, "case %d", i)
+		assert.Equal(t, c.Name, user.name, "case %d", i)
+		assert.Equal(t, []string{c.Audience}, user.audiences, "case %d", i)
+	}
+}
+
 func TestGetUserContext(t *testing.T) {
-	context, err := extractIdentity(newFakeAccessToken())
+	context, err := extractIdentity(newFakeAccessToken(), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -162,12 +271,12 @@ func TestGetUserContext(t *testing.T) {
 func BenchmarkExtractIdentity(b *testing.B) {
 	token := newFakeAccessToken()
 	for n := 0; n < b.N; n++ {
-		extractIdentity(token)
+		extractIdentity(token, nil)
 	}
 }
 
 func TestGetUserRealmRoleContext(t *testing.T) {
-	context, err := extractIdentity(getFakeRealmAccessToken(t))
+	context, err := extractIdentity(getFakeRealmAccessToken(t), nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -179,3 +288,32 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 	}
 
 }
+
+func TestIsAuthenticatedWithin(t *testing.T) {
+	now := time.Now()
+	user := &userContext{claims: jose.Claims{
+		"auth_time": now.Add(-time.Duration(10) * time.Minute).Unix(),
+		"iat":       now.Unix(),
+	}}
+	assert.True(t, user.isAuthenticatedWithin(time.Duration(15)*time.Minute, now))
+	// step: the token was issued now (i.e. refreshed), the authentication is still too old
+	assert.False(t, user.isAuthenticatedWithin(time.Duration(5)*time.Minute, now))
+	assert.False(t, (&userContext{claims: jose.Claims{"iat": now.Unix()}}).isAuthenticatedWithin(time.Hour, now))
+}
+
+func TestHasScopes(t *testing.T) {
+	tests := []struct {
+		Claims   jose.Claims
+		Required []string
+		Ok       bool
+	}{
+		{Claims: jose.Claims{"scope": "openid read:orders write:orders"}, Required: []string{"read:orders"}, Ok: true},
+		{Claims: jose.Claims{"scope": "openid read:orders"}, Required: []string{"read:orders", "write:orders"}},
+		{Claims: jose.Claims{"scp": []interface{}{"read:orders"}}, Required: []string{"read:orders"}, Ok: true},
+		{Claims: jose.Claims{}, Required: []string{"read:orders"}},
+		{Claims: jose.Claims{}, Ok: true},
+	}
+	for i, c := range tests {
+		assert.Equal(t, c.Ok, (&userContext{claims: c.Claims}).hasScopes(c.Required), "case %d", i)
+	}
+}
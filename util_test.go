@@ -17,14 +17,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -38,6 +47,117 @@ func TestCreateOpenIDClient(t *testing.T) {
 	assert.NotNil(t, client)
 }
 
+func TestDecodeRateLimitTier(t *testing.T) {
+	cs := []struct {
+		Tier  string
+		Name  string
+		Limit RateLimit
+		Ok    bool
+	}{
+		{Tier: "premium=50:100", Name: "premium", Limit: RateLimit{Rate: 50, Burst: 100}, Ok: true},
+		{Tier: "free=0.5", Name: "free", Limit: RateLimit{Rate: 0.5}, Ok: true},
+		{Tier: "free"},
+		{Tier: "=10"},
+		{Tier: "free=fast"},
+		{Tier: "free=10:many"},
+	}
+	for i, c := range cs {
+		name, limit, err := decodeRateLimitTier(c.Tier)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+		assert.Equal(t, c.Name, name, "case %d", i)
+		assert.Equal(t, c.Limit, limit, "case %d", i)
+	}
+}
+
+func TestDecodeCertificatePair(t *testing.T) {
+	pair, err := decodeCertificatePair("/etc/ssl/cert.pem:/etc/ssl/key.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, CertificatePair{Certificate: "/etc/ssl/cert.pem", PrivateKey: "/etc/ssl/key.pem"}, pair)
+
+	for _, x := range []string{"", "/etc/ssl/cert.pem", "/etc/ssl/cert.pem:", ":/etc/ssl/key.pem", "a:b:c"} {
+		_, err := decodeCertificatePair(x)
+		assert.Error(t, err, "pair: %s", x)
+	}
+}
+
+func TestDecodeCookieNames(t *testing.T) {
+	names, err := decodeCookieNames("old-access:old-state")
+	assert.NoError(t, err)
+	assert.Equal(t, CookieNames{Access: "old-access", Refresh: "old-state"}, names)
+	names, err = decodeCookieNames("old-access:")
+	assert.NoError(t, err)
+	assert.Equal(t, CookieNames{Access: "old-access"}, names)
+
+	for _, x := range []string{"", ":", "old-access", "a:b:c"} {
+		_, err := decodeCookieNames(x)
+		assert.Error(t, err, "names: %s", x)
+	}
+}
+
+func TestLoadCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{}
+	for _, hostname := range []string{"example.com", "example.org"} {
+		pair := newFakeCertificatePair(t, dir, hostname)
+		if cfg.TLSCertificate == "" {
+			cfg.TLSCertificate, cfg.TLSPrivateKey = pair.Certificate, pair.PrivateKey
+			continue
+		}
+		cfg.TLSCertificates = append(cfg.TLSCertificates, pair)
+	}
+
+	certificates, names, err := loadCertificates(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, certificates, 2)
+	assert.Len(t, names, 2)
+	assert.NotNil(t, names["example.com"])
+	assert.NotNil(t, names["example.org"])
+
+	cfg.TLSCertificates = append(cfg.TLSCertificates, CertificatePair{Certificate: "/does/not/exist", PrivateKey: "/does/not/exist"})
+	_, _, err = loadCertificates(cfg)
+	assert.Error(t, err)
+}
+
+func newFakeCertificatePair(t *testing.T, dir, hostname string) CertificatePair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate the private key, error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Duration(1) * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create the certificate, error: %s", err)
+	}
+	encoded, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to encode the private key, error: %s", err)
+	}
+
+	pair := CertificatePair{
+		Certificate: filepath.Join(dir, hostname+".pem"),
+		PrivateKey:  filepath.Join(dir, hostname+"-key.pem"),
+	}
+	ioutil.WriteFile(pair.Certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(pair.PrivateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}), 0600)
+
+	return pair
+}
+
 func TestDecodeKeyPairs(t *testing.T) {
 	testCases := []struct {
 		List     []string
@@ -199,6 +319,12 @@ func TestHasRoles(t *testing.T) {
 	}
 }
 
+func TestHasAnyRole(t *testing.T) {
+	assert.True(t, hasAnyRole([]string{"a", "d"}, []string{"a", "b", "c"}))
+	assert.False(t, hasAnyRole([]string{"d", "e"}, []string{"a", "b", "c"}))
+	assert.False(t, hasAnyRole([]string{"a"}, []string{}))
+}
+
 func TestContainedIn(t *testing.T) {
 	assert.False(t, containedIn("1", []string{"2", "3", "4"}))
 	assert.True(t, containedIn("1", []string{"1", "2", "3", "4"}))
@@ -216,6 +342,129 @@ func BenchmarkContainsSubString(t *testing.B) {
 	}
 }
 
+func TestApplyTLSOptions(t *testing.T) {
+	cs := []struct {
+		Config   *Config
+		Expected *tls.Config
+		Ok       bool
+	}{
+		{Config: &Config{}, Expected: &tls.Config{}, Ok: true},
+		{
+			Config: &Config{
+				TLSMinVersion:       "TLSv1.2",
+				TLSCipherSuites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_aes_256_gcm_sha384"},
+				TLSCurvePreferences: []string{"P384", "p256"},
+			},
+			Expected: &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+				CurvePreferences: []tls.CurveID{tls.CurveP384, tls.CurveP256},
+			},
+			Ok: true,
+		},
+		{Config: &Config{TLSMinVersion: "sslv3"}},
+		{Config: &Config{TLSCipherSuites: []string{"TLS_NOT_A_CIPHER"}}},
+		{Config: &Config{TLSCurvePreferences: []string{"P128"}}},
+	}
+	for i, c := range cs {
+		tlsConfig := &tls.Config{}
+		err := applyTLSOptions(c.Config, tlsConfig)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d should not have failed", i)
+		assert.Equal(t, c.Expected, tlsConfig, "case %d", i)
+	}
+}
+
+func TestCreateUpstreamTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	pair := newFakeCertificatePair(t, dir, "upstream.internal")
+
+	tlsConfig, err := createUpstreamTLSConfig(&Config{SkipUpstreamTLSVerify: true})
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.RootCAs)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	tlsConfig, err = createUpstreamTLSConfig(&Config{
+		UpstreamCA:                pair.Certificate,
+		UpstreamClientCertificate: pair.Certificate,
+		UpstreamClientPrivateKey:  pair.PrivateKey,
+	})
+	assert.NoError(t, err)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.Len(t, tlsConfig.RootCAs.Subjects(), 1)
+	assert.Len(t, tlsConfig.Certificates, 1)
+
+	_, err = createUpstreamTLSConfig(&Config{UpstreamCA: pair.PrivateKey})
+	assert.Error(t, err)
+	_, err = createUpstreamTLSConfig(&Config{UpstreamClientCertificate: pair.Certificate, UpstreamClientPrivateKey: pair.Certificate})
+	assert.Error(t, err)
+}
+
+func TestTryDialEndpointTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	server := newFakeCertificatePair(t, dir, "upstream.internal")
+	client := newFakeCertificatePair(t, dir, "proxy.internal")
+	certificate, err := tls.LoadX509KeyPair(server.Certificate, server.PrivateKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	peers := make(chan int, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			tlsConn.Handshake()
+			peers <- len(tlsConn.ConnectionState().PeerCertificates)
+			conn.Close()
+		}
+	}()
+	location := &url.URL{Scheme: "https", Host: listener.Addr().String()}
+
+	// step: the upstream certificate is not trusted without the ca
+	_, err = tryDialEndpoint(location, &tls.Config{ServerName: "upstream.internal"})
+	assert.Error(t, err)
+	<-peers
+
+	// step: the upstream ca and client certificate are used
+	tlsConfig, err := createUpstreamTLSConfig(&Config{
+		UpstreamCA:                server.Certificate,
+		UpstreamClientCertificate: client.Certificate,
+		UpstreamClientPrivateKey:  client.PrivateKey,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tlsConfig.ServerName = "upstream.internal"
+	conn, err := tryDialEndpoint(location, tlsConfig)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, 1, <-peers)
+}
+
 func TestCloneTLSConfig(t *testing.T) {
 	assert.NotNil(t, cloneTLSConfig(nil))
 	assert.NotNil(t, cloneTLSConfig(&tls.Config{}))
@@ -227,6 +476,17 @@ func TestDialAddress(t *testing.T) {
 	assert.Equal(t, dialAddress(getFakeURL("http://127.0.0.1:8080")), "127.0.0.1:8080")
 }
 
+func TestIsLoopbackListener(t *testing.T) {
+	assert.True(t, isLoopbackListener("127.0.0.1:3000"))
+	assert.True(t, isLoopbackListener("[::1]:3000"))
+	assert.True(t, isLoopbackListener("localhost:3000"))
+	assert.True(t, isLoopbackListener("unix:///var/run/proxy.sock"))
+	assert.False(t, isLoopbackListener(":3000"))
+	assert.False(t, isLoopbackListener("0.0.0.0:3000"))
+	assert.False(t, isLoopbackListener("10.0.0.1:3000"))
+	assert.False(t, isLoopbackListener("127.0.0.1"))
+}
+
 func TestIsUpgradedConnection(t *testing.T) {
 	header := http.Header{}
 	header.Add(headerUpgrade, "")
@@ -267,6 +527,10 @@ func TestToHeader(t *testing.T) {
 			Word:     "perferredname",
 			Expected: "Perferredname",
 		},
+		{
+			Word:     "resource_access.myapp.roles[0]",
+			Expected: "Resource-Access-Myapp-Roles-0",
+		},
 	}
 	for i, x := range cases {
 		assert.Equal(t, x.Expected, toHeader(x.Word), "case %d, expected: %s but got: %s",
@@ -331,3 +595,40 @@ func getFakeURL(location string) *url.URL {
 	u, _ := url.Parse(location)
 	return u
 }
+
+func TestGetClientAddress(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"127.0.0.0/8", "10.0.0.0/8"})
+	tests := []struct {
+		RemoteAddr string
+		Forwarded  []string
+		RealIP     string
+		Expected   string
+	}{
+		{RemoteAddr: "192.168.0.1:80", Forwarded: []string{"172.16.0.1"}},
+		{RemoteAddr: "127.0.0.1:80"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"172.16.0.1"}, Expected: "172.16.0.1"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"1.1.1.1, 172.16.0.1, 10.0.0.1"}, Expected: "172.16.0.1"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"1.1.1.1", "172.16.0.1"}, Expected: "172.16.0.1"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"10.0.0.2, 10.0.0.1"}, Expected: "10.0.0.2"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"bad, 172.16.0.1"}},
+		{RemoteAddr: "127.0.0.1:80", RealIP: "172.16.0.1", Expected: "172.16.0.1"},
+		{RemoteAddr: "127.0.0.1:80", Forwarded: []string{"172.16.0.2"}, RealIP: "172.16.0.1", Expected: "172.16.0.2"},
+		{RemoteAddr: "bad", Forwarded: []string{"172.16.0.1"}},
+	}
+	for i, c := range tests {
+		req := newFakeHTTPRequest("GET", "/")
+		req.RemoteAddr = c.RemoteAddr
+		req.Header["X-Forwarded-For"] = c.Forwarded
+		if c.RealIP != "" {
+			req.Header.Set("X-Real-IP", c.RealIP)
+		}
+		assert.Equal(t, c.Expected, getClientAddress(req, trusted), "case %d", i)
+	}
+}
+
+func TestGetRealmName(t *testing.T) {
+	assert.Equal(t, "commons", getRealmName("https://keycloak.example.com/auth/realms/commons"))
+	assert.Equal(t, "commons", getRealmName("https://keycloak.example.com/auth/realms/commons/"))
+	assert.Empty(t, getRealmName("https://accounts.example.com"))
+	assert.Empty(t, getRealmName("https://keycloak.example.com/auth/realms"))
+}
@@ -18,18 +18,23 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -45,8 +50,51 @@ import (
 var (
 	httpMethodRegex = regexp.MustCompile("^(ANY|GET|POST|DELETE|PATCH|HEAD|PUT|TRACE|CONNECT)$")
 	symbolsFilter   = regexp.MustCompilePOSIX("[_$><\\[\\].,\\+-/'%^&*()!\\\\]+")
+
+	// tlsVersions is a map of the tls versions by name
+	tlsVersions = map[string]uint16{
+		"tlsv1.0": tls.VersionTLS10,
+		"tlsv1.1": tls.VersionTLS11,
+		"tlsv1.2": tls.VersionTLS12,
+	}
+	// tlsCipherSuites is a map of the supported cipher suites by name
+	tlsCipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+	// tlsCurves is a map of the supported elliptic curves by name
+	tlsCurves = map[string]tls.CurveID{
+		"P256": tls.CurveP256,
+		"P384": tls.CurveP384,
+		"P521": tls.CurveP521,
+	}
 )
 
+//
+// signData generates the hmac (sha256) of the data with the key
+//
+func signData(data []byte, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
 //
 // encryptDataBlock encrypts the plaintext string with the key
 //
@@ -135,10 +183,16 @@ func createOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, error)
 	if strings.HasSuffix(cfg.DiscoveryURL, "/.well-known/openid-configuration") {
 		cfg.DiscoveryURL = strings.TrimSuffix(cfg.DiscoveryURL, "/.well-known/openid-configuration")
 	}
+	// step: create the http client for the identity provider
+	hc, err := createHTTPClient(cfg)
+	if err != nil {
+		return nil, oidc.ProviderConfig{}, err
+	}
+
 	// attempt to retrieve the provider configuration
 	for i := 0; i < 3; i++ {
 		log.Infof("attempting to retrieve the openid configuration from the discovery url: %s", cfg.DiscoveryURL)
-		providerConfig, err = oidc.FetchProviderConfig(http.DefaultClient, cfg.DiscoveryURL)
+		providerConfig, err = oidc.FetchProviderConfig(hc, cfg.DiscoveryURL)
 		if err == nil {
 			goto GOT_CONFIG
 		}
@@ -150,6 +204,7 @@ func createOpenIDClient(cfg *Config) (*oidc.Client, oidc.ProviderConfig, error)
 
 GOT_CONFIG:
 	client, err := oidc.NewClient(oidc.ClientConfig{
+		HTTPClient:     hc,
 		ProviderConfig: providerConfig,
 		Credentials: oidc.ClientCredentials{
 			ID:     cfg.ClientID,
@@ -186,6 +241,159 @@ func decodeKeyPairs(list []string) (map[string]string, error) {
 	return kp, nil
 }
 
+//
+// decodeRateLimitTier converts a tier (name=rate[:burst]) to the name and rate limit
+//
+func decodeRateLimitTier(tier string) (string, RateLimit, error) {
+	var limit RateLimit
+	items := strings.Split(tier, "=")
+	if len(items) != 2 || items[0] == "" {
+		return "", limit, fmt.Errorf("invalid rate limit tier '%s' should be tier=rate[:burst]", tier)
+	}
+	values := strings.SplitN(items[1], ":", 2)
+	rate, err := strconv.ParseFloat(values[0], 64)
+	if err != nil {
+		return "", limit, fmt.Errorf("invalid rate for tier '%s', error: %s", tier, err)
+	}
+	limit.Rate = rate
+	if len(values) == 2 {
+		if limit.Burst, err = strconv.Atoi(values[1]); err != nil {
+			return "", limit, fmt.Errorf("invalid burst for tier '%s', error: %s", tier, err)
+		}
+	}
+
+	return items[0], limit, nil
+}
+
+//
+// decodeCertificatePair converts a pair (cert:key) to the certificate and private key
+//
+func decodeCertificatePair(pair string) (CertificatePair, error) {
+	items := strings.Split(pair, ":")
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		return CertificatePair{}, fmt.Errorf("invalid certificate pair '%s' should be cert:key", pair)
+	}
+
+	return CertificatePair{Certificate: items[0], PrivateKey: items[1]}, nil
+}
+
+//
+// decodeCookieNames decodes the access and refresh cookie names, access:refresh
+//
+func decodeCookieNames(names string) (CookieNames, error) {
+	items := strings.Split(names, ":")
+	if len(items) != 2 || (items[0] == "" && items[1] == "") {
+		return CookieNames{}, fmt.Errorf("invalid cookie names '%s' should be access:refresh", names)
+	}
+
+	return CookieNames{Access: items[0], Refresh: items[1]}, nil
+}
+
+//
+// loadCertificates loads the default and additional certificates, the name mapping is built so the
+// certificate is selected from the server name (SNI) of the client, else the first is used
+//
+func loadCertificates(cfg *Config) ([]tls.Certificate, map[string]*tls.Certificate, error) {
+	var pairs []CertificatePair
+	if cfg.TLSCertificate != "" && cfg.TLSPrivateKey != "" {
+		pairs = append(pairs, CertificatePair{Certificate: cfg.TLSCertificate, PrivateKey: cfg.TLSPrivateKey})
+	}
+	pairs = append(pairs, cfg.TLSCertificates...)
+
+	config := &tls.Config{}
+	for _, x := range pairs {
+		certificate, err := tls.LoadX509KeyPair(x.Certificate, x.PrivateKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load the certificate: %s, error: %s", x.Certificate, err)
+		}
+		config.Certificates = append(config.Certificates, certificate)
+	}
+	config.BuildNameToCertificate()
+
+	return config.Certificates, config.NameToCertificate, nil
+}
+
+//
+// parseCIDRs parses a list of networks in cidr notation
+//
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, x := range list {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(x))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s', should be in cidr notation i.e. 10.0.0.0/8", x)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+//
+// getRealmName returns the name of the keycloak realm from the discovery url, i.e. /auth/realms/<name>
+//
+func getRealmName(discoveryURL string) string {
+	items := strings.Split(strings.Trim(discoveryURL, "/"), "/")
+	for i := 0; i < len(items)-1; i++ {
+		if items[i] == "realms" {
+			return items[i+1]
+		}
+	}
+
+	return ""
+}
+
+//
+// getClientAddress returns the address of the client from the forwarding headers, if the request came from a trusted
+// proxy; the X-Forwarded-For is walked from the right, skipping the trusted proxies, else the X-Real-IP is used
+//
+func getClientAddress(req *http.Request, trusted []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	if address := net.ParseIP(peer); address == nil || !containsAddress(trusted, address) {
+		return ""
+	}
+
+	var hops []net.IP
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, x := range strings.Split(header, ",") {
+			address := net.ParseIP(strings.TrimSpace(x))
+			if address == nil {
+				return ""
+			}
+			hops = append(hops, address)
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !containsAddress(trusted, hops[i]) {
+			return hops[i].String()
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0].String()
+	}
+	if address := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); address != nil {
+		return address.String()
+	}
+
+	return ""
+}
+
+//
+// containsAddress checks if the address is within any of the networks
+//
+func containsAddress(networks []*net.IPNet, address net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
 //
 // isValidMethod ensure this is a valid http method type
 //
@@ -223,6 +431,114 @@ func cloneTLSConfig(cfg *tls.Config) *tls.Config {
 	}
 }
 
+//
+// applyTLSOptions sets the minimum version, cipher suites and curve preferences from the config
+//
+func applyTLSOptions(cfg *Config, tlsConfig *tls.Config) error {
+	if cfg.TLSMinVersion != "" {
+		version, found := tlsVersions[strings.ToLower(cfg.TLSMinVersion)]
+		if !found {
+			return fmt.Errorf("invalid tls minimum version: %s, should be tlsv1.0, tlsv1.1 or tlsv1.2", cfg.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	for _, x := range cfg.TLSCipherSuites {
+		suite, found := tlsCipherSuites[strings.ToUpper(x)]
+		if !found {
+			return fmt.Errorf("unsupported tls cipher suite: %s", x)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+	}
+	for _, x := range cfg.TLSCurvePreferences {
+		curve, found := tlsCurves[strings.ToUpper(x)]
+		if !found {
+			return fmt.Errorf("unsupported tls curve: %s, should be P256, P384 or P521", x)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	return nil
+}
+
+//
+// createHTTPClient creates a http client for the identity provider, using the tls options from the config
+//
+func createHTTPClient(cfg *Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if err := applyTLSOptions(cfg, tlsConfig); err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: time.Duration(10) * time.Second,
+	}
+
+	// step: are we pinning the certificate of the identity provider? the pins are checked on the tls dial, which
+	// a http proxy would bypass, so the provider is dialed directly
+	if len(cfg.OpenIDProviderPins) > 0 {
+		pins, err := parseCertificatePins(cfg.OpenIDProviderPins)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = nil
+		transport.DialTLS = createPinnedDialer(tlsConfig, pins, transport.TLSHandshakeTimeout)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+//
+// createServiceHTTPClient creates a http client for the policy services i.e. the open policy agent, using the tls
+// options from the config and the timeout; the certificate pins of the identity provider are not applied
+//
+func createServiceHTTPClient(cfg *Config, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if err := applyTLSOptions(cfg, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: time.Duration(10) * time.Second,
+		},
+		Timeout: timeout,
+	}, nil
+}
+
+//
+// createUpstreamTLSConfig creates the tls configuration for the upstream, with the ca bundle and client certificate
+//
+func createUpstreamTLSConfig(cfg *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.SkipUpstreamTLSVerify,
+	}
+	if err := applyTLSOptions(cfg, tlsConfig); err != nil {
+		return nil, err
+	}
+	if cfg.UpstreamCA != "" {
+		content, err := ioutil.ReadFile(cfg.UpstreamCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("the upstream ca: %s does not contain any certificates", cfg.UpstreamCA)
+		}
+	}
+	if cfg.UpstreamClientCertificate != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.UpstreamClientCertificate, cfg.UpstreamClientPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the upstream client certificate, error: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
 //
 // fileExists check if a file exists
 //
@@ -236,6 +552,25 @@ func fileExists(filename string) bool {
 	return true
 }
 
+//
+// isLoopbackListener checks the listener is a unix socket or bound to a loopback interface
+//
+func isLoopbackListener(listen string) bool {
+	if strings.HasPrefix(listen, "unix://") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
 //
 // hasRoles checks the scopes are the same
 //
@@ -249,6 +584,19 @@ func hasRoles(required, issued []string) bool {
 	return true
 }
 
+//
+// hasAnyRole checks any of the required roles was issued
+//
+func hasAnyRole(required, issued []string) bool {
+	for _, role := range required {
+		if containedIn(role, issued) {
+			return true
+		}
+	}
+
+	return false
+}
+
 //
 // containedIn checks if a value in a list of a strings
 //
@@ -276,17 +624,16 @@ func containsSubString(value string, list []string) bool {
 }
 
 //
-// tryDialEndpoint dials the upstream endpoint via plain
+// tryDialEndpoint dials the upstream endpoint via plain, or tls with the tls configuration of the upstream
 //
-func tryDialEndpoint(location *url.URL) (net.Conn, error) {
+func tryDialEndpoint(location *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
 	switch dialAddress := dialAddress(location); location.Scheme {
 	case "http":
 		return net.Dial("tcp", dialAddress)
+	case "unix":
+		return net.Dial("unix", location.Path)
 	default:
-		return tls.Dial("tcp", dialAddress, &tls.Config{
-			Rand:               rand.Reader,
-			InsecureSkipVerify: true,
-		})
+		return tls.Dial("tcp", dialAddress, tlsConfig)
 	}
 }
 
@@ -317,9 +664,9 @@ func transferBytes(src io.Reader, dest io.Writer, wg *sync.WaitGroup) (int64, er
 //
 // tryUpdateConnection attempt to upgrade the connection to a http pdy stream
 //
-func tryUpdateConnection(cx *gin.Context, endpoint *url.URL) error {
+func tryUpdateConnection(cx *gin.Context, endpoint *url.URL, tlsConfig *tls.Config) error {
 	// step: dial the endpoint
-	tlsConn, err := tryDialEndpoint(endpoint)
+	tlsConn, err := tryDialEndpoint(endpoint, tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -385,7 +732,9 @@ func toHeader(v string) string {
 
 	// step: filter out any symbols and convert to dashes
 	for _, x := range symbolsFilter.Split(v, -1) {
-		list = append(list, capitalize(x))
+		if x != "" {
+			list = append(list, capitalize(x))
+		}
 	}
 
 	return strings.Join(list, "-")
@@ -0,0 +1,170 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/gambol99/go-oidc/oidc"
+)
+
+//
+// getValidateCommand returns the validate command, checking the configuration without starting the service
+//
+func getValidateCommand() cli.Command {
+	return cli.Command{
+		Name:      "validate",
+		Usage:     "validate the configuration and exit, non-zero when any problems are found",
+		UsageText: "keycloak-proxy validate [options]",
+		Flags: append(getOptions(), cli.BoolFlag{
+			Name:  "skip-discovery",
+			Usage: "skip checking the discovery url is reachable, i.e. when the provider is not accessible from the ci",
+		}),
+		Action: validateCommand,
+	}
+}
+
+//
+// validateCommand loads the configuration and prints the problems found
+//
+func validateCommand(cx *cli.Context) error {
+	config := newDefaultConfig()
+	if filename := cx.String("config"); filename != "" {
+		if err := readConfigFile(filename, config); err != nil {
+			return printError("unable to read the configuration file: %s, error: %s", filename, err.Error())
+		}
+	}
+	if err := readOptions(cx, config); err != nil {
+		return printError(err.Error())
+	}
+	if err := loadSecretFiles(config); err != nil {
+		return printError(err.Error())
+	}
+	if _, err := loadVaultSecrets(config); err != nil {
+		return printError(err.Error())
+	}
+
+	config.normalize()
+	problems := validateConfig(config, !cx.Bool("skip-discovery"))
+	for _, x := range problems {
+		fmt.Fprintf(os.Stderr, "[error] %s\n", x)
+	}
+	if len(problems) > 0 {
+		return printError("the configuration is invalid, %d problem(s) found", len(problems))
+	}
+	fmt.Fprintln(os.Stdout, "[ok] the configuration is valid")
+
+	return nil
+}
+
+//
+// validateConfig checks the configuration, returning all the problems found rather than the first
+//
+func validateConfig(config *Config, checkDiscovery bool) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	add := func(err error, format string, args ...interface{}) {
+		seen[err.Error()] = true
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// step: check each of the resources
+	for i, x := range config.Resources {
+		if err := x.IsValid(); err != nil {
+			add(err, "the resource %d (uri: %s) is invalid, %s", i+1, x.URL, err)
+		}
+	}
+	// step: check the claim matchers are valid expressions
+	for claim, match := range config.MatchClaims {
+		if _, err := regexp.Compile(match); err != nil {
+			add(fmt.Errorf("the claim matcher: %s for claim: %s is not a valid regex", match, claim),
+				"the claim matcher: %s for claim: %s is not a valid regex, %s", match, claim, err)
+		}
+	}
+	// step: check the length of the encryption key, regardless of the features using it
+	if config.EncryptionKey != "" && len(config.EncryptionKey) != 16 && len(config.EncryptionKey) != 32 {
+		err := fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(config.EncryptionKey))
+		add(err, "%s, i.e. generate one with: head -c 32 /dev/urandom | base64 | cut -c1-32", err)
+	}
+	// step: check the tls files can be loaded, rather than only exist
+	pairs := map[string]string{}
+	if config.TLSCertificate != "" && config.TLSPrivateKey != "" {
+		pairs[config.TLSCertificate] = config.TLSPrivateKey
+	}
+	for _, x := range config.TLSCertificates {
+		if x.Certificate != "" && x.PrivateKey != "" {
+			pairs[x.Certificate] = x.PrivateKey
+		}
+	}
+	authorities := []string{config.TLSCaCertificate, config.UpstreamCA}
+	for _, x := range config.Listeners {
+		if x.TLSCertificate != "" && x.TLSPrivateKey != "" {
+			pairs[x.TLSCertificate] = x.TLSPrivateKey
+		}
+		authorities = append(authorities, x.TLSCaCertificate)
+	}
+	for certificate, key := range pairs {
+		if !fileExists(certificate) || !fileExists(key) {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(certificate, key); err != nil {
+			add(err, "the tls certificate: %s and private key: %s cannot be loaded, %s", certificate, key, err)
+		}
+	}
+	for _, x := range authorities {
+		if x == "" || !fileExists(x) {
+			continue
+		}
+		if content, err := ioutil.ReadFile(x); err != nil {
+			add(err, "the ca certificate: %s cannot be read, %s", x, err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(content) {
+			add(fmt.Errorf("no certificates in %s", x), "the ca certificate: %s does not contain any pem encoded certificates", x)
+		}
+	}
+	// step: the remaining checks of the service, unless already reported
+	if err := config.isValid(); err != nil && !seen[err.Error()] {
+		problems = append(problems, err.Error())
+	}
+	// step: check the provider is reachable
+	if checkDiscovery && config.DiscoveryURL != "" && !config.SkipTokenVerification && !config.DevMode {
+		if err := checkDiscoveryURL(config); err != nil {
+			problems = append(problems, fmt.Sprintf("unable to retrieve the openid configuration from the discovery url: %s, %s, "+
+				"check the url (normally <server>/auth/realms/<realm>) and the provider is reachable", config.DiscoveryURL, err))
+		}
+	}
+
+	return problems
+}
+
+//
+// checkDiscoveryURL attempts once to retrieve the openid configuration of the provider
+//
+func checkDiscoveryURL(config *Config) error {
+	hc, err := createHTTPClient(config)
+	if err != nil {
+		return err
+	}
+	_, err = oidc.FetchProviderConfig(hc, strings.TrimSuffix(config.DiscoveryURL, "/.well-known/openid-configuration"))
+
+	return err
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeValidateConfig() *Config {
+	config := newFakeKeycloakConfig()
+	config.Listen = "127.0.0.1:3000"
+	config.Upstream = "http://127.0.0.1:8080"
+
+	return config
+}
+
+func hasProblem(problems []string, text string) bool {
+	for _, x := range problems {
+		if strings.Contains(x, text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert.Empty(t, validateConfig(newFakeValidateConfig(), true))
+}
+
+func TestValidateConfigProblems(t *testing.T) {
+	config := newFakeValidateConfig()
+	config.EncryptionKey = "short"
+	config.MatchClaims = map[string]string{"iss": "^(bad"}
+	config.Resources = append(config.Resources, &Resource{URL: "/api", Methods: []string{"BAD"}})
+
+	problems := validateConfig(config, false)
+	assert.Len(t, problems, 3, "problems: %v", problems)
+	assert.True(t, hasProblem(problems, "the resource 7 (uri: /api) is invalid, invalid method BAD"), "problems: %v", problems)
+	assert.True(t, hasProblem(problems, "the claim matcher: ^(bad for claim: iss"), "problems: %v", problems)
+	assert.True(t, hasProblem(problems, "the encryption key (5)"), "problems: %v", problems)
+}
+
+func TestValidateConfigTLSFiles(t *testing.T) {
+	file, err := ioutil.TempFile("", "validate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not a certificate")
+	file.Close()
+
+	config := newFakeValidateConfig()
+	config.TLSCertificate = file.Name()
+	config.TLSPrivateKey = file.Name()
+	config.TLSCaCertificate = file.Name()
+
+	problems := validateConfig(config, false)
+	assert.True(t, hasProblem(problems, "cannot be loaded"), "problems: %v", problems)
+	assert.True(t, hasProblem(problems, "does not contain any pem encoded certificates"), "problems: %v", problems)
+}
+
+func TestValidateConfigDiscovery(t *testing.T) {
+	config := newFakeValidateConfig()
+	config.SkipTokenVerification = false
+	config.DiscoveryURL = newFakeOAuthServer(t).getLocation()
+	assert.Empty(t, validateConfig(config, true))
+
+	config.DiscoveryURL = "http://127.0.0.1:1/auth/realms/missing"
+	assert.Empty(t, validateConfig(config, false))
+	problems := validateConfig(config, true)
+	assert.Len(t, problems, 1)
+	assert.True(t, hasProblem(problems, "unable to retrieve the openid configuration"), "problems: %v", problems)
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// vaultTokenHeader is the header carrying the vault token
+	vaultTokenHeader = "X-Vault-Token"
+	// vaultTimeout is the timeout of the requests to vault
+	vaultTimeout = time.Duration(10) * time.Second
+	// vaultRetryInterval is the interval a failed renewal is retried
+	vaultRetryInterval = time.Duration(10) * time.Second
+)
+
+//
+// vaultSecret is the response of vault to a read of a secret
+//
+type vaultSecret struct {
+	// the lease of the secret, if any
+	LeaseID string `json:"lease_id"`
+	// the duration of the lease in seconds
+	LeaseDuration int `json:"lease_duration"`
+	// whether the lease can be renewed
+	Renewable bool `json:"renewable"`
+	// the data of the secret
+	Data map[string]interface{} `json:"data"`
+	// the token of a token renewal
+	Auth *vaultAuth `json:"auth"`
+}
+
+//
+// vaultAuth is the token of a vault response
+//
+type vaultAuth struct {
+	// the duration of the token in seconds
+	LeaseDuration int `json:"lease_duration"`
+	// whether the token can be renewed
+	Renewable bool `json:"renewable"`
+}
+
+//
+// vaultClient retrieves the credentials of the service from vault and renews the leases
+//
+type vaultClient struct {
+	// the address of vault
+	location *url.URL
+	// the token used to authenticate to vault
+	token string
+	// the http client
+	client *http.Client
+	// the secrets read, keyed on the path
+	secrets map[string]*vaultSecret
+	// the certificate of the listener, if held in vault
+	certificate *tls.Certificate
+}
+
+//
+// newVaultClient creates the vault client, or nil when vault is not configured
+//
+func newVaultClient(config *Config) (*vaultClient, error) {
+	if config.VaultURL == "" {
+		return nil, nil
+	}
+	location, err := url.Parse(config.VaultURL)
+	if err != nil {
+		return nil, fmt.Errorf("the vault url is invalid, %s", err)
+	}
+	tlsConfig := &tls.Config{}
+	if err := applyTLSOptions(config, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	return &vaultClient{
+		location: location,
+		token:    config.VaultToken,
+		client: &http.Client{
+			Timeout: vaultTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: vaultTimeout,
+			},
+		},
+		secrets: make(map[string]*vaultSecret, 0),
+	}, nil
+}
+
+//
+// loadVaultSecrets retrieves the credentials of the configuration held in vault, returning the client to renew the
+// leases, or nil when vault is not configured
+//
+func loadVaultSecrets(config *Config) (*vaultClient, error) {
+	client, err := newVaultClient(config)
+	if err != nil || client == nil {
+		return nil, err
+	}
+	if err := client.load(config); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+//
+// load retrieves the client secret, encryption key and tls material of the configuration from vault
+//
+func (r *vaultClient) load(config *Config) error {
+	for _, x := range []struct {
+		name      string
+		reference string
+		value     *string
+	}{
+		{name: "client-secret", reference: config.VaultClientSecret, value: &config.ClientSecret},
+		{name: "encryption-key", reference: config.VaultEncryptionKey, value: &config.EncryptionKey},
+	} {
+		if x.reference == "" {
+			continue
+		}
+		if *x.value != "" {
+			return fmt.Errorf("you cannot specify both the %s and vault-%s options", x.name, x.name)
+		}
+		value, err := r.getField(x.reference)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve the %s from vault, %s", x.name, err)
+		}
+		*x.value = value
+	}
+
+	// step: the tls material is held in memory, never written to disk
+	if config.VaultTLS != "" {
+		certificate, err := r.getField(config.VaultTLS + "#certificate")
+		if err != nil {
+			return fmt.Errorf("unable to retrieve the tls certificate from vault, %s", err)
+		}
+		key, err := r.getField(config.VaultTLS + "#private_key")
+		if err != nil {
+			return fmt.Errorf("unable to retrieve the tls private key from vault, %s", err)
+		}
+		pair, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+		if err != nil {
+			return fmt.Errorf("unable to load the tls certificate from vault: %s, %s", config.VaultTLS, err)
+		}
+		r.certificate = &pair
+	}
+
+	return nil
+}
+
+//
+// getField retrieves a field of a secret, referenced as path#field i.e. secret/data/keycloak-proxy#client-secret
+//
+func (r *vaultClient) getField(reference string) (string, error) {
+	path, field, err := decodeVaultReference(reference)
+	if err != nil {
+		return "", err
+	}
+	secret, found := r.secrets[path]
+	if !found {
+		if secret, err = r.read(path); err != nil {
+			return "", err
+		}
+		r.secrets[path] = secret
+	}
+	value, found := getVaultData(secret)[field].(string)
+	if !found || value == "" {
+		return "", fmt.Errorf("the secret: %s has no field: %s", path, field)
+	}
+
+	return value, nil
+}
+
+//
+// decodeVaultReference decodes the reference to a field of a secret, path#field
+//
+func decodeVaultReference(reference string) (string, string, error) {
+	items := strings.SplitN(reference, "#", 2)
+	if len(items) != 2 || strings.Trim(items[0], "/") == "" || items[1] == "" {
+		return "", "", fmt.Errorf("invalid vault reference '%s' should be path#field", reference)
+	}
+
+	return strings.Trim(items[0], "/"), items[1], nil
+}
+
+//
+// getVaultData returns the data of a secret, unwrapping the versioned (kv v2) secrets
+//
+func getVaultData(secret *vaultSecret) map[string]interface{} {
+	if data, found := secret.Data["data"].(map[string]interface{}); found {
+		if _, versioned := secret.Data["metadata"]; versioned {
+			return data
+		}
+	}
+
+	return secret.Data
+}
+
+//
+// read retrieves a secret from vault
+//
+func (r *vaultClient) read(path string) (*vaultSecret, error) {
+	return r.do("GET", path, nil)
+}
+
+//
+// do performs a request against the vault api
+//
+func (r *vaultClient) do(method, path string, body interface{}) (*vaultSecret, error) {
+	var content []byte
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		content = encoded
+	}
+	location := *r.location
+	location.Path = strings.TrimSuffix(location.Path, "/") + "/v1/" + path
+
+	req, err := http.NewRequest(method, location.String(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(vaultTokenHeader, r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault responded with: %s, path: %s", resp.Status, path)
+	}
+	secret := new(vaultSecret)
+	if err := json.NewDecoder(resp.Body).Decode(secret); err != nil {
+		return nil, fmt.Errorf("unable to decode the response of vault, %s", err)
+	}
+
+	return secret, nil
+}
+
+//
+// renew keeps the token and the leases of the secrets alive, renewing each at half of its duration until done is
+// closed
+//
+func (r *vaultClient) renew(done <-chan struct{}) {
+	token, err := r.do("GET", "auth/token/lookup-self", nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warnf("unable to lookup the vault token, the token is not renewed")
+	} else if renewable, _ := token.Data["renewable"].(bool); renewable {
+		if ttl, _ := token.Data["ttl"].(float64); ttl > 0 {
+			go r.renewLease(done, "", int(ttl))
+		}
+	}
+	for path, x := range r.secrets {
+		if x.LeaseID != "" && x.Renewable && x.LeaseDuration > 0 {
+			log.WithFields(log.Fields{
+				"path":  path,
+				"lease": x.LeaseID,
+			}).Infof("renewing the lease of the vault secret")
+
+			go r.renewLease(done, x.LeaseID, x.LeaseDuration)
+		}
+	}
+}
+
+//
+// renewLease renews a lease, or the token when empty, at half of its duration until refused or done is closed
+//
+func (r *vaultClient) renewLease(done <-chan struct{}, lease string, duration int) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(getVaultRenewal(duration)):
+		}
+
+		var response *vaultSecret
+		var err error
+		switch lease {
+		case "":
+			if response, err = r.do("POST", "auth/token/renew-self", nil); err == nil && response.Auth != nil {
+				duration = response.Auth.LeaseDuration
+			}
+		default:
+			if response, err = r.do("PUT", "sys/leases/renew", map[string]string{"lease_id": lease}); err == nil {
+				duration = response.LeaseDuration
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"lease": lease,
+			}).Errorf("unable to renew the vault lease, retrying")
+
+			duration = int(vaultRetryInterval.Seconds() * 2)
+			continue
+		}
+		if duration <= 0 {
+			log.WithFields(log.Fields{
+				"lease": lease,
+			}).Warnf("the vault lease is no longer renewable")
+			return
+		}
+	}
+}
+
+//
+// hasVaultCertificate checks if the certificate of the listener is held in vault
+//
+func (r *oauthProxy) hasVaultCertificate() bool {
+	return r.vault != nil && r.vault.certificate != nil
+}
+
+//
+// getVaultRenewal returns the time to wait before renewing a lease of the duration (in seconds)
+//
+func getVaultRenewal(duration int) time.Duration {
+	return time.Duration(duration) * time.Second / 2
+}
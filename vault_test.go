@@ -0,0 +1,179 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fakeVaultToken = "s.fake-token"
+
+type fakeVaultServer struct {
+	// the secrets, keyed on the path
+	secrets map[string]interface{}
+	// the number of lease renewals
+	renewals int32
+}
+
+func newFakeVaultServer(t *testing.T) (*fakeVaultServer, *httptest.Server) {
+	dir, err := ioutil.TempDir("", "vault")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pair := newFakeCertificatePair(t, dir, "proxy.example.com")
+	certificate, _ := ioutil.ReadFile(pair.Certificate)
+	key, _ := ioutil.ReadFile(pair.PrivateKey)
+
+	vault := &fakeVaultServer{
+		secrets: map[string]interface{}{
+			"/v1/secret/data/proxy": map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"client-secret": "vault-secret"},
+					"metadata": map[string]interface{}{"version": 1},
+				},
+			},
+			"/v1/kv/proxy": map[string]interface{}{
+				"lease_id":       "kv/proxy/lease",
+				"lease_duration": 1,
+				"renewable":      true,
+				"data":           map[string]interface{}{"encryption-key": "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j"},
+			},
+			"/v1/pki/proxy": map[string]interface{}{
+				"data": map[string]interface{}{"certificate": string(certificate), "private_key": string(key)},
+			},
+		},
+	}
+
+	return vault, httptest.NewServer(vault)
+}
+
+func (r *fakeVaultServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(vaultTokenHeader) != fakeVaultToken {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.URL.Path == "/v1/sys/leases/renew" {
+		atomic.AddInt32(&r.renewals, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"lease_id": "kv/proxy/lease", "lease_duration": 0})
+		return
+	}
+	secret, found := r.secrets[req.URL.Path]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(secret)
+}
+
+func newFakeVaultConfig(location string) *Config {
+	return &Config{
+		VaultURL:           location,
+		VaultToken:         fakeVaultToken,
+		VaultClientSecret:  "secret/data/proxy#client-secret",
+		VaultEncryptionKey: "kv/proxy#encryption-key",
+		VaultTLS:           "pki/proxy",
+	}
+}
+
+func TestDecodeVaultReference(t *testing.T) {
+	cs := []struct {
+		Reference string
+		Path      string
+		Field     string
+		Ok        bool
+	}{
+		{Reference: "secret/data/proxy#client-secret", Path: "secret/data/proxy", Field: "client-secret", Ok: true},
+		{Reference: "/kv/proxy/#key", Path: "kv/proxy", Field: "key", Ok: true},
+		{Reference: "secret/data/proxy"},
+		{Reference: "secret/data/proxy#"},
+		{Reference: "/#field"},
+	}
+	for i, c := range cs {
+		path, field, err := decodeVaultReference(c.Reference)
+		if !c.Ok {
+			assert.Error(t, err, "case %d should have failed", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Path, path, "case %d", i)
+		assert.Equal(t, c.Field, field, "case %d", i)
+	}
+}
+
+func TestLoadVaultSecrets(t *testing.T) {
+	_, server := newFakeVaultServer(t)
+	defer server.Close()
+
+	config := newFakeVaultConfig(server.URL)
+	client, err := loadVaultSecrets(config)
+	require.NoError(t, err)
+	require.NotNil(t, client)
+	assert.Equal(t, "vault-secret", config.ClientSecret)
+	assert.Equal(t, "AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j", config.EncryptionKey)
+	assert.NotNil(t, client.certificate)
+
+	// step: vault is optional
+	client, err = loadVaultSecrets(&Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, client)
+}
+
+func TestLoadVaultSecretsErrors(t *testing.T) {
+	_, server := newFakeVaultServer(t)
+	defer server.Close()
+
+	token := newFakeVaultConfig(server.URL)
+	token.VaultToken = "invalid"
+	both := newFakeVaultConfig(server.URL)
+	both.ClientSecret = "secret"
+	field := newFakeVaultConfig(server.URL)
+	field.VaultClientSecret = "secret/data/proxy#missing"
+	path := newFakeVaultConfig(server.URL)
+	path.VaultEncryptionKey = "kv/missing#encryption-key"
+	tls := newFakeVaultConfig(server.URL)
+	tls.VaultTLS = "secret/data/proxy"
+
+	for i, c := range []*Config{token, both, field, path, tls} {
+		_, err := loadVaultSecrets(c)
+		assert.Error(t, err, "case %d should have failed", i)
+	}
+}
+
+func TestVaultRenewLease(t *testing.T) {
+	vault, server := newFakeVaultServer(t)
+	defer server.Close()
+
+	client, err := loadVaultSecrets(newFakeVaultConfig(server.URL))
+	require.NoError(t, err)
+	client.renewLease(make(chan struct{}), "kv/proxy/lease", 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&vault.renewals))
+
+	// step: the renewal stops once done is closed
+	done := make(chan struct{})
+	close(done)
+	client.renewLease(done, "kv/proxy/lease", 60)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&vault.renewals))
+	assert.Equal(t, time.Duration(30)*time.Second, getVaultRenewal(60))
+}
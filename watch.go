@@ -0,0 +1,129 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+//
+// fileWatcher watches the content of the files for changes, i.e. the mounted kubernetes configmaps and secrets
+//
+type fileWatcher struct {
+	// the content of the files, keyed on the path
+	contents map[string]string
+}
+
+//
+// newFileWatcher creates a watcher of the files, recording the current content
+//
+func newFileWatcher(files []string) *fileWatcher {
+	r := &fileWatcher{contents: make(map[string]string, 0)}
+	for _, x := range files {
+		content, _ := readSecretFile(x)
+		r.contents[x] = content
+	}
+
+	return r
+}
+
+//
+// changed returns the files whose content has changed since last checked, the unreadable or empty files are
+// ignored, as the files are replaced i.e. the symlink of a mounted configmap is swapped
+//
+func (r *fileWatcher) changed() []string {
+	var list []string
+	for path, content := range r.contents {
+		value, err := readSecretFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+				"file":  path,
+			}).Warnf("unable to read the watched file, keeping the current version")
+			continue
+		}
+		if value != content {
+			r.contents[path] = value
+			list = append(list, path)
+		}
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+//
+// watchFiles gracefully reloads the service when the files change and the check, if any, passes; the files are
+// watched until done is closed, so a reload which fails is attempted again on the next change
+//
+func watchFiles(done <-chan struct{}, watcher *fileWatcher, interval time.Duration, check func() error) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		changed := watcher.changed()
+		if len(changed) <= 0 {
+			continue
+		}
+		if check != nil {
+			if err := check(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+					"files": strings.Join(changed, ","),
+				}).Errorf("the changed files are invalid, keeping the current configuration")
+				continue
+			}
+		}
+		log.WithFields(log.Fields{
+			"files": strings.Join(changed, ","),
+		}).Infof("the watched files have changed, gracefully reloading the service")
+
+		// step: the reload is handled alongside the signal, handing the listener to a new process
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Errorf("unable to signal the reload of the service")
+		}
+	}
+}
+
+//
+// checkConfigFile checks the configuration file would be accepted by the new process, read as on startup
+//
+func checkConfigFile(cx *cli.Context, filename string) error {
+	config := newDefaultConfig()
+	if err := readConfigFile(filename, config); err != nil {
+		return err
+	}
+	if err := readOptions(cx, config); err != nil {
+		return err
+	}
+	if err := loadSecretFiles(config); err != nil {
+		return err
+	}
+	config.normalize()
+
+	return config.isValid()
+}
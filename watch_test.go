@@ -0,0 +1,96 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileWatcherChanged(t *testing.T) {
+	first := newFakeSecretFile(t, "first")
+	defer os.Remove(first)
+	second := newFakeSecretFile(t, "second")
+	defer os.Remove(second)
+
+	watcher := newFileWatcher([]string{first, second})
+	assert.Empty(t, watcher.changed())
+
+	require.NoError(t, ioutil.WriteFile(second, []byte("updated"), 0600))
+	assert.Equal(t, []string{second}, watcher.changed())
+	assert.Empty(t, watcher.changed(), "the change should only be reported once")
+
+	require.NoError(t, ioutil.WriteFile(first, []byte("updated"), 0600))
+	require.NoError(t, ioutil.WriteFile(second, []byte("again"), 0600))
+	assert.Len(t, watcher.changed(), 2)
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	cx := cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil)
+
+	valid := newFakeSecretFile(t, "listen: 127.0.0.1:3000\nupstream-url: http://127.0.0.1:8080\nskip-token-verification: true\n")
+	defer os.Remove(valid)
+	assert.NoError(t, checkConfigFile(cx, valid))
+
+	invalid := newFakeSecretFile(t, "listen: 127.0.0.1:3000\nupstream-url: http://127.0.0.1:8080\n")
+	defer os.Remove(invalid)
+	assert.Error(t, checkConfigFile(cx, invalid), "the discovery url should be required")
+
+	malformed := newFakeSecretFile(t, "listen: [")
+	defer os.Remove(malformed)
+	assert.Error(t, checkConfigFile(cx, malformed))
+}
+
+func TestWatchFilesSignals(t *testing.T) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	file := newFakeSecretFile(t, "first")
+	defer os.Remove(file)
+	watcher := newFileWatcher([]string{file})
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		watchFiles(done, watcher, time.Duration(10)*time.Millisecond, nil)
+		close(stopped)
+	}()
+
+	// step: the files are still watched after a reload is signalled
+	for _, x := range []string{"second", "third"} {
+		require.NoError(t, ioutil.WriteFile(file, []byte(x), 0600))
+		select {
+		case <-signals:
+		case <-time.After(time.Second):
+			t.Fatalf("the change to %s should have signalled a reload", x)
+		}
+	}
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("the watch should have stopped")
+	}
+}